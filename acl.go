@@ -0,0 +1,132 @@
+// Copyright 2018 Axel Wagner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nbd
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"net/netip"
+)
+
+// Access is the access a client is granted to an export.
+type Access int
+
+const (
+	// AccessDenied refuses the export to the client.
+	AccessDenied Access = iota
+	// AccessReadOnly serves the export read-only, as if FlagReadOnly was
+	// set.
+	AccessReadOnly
+	// AccessReadWrite serves the export as configured.
+	AccessReadWrite
+)
+
+func (a Access) String() string {
+	switch a {
+	case AccessDenied:
+		return "denied"
+	case AccessReadOnly:
+		return "read-only"
+	case AccessReadWrite:
+		return "read-write"
+	default:
+		return "invalid"
+	}
+}
+
+// ACL restricts the clients allowed to use an export, by their IP address.
+// Clients not connected over IP (e.g. over unix sockets) match no prefix.
+type ACL struct {
+	// ReadWrite are the networks of clients allowed to read and write the
+	// export.
+	ReadWrite []netip.Prefix
+	// ReadOnly are the networks of clients allowed to read the export. A
+	// client matching both lists gets read-write access.
+	ReadOnly []netip.Prefix
+}
+
+// Access returns the access granted to a client connected from addr.
+func (a *ACL) Access(addr net.Addr) Access {
+	ip, ok := addrIP(addr)
+	if !ok {
+		return AccessDenied
+	}
+	for _, p := range a.ReadWrite {
+		if p.Contains(ip) {
+			return AccessReadWrite
+		}
+	}
+	for _, p := range a.ReadOnly {
+		if p.Contains(ip) {
+			return AccessReadOnly
+		}
+	}
+	return AccessDenied
+}
+
+// addrIP returns the IP address of addr, if it has one.
+func addrIP(addr net.Addr) (netip.Addr, bool) {
+	var ip net.IP
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		ip = a.IP
+	case *net.UDPAddr:
+		ip = a.IP
+	case *net.IPAddr:
+		ip = a.IP
+	default:
+		return netip.Addr{}, false
+	}
+	nip, ok := netip.AddrFromSlice(ip)
+	return nip.Unmap(), ok
+}
+
+// ClientCertificate returns the verified certificate of the client connected
+// via c, if c was upgraded to TLS and the client presented a certificate
+// verified against Server.TLSConfig.ClientCAs (see tls.Config.ClientAuth).
+// Otherwise, it returns nil. It can be used by Server.Authorizer and
+// Server.Identify to authorize and account clients by their certificates.
+func ClientCertificate(c net.Conn) *x509.Certificate {
+	t, ok := c.(*tls.Conn)
+	if !ok {
+		return nil
+	}
+	cs := t.ConnectionState()
+	if !cs.HandshakeComplete || len(cs.VerifiedChains) == 0 || len(cs.VerifiedChains[0]) == 0 {
+		return nil
+	}
+	return cs.VerifiedChains[0][0]
+}
+
+// authorize returns the access of the client connected via c to e. It is the
+// lesser of the access granted by e.ACL and by s.Authorizer, if set.
+func (s *Server) authorize(c net.Conn, e Export) (Access, error) {
+	a := AccessReadWrite
+	if e.ACL != nil {
+		a = e.ACL.Access(c.RemoteAddr())
+	}
+	if a == AccessDenied || s.Authorizer == nil {
+		return a, nil
+	}
+	b, err := s.Authorizer(c, e.Name)
+	if err != nil {
+		return AccessDenied, err
+	}
+	if b < a {
+		a = b
+	}
+	return a, nil
+}
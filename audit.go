@@ -0,0 +1,152 @@
+// Copyright 2018 Axel Wagner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nbd
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+)
+
+// Auditor records an audit trail of the security relevant events of a
+// Server: connections, the exports they negotiate and privileged operations.
+// Unlike Logger, it is meant to be complete and is not subject to log levels.
+// Audit is called synchronously, so it must be safe for concurrent use and
+// should not block for long.
+type Auditor interface {
+	Audit(AuditEvent)
+}
+
+// AuditFunc is an Auditor calling itself.
+type AuditFunc func(AuditEvent)
+
+// Audit implements Auditor.
+func (f AuditFunc) Audit(e AuditEvent) {
+	f(e)
+}
+
+// AuditAction is the kind of an AuditEvent.
+type AuditAction string
+
+// Actions recorded by a Server. AuditAttach, AuditDetach and AuditSnapshot
+// are not recorded by the Server itself, but by the components performing
+// them (e.g. package nbdctl), so all events can go to the same Auditor.
+const (
+	// AuditConnect is recorded when a connection is accepted.
+	AuditConnect AuditAction = "connect"
+	// AuditNegotiate is recorded when the handshake of a connection is done,
+	// successfully or not.
+	AuditNegotiate AuditAction = "negotiate"
+	// AuditClose is recorded when a connection is terminated.
+	AuditClose AuditAction = "close"
+	// AuditDisconnect is recorded when a client requests a disconnect.
+	AuditDisconnect AuditAction = "disconnect"
+	// AuditResize is recorded when a client requests to resize an export
+	// and by Server.ResizeExport.
+	AuditResize AuditAction = "resize"
+	// AuditAddExport and AuditRemoveExport are recorded when an export is
+	// added to or removed from a Server.
+	AuditAddExport    AuditAction = "add_export"
+	AuditRemoveExport AuditAction = "remove_export"
+	// AuditAttach and AuditDetach are recorded when an export is attached to
+	// or detached from a kernel NBD device.
+	AuditAttach AuditAction = "attach"
+	AuditDetach AuditAction = "detach"
+	// AuditSnapshot is recorded when a snapshot of an export is taken.
+	AuditSnapshot AuditAction = "snapshot"
+)
+
+// AuditEvent is an entry of the audit trail.
+type AuditEvent struct {
+	Time   time.Time   `json:"time"`
+	Action AuditAction `json:"action"`
+	// Remote is the address of the client. It is empty for events not
+	// caused by a connection.
+	Remote string `json:"remote,omitempty"`
+	// Identity is the identity of the client, as returned by
+	// Server.Identify.
+	Identity string `json:"identity,omitempty"`
+	// Export is the name of the export affected.
+	Export string `json:"export,omitempty"`
+	// Detail contains additional, action specific information, e.g. the
+	// requested size for AuditResize.
+	Detail string `json:"detail,omitempty"`
+	// Error is the error the action failed with. It is empty, if the action
+	// succeeded.
+	Error string `json:"error,omitempty"`
+}
+
+// NewAuditEvent returns an AuditEvent for the given action at the current
+// time, with Error set from err.
+func NewAuditEvent(action AuditAction, export string, err error) AuditEvent {
+	e := AuditEvent{Time: time.Now(), Action: action, Export: export}
+	if err != nil {
+		e.Error = err.Error()
+	}
+	return e
+}
+
+// JSONAuditor returns an Auditor writing every event as a line of JSON to w.
+// Writes are serialized. Errors writing to w are passed to onError, if it is
+// not nil.
+func JSONAuditor(w io.Writer, onError func(error)) Auditor {
+	var mu sync.Mutex
+	enc := json.NewEncoder(w)
+	return AuditFunc(func(e AuditEvent) {
+		mu.Lock()
+		err := enc.Encode(e)
+		mu.Unlock()
+		if err != nil && onError != nil {
+			onError(err)
+		}
+	})
+}
+
+// SlogAuditor returns an Auditor logging every event to l at level Info.
+func SlogAuditor(l *slog.Logger) Auditor {
+	return AuditFunc(func(e AuditEvent) {
+		attrs := []slog.Attr{slog.String("action", string(e.Action))}
+		for _, a := range [][2]string{
+			{"remote", e.Remote},
+			{"identity", e.Identity},
+			{"export", e.Export},
+			{"detail", e.Detail},
+			{"err", e.Error},
+		} {
+			if a[1] != "" {
+				attrs = append(attrs, slog.String(a[0], a[1]))
+			}
+		}
+		l.LogAttrs(context.Background(), slog.LevelInfo, "audit", attrs...)
+	})
+}
+
+// audit records an event for the connection c, if s has an Auditor.
+func (s *Server) audit(c net.Conn, e AuditEvent) {
+	if s.Audit == nil {
+		return
+	}
+	if c != nil {
+		if a := c.RemoteAddr(); a != nil {
+			e.Remote = a.String()
+		}
+		e.Identity = s.identify(c)
+	}
+	s.Audit.Audit(e)
+}
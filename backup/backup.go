@@ -0,0 +1,525 @@
+// Copyright 2018 Axel Wagner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package backup implements full and incremental backups of Devices.
+//
+// Incremental backups use a dirty.Tracker to find the blocks written since
+// the previous backup, or a remote dirty bitmap of an nbd.Conn (see
+// DirtyBitmap). Full backups skip the ranges a Device reports as reading as
+// zeros, if it implements nbd.Extenter. A backup chain consists of a full backup followed by
+// any number of incremental ones. Restore applies a chain to a Device and
+// Consolidate merges a chain (or a part of it) into a single backup.
+//
+// A backup reads the Device while it is in use, so it is only consistent if
+// nothing writes to it in the meantime. Use package quiesce to pause the
+// users of the Device (e.g. by freezing the filesystem on it) while the
+// backup is written.
+//
+// # Format
+//
+// A backup file ("delta") starts with a 32 byte header, followed by any
+// number of records and a trailer. All integers are big-endian.
+//
+//	header:
+//		magic      [8]byte  "NBDDELTA"
+//		version    uint32   1
+//		flags      uint32   bit 0: full backup (blocks not contained are
+//		                    zero)
+//		blockSize  uint32   granularity of the tracked blocks
+//		reserved   uint32   0
+//		size       uint64   size of the Device in bytes
+//	record:
+//		offset     uint64   offset in the Device, a multiple of blockSize
+//		length     uint32   length of data, a multiple of blockSize (except
+//		                    for a range ending at the end of the Device)
+//		checksum   uint32   CRC-32C (Castagnoli) of data
+//		data       [length]byte
+//	trailer:
+//		offset     uint64   0xffffffffffffffff
+//		length     uint32   0
+//		count      uint32   number of records
+//
+// Records are ordered by offset and do not overlap.
+package backup
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+
+	"github.com/Merovius/nbd"
+	"github.com/Merovius/nbd/dirty"
+)
+
+// Magic is the magic number at the start of every backup file.
+const Magic = "NBDDELTA"
+
+const (
+	version    = 1
+	flagFull   = 1
+	headerSize = 32
+	recordSize = 16
+	// maxRecord is the maximum length of data in a record written.
+	maxRecord = 1 << 20
+	// trailerOffset is the offset of the trailer record.
+	trailerOffset = ^uint64(0)
+)
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// Header describes a backup.
+type Header struct {
+	// Full is true, if the backup contains all blocks of the Device. Blocks
+	// not contained in a full backup are zero.
+	Full bool
+	// BlockSize is the granularity of the backup.
+	BlockSize uint32
+	// Size is the size of the Device.
+	Size uint64
+}
+
+// Record is a range of data in a backup.
+type Record struct {
+	Offset int64
+	Data   []byte
+}
+
+// Full writes a full backup of d, which has the given size, to w, in blocks
+// of blockSize bytes. To start a chain of incremental backups on a
+// dirty.Tracker, use Incremental with a full Bitmap instead, so no writes are
+// missed.
+func Full(w io.Writer, d io.ReaderAt, size uint64, blockSize int) error {
+	bm := dirty.NewBitmap(size, blockSize)
+	bm.MarkAll()
+	return Write(w, d, bm, true)
+}
+
+// Incremental writes an incremental backup of all blocks written to t since
+// the last backup to w. If it fails, the blocks are given back to t, so they
+// are contained in the next backup. If full is true, all blocks are written
+// (starting a new chain) and tracking is reset.
+func Incremental(w io.Writer, t *dirty.Tracker, full bool) error {
+	bm := t.Swap()
+	complete := bm
+	if full {
+		complete = bm.Clone()
+		complete.MarkAll()
+	}
+	if err := Write(w, t, complete, full); err != nil {
+		t.Merge(bm)
+		return err
+	}
+	return nil
+}
+
+// DirtyBitmap returns a Bitmap, in blocks of blockSize bytes, of the blocks
+// of a Device of the given size, which are marked in the named dirty bitmap of
+// d. d is usually an nbd.Conn, on which the qemu:dirty-bitmap:<name> context
+// was selected, so an incremental backup of a remote Device can be written
+// with Write.
+func DirtyBitmap(d nbd.DirtyBitmapper, name string, size uint64, blockSize int) (*dirty.Bitmap, error) {
+	bm := dirty.NewBitmap(size, blockSize)
+	for off := int64(0); uint64(off) < size; {
+		ext, err := d.DirtyExtents(name, off, int64(size)-off)
+		if err != nil {
+			return nil, err
+		}
+		if len(ext) == 0 || ext[0].Length <= 0 {
+			return nil, errors.New("invalid dirty extents reported")
+		}
+		for _, e := range ext {
+			if e.Length <= 0 || uint64(off) >= size {
+				break
+			}
+			l := e.Length
+			if rest := int64(size) - off; l > rest {
+				l = rest
+			}
+			for e.Dirty && l > 0 {
+				// Mark takes an int, so mark large extents in pieces.
+				n := l
+				if n > 1<<30 {
+					n = 1 << 30
+				}
+				bm.Mark(off, int(n))
+				off, l = off+n, l-n
+			}
+			off += l
+		}
+	}
+	return bm, nil
+}
+
+// Write writes a backup of the blocks of d contained in bm to w. full must
+// only be set if bm contains all blocks. A full backup skips the blocks d
+// reports as reading as zeros, if it implements nbd.Extenter.
+func Write(w io.Writer, d io.ReaderAt, bm *dirty.Bitmap, full bool) error {
+	bw := newWriter(w, Header{Full: full, BlockSize: uint32(bm.BlockSize()), Size: bm.Size()})
+	x, _ := d.(nbd.Extenter)
+	if !full {
+		x = nil
+	}
+	var buf []byte
+	for _, r := range bm.Ranges(maxRecord) {
+		rs, err := allocated(x, r, bm.BlockSize())
+		if err != nil {
+			return err
+		}
+		for _, r := range rs {
+			if int64(len(buf)) < r.Length {
+				buf = make([]byte, r.Length)
+			}
+			b := buf[:r.Length]
+			if n, err := d.ReadAt(b, r.Offset); err != nil && !(err == io.EOF && n == len(b)) {
+				return err
+			}
+			bw.record(r.Offset, b)
+		}
+	}
+	return bw.close()
+}
+
+// allocated returns the parts of r containing blocks x does not report as
+// reading as zeros. If x is nil, r is returned.
+func allocated(x nbd.Extenter, r dirty.Range, blockSize int) ([]dirty.Range, error) {
+	if x == nil {
+		return []dirty.Range{r}, nil
+	}
+	// keep contains the blocks of r with any data.
+	keep := dirty.NewBitmap(uint64(r.Length), blockSize)
+	for pos := int64(0); pos < r.Length; {
+		ext, err := x.Extents(r.Offset+pos, r.Length-pos)
+		if err != nil {
+			return nil, err
+		}
+		if len(ext) == 0 || ext[0].Length <= 0 {
+			return nil, errors.New("invalid extents reported")
+		}
+		for _, e := range ext {
+			l := e.Length
+			if l <= 0 || pos >= r.Length {
+				break
+			}
+			if l > r.Length-pos {
+				l = r.Length - pos
+			}
+			if !e.Zero {
+				keep.Mark(pos, int(l))
+			}
+			pos += l
+		}
+	}
+	rs := keep.Ranges(0)
+	for i := range rs {
+		rs[i].Offset += r.Offset
+	}
+	return rs, nil
+}
+
+// writer writes a backup file.
+type writer struct {
+	w     *bufio.Writer
+	count uint32
+	err   error
+}
+
+func newWriter(w io.Writer, h Header) *writer {
+	bw := &writer{w: bufio.NewWriter(w)}
+	var b [headerSize]byte
+	copy(b[:], Magic)
+	binary.BigEndian.PutUint32(b[8:], version)
+	if h.Full {
+		binary.BigEndian.PutUint32(b[12:], flagFull)
+	}
+	binary.BigEndian.PutUint32(b[16:], h.BlockSize)
+	binary.BigEndian.PutUint64(b[24:], h.Size)
+	_, bw.err = bw.w.Write(b[:])
+	return bw
+}
+
+func (w *writer) record(off int64, data []byte) {
+	if w.err != nil {
+		return
+	}
+	var b [recordSize]byte
+	binary.BigEndian.PutUint64(b[0:], uint64(off))
+	binary.BigEndian.PutUint32(b[8:], uint32(len(data)))
+	binary.BigEndian.PutUint32(b[12:], crc32.Checksum(data, castagnoli))
+	if _, w.err = w.w.Write(b[:]); w.err == nil {
+		_, w.err = w.w.Write(data)
+	}
+	w.count++
+}
+
+func (w *writer) close() error {
+	if w.err != nil {
+		return w.err
+	}
+	var b [recordSize]byte
+	binary.BigEndian.PutUint64(b[0:], trailerOffset)
+	binary.BigEndian.PutUint32(b[12:], w.count)
+	if _, err := w.w.Write(b[:]); err != nil {
+		return err
+	}
+	return w.w.Flush()
+}
+
+// Reader reads a backup file.
+type Reader struct {
+	Header
+
+	r     *bufio.Reader
+	pos   int64
+	last  int64
+	count uint32
+	done  bool
+}
+
+// NewReader reads the header of a backup from r.
+func NewReader(r io.Reader) (*Reader, error) {
+	br := &Reader{r: bufio.NewReader(r), last: -1}
+	var b [headerSize]byte
+	if _, err := io.ReadFull(br.r, b[:]); err != nil {
+		return nil, err
+	}
+	if string(b[:8]) != Magic {
+		return nil, errors.New("not a backup file")
+	}
+	if v := binary.BigEndian.Uint32(b[8:]); v != version {
+		return nil, fmt.Errorf("unsupported backup version %d", v)
+	}
+	br.Full = binary.BigEndian.Uint32(b[12:])&flagFull != 0
+	br.BlockSize = binary.BigEndian.Uint32(b[16:])
+	br.Size = binary.BigEndian.Uint64(b[24:])
+	if br.BlockSize == 0 {
+		return nil, errors.New("invalid block size 0 in backup")
+	}
+	br.pos = headerSize
+	return br, nil
+}
+
+// Next returns the next record. It returns io.EOF after the last record.
+func (r *Reader) Next() (Record, error) {
+	rec, _, err := r.next()
+	return rec, err
+}
+
+// next reads the next record and also returns the position of its data in
+// the file.
+func (r *Reader) next() (Record, int64, error) {
+	if r.done {
+		return Record{}, 0, io.EOF
+	}
+	var b [recordSize]byte
+	if _, err := io.ReadFull(r.r, b[:]); err != nil {
+		return Record{}, 0, unexpected(err)
+	}
+	r.pos += recordSize
+	off := binary.BigEndian.Uint64(b[0:])
+	n := binary.BigEndian.Uint32(b[8:])
+	sum := binary.BigEndian.Uint32(b[12:])
+	if off == trailerOffset {
+		if n != 0 || sum != r.count {
+			return Record{}, 0, errors.New("corrupt backup trailer")
+		}
+		r.done = true
+		return Record{}, 0, io.EOF
+	}
+	if int64(off) < r.last || off%uint64(r.BlockSize) != 0 || off+uint64(n) > r.Size || off+uint64(n) < off {
+		return Record{}, 0, fmt.Errorf("invalid record for range [%d,%d) in backup", off, off+uint64(n))
+	}
+	r.last = int64(off) + int64(n)
+	r.count++
+	pos := r.pos
+	r.pos += int64(n)
+	p := make([]byte, n)
+	if _, err := io.ReadFull(r.r, p); err != nil {
+		return Record{}, 0, unexpected(err)
+	}
+	if crc32.Checksum(p, castagnoli) != sum {
+		return Record{}, 0, fmt.Errorf("checksum mismatch in record at offset %d", off)
+	}
+	return Record{Offset: int64(off), Data: p}, pos, nil
+}
+
+func unexpected(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// Apply writes the records of the backup read from r to d. The blocks not
+// contained in a full backup are zeroed. It returns the header of the backup.
+func Apply(d io.WriterAt, r io.Reader) (Header, error) {
+	br, err := NewReader(r)
+	if err != nil {
+		return Header{}, err
+	}
+	return br.Header, br.apply(d)
+}
+
+// apply writes the remaining records of r to d, zeroing the blocks between
+// them, if r is a full backup.
+func (r *Reader) apply(d io.WriterAt) error {
+	var end int64
+	for {
+		rec, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if r.Full && rec.Offset > end {
+			if err := nbd.WriteZeroes(d, end, rec.Offset-end, false); err != nil {
+				return err
+			}
+		}
+		if _, err := d.WriteAt(rec.Data, rec.Offset); err != nil {
+			return err
+		}
+		end = rec.Offset + int64(len(rec.Data))
+	}
+	if r.Full && uint64(end) < r.Size {
+		return nbd.WriteZeroes(d, end, int64(r.Size)-end, false)
+	}
+	return nil
+}
+
+// Restore applies a chain of backups to d, in order. The first one must be a
+// full backup and all must be for the same Device size. The headers of all
+// backups are checked, before d is written to.
+func Restore(d io.WriterAt, chain ...io.Reader) error {
+	if len(chain) == 0 {
+		return errors.New("empty backup chain")
+	}
+	rs := make([]*Reader, len(chain))
+	for i, r := range chain {
+		br, err := NewReader(r)
+		if err != nil {
+			return fmt.Errorf("backup %d: %v", i, err)
+		}
+		if i == 0 && !br.Full {
+			return errors.New("backup chain does not start with a full backup")
+		}
+		if i > 0 && br.Size != rs[0].Size {
+			return fmt.Errorf("backup %d is for size %d, not %d", i, br.Size, rs[0].Size)
+		}
+		rs[i] = br
+	}
+	for i, br := range rs {
+		if err := br.apply(d); err != nil {
+			return fmt.Errorf("backup %d: %v", i, err)
+		}
+	}
+	return nil
+}
+
+// location is the location of a block in a backup of a chain.
+type location struct {
+	file int
+	pos  int64
+}
+
+// Consolidate merges a chain of backups into a single backup written to w,
+// which contains the latest version of every block. All backups must have the
+// same block and Device size. The result is a full backup, if the first
+// backup of the chain is.
+//
+// The checksums of all backups are verified, even of data overwritten by
+// later backups.
+func Consolidate(w io.Writer, chain ...io.ReaderAt) error {
+	if len(chain) == 0 {
+		return errors.New("empty backup chain")
+	}
+	var (
+		h    Header
+		locs []location
+		have []bool
+	)
+	for i, ra := range chain {
+		br, err := NewReader(io.NewSectionReader(ra, 0, 1<<62))
+		if err != nil {
+			return fmt.Errorf("backup %d: %v", i, err)
+		}
+		if i == 0 {
+			h = br.Header
+			bm := dirty.NewBitmap(h.Size, int(h.BlockSize))
+			locs = make([]location, bm.Blocks())
+			have = make([]bool, bm.Blocks())
+		} else if br.BlockSize != h.BlockSize || br.Size != h.Size {
+			return fmt.Errorf("backup %d does not match the block or Device size of the chain", i)
+		}
+		for {
+			rec, pos, err := br.next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return fmt.Errorf("backup %d: %v", i, err)
+			}
+			end := br.last
+			for off := rec.Offset; off < end; off += int64(h.BlockSize) {
+				b := off / int64(h.BlockSize)
+				locs[b] = location{i, pos + off - rec.Offset}
+				have[b] = true
+			}
+		}
+	}
+
+	bw := newWriter(w, h)
+	var (
+		bs   = int64(h.BlockSize)
+		buf  []byte
+		cur  int64
+		data []byte
+	)
+	flush := func() {
+		if len(data) > 0 {
+			bw.record(cur, data)
+		}
+		data = data[:0]
+	}
+	for b := range locs {
+		if !have[b] {
+			flush()
+			continue
+		}
+		off := int64(b) * bs
+		l := bs
+		if rest := int64(h.Size) - off; rest < l {
+			l = rest
+		}
+		if len(data) == 0 {
+			cur = off
+		} else if len(data)+int(l) > maxRecord {
+			flush()
+			cur = off
+		}
+		if int64(len(buf)) < l {
+			buf = make([]byte, l)
+		}
+		loc := locs[b]
+		if n, err := chain[loc.file].ReadAt(buf[:l], loc.pos); err != nil && !(err == io.EOF && int64(n) == l) {
+			return fmt.Errorf("backup %d: %v", loc.file, unexpected(err))
+		}
+		data = append(data, buf[:l]...)
+	}
+	flush()
+	return bw.close()
+}
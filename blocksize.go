@@ -0,0 +1,51 @@
+// Copyright 2018 Axel Wagner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nbd
+
+// BlockSizer is an optional interface a Device can implement, to declare the
+// block sizes it supports, e.g. because it is backed by fixed size chunks of
+// an object store. A Server advertises them with NBD_INFO_BLOCK_SIZE, unless
+// Export.BlockSizes is set.
+//
+// Clients requesting the constraints during NBD_OPT_GO promise to honor them,
+// so a Server refuses their requests, if the offset or length is not a
+// multiple of Min, or if a read or write is larger than Max, with EINVAL.
+type BlockSizer interface {
+	BlockSizes() BlockSizeConstraints
+}
+
+// blockSizes returns the block size constraints of e, or nil if it has none.
+func blockSizes(e Export) *BlockSizeConstraints {
+	if e.BlockSizes != nil {
+		return e.BlockSizes
+	}
+	var b BlockSizer
+	if As(e.Device, &b) {
+		bs := b.BlockSizes()
+		return &bs
+	}
+	return nil
+}
+
+// checkBlockSizes returns whether req satisfies the constraints bs.
+func checkBlockSizes(req *request, bs BlockSizeConstraints) bool {
+	if bs.Min > 1 && (req.offset%uint64(bs.Min) != 0 || req.length%uint64(bs.Min) != 0) {
+		return false
+	}
+	if req.typ == cmdRead || req.typ == cmdWrite {
+		return bs.Max == 0 || req.length <= uint64(bs.Max)
+	}
+	return true
+}
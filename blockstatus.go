@@ -0,0 +1,283 @@
+// Copyright 2018 Axel Wagner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nbd
+
+import (
+	"encoding/binary"
+	"strings"
+)
+
+// MetaContextAllocation is the name of the metadata context describing which
+// ranges of an export are allocated, as reported by NBD_CMD_BLOCK_STATUS.
+const MetaContextAllocation = "base:allocation"
+
+// MetaContextDirtyBitmap is the prefix of the names of the metadata contexts
+// describing which ranges of an export are marked in a bitmap of written
+// blocks, as defined by qemu. The name of the bitmap follows the prefix
+// (e.g. qemu:dirty-bitmap:backup).
+const MetaContextDirtyBitmap = "qemu:dirty-bitmap:"
+
+// metaAllocationID is the id of MetaContextAllocation sent by a Server. The
+// dirty bitmaps of an export have the ids following it, in the order
+// returned by DirtyBitmaps.
+const metaAllocationID = 1
+
+// Status flags of the base:allocation metadata context.
+const (
+	stateHole = 1 << 0
+	stateZero = 1 << 1
+)
+
+// stateDirty is the status flag of the qemu:dirty-bitmap: metadata contexts.
+const stateDirty = 1 << 0
+
+// metaContext is a metadata context selected by a client.
+type metaContext struct {
+	id   uint32
+	name string
+}
+
+// Extent is a range of a Device with uniform allocation status.
+type Extent struct {
+	Length int64
+	// Hole is set, if the range is not allocated.
+	Hole bool
+	// Zero is set, if the range reads as zeros.
+	Zero bool
+}
+
+// Extenter is an optional interface a Device can implement, to report which
+// of its ranges are allocated, e.g. with SEEK_DATA and SEEK_HOLE. A Server
+// uses it to answer NBD_CMD_BLOCK_STATUS for MetaContextAllocation, which
+// lets clients like qemu-img skip holes. Devices not implementing it are
+// reported as entirely allocated.
+//
+// Extents returns consecutive extents starting at off. They should cover
+// length bytes, but may cover less (as long as there is at least one) or
+// more.
+type Extenter interface {
+	Extents(off, length int64) ([]Extent, error)
+}
+
+// DirtyExtent is a range of a Device, which is either entirely marked in a
+// dirty bitmap or not at all.
+type DirtyExtent struct {
+	Length int64
+	Dirty  bool
+}
+
+// DirtyBitmapper is an optional interface a Device can implement, to expose
+// bitmaps of the blocks written to it (e.g. since the last backup) as the
+// metadata contexts qemu:dirty-bitmap:<name>. Incremental backup tools like
+// qemu's use them to only copy changed blocks. See package dirty for an
+// implementation.
+//
+// DirtyExtents returns consecutive extents of the named bitmap starting at
+// off, like Extenter.Extents.
+type DirtyBitmapper interface {
+	DirtyBitmaps() []string
+	DirtyExtents(name string, off, length int64) ([]DirtyExtent, error)
+}
+
+// blockStatus returns the payloads of the NBD_REPLY_TYPE_BLOCK_STATUS chunks
+// (or NBD_REPLY_TYPE_BLOCK_STATUS_EXT, if extended is set) for length bytes of
+// d at off, one for each of the contexts in meta. If one is set, only the
+// first extent of each context is returned.
+func blockStatus(d Device, meta []metaContext, off, length int64, one, extended bool) ([][]byte, error) {
+	var out [][]byte
+	for _, m := range meta {
+		var (
+			desc []descriptor
+			err  error
+		)
+		if m.name == MetaContextAllocation {
+			desc, err = allocationStatus(d, off, length, one)
+		} else {
+			desc, err = dirtyStatus(d, strings.TrimPrefix(m.name, MetaContextDirtyBitmap), off, length, one)
+		}
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, encodeDescriptors(m.id, desc, extended))
+	}
+	return out, nil
+}
+
+// allocationStatus returns the descriptors of the base:allocation context for
+// length bytes of d at off.
+func allocationStatus(d Device, off, length int64, one bool) ([]descriptor, error) {
+	var ext []Extent
+	var x Extenter
+	if As(d, &x) {
+		var err error
+		if ext, err = x.Extents(off, length); err != nil {
+			return nil, err
+		}
+	}
+	var desc descriptors
+	for _, x := range ext {
+		var flags uint32
+		if x.Hole {
+			flags |= stateHole
+		}
+		if x.Zero {
+			flags |= stateZero
+		}
+		if !desc.add(x.Length, flags, length, one) {
+			break
+		}
+	}
+	return desc.done(length), nil
+}
+
+// dirtyStatus returns the descriptors of the qemu:dirty-bitmap: context of
+// the named bitmap for length bytes of d at off. Bitmaps d does not have (any
+// more) report the range as clean.
+func dirtyStatus(d Device, name string, off, length int64, one bool) ([]descriptor, error) {
+	var ext []DirtyExtent
+	var x DirtyBitmapper
+	if As(d, &x) {
+		var err error
+		if ext, err = x.DirtyExtents(name, off, length); err != nil {
+			return nil, err
+		}
+	}
+	var desc descriptors
+	for _, x := range ext {
+		var flags uint32
+		if x.Dirty {
+			flags |= stateDirty
+		}
+		if !desc.add(x.Length, flags, length, one) {
+			break
+		}
+	}
+	return desc.done(length), nil
+}
+
+// descriptors collects the descriptors of a context from extents.
+type descriptors struct {
+	desc  []descriptor
+	total int64
+}
+
+// add adds an extent of l bytes with the given flags, merging it with the
+// previous one if the flags are the same. It returns whether more extents
+// are needed to cover length bytes. If one is set, only a single descriptor
+// is collected.
+func (d *descriptors) add(l int64, flags uint32, length int64, one bool) bool {
+	if l <= 0 {
+		return true
+	}
+	if l > length-d.total {
+		l = length - d.total
+	}
+	if n := len(d.desc); n > 0 && d.desc[n-1].flags == flags {
+		// Merge with the previous descriptor.
+		d.desc[n-1].length += uint64(l)
+	} else {
+		if n > 0 && one {
+			return false
+		}
+		d.desc = append(d.desc, descriptor{uint64(l), flags})
+	}
+	d.total += l
+	return d.total < length
+}
+
+// done returns the collected descriptors. If there are none, the entire
+// length bytes are described with no flags set.
+func (d *descriptors) done(length int64) []descriptor {
+	if len(d.desc) == 0 {
+		return []descriptor{{uint64(length), 0}}
+	}
+	return d.desc
+}
+
+// descriptor is a block status descriptor.
+type descriptor struct {
+	length uint64
+	flags  uint32
+}
+
+// encodeDescriptors encodes the payload of a block status chunk of the
+// context with the given id. Extended descriptors have 64 bit fields and are
+// preceded by their number.
+func encodeDescriptors(id uint32, desc []descriptor, extended bool) []byte {
+	if !extended {
+		b := make([]byte, 4+8*len(desc))
+		binary.BigEndian.PutUint32(b, id)
+		for i, d := range desc {
+			binary.BigEndian.PutUint32(b[4+8*i:], uint32(d.length))
+			binary.BigEndian.PutUint32(b[8+8*i:], d.flags)
+		}
+		return b
+	}
+	b := make([]byte, 8+16*len(desc))
+	binary.BigEndian.PutUint32(b, id)
+	binary.BigEndian.PutUint32(b[4:], uint32(len(desc)))
+	for i, d := range desc {
+		binary.BigEndian.PutUint64(b[8+16*i:], d.length)
+		binary.BigEndian.PutUint64(b[16+16*i:], uint64(d.flags))
+	}
+	return b
+}
+
+// structuredBlockStatus returns the chunks of a successful reply to the block
+// status request req, with the payloads p returned by blockStatus.
+func structuredBlockStatus(req *request, p [][]byte) [][]byte {
+	typ := uint16(replyTypeBlockStatus)
+	if req.extended {
+		typ = replyTypeBlockStatusExt
+	}
+	var out [][]byte
+	for i, b := range p {
+		var flags uint16
+		if i == len(p)-1 {
+			flags = replyFlagDone
+		}
+		out = append(out, chunkHeader(req, flags, typ, uint64(len(b)), nil), b)
+	}
+	return out
+}
+
+// metaContexts returns the metadata contexts of d matching queries. For
+// NBD_OPT_LIST_META_CONTEXT (list is set), no queries match all contexts and
+// a namespace (like "base:") or the prefix MetaContextDirtyBitmap all of its
+// contexts. Otherwise, only full names match.
+func metaContexts(d Device, queries []string, list bool) []metaContext {
+	all := []metaContext{{metaAllocationID, MetaContextAllocation}}
+	var x DirtyBitmapper
+	if As(d, &x) {
+		for i, n := range x.DirtyBitmaps() {
+			all = append(all, metaContext{metaAllocationID + 1 + uint32(i), MetaContextDirtyBitmap + n})
+		}
+	}
+	if list && len(queries) == 0 {
+		return all
+	}
+	var out []metaContext
+	for _, m := range all {
+		for _, q := range queries {
+			ns := q == "base:" && m.name == MetaContextAllocation
+			ns = ns || ((q == "qemu:" || q == MetaContextDirtyBitmap) && strings.HasPrefix(m.name, MetaContextDirtyBitmap))
+			if q == m.name || (list && ns) {
+				out = append(out, m)
+				break
+			}
+		}
+	}
+	return out
+}
@@ -0,0 +1,65 @@
+// Copyright 2018 Axel Wagner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nbd
+
+import (
+	"math/bits"
+	"sync"
+)
+
+// Sizes of pooled buffers. Buffers are pooled in power of two size classes
+// between minPooled and maxPooled, which is the maximum size of a write.
+const (
+	minPooledShift = 12
+	maxPooledShift = 22
+	maxPooled      = 1 << maxPooledShift
+)
+
+// bufPool recycles the buffers of reads and writes, which otherwise dominate
+// the allocations of a Server under small random I/O. The zero value is ready
+// to use.
+type bufPool struct {
+	classes [maxPooledShift - minPooledShift + 1]sync.Pool
+}
+
+// class returns the index of the smallest size class fitting n bytes.
+func class(n int) int {
+	if n <= 1<<minPooledShift {
+		return 0
+	}
+	return bits.Len(uint(n-1)) - minPooledShift
+}
+
+// get returns a buffer of n bytes. Its contents are undefined.
+func (p *bufPool) get(n int) []byte {
+	if n > maxPooled {
+		return make([]byte, n)
+	}
+	c := class(n)
+	if b, ok := p.classes[c].Get().(*[]byte); ok {
+		return (*b)[:n]
+	}
+	return make([]byte, n, 1<<(c+minPooledShift))
+}
+
+// put returns a buffer obtained by get to p. b must not be used afterwards.
+func (p *bufPool) put(b []byte) {
+	n := cap(b)
+	if n > maxPooled || n < 1<<minPooledShift || n&(n-1) != 0 {
+		return
+	}
+	b = b[:0]
+	p.classes[class(n)].Put(&b)
+}
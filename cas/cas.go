@@ -0,0 +1,539 @@
+// Copyright 2018 Axel Wagner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package cas implements a Device described by a manifest of chunk digests,
+// whose chunks are fetched lazily from a content-addressable store (CAS).
+//
+// This is the usual way to start virtual machines from large disk images
+// quickly: Only the manifest is needed to expose the Device and chunks are
+// fetched on first read and cached locally, so only the data actually used
+// is transferred. Chunks are identified by their SHA-256 digest, so
+// identical chunks of different images are stored and cached once.
+//
+// Writes are kept in a local overlay. The modified chunks are uploaded by
+// Commit, which returns the manifest of the new contents:
+//
+//	m, err := cas.Build(ctx, img, size, 0, remote)
+//	// store m
+//	d, err := cas.Open(m, remote, &cas.Options{Cache: cas.Dir("/var/cache/cas")})
+//	srv.AddExport(nbd.Export{Name: "vm", Size: m.Size, Device: d})
+//	// later
+//	m, err = d.Commit(ctx)
+package cas
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/Merovius/nbd"
+	"golang.org/x/time/rate"
+)
+
+// DefaultChunkSize is the chunk size used by Build, if it is passed 0.
+const DefaultChunkSize = 1 << 20
+
+// Digest is the SHA-256 digest of a chunk. The zero Digest denotes a chunk
+// only containing zeros, which is not stored.
+type Digest [sha256.Size]byte
+
+// Sum returns the Digest of data, which is the zero Digest, if data only
+// contains zeros.
+func Sum(data []byte) Digest {
+	if isZero(data) {
+		return Digest{}
+	}
+	return sha256.Sum256(data)
+}
+
+// IsZero returns whether d is the zero Digest.
+func (d Digest) IsZero() bool {
+	return d == Digest{}
+}
+
+// String returns d in hex. The zero Digest is the empty string.
+func (d Digest) String() string {
+	if d.IsZero() {
+		return ""
+	}
+	return hex.EncodeToString(d[:])
+}
+
+// MarshalText implements encoding.TextMarshaler.
+func (d Digest) MarshalText() ([]byte, error) {
+	return []byte(d.String()), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler.
+func (d *Digest) UnmarshalText(b []byte) error {
+	if len(b) == 0 {
+		*d = Digest{}
+		return nil
+	}
+	if len(b) != 2*len(d) {
+		return fmt.Errorf("invalid digest %q", b)
+	}
+	_, err := hex.Decode(d[:], b)
+	return err
+}
+
+// Manifest describes the contents of a Device. It can be stored as JSON.
+type Manifest struct {
+	// Size is the size of the Device in bytes.
+	Size uint64 `json:"size"`
+	// ChunkSize is the size of all chunks but the last, which might be
+	// shorter.
+	ChunkSize int `json:"chunk_size"`
+	// Chunks are the digests of the chunks.
+	Chunks []Digest `json:"chunks"`
+}
+
+// chunkLen returns the length of chunk i.
+func (m *Manifest) chunkLen(i int) int64 {
+	off := int64(i) * int64(m.ChunkSize)
+	if rest := int64(m.Size) - off; rest < int64(m.ChunkSize) {
+		return rest
+	}
+	return int64(m.ChunkSize)
+}
+
+// check returns an error, if m is inconsistent.
+func (m *Manifest) check() error {
+	if m.ChunkSize <= 0 {
+		return fmt.Errorf("invalid chunk size %d", m.ChunkSize)
+	}
+	if n := (m.Size + uint64(m.ChunkSize) - 1) / uint64(m.ChunkSize); uint64(len(m.Chunks)) != n {
+		return fmt.Errorf("manifest has %d chunks, want %d", len(m.Chunks), n)
+	}
+	return nil
+}
+
+// ErrNotExist is returned by Store.Get, if the chunk does not exist.
+var ErrNotExist = errors.New("chunk does not exist")
+
+// Store is a content-addressable store of chunks.
+type Store interface {
+	// Get returns the chunk with the given digest. If it does not exist,
+	// it returns ErrNotExist.
+	Get(ctx context.Context, d Digest) ([]byte, error)
+	// Put stores the chunk data with the digest d.
+	Put(ctx context.Context, d Digest, data []byte) error
+}
+
+// Build splits the size bytes of r into chunks of chunkSize bytes, uploads
+// them to s and returns the Manifest describing them. If chunkSize is <= 0,
+// DefaultChunkSize is used.
+func Build(ctx context.Context, r io.ReaderAt, size uint64, chunkSize int, s Store) (*Manifest, error) {
+	if chunkSize <= 0 {
+		chunkSize = DefaultChunkSize
+	}
+	m := &Manifest{Size: size, ChunkSize: chunkSize}
+	m.Chunks = make([]Digest, (size+uint64(chunkSize)-1)/uint64(chunkSize))
+	buf := make([]byte, chunkSize)
+	for i := range m.Chunks {
+		b := buf[:m.chunkLen(i)]
+		if n, err := r.ReadAt(b, int64(i)*int64(chunkSize)); err != nil && !(err == io.EOF && n == len(b)) {
+			return nil, err
+		}
+		d := Sum(b)
+		if !d.IsZero() {
+			if err := s.Put(ctx, d, b); err != nil {
+				return nil, err
+			}
+		}
+		m.Chunks[i] = d
+	}
+	return m, nil
+}
+
+// Options configures a Device.
+type Options struct {
+	// Cache, if not nil, stores chunks fetched from the remote Store, so
+	// they are only fetched once. It is typically a Dir.
+	Cache Store
+	// Overlay holds the modified chunks. It must have the size of the
+	// Device. If it is nil, a MemDevice is used; a sparse file allows larger
+	// modifications.
+	Overlay nbd.Device
+}
+
+// Device is a Device with the contents described by a Manifest. It is safe
+// for concurrent use.
+type Device struct {
+	remote  Store
+	cache   Store
+	overlay nbd.Device
+
+	// mu protects m and dirty. The chunk of either is only modified while
+	// holding mu and the lock of the chunk.
+	mu    sync.Mutex
+	m     Manifest
+	dirty []bool
+	// locks serialize accesses to each chunk, so chunks are fetched once.
+	locks []sync.Mutex
+}
+
+// Open returns a Device with the contents described by m, fetching chunks
+// from remote. opts may be nil.
+func Open(m *Manifest, remote Store, opts *Options) (*Device, error) {
+	if err := m.check(); err != nil {
+		return nil, err
+	}
+	if opts == nil {
+		opts = new(Options)
+	}
+	d := &Device{
+		remote:  remote,
+		cache:   opts.Cache,
+		overlay: opts.Overlay,
+		m:       *m,
+		dirty:   make([]bool, len(m.Chunks)),
+		locks:   make([]sync.Mutex, len(m.Chunks)),
+	}
+	d.m.Chunks = append([]Digest(nil), m.Chunks...)
+	if d.overlay == nil {
+		md, err := nbd.NewMemDevice(m.Size)
+		if err != nil {
+			return nil, err
+		}
+		d.overlay = md
+	}
+	return d, nil
+}
+
+// Size returns the size of d.
+func (d *Device) Size() uint64 {
+	return d.m.Size
+}
+
+// chunk returns the Digest of chunk i and whether it was modified. The lock
+// of the chunk must be held.
+func (d *Device) chunk(i int) (Digest, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.m.Chunks[i], d.dirty[i]
+}
+
+// fetch reads the chunk with Digest dg into b, which has its length. It is
+// read from the cache, if possible, and verified otherwise.
+func (d *Device) fetch(ctx context.Context, dg Digest, b []byte) error {
+	if dg.IsZero() {
+		zero(b)
+		return nil
+	}
+	if d.cache != nil {
+		if data, err := d.cache.Get(ctx, dg); err == nil && len(data) == len(b) && Sum(data) == dg {
+			copy(b, data)
+			return nil
+		}
+	}
+	data, err := d.remote.Get(ctx, dg)
+	if err != nil {
+		return nbd.Errorf(nbd.EIO, "fetching chunk %v: %v", dg, err)
+	}
+	if len(data) != len(b) || Sum(data) != dg {
+		return nbd.Errorf(nbd.EIO, "chunk %v is corrupt", dg)
+	}
+	copy(b, data)
+	if d.cache != nil {
+		// Failing to cache the chunk only means it is fetched again.
+		d.cache.Put(ctx, dg, data)
+	}
+	return nil
+}
+
+// do calls f for the parts of the n bytes at off in each chunk, holding the
+// lock of the chunk, with the index of the chunk, the offset of the part
+// and its offset in the range.
+func (d *Device) do(off, n int64, f func(i int, off, pos, n int64) error) error {
+	cs := int64(d.m.ChunkSize)
+	for pos := int64(0); pos < n; {
+		i := int((off + pos) / cs)
+		m := (int64(i)+1)*cs - (off + pos)
+		if m > n-pos {
+			m = n - pos
+		}
+		d.locks[i].Lock()
+		err := f(i, off+pos, pos, m)
+		d.locks[i].Unlock()
+		if err != nil {
+			return err
+		}
+		pos += m
+	}
+	return nil
+}
+
+// ReadAt implements nbd.Device.
+func (d *Device) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, nbd.Errorf(nbd.EINVAL, "negative offset")
+	}
+	if uint64(off) >= d.m.Size {
+		return 0, io.EOF
+	}
+	var eof error
+	if rest := int64(d.m.Size) - off; int64(len(p)) > rest {
+		p, eof = p[:rest], io.EOF
+	}
+	var buf []byte
+	err := d.do(off, int64(len(p)), func(i int, off, pos, n int64) error {
+		b := p[pos : pos+n]
+		dg, dirty := d.chunk(i)
+		if dirty {
+			_, err := d.overlay.ReadAt(b, off)
+			return err
+		}
+		start := int64(i) * int64(d.m.ChunkSize)
+		if off == start && n == d.m.chunkLen(i) {
+			return d.fetch(context.Background(), dg, b)
+		}
+		if buf == nil {
+			buf = make([]byte, d.m.ChunkSize)
+		}
+		c := buf[:d.m.chunkLen(i)]
+		if err := d.fetch(context.Background(), dg, c); err != nil {
+			return err
+		}
+		copy(b, c[off-start:])
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return len(p), eof
+}
+
+// WriteAt implements nbd.Device. The first write to a chunk copies it to the
+// overlay, fetching it if only part of it is written.
+func (d *Device) WriteAt(p []byte, off int64) (int, error) {
+	if off < 0 || off+int64(len(p)) > int64(d.m.Size) {
+		return 0, nbd.Errorf(nbd.ENOSPC, "write past end of device")
+	}
+	var buf []byte
+	err := d.do(off, int64(len(p)), func(i int, off, pos, n int64) error {
+		dg, dirty := d.chunk(i)
+		start, l := int64(i)*int64(d.m.ChunkSize), d.m.chunkLen(i)
+		if !dirty && n < l {
+			if buf == nil {
+				buf = make([]byte, d.m.ChunkSize)
+			}
+			c := buf[:l]
+			if err := d.fetch(context.Background(), dg, c); err != nil {
+				return err
+			}
+			if _, err := d.overlay.WriteAt(c, start); err != nil {
+				return err
+			}
+		}
+		if _, err := d.overlay.WriteAt(p[pos:pos+n], off); err != nil {
+			return err
+		}
+		d.mu.Lock()
+		d.dirty[i] = true
+		d.mu.Unlock()
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Sync implements nbd.Device, by syncing the overlay. Modified chunks are
+// only uploaded by Commit.
+func (d *Device) Sync() error {
+	return d.overlay.Sync()
+}
+
+// Dirty returns the number of modified chunks, not yet uploaded by Commit.
+func (d *Device) Dirty() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var n int
+	for _, dirty := range d.dirty {
+		if dirty {
+			n++
+		}
+	}
+	return n
+}
+
+// Manifest returns the manifest of the contents of d, as of the last Commit
+// (or Open). Chunks dropped from the overlay by Compact are included.
+func (d *Device) Manifest() *Manifest {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	m := d.m
+	m.Chunks = append([]Digest(nil), d.m.Chunks...)
+	return &m
+}
+
+// Commit uploads the modified chunks to the remote Store and returns the
+// Manifest of the contents of d. Chunks written concurrently may or may not
+// be included.
+func (d *Device) Commit(ctx context.Context) (*Manifest, error) {
+	buf := make([]byte, d.m.ChunkSize)
+	for i := range d.locks {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		if _, dirty := d.chunk(i); !dirty {
+			continue
+		}
+		if err := d.commit(ctx, i, buf); err != nil {
+			return nil, err
+		}
+	}
+	return d.Manifest(), nil
+}
+
+// commit uploads the modified chunk i.
+func (d *Device) commit(ctx context.Context, i int, buf []byte) error {
+	d.locks[i].Lock()
+	defer d.locks[i].Unlock()
+	c := buf[:d.m.chunkLen(i)]
+	if n, err := d.overlay.ReadAt(c, int64(i)*int64(d.m.ChunkSize)); err != nil && !(err == io.EOF && n == len(c)) {
+		return err
+	}
+	dg := Sum(c)
+	if !dg.IsZero() {
+		if err := d.remote.Put(ctx, dg, c); err != nil {
+			return err
+		}
+		if d.cache != nil {
+			d.cache.Put(ctx, dg, c)
+		}
+	}
+	d.mu.Lock()
+	d.m.Chunks[i], d.dirty[i] = dg, false
+	d.mu.Unlock()
+	// The chunk is read from the stores from now on.
+	if t, ok := d.overlay.(nbd.Trimmer); ok {
+		t.Trim(int64(i)*int64(d.m.ChunkSize), int64(len(c)))
+	}
+	return nil
+}
+
+// CompactOptions configures Compact.
+type CompactOptions struct {
+	// BytesPerSecond limits the rate of data read by Compact, so it does not
+	// starve clients of the Device. If it is <= 0, the rate is not limited.
+	BytesPerSecond float64
+	// Progress, if not nil, is called after every chunk processed.
+	Progress func(CompactProgress)
+}
+
+// CompactProgress describes the progress of Compact.
+type CompactProgress struct {
+	// Scanned is the number of modified chunks checked out of Total.
+	Scanned, Total int
+	// Freed is the number of chunks dropped from the overlay.
+	Freed int
+}
+
+// Compact reclaims space in the overlay: modified chunks, which only contain
+// zeros (e.g. because they were trimmed) or the same data as before they
+// were modified, are dropped from it and read from the stores again. Zero
+// chunks are not stored, so they are recorded in the Manifest right away.
+// Space is only freed, if the overlay implements nbd.Trimmer. If ctx is
+// cancelled, Compact stops, leaving the Device consistent.
+func (d *Device) Compact(ctx context.Context, opts *CompactOptions) error {
+	if opts == nil {
+		opts = new(CompactOptions)
+	}
+	var lim *rate.Limiter
+	if opts.BytesPerSecond > 0 {
+		burst := d.m.ChunkSize
+		if opts.BytesPerSecond > float64(burst) {
+			burst = int(opts.BytesPerSecond)
+		}
+		lim = rate.NewLimiter(rate.Limit(opts.BytesPerSecond), burst)
+	}
+	pr := CompactProgress{Total: d.Dirty()}
+	buf := make([]byte, d.m.ChunkSize)
+	for i := range d.locks {
+		if pr.Scanned == pr.Total {
+			break
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if _, dirty := d.chunk(i); !dirty {
+			continue
+		}
+		if lim != nil {
+			if err := lim.WaitN(ctx, d.m.ChunkSize); err != nil {
+				return err
+			}
+		}
+		freed, err := d.drop(i, buf)
+		if err != nil {
+			return err
+		}
+		pr.Scanned++
+		if freed {
+			pr.Freed++
+		}
+		if opts.Progress != nil {
+			opts.Progress(pr)
+		}
+	}
+	return nil
+}
+
+// drop drops the modified chunk i from the overlay, if it only contains
+// zeros or its committed contents. It returns whether it was dropped.
+func (d *Device) drop(i int, buf []byte) (bool, error) {
+	d.locks[i].Lock()
+	defer d.locks[i].Unlock()
+	old, dirty := d.chunk(i)
+	if !dirty {
+		return false, nil
+	}
+	c := buf[:d.m.chunkLen(i)]
+	if n, err := d.overlay.ReadAt(c, int64(i)*int64(d.m.ChunkSize)); err != nil && !(err == io.EOF && n == len(c)) {
+		return false, err
+	}
+	dg := Sum(c)
+	if !dg.IsZero() && dg != old {
+		return false, nil
+	}
+	d.mu.Lock()
+	d.m.Chunks[i], d.dirty[i] = dg, false
+	d.mu.Unlock()
+	if t, ok := d.overlay.(nbd.Trimmer); ok {
+		t.Trim(int64(i)*int64(d.m.ChunkSize), int64(len(c)))
+	}
+	return true, nil
+}
+
+func isZero(b []byte) bool {
+	for _, c := range b {
+		if c != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func zero(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
@@ -0,0 +1,128 @@
+// Copyright 2018 Axel Wagner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cas
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Dir is a Store keeping chunks as files in a local directory, named by
+// their digest. It is typically used as a cache.
+type Dir string
+
+func (dir Dir) path(d Digest) string {
+	s := d.String()
+	// Spread the chunks over subdirectories, to keep them small.
+	return filepath.Join(string(dir), s[:2], s)
+}
+
+// Get implements Store.
+func (dir Dir) Get(ctx context.Context, d Digest) ([]byte, error) {
+	b, err := os.ReadFile(dir.path(d))
+	if os.IsNotExist(err) {
+		return nil, ErrNotExist
+	}
+	return b, err
+}
+
+// Put implements Store.
+func (dir Dir) Put(ctx context.Context, d Digest, data []byte) error {
+	name := dir.path(d)
+	if _, err := os.Stat(name); err == nil {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(name), ".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), name)
+}
+
+// HTTP is a Store accessing chunks under a base URL with GET and PUT
+// requests, at URL/<digest>. A URL ending in /cas is compatible with the
+// HTTP remote caching protocol of Bazel, so its cache servers can be used.
+type HTTP struct {
+	// URL is the base URL of the chunks.
+	URL string
+	// Header is added to all requests, e.g. for authorization.
+	Header http.Header
+	// Client is used to issue requests. If it is nil, http.DefaultClient is
+	// used.
+	Client *http.Client
+}
+
+func (h *HTTP) do(ctx context.Context, method string, d Digest, body []byte) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, strings.TrimSuffix(h.URL, "/")+"/"+d.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = int64(len(body))
+	for k, v := range h.Header {
+		req.Header[k] = v
+	}
+	c := h.Client
+	if c == nil {
+		c = http.DefaultClient
+	}
+	return c.Do(req)
+}
+
+// Get implements Store.
+func (h *HTTP) Get(ctx context.Context, d Digest) ([]byte, error) {
+	resp, err := h.do(ctx, http.MethodGet, d, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return io.ReadAll(resp.Body)
+	case http.StatusNotFound:
+		return nil, ErrNotExist
+	default:
+		return nil, fmt.Errorf("GET %v: %s", d, resp.Status)
+	}
+}
+
+// Put implements Store.
+func (h *HTTP) Put(ctx context.Context, d Digest, data []byte) error {
+	resp, err := h.do(ctx, http.MethodPut, d, data)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("PUT %v: %s", d, resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,638 @@
+// Copyright 2018 Axel Wagner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nbd
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// maxClientRequest is the maximum length of a single read or write request
+// sent by a Conn. Larger requests are split.
+const maxClientRequest = 4 << 20
+
+// maxBlockStatusChunk is the maximum length of a block status reply chunk
+// accepted by a Conn. Block status requests are limited to maxClientRequest
+// bytes, so it allows an extended descriptor for every byte.
+const maxBlockStatusChunk = 8 + 16*maxClientRequest
+
+// errConnClosed is returned by a Conn after Close.
+var errConnClosed = errors.New("nbd: connection closed")
+
+// Conn is an export opened by a Client, in transmission phase. It implements
+// Device, so it can be used like a local Device, or served again.
+//
+// Conn is safe for concurrent use. Concurrent requests are sent without
+// waiting for the replies of earlier ones, so the server can execute them
+// concurrently. Like on a Server, every request gets a unique ID (see
+// RequestInfo.ID), which is used in logs.
+type Conn struct {
+	// counters are the statistics of the connection. They are first, to
+	// be 64-bit aligned for atomic access.
+	counters Counters
+
+	exp Export
+	c   net.Conn
+	log *slog.Logger
+	obs Observer
+	// id identifies the connection in logs.
+	id uint64
+	// meta are the ids of the metadata contexts selected with
+	// SetMetaContext, by name.
+	meta map[string]uint32
+	// extended is set, if extended headers were negotiated.
+	extended bool
+
+	// wmu serializes writing requests to c.
+	wmu sync.Mutex
+
+	mu      sync.Mutex
+	handle  uint64
+	pending map[uint64]*call
+	// err is the error which terminated the connection. Once it is set,
+	// all requests fail with it.
+	err error
+}
+
+// call is a request waiting for its reply.
+type call struct {
+	// id is the unique ID of the request.
+	id uint64
+	// into receives the payload of a successful read at off.
+	into []byte
+	off  uint64
+	// desc receives the descriptors of a block status reply for the
+	// context meta.
+	meta uint32
+	desc []descriptor
+	// err is the first error reported by a structured reply chunk.
+	err  error
+	done chan error
+}
+
+// Open terminates the handshake phase, like Go, and returns a Conn to issue
+// requests to the opened export. c should not be used after Open returns.
+func (c *Client) Open(exportName string) (*Conn, error) {
+	ex, err := c.Go(exportName)
+	if err != nil {
+		return nil, err
+	}
+	id := nextConnID()
+	cn := &Conn{
+		exp:      ex,
+		c:        c.conn,
+		log:      orDiscard(c.Logger).With("conn", id, "export", ex.Name),
+		obs:      c.Observer,
+		id:       id,
+		pending:  make(map[uint64]*call),
+		extended: c.extended,
+	}
+	if c.meta != nil && c.metaExport == exportName {
+		cn.meta = c.meta
+	}
+	cn.counters.Connections = 1
+	go cn.readReplies()
+	return cn, nil
+}
+
+// Export returns the export c is connected to, as described by the server.
+func (c *Conn) Export() Export {
+	return c.exp
+}
+
+// Size returns the size of the export.
+func (c *Conn) Size() uint64 {
+	return c.exp.Size
+}
+
+// Stats returns a snapshot of the statistics of c. Connections is 1 until
+// the connection fails or is closed. BytesRead and BytesWritten count the
+// payload of successful reads and writes. It is safe to call concurrently
+// with requests.
+func (c *Conn) Stats() Counters {
+	return c.counters.load()
+}
+
+// maxRequest returns the maximum length of a single read or write request,
+// honoring the maximum block size advertised by the server.
+func (c *Conn) maxRequest() int {
+	if bs := c.exp.BlockSizes; bs != nil && bs.Max > 0 && bs.Max < maxClientRequest {
+		return int(bs.Max)
+	}
+	return maxClientRequest
+}
+
+// ReadAt implements Device and io.ReaderAt. Reads past the end of the export
+// are truncated and return io.EOF.
+func (c *Conn) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, Errorf(EINVAL, "negative offset")
+	}
+	var eof error
+	if uint64(off) >= c.exp.Size {
+		return 0, io.EOF
+	}
+	if rest := c.exp.Size - uint64(off); uint64(len(p)) > rest {
+		p, eof = p[:rest], io.EOF
+	}
+	n := 0
+	for n < len(p) {
+		l := len(p) - n
+		if max := c.maxRequest(); l > max {
+			l = max
+		}
+		if err := c.do(cmdRead, 0, off+int64(n), uint64(l), nil, p[n:n+l]); err != nil {
+			return n, err
+		}
+		n += l
+	}
+	return n, eof
+}
+
+// WriteAt implements Device and io.WriterAt.
+func (c *Conn) WriteAt(p []byte, off int64) (int, error) {
+	if c.exp.Flags&FlagReadOnly != 0 {
+		return 0, Errorf(EPERM, "export is read-only")
+	}
+	if off < 0 {
+		return 0, Errorf(EINVAL, "negative offset")
+	}
+	n := 0
+	for n < len(p) {
+		l := len(p) - n
+		if max := c.maxRequest(); l > max {
+			l = max
+		}
+		if err := c.do(cmdWrite, 0, off+int64(n), uint64(l), p[n:n+l], nil); err != nil {
+			return n, err
+		}
+		n += l
+	}
+	return n, nil
+}
+
+// Sync implements Device, by calling Flush.
+func (c *Conn) Sync() error {
+	return c.Flush()
+}
+
+// NeedsFlush implements Flusher. It reports whether the server caches writes,
+// so serving c again passes its flushes on.
+func (c *Conn) NeedsFlush() bool {
+	return c.exp.Flags&FlagSendFlush != 0
+}
+
+// Flush asks the server to persist all completed writes. If the export does
+// not support flushes, it is a no-op.
+func (c *Conn) Flush() error {
+	if c.exp.Flags&FlagSendFlush == 0 {
+		return nil
+	}
+	return c.do(cmdFlush, 0, 0, 0, nil, nil)
+}
+
+// Trim tells the server, that the given range is no longer needed. Its
+// contents are undefined afterwards. It returns an error, if the export does
+// not support trimming.
+func (c *Conn) Trim(off, length int64) error {
+	if c.exp.Flags&FlagSendTrim == 0 {
+		return Errorf(EINVAL, "export does not support trim")
+	}
+	for length > 0 {
+		l := length
+		if l > 1<<31 && !c.extended {
+			l = 1 << 31
+		}
+		if err := c.do(cmdTrim, 0, off, uint64(l), nil, nil); err != nil {
+			return err
+		}
+		off, length = off+l, length-l
+	}
+	return nil
+}
+
+// WriteZeroes implements ZeroWriter. If the export does not support
+// NBD_CMD_WRITE_ZEROES, zeros are written with WriteAt instead.
+func (c *Conn) WriteZeroes(off, length int64, noHole bool) error {
+	if c.exp.Flags&FlagReadOnly != 0 {
+		return Errorf(EPERM, "export is read-only")
+	}
+	if c.exp.Flags&FlagSendWriteZeroes == 0 {
+		// Hide the ZeroWriter method, to not recurse.
+		return WriteZeroes(struct{ io.WriterAt }{c}, off, length, noHole)
+	}
+	var flags uint16
+	if noHole {
+		flags = cmdFlagNoHole
+	}
+	for length > 0 {
+		l := length
+		if l > 1<<31 && !c.extended {
+			l = 1 << 31
+		}
+		if err := c.do(cmdWriteZeroes, flags, off, uint64(l), nil, nil); err != nil {
+			return err
+		}
+		off, length = off+l, length-l
+	}
+	return nil
+}
+
+// Extents implements Extenter. If MetaContextAllocation was not selected with
+// SetMetaContext, the range is reported as allocated.
+func (c *Conn) Extents(off, length int64) ([]Extent, error) {
+	id, ok := c.meta[MetaContextAllocation]
+	desc, err := c.blockStatus(id, ok, off, length)
+	if err != nil {
+		return nil, err
+	}
+	ext := make([]Extent, len(desc))
+	for i, d := range desc {
+		ext[i] = Extent{
+			Length: int64(d.length),
+			Hole:   d.flags&stateHole != 0,
+			Zero:   d.flags&stateZero != 0,
+		}
+	}
+	return ext, nil
+}
+
+// DirtyBitmaps implements DirtyBitmapper. It returns the names of the
+// qemu:dirty-bitmap: contexts selected with SetMetaContext, without the
+// prefix.
+func (c *Conn) DirtyBitmaps() []string {
+	var names []string
+	for _, n := range metaNames(c.meta) {
+		if strings.HasPrefix(n, MetaContextDirtyBitmap) {
+			names = append(names, strings.TrimPrefix(n, MetaContextDirtyBitmap))
+		}
+	}
+	return names
+}
+
+// DirtyExtents implements DirtyBitmapper, with NBD_CMD_BLOCK_STATUS for the
+// context qemu:dirty-bitmap:<name>, which must have been selected with
+// SetMetaContext.
+func (c *Conn) DirtyExtents(name string, off, length int64) ([]DirtyExtent, error) {
+	id, ok := c.meta[MetaContextDirtyBitmap+name]
+	if !ok {
+		return nil, Errorf(EINVAL, "unknown dirty bitmap %q", name)
+	}
+	desc, err := c.blockStatus(id, ok, off, length)
+	if err != nil {
+		return nil, err
+	}
+	ext := make([]DirtyExtent, len(desc))
+	for i, d := range desc {
+		ext[i] = DirtyExtent{Length: int64(d.length), Dirty: d.flags&stateDirty != 0}
+	}
+	return ext, nil
+}
+
+// blockStatus returns the descriptors of the metadata context id for length
+// bytes at off. At most maxClientRequest bytes are requested, to bound the
+// size of the reply. If ok is not set, the context was not selected and the
+// range is described by a single descriptor with no flags set.
+func (c *Conn) blockStatus(id uint32, ok bool, off, length int64) ([]descriptor, error) {
+	if off < 0 || length < 0 || uint64(off) > c.exp.Size {
+		return nil, Errorf(EINVAL, "invalid range")
+	}
+	if rest := int64(c.exp.Size) - off; length > rest {
+		length = rest
+	}
+	if length > maxClientRequest {
+		length = maxClientRequest
+	}
+	if !ok || length == 0 {
+		return []descriptor{{uint64(length), 0}}, nil
+	}
+	cl := &call{meta: id}
+	if err := c.roundTrip(cl, cmdBlockStatus, 0, off, uint64(length), nil); err != nil {
+		return nil, err
+	}
+	if len(cl.desc) == 0 {
+		return nil, errors.New("nbd: empty block status reply")
+	}
+	return cl.desc, nil
+}
+
+// Close sends a disconnect request and closes the connection. Requests in
+// flight fail.
+func (c *Conn) Close() error {
+	c.wmu.Lock()
+	var req [32]byte
+	n := putRequest(req[:], c.extended, 0, cmdDisc, 0, 0, 0)
+	c.c.Write(req[:n])
+	c.wmu.Unlock()
+	err := c.c.Close()
+	c.fail(errConnClosed)
+	return err
+}
+
+// putRequest encodes a request header into b, which must have room for an
+// extended header, and returns its length. If extended is not set, a compact
+// header is used.
+func putRequest(b []byte, extended bool, flags, typ uint16, handle uint64, off uint64, length uint64) int {
+	magic := uint32(reqMagic)
+	if extended {
+		magic = extendedRequestMagic
+	}
+	binary.BigEndian.PutUint32(b[0:], magic)
+	binary.BigEndian.PutUint16(b[4:], flags)
+	binary.BigEndian.PutUint16(b[6:], typ)
+	binary.BigEndian.PutUint64(b[8:], handle)
+	binary.BigEndian.PutUint64(b[16:], off)
+	if extended {
+		binary.BigEndian.PutUint64(b[24:], length)
+		return 32
+	}
+	binary.BigEndian.PutUint32(b[24:], uint32(length))
+	return 28
+}
+
+// do sends a request and waits for its reply. The payload of a successful
+// read is read into into. An error returned by the server is an Errno;
+// errors of the connection are permanent.
+func (c *Conn) do(typ, flags uint16, off int64, length uint64, data, into []byte) error {
+	return c.roundTrip(&call{into: into}, typ, flags, off, length, data)
+}
+
+// roundTrip sends a request for cl and waits for its reply.
+func (c *Conn) roundTrip(cl *call, typ, flags uint16, off int64, length uint64, data []byte) error {
+	cl.id, cl.off, cl.done = nextRequestID(), uint64(off), make(chan error, 1)
+	atomic.AddInt64(&c.counters.InFlight, 1)
+	c.mu.Lock()
+	if c.err != nil {
+		err := c.err
+		c.mu.Unlock()
+		c.counters.record(typ, length, err)
+		return err
+	}
+	c.handle++
+	h := c.handle
+	c.pending[h] = cl
+	c.mu.Unlock()
+	var done func(error)
+	if c.obs != nil {
+		done = c.obs.Start(RequestInfo{
+			ID:      cl.id,
+			Conn:    c.id,
+			Handle:  h,
+			Export:  c.exp.Name,
+			Command: Command(typ),
+			Offset:  uint64(off),
+			Length:  length,
+		})
+	}
+
+	b := make([]byte, 32, 32+len(data))
+	n := putRequest(b, c.extended, flags, typ, h, uint64(off), length)
+	c.wmu.Lock()
+	_, err := c.c.Write(append(b[:n], data...))
+	c.wmu.Unlock()
+	if err != nil {
+		c.fail(err)
+	}
+	err = <-cl.done
+	c.counters.record(typ, length, err)
+	if done != nil {
+		done(err)
+	}
+	if _, ok := err.(Error); ok {
+		c.log.Debug("request failed", "request_id", cl.id, "handle", h, "command", Command(typ), "offset", off, "length", length, "err", err)
+	}
+	return err
+}
+
+// readReplies reads replies and dispatches them to the waiting calls, until
+// the connection fails.
+func (c *Conn) readReplies() {
+	var hdr [32]byte
+	for {
+		if _, err := io.ReadFull(c.c, hdr[:4]); err != nil {
+			c.fail(err)
+			return
+		}
+		var err error
+		switch binary.BigEndian.Uint32(hdr[0:]) {
+		case simpleReplyMagic:
+			err = c.readSimple(hdr[:16])
+		case structuredReplyMagic:
+			err = c.readChunk(hdr[:20], false)
+		case extendedReplyMagic:
+			err = c.readChunk(hdr[:32], true)
+		default:
+			err = errors.New("nbd: invalid reply magic")
+		}
+		if err != nil {
+			c.fail(err)
+			return
+		}
+	}
+}
+
+// lookup returns the pending call for handle h. If done is set, it is removed
+// from the pending calls.
+func (c *Conn) lookup(h uint64, done bool) (*call, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	cl, ok := c.pending[h]
+	if !ok {
+		return nil, errors.New("nbd: reply for unknown handle")
+	}
+	if done {
+		delete(c.pending, h)
+	}
+	return cl, nil
+}
+
+// readSimple reads the rest of a simple reply, whose magic has already been
+// read into hdr.
+func (c *Conn) readSimple(hdr []byte) error {
+	if _, err := io.ReadFull(c.c, hdr[4:]); err != nil {
+		return err
+	}
+	errno := binary.BigEndian.Uint32(hdr[4:])
+	cl, err := c.lookup(binary.BigEndian.Uint64(hdr[8:]), true)
+	if err != nil {
+		return err
+	}
+	if errno != 0 {
+		cl.done <- Errno(errno)
+		return nil
+	}
+	if cl.into != nil {
+		if _, err := io.ReadFull(c.c, cl.into); err != nil {
+			cl.done <- err
+			return err
+		}
+	}
+	cl.done <- nil
+	return nil
+}
+
+// readChunk reads the rest of a structured reply chunk, whose magic has
+// already been read into hdr. If extended is set, the chunk has an extended
+// header.
+func (c *Conn) readChunk(hdr []byte, extended bool) error {
+	if _, err := io.ReadFull(c.c, hdr[4:]); err != nil {
+		return err
+	}
+	flags := binary.BigEndian.Uint16(hdr[4:])
+	typ := binary.BigEndian.Uint16(hdr[6:])
+	var length uint64
+	if extended {
+		length = binary.BigEndian.Uint64(hdr[24:])
+	} else {
+		length = uint64(binary.BigEndian.Uint32(hdr[16:]))
+	}
+	limit := uint64(maxClientRequest + 8)
+	if typ == replyTypeBlockStatus || typ == replyTypeBlockStatusExt {
+		limit = maxBlockStatusChunk
+	}
+	if length > limit {
+		return errors.New("nbd: reply chunk too large")
+	}
+	done := flags&replyFlagDone != 0
+	cl, err := c.lookup(binary.BigEndian.Uint64(hdr[8:]), done)
+	if err != nil {
+		return err
+	}
+	switch typ {
+	case replyTypeOffsetData:
+		if length < 8 {
+			return errors.New("nbd: invalid data chunk")
+		}
+		var off [8]byte
+		if _, err := io.ReadFull(c.c, off[:]); err != nil {
+			return err
+		}
+		b, err := cl.chunk(binary.BigEndian.Uint64(off[:]), uint32(length-8))
+		if err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(c.c, b); err != nil {
+			return err
+		}
+	default:
+		p := make([]byte, length)
+		if _, err := io.ReadFull(c.c, p); err != nil {
+			return err
+		}
+		if err := cl.decodeChunk(c.log, typ, p); err != nil {
+			return err
+		}
+	}
+	if done {
+		cl.done <- cl.err
+	}
+	return nil
+}
+
+// chunk returns the part of cl.into receiving n bytes at off.
+func (cl *call) chunk(off uint64, n uint32) ([]byte, error) {
+	if off < cl.off || off-cl.off > uint64(len(cl.into)) || uint64(n) > uint64(len(cl.into))-(off-cl.off) {
+		return nil, errors.New("nbd: reply chunk out of range")
+	}
+	return cl.into[off-cl.off:][:n], nil
+}
+
+// decodeChunk applies the payload p of a structured reply chunk of type typ,
+// other than NBD_REPLY_TYPE_OFFSET_DATA, to cl. Unexpected, but harmless,
+// chunks are logged to log.
+func (cl *call) decodeChunk(log *slog.Logger, typ uint16, p []byte) error {
+	switch {
+	case typ == replyTypeNone:
+		if len(p) != 0 {
+			return errors.New("nbd: invalid none chunk")
+		}
+	case typ == replyTypeOffsetHole:
+		if len(p) != 12 {
+			return errors.New("nbd: invalid hole chunk")
+		}
+		b, err := cl.chunk(binary.BigEndian.Uint64(p), binary.BigEndian.Uint32(p[8:]))
+		if err != nil {
+			return err
+		}
+		for i := range b {
+			b[i] = 0
+		}
+	case typ == replyTypeBlockStatus:
+		if len(p) < 4 || (len(p)-4)%8 != 0 {
+			return errors.New("nbd: invalid block status chunk")
+		}
+		if id := binary.BigEndian.Uint32(p); id != cl.meta {
+			log.Debug("ignoring block status for unknown metadata context", "request_id", cl.id, "context", id)
+			break
+		}
+		for p = p[4:]; len(p) > 0; p = p[8:] {
+			cl.desc = append(cl.desc, descriptor{uint64(binary.BigEndian.Uint32(p)), binary.BigEndian.Uint32(p[4:])})
+		}
+	case typ == replyTypeBlockStatusExt:
+		if len(p) < 8 || (len(p)-8)%16 != 0 || int(binary.BigEndian.Uint32(p[4:])) != (len(p)-8)/16 {
+			return errors.New("nbd: invalid block status chunk")
+		}
+		if id := binary.BigEndian.Uint32(p); id != cl.meta {
+			log.Debug("ignoring block status for unknown metadata context", "request_id", cl.id, "context", id)
+			break
+		}
+		for p = p[8:]; len(p) > 0; p = p[16:] {
+			cl.desc = append(cl.desc, descriptor{binary.BigEndian.Uint64(p), uint32(binary.BigEndian.Uint64(p[8:]))})
+		}
+	case typ&(1<<15) != 0:
+		if len(p) < 6 {
+			return errors.New("nbd: invalid error chunk")
+		}
+		errno := Errno(binary.BigEndian.Uint32(p))
+		if l := int(binary.BigEndian.Uint16(p[4:])); l <= len(p)-6 && l > 0 {
+			cl.setErr(Errorf(errno, "%s", p[6:6+l]))
+		} else {
+			cl.setErr(errno)
+		}
+	default:
+		return errors.New("nbd: unknown reply chunk type")
+	}
+	return nil
+}
+
+// setErr records err as the error of cl, if it is the first one.
+func (cl *call) setErr(err error) {
+	if cl.err == nil {
+		cl.err = err
+	}
+}
+
+// fail terminates c with err, failing all pending calls.
+func (c *Conn) fail(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err == nil {
+		c.err = err
+		atomic.StoreInt64(&c.counters.Connections, 0)
+		if err != errConnClosed {
+			c.log.Error("connection failed", "err", err)
+		}
+	}
+	for h, cl := range c.pending {
+		cl.done <- c.err
+		delete(c.pending, h)
+	}
+}
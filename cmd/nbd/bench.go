@@ -0,0 +1,136 @@
+// Copyright 2018 Axel Wagner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/Merovius/nbd"
+	"github.com/Merovius/nbd/nbdbench"
+	"github.com/google/subcommands"
+)
+
+func init() {
+	commands = append(commands, &benchCmd{})
+}
+
+type benchCmd struct {
+	w      nbdbench.Workload
+	random bool
+}
+
+func (cmd *benchCmd) Name() string {
+	return "bench"
+}
+
+func (cmd *benchCmd) Synopsis() string {
+	return "benchmark a file, block device or remote export"
+}
+
+func (cmd *benchCmd) Usage() string {
+	return `Usage: nbd bench [flags] <file>|<uri>
+
+Generate load on a file or block device and print the achieved performance.
+Unless -reads=1 is given, the contents of the file are overwritten.
+
+An NBD URI (like nbd://example.com/disk or nbd+unix:///disk?socket=/run/nbd.sock)
+benchmarks the export on the server directly, without the kernel.
+`
+}
+
+func (cmd *benchCmd) SetFlags(fs *flag.FlagSet) {
+	fs.IntVar(&cmd.w.BlockSize, "bs", 4096, "Size of each read and write")
+	fs.Int64Var(&cmd.w.Size, "size", 0, "Size of the region to access. If zero, the whole file is used")
+	fs.BoolVar(&cmd.random, "random", false, "Access random instead of sequential offsets")
+	fs.Float64Var(&cmd.w.Reads, "reads", 1, "Fraction of operations that are reads")
+	fs.IntVar(&cmd.w.Concurrency, "jobs", 1, "Number of operations issued in parallel")
+	fs.Int64Var(&cmd.w.Ops, "ops", 0, "Number of operations to issue. If zero, -time is used")
+	fs.DurationVar(&cmd.w.Duration, "time", 10*time.Second, "Time to run for")
+	fs.IntVar(&cmd.w.SyncEvery, "sync-every", 0, "Sync after that many writes per job. If zero, sync is never called")
+}
+
+func (cmd *benchCmd) Execute(ctx context.Context, fs *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
+	if fs.NArg() != 1 {
+		log.Print(cmd.Usage())
+		return subcommands.ExitUsageError
+	}
+	d, size, err := cmd.open(ctx, fs.Arg(0))
+	if err != nil {
+		log.Println(err)
+		return subcommands.ExitFailure
+	}
+	defer d.Close()
+
+	w := cmd.w
+	if cmd.random {
+		w.Pattern = nbdbench.Random
+	}
+	if w.Ops != 0 {
+		w.Duration = 0
+	}
+	if w.Size == 0 {
+		w.Size = size
+	}
+	res, err := nbdbench.Run(ctx, d, w)
+	if err != nil {
+		log.Println(err)
+		return subcommands.ExitFailure
+	}
+	fmt.Println(res)
+	return subcommands.ExitSuccess
+}
+
+// benchDevice is a Device, which has to be closed after the benchmark.
+type benchDevice interface {
+	nbd.Device
+	io.Closer
+}
+
+// open opens the file or NBD URI arg for benchmarking and returns its size.
+func (cmd *benchCmd) open(ctx context.Context, arg string) (benchDevice, int64, error) {
+	if strings.Contains(arg, "://") {
+		c, err := nbd.OpenURI(ctx, arg)
+		if err != nil {
+			return nil, 0, err
+		}
+		if cmd.w.Reads != 1 && c.Export().Flags&nbd.FlagReadOnly != 0 {
+			c.Close()
+			return nil, 0, fmt.Errorf("export %q is read-only", c.Export().Name)
+		}
+		return c, int64(c.Size()), nil
+	}
+	mode := os.O_RDWR
+	if cmd.w.Reads == 1 {
+		mode = os.O_RDONLY
+	}
+	f, err := os.OpenFile(arg, mode, 0)
+	if err != nil {
+		return nil, 0, err
+	}
+	// Seeking also works for block devices, unlike Stat.
+	size, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+	return f, size, nil
+}
@@ -0,0 +1,82 @@
+// Copyright 2018 Axel Wagner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+
+	"github.com/Merovius/nbd/compressed"
+	"github.com/google/subcommands"
+)
+
+func init() {
+	commands = append(commands, &compressCmd{})
+}
+
+type compressCmd struct {
+	format    string
+	chunkSize int
+}
+
+func (cmd *compressCmd) Name() string {
+	return "compress"
+}
+
+func (cmd *compressCmd) Synopsis() string {
+	return "convert an image into a compressed image"
+}
+
+func (cmd *compressCmd) Usage() string {
+	return `Usage: nbd compress [-format <format>] [-chunk-size <n>] <image> <output>
+
+Convert an image (e.g. a raw image) into a compressed image, which is stored
+in chunks compressed with zstd and can be served like any other image. The
+output must not exist. Compressing a compressed image reclaims the space of
+overwritten chunks.
+`
+}
+
+func (cmd *compressCmd) SetFlags(fs *flag.FlagSet) {
+	fs.StringVar(&cmd.format, "format", "auto", "Format of the input image (raw, thin, compressed or auto)")
+	fs.IntVar(&cmd.chunkSize, "chunk-size", compressed.DefaultChunkSize, "Size of the compressed chunks. Must be a power of two of at least 4096")
+}
+
+func (cmd *compressCmd) Execute(ctx context.Context, fs *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
+	if fs.NArg() != 2 {
+		log.Print(cmd.Usage())
+		return subcommands.ExitUsageError
+	}
+	in, err := openImage(fs.Arg(0), cmd.format)
+	if err != nil {
+		log.Println(err)
+		return subcommands.ExitFailure
+	}
+	defer in.Close()
+	out, err := compressed.Convert(fs.Arg(1), in, in.Size(), cmd.chunkSize)
+	if err != nil {
+		log.Println(err)
+		return subcommands.ExitFailure
+	}
+	st := out.Stats()
+	if err := out.Close(); err != nil {
+		log.Println(err)
+		return subcommands.ExitFailure
+	}
+	fmt.Printf("%d bytes compressed to %d bytes\n", st.Size, st.Stored)
+	return subcommands.ExitSuccess
+}
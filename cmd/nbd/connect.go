@@ -24,9 +24,11 @@ import (
 	"log"
 	"net"
 	"os"
+	"strconv"
 	"time"
 
 	"github.com/Merovius/nbd"
+	"github.com/Merovius/nbd/nbduri"
 	"github.com/google/subcommands"
 )
 
@@ -37,7 +39,9 @@ func init() {
 type connectCmd struct {
 	addr   string
 	unix   bool
+	vsock  bool
 	export string
+	conns  int
 }
 
 func (cmd *connectCmd) Name() string {
@@ -45,42 +49,133 @@ func (cmd *connectCmd) Name() string {
 }
 
 func (cmd *connectCmd) Synopsis() string {
-	return "connect a file as a block device"
+	return "connect a remote export as a block device"
 }
 
 func (cmd *connectCmd) Usage() string {
-	return `Usage: nbd connect -addr <addr> [-unix]
+	return `Usage: nbd connect [-connections <n>] [-addr <addr> [-unix|-vsock] [-export <name>] | <uri>]
 
-Connect a server to an NBD device node.
+Connect a server to an NBD device node. The connections to the server are
+handed to the kernel, so the device is backed by the server directly. With
+-connections, several connections are used, if the server supports it.
+
+The address can be given as unix:<path> instead of using -unix. The server
+can also be given as an NBD URI, like nbd://example.com/disk,
+nbd+unix:///disk?socket=/run/nbd.sock or nbd+vsock://2/disk.
+
+With -vsock, the server is connected over AF_VSOCK. The address is
+[cid:]port, where cid can also be host, hypervisor or local. It defaults to
+port 10809 on the host, which is what a virtual machine connecting to a disk
+served by its host needs.
 `
 }
 
 func (cmd *connectCmd) SetFlags(fs *flag.FlagSet) {
 	fs.StringVar(&cmd.export, "export", "", "Export to use. If not provided, the default is used")
-	fs.StringVar(&cmd.addr, "addr", "localhost:10809", "Address to listen on")
-	fs.BoolVar(&cmd.unix, "unix", false, "Serve on a unix domain socket")
+	fs.StringVar(&cmd.addr, "addr", "localhost:10809", "Address of the server. A unix: prefix selects a unix domain socket")
+	fs.BoolVar(&cmd.unix, "unix", false, "Connect over a unix domain socket")
+	fs.BoolVar(&cmd.vsock, "vsock", false, "Connect over AF_VSOCK")
+	fs.IntVar(&cmd.conns, "connections", 1, "Number of connections to the server")
 }
 
 func (cmd *connectCmd) Execute(ctx context.Context, fs *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
-	if fs.NArg() != 0 {
+	var u *nbduri.URI
+	switch fs.NArg() {
+	case 0:
+		u = &nbduri.URI{Network: nbduri.TCP, Addr: cmd.addr, Export: cmd.export}
+		if cmd.unix {
+			u.Network = nbduri.Unix
+		}
+		u.Network, u.Addr = splitAddr(u.Addr, u.Network)
+		if cmd.vsock {
+			u.Network = nbduri.Vsock
+			if !isSet(fs, "addr") {
+				u.Addr = strconv.Itoa(defaultVsockPort)
+			}
+		}
+	case 1:
+		var err error
+		if u, err = nbduri.Parse(fs.Arg(0)); err != nil {
+			log.Println(err)
+			return subcommands.ExitUsageError
+		}
+		if u.TLS {
+			log.Println("the kernel can not use TLS connections; use an nbd:// URI")
+			return subcommands.ExitFailure
+		}
+	default:
 		log.Print(cmd.Usage())
 		return subcommands.ExitUsageError
 	}
 
-	network := "tcp"
-	if cmd.unix {
-		network = "unix"
-	}
 	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
 	defer cancel()
 
-	c, err := new(net.Dialer).DialContext(ctx, network, cmd.addr)
+	var (
+		exp   nbd.Export
+		socks []*os.File
+	)
+	for i := 0; i < cmd.conns || i == 0; i++ {
+		if i == 1 && exp.Flags&nbd.FlagCanMultiConn == 0 {
+			log.Println("server does not support multiple connections")
+			return subcommands.ExitFailure
+		}
+		e, sock, err := cmd.open(ctx, u)
+		if err != nil {
+			log.Println(err)
+			return subcommands.ExitFailure
+		}
+		defer sock.Close()
+		exp, socks = e, append(socks, sock)
+	}
+	n, err := nbd.Configure(exp, socks...)
 	if err != nil {
 		log.Println(err)
 		return subcommands.ExitFailure
 	}
+	fmt.Printf("/dev/nbd%d\n", n)
+	return subcommands.ExitSuccess
+}
+
+// open connects to the server at u and negotiates its export. It returns the
+// export and the file descriptor of the connection, to pass to the kernel.
+func (cmd *connectCmd) open(ctx context.Context, u *nbduri.URI) (nbd.Export, *os.File, error) {
+	var (
+		c    net.Conn
+		sock *os.File
+		err  error
+	)
+	if u.Network == nbduri.Vsock {
+		c, sock, err = dialVsock(u.Addr)
+	} else {
+		c, sock, err = dial(ctx, u.Network, u.Addr)
+	}
+	if err != nil {
+		return nbd.Export{}, nil, err
+	}
+	// The kernel uses sock, which is a duplicate of the descriptor of c.
 	defer c.Close()
 
+	cl, err := nbd.ClientHandshake(ctx, c)
+	if err != nil {
+		sock.Close()
+		return nbd.Export{}, nil, err
+	}
+	exp, err := cl.Go(u.Export)
+	if err != nil {
+		sock.Close()
+		return nbd.Export{}, nil, err
+	}
+	return exp, sock, nil
+}
+
+// dial connects to the given address. It also returns the file descriptor of
+// the connection, to pass to the kernel.
+func dial(ctx context.Context, network, addr string) (net.Conn, *os.File, error) {
+	c, err := new(net.Dialer).DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, nil, err
+	}
 	var sock *os.File
 	switch c := c.(type) {
 	case *net.TCPConn:
@@ -91,26 +186,8 @@ func (cmd *connectCmd) Execute(ctx context.Context, fs *flag.FlagSet, _ ...inter
 		err = errors.New("could not get file descriptor: unknown connection type")
 	}
 	if err != nil {
-		log.Println(err)
-		return subcommands.ExitFailure
-	}
-	defer sock.Close()
-
-	cl, err := nbd.ClientHandshake(ctx, c)
-	if err != nil {
-		log.Println(err)
-		return subcommands.ExitFailure
+		c.Close()
+		return nil, nil, err
 	}
-	exp, err := cl.Go("")
-	if err != nil {
-		log.Println(err)
-		return subcommands.ExitFailure
-	}
-	n, err := nbd.Configure(exp, sock)
-	if err != nil {
-		log.Println(err)
-		return subcommands.ExitFailure
-	}
-	fmt.Printf("/dev/nbd%d\n", n)
-	return subcommands.ExitSuccess
+	return c, sock, nil
 }
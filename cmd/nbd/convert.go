@@ -0,0 +1,186 @@
+// Copyright 2018 Axel Wagner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+
+	"github.com/Merovius/nbd"
+	"github.com/Merovius/nbd/compressed"
+	"github.com/Merovius/nbd/detect"
+	"github.com/Merovius/nbd/thin"
+	"github.com/google/subcommands"
+)
+
+func init() {
+	commands = append(commands, &convertCmd{})
+}
+
+type convertCmd struct {
+	format    string
+	output    string
+	chunkSize int
+}
+
+func (cmd *convertCmd) Name() string {
+	return "convert"
+}
+
+func (cmd *convertCmd) Synopsis() string {
+	return "convert an image into another format"
+}
+
+func (cmd *convertCmd) Usage() string {
+	return `Usage: nbd convert [-format <format>] [-O <format>] [-chunk-size <n>] <image> <output>
+
+Convert an image into a raw, thin or compressed image. The format of the input
+is detected automatically, unless given with -format. The output must not
+exist. Ranges of the input only containing zeros are not written, so raw
+outputs are sparse and thin outputs do not allocate them.
+`
+}
+
+func (cmd *convertCmd) SetFlags(fs *flag.FlagSet) {
+	fs.StringVar(&cmd.format, "format", "auto", "Format of the input image (raw, thin, compressed or auto)")
+	fs.StringVar(&cmd.output, "O", string(detect.Raw), "Format of the output image (raw, thin or compressed)")
+	fs.IntVar(&cmd.chunkSize, "chunk-size", 0, "Size of the chunks of thin and compressed outputs. Must be a power of two of at least 4096. If zero, the default of the format is used")
+}
+
+func (cmd *convertCmd) Execute(ctx context.Context, fs *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
+	if fs.NArg() != 2 {
+		log.Print(cmd.Usage())
+		return subcommands.ExitUsageError
+	}
+	in, err := openImage(fs.Arg(0), cmd.format)
+	if err != nil {
+		log.Println(err)
+		return subcommands.ExitFailure
+	}
+	defer in.Close()
+	if err := cmd.convert(fs.Arg(1), in); err != nil {
+		log.Println(err)
+		return subcommands.ExitFailure
+	}
+	return subcommands.ExitSuccess
+}
+
+// convertOutput is an image written by convert.
+type convertOutput interface {
+	io.WriterAt
+	Sync() error
+	Close() error
+}
+
+// convert writes the contents of in to a new image at path, in the format
+// cmd.output.
+func (cmd *convertCmd) convert(path string, in detect.Image) error {
+	var (
+		out convertOutput
+		err error
+	)
+	switch detect.Format(cmd.output) {
+	case detect.Raw:
+		var f *os.File
+		if f, err = os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644); err == nil {
+			out = f
+			if err = f.Truncate(int64(in.Size())); err != nil {
+				f.Close()
+				os.Remove(path)
+			}
+		}
+	case detect.Thin:
+		out, err = thin.Create(path, in.Size(), cmd.chunkSize)
+	case detect.Compressed:
+		// Convert already skips zero chunks and syncs the image.
+		img, err := compressed.Convert(path, in, in.Size(), cmd.chunkSize)
+		if err != nil {
+			return err
+		}
+		return img.Close()
+	default:
+		return fmt.Errorf("unsupported output format %q", cmd.output)
+	}
+	if err != nil {
+		return err
+	}
+	err = copyImage(out, in)
+	if err == nil {
+		err = out.Sync()
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(path)
+	}
+	return err
+}
+
+// copyImage copies the contents of in to out, which must read as zeros.
+// Ranges in reports as reading as zeros are not read, other ranges only
+// containing zeros are not written.
+func copyImage(out io.WriterAt, in detect.Image) error {
+	const bufSize = 1 << 20
+	var (
+		x    nbd.Extenter
+		buf  = make([]byte, bufSize)
+		size = int64(in.Size())
+	)
+	nbd.As(in, &x)
+	for off := int64(0); off < size; {
+		n := size - off
+		if n > bufSize {
+			n = bufSize
+		}
+		if x != nil {
+			ext, err := x.Extents(off, n)
+			if err != nil {
+				return err
+			}
+			if len(ext) > 0 && ext[0].Zero && ext[0].Length > 0 {
+				if ext[0].Length < n {
+					n = ext[0].Length
+				}
+				off += n
+				continue
+			}
+		}
+		b := buf[:n]
+		if m, err := in.ReadAt(b, off); err != nil && !(err == io.EOF && m == len(b)) {
+			return err
+		}
+		if !isZero(b) {
+			if _, err := out.WriteAt(b, off); err != nil {
+				return err
+			}
+		}
+		off += n
+	}
+	return nil
+}
+
+func isZero(b []byte) bool {
+	for _, c := range b {
+		if c != 0 {
+			return false
+		}
+	}
+	return true
+}
@@ -19,14 +19,17 @@ package main
 import (
 	"context"
 	"flag"
+	"fmt"
 	"log"
+	"strconv"
+	"strings"
 
 	"github.com/Merovius/nbd/nbdnl"
 	"github.com/google/subcommands"
 )
 
 func init() {
-	commands = append(commands, &discCmd{})
+	commands = append(commands, &discCmd{}, subcommands.Alias("disc", &discCmd{}))
 }
 
 type discCmd struct {
@@ -34,18 +37,20 @@ type discCmd struct {
 }
 
 func (cmd *discCmd) Name() string {
-	return "disc"
+	return "disconnect"
 }
 
 func (cmd *discCmd) Synopsis() string {
-	return "Disconnect an NBD devices"
+	return "Disconnect an NBD device"
 }
 
 func (cmd *discCmd) Usage() string {
-	return `Usage: nbd disc -index <n>
+	return `Usage: nbd disconnect <n>|/dev/nbd<n>
+       nbd disconnect -index <n>
 
-Disconnect an NBD device. If the given device is not connected, disc is a
-no-op.
+Disconnect an NBD device, which can also be one connected by another process.
+If the given device is not connected, disconnect is a no-op. disc is an alias
+of disconnect.
 `
 }
 
@@ -55,7 +60,18 @@ func (cmd *discCmd) SetFlags(fs *flag.FlagSet) {
 }
 
 func (cmd *discCmd) Execute(ctx context.Context, fs *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
-	if !cmd.index.set {
+	switch {
+	case fs.NArg() == 1 && !cmd.index.set:
+		idx, err := parseDevice(fs.Arg(0))
+		if err != nil {
+			log.Println(err)
+			return subcommands.ExitUsageError
+		}
+		cmd.index.set, cmd.index.val = true, idx
+	case fs.NArg() != 0:
+		log.Print(cmd.Usage())
+		return subcommands.ExitUsageError
+	case !cmd.index.set:
 		log.Println("-index is required")
 		return subcommands.ExitFailure
 	}
@@ -65,3 +81,13 @@ func (cmd *discCmd) Execute(ctx context.Context, fs *flag.FlagSet, _ ...interfac
 	}
 	return subcommands.ExitSuccess
 }
+
+// parseDevice parses an NBD device given as an index or as a path like
+// /dev/nbd<index>.
+func parseDevice(s string) (uint32, error) {
+	v, err := strconv.ParseUint(strings.TrimPrefix(s, "/dev/nbd"), 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid NBD device %q", s)
+	}
+	return uint32(v), nil
+}
@@ -0,0 +1,62 @@
+// Copyright 2018 Axel Wagner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"os"
+
+	"github.com/Merovius/nbd"
+	"github.com/Merovius/nbd/encrypt"
+)
+
+// keyProvider returns the KeyProvider selected by the flags of cmd, or nil if
+// files are not encrypted.
+func (cmd *serveCmd) keyProvider() encrypt.KeyProvider {
+	switch {
+	case cmd.encryptKeys != "":
+		return &encrypt.FileKeyProvider{Path: cmd.encryptKeys}
+	case cmd.encryptKeyEnv != "":
+		return &encrypt.EnvKeyProvider{Name: cmd.encryptKeyEnv}
+	default:
+		return nil
+	}
+}
+
+// openEncrypted returns a Device encrypting d, which is backed by the file at
+// path. The wrapped data key is stored next to it, in path.dek. If it does
+// not exist, a new data key is created.
+func openEncrypted(ctx context.Context, p encrypt.KeyProvider, d nbd.Device, path string) (nbd.Device, error) {
+	keyFile := path + ".dek"
+	wrapped, err := os.ReadFile(keyFile)
+	if err == nil {
+		return encrypt.Open(ctx, d, p, wrapped, 0)
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+	dek, wrapped, err := encrypt.NewKey(ctx, p)
+	if err != nil {
+		return nil, err
+	}
+	ed, err := encrypt.New(d, dek, 0)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(keyFile, wrapped, 0600); err != nil {
+		return nil, err
+	}
+	return ed, nil
+}
@@ -63,9 +63,9 @@ func (cmd *listCmd) Execute(ctx context.Context, fs *flag.FlagSet, _ ...interfac
 	sort.Slice(st, func(i, j int) bool { return st[i].Index < st[j].Index })
 
 	w := tabwriter.NewWriter(os.Stdout, 0, 0, 1, ' ', 0)
-	fmt.Fprintf(w, "Device\tConnected\n")
+	fmt.Fprintf(w, "Device\tConnected\tConnections\n")
 	for _, s := range st {
-		fmt.Fprintf(w, "/dev/nbd%d\t%v\n", s.Index, s.Connected)
+		fmt.Fprintf(w, "/dev/nbd%d\t%v\t%d\n", s.Index, s.Connected, s.Connections)
 	}
 	w.Flush()
 	return subcommands.ExitSuccess
@@ -21,12 +21,18 @@ import (
 	"flag"
 	"fmt"
 	"log"
+	"log/slog"
+	"net/http"
 	"os"
 	"os/signal"
-	"sync/atomic"
+	"time"
 
 	"github.com/Merovius/nbd"
+	"github.com/Merovius/nbd/crashtest"
+	"github.com/Merovius/nbd/metrics"
 	"github.com/google/subcommands"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"golang.org/x/sys/unix"
 )
 
@@ -34,7 +40,20 @@ func init() {
 	commands = append(commands, &loCmd{})
 }
 
-type loCmd struct{}
+type loCmd struct {
+	format     string
+	conns      int
+	workers    int
+	readOnly   bool
+	blockSize  uint
+	timeout    time.Duration
+	reqTimeout time.Duration
+	drain      time.Duration
+	partScan   bool
+	throttle   throttleFlags
+
+	metricsAddr string
+}
 
 func (cmd *loCmd) Name() string {
 	return "lo"
@@ -45,10 +64,24 @@ func (cmd *loCmd) Synopsis() string {
 }
 
 func (cmd *loCmd) Usage() string {
-	return `Usage: nbd lo <file>
+	return `Usage: nbd lo [-format <format>] [-connections <n>] [-workers <n>] [-read-only] [-block-size <n>] [-timeout <d>] [-request-timeout <d>] [-drain-timeout <d>] [-partitions] [-throttle-*] [-metrics-addr <addr>] <file>
 
 Provide file locally as a block device. An NBD device node will be chosen automatically and the path of that device printed to stdout.
 
+The format of the image is detected automatically, unless given with -format.
+With -connections, the kernel uses several connections, which are served in
+parallel. With -workers, the requests on each connection are executed
+concurrently, which helps with images on slow or remote storage. With
+-read-only, the block device is read-only. With -partitions, the kernel scans
+the device for partitions (this requires the nbd module to be loaded with
+max_part > 0). With -throttle-read-bps, -throttle-write-bps and
+-throttle-iops, the device is throttled, e.g. to simulate slow media. With
+-metrics-addr, Prometheus metrics about the requests of the kernel, labeled by
+connection, are served under /metrics.
+
+On SIGINT or SIGTERM, the device is drained before disconnecting it: Requests
+in flight are completed and the image is flushed, for at most -drain-timeout.
+
 As a special feature, you can toggle write-only mode by sending a SIGUSR1. In
 write-only mode, all write-requests are denied with a EPERM. This is useful for
 testing crash-resilience of an application on a given filesystem. You can
@@ -59,7 +92,19 @@ filesystem to check whether invariants of the application survived the "crash".
 `
 }
 
-func (cmd *loCmd) SetFlags(fs *flag.FlagSet) {}
+func (cmd *loCmd) SetFlags(fs *flag.FlagSet) {
+	fs.StringVar(&cmd.format, "format", "auto", "Format of the image (raw, thin, compressed or auto)")
+	fs.IntVar(&cmd.conns, "connections", 1, "Number of connections to serve the device over")
+	fs.IntVar(&cmd.workers, "workers", 1, "Number of requests per connection executed concurrently")
+	fs.BoolVar(&cmd.readOnly, "read-only", false, "Provide a read-only block device")
+	fs.UintVar(&cmd.blockSize, "block-size", 0, "Logical block size of the device. If 0, 4096 is used")
+	fs.DurationVar(&cmd.timeout, "timeout", 0, "Timeout after which the kernel fails requests. If 0, the kernel default is used")
+	fs.DurationVar(&cmd.reqTimeout, "request-timeout", 0, "Fail requests with EIO, if the image does not complete them within this time. If 0, requests do not time out")
+	fs.DurationVar(&cmd.drain, "drain-timeout", 30*time.Second, "Time to wait for requests in flight to complete, when disconnecting on SIGINT or SIGTERM")
+	fs.BoolVar(&cmd.partScan, "partitions", false, "Scan the device for partitions")
+	fs.StringVar(&cmd.metricsAddr, "metrics-addr", "", "Address to serve Prometheus metrics (under /metrics) on. If empty, metrics are not exported")
+	cmd.throttle.register(fs)
+}
 
 func (cmd *loCmd) Execute(ctx context.Context, fs *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
 	if fs.NArg() != 1 {
@@ -67,58 +112,73 @@ func (cmd *loCmd) Execute(ctx context.Context, fs *flag.FlagSet, _ ...interface{
 		return subcommands.ExitUsageError
 	}
 
-	f, err := os.OpenFile(fs.Arg(0), os.O_RDWR, 0)
-	if err != nil {
-		log.Println(err)
-		return subcommands.ExitFailure
-	}
-	defer f.Close()
-
-	fi, err := f.Stat()
+	img, err := openImage(fs.Arg(0), cmd.format)
 	if err != nil {
 		log.Println(err)
 		return subcommands.ExitFailure
 	}
-	log.Println(fi.Size())
+	defer img.Close()
+	log.Println(img.Size())
 
-	d := &crashable{Device: f}
-	ch := make(chan os.Signal)
+	d := &crashtest.Device{Device: img}
+	ch := make(chan os.Signal, 1)
 	signal.Notify(ch, unix.SIGUSR1)
 	go func() {
 		for range ch {
-			d.toggleCrash()
+			if d.Crashed() {
+				d.Restart()
+				log.Println("SIGUSR1 received, device is read-write")
+			} else {
+				d.Crash()
+				log.Println("SIGUSR1 received, device is read-only")
+			}
 		}
 	}()
 
-	idx, wait, err := nbd.Loopback(ctx, d, uint64(fi.Size()))
+	opts := &nbd.LoopbackOptions{
+		BlockSize:      uint32(cmd.blockSize),
+		Timeout:        cmd.timeout,
+		RequestTimeout: cmd.reqTimeout,
+		Connections:    cmd.conns,
+		Workers:        cmd.workers,
+		ReadOnly:       cmd.readOnly,
+		PartitionScan:  cmd.partScan,
+		Logger:         slog.Default(),
+	}
+	if cmd.metricsAddr != "" {
+		c := metrics.NewWithOptions(&metrics.Options{PerConnection: true})
+		reg := prometheus.NewRegistry()
+		reg.MustRegister(c, prometheus.NewGoCollector(), prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}))
+		opts.Observer = c
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", promhttp.HandlerFor(reg, promhttp.HandlerOpts{}))
+		go func() {
+			log.Println(http.ListenAndServe(cmd.metricsAddr, mux))
+		}()
+	}
+
+	dev, err := nbd.LoopbackWithOptions(ctx, cmd.throttle.wrap(d), img.Size(), opts)
 	if err != nil {
 		log.Println(err)
 		return subcommands.ExitFailure
 	}
-	fmt.Printf("Connected to /dev/nbd%d\n", idx)
-	if err := wait(); err != nil {
+	fmt.Printf("Connected to /dev/nbd%d\n", dev.Index)
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, unix.SIGINT, unix.SIGTERM)
+	defer signal.Stop(stop)
+	go func() {
+		sig := <-stop
+		log.Printf("%v received, draining device", sig)
+		ctx, cancel := context.WithTimeout(ctx, cmd.drain)
+		defer cancel()
+		if err := nbd.Drain(ctx, dev.Index); err != nil {
+			log.Println(err)
+		}
+	}()
+	if err := dev.Wait(); err != nil {
 		log.Println(err)
 		return subcommands.ExitFailure
 	}
 	return subcommands.ExitSuccess
 }
-
-type crashable struct {
-	nbd.Device
-	crashed uint32
-}
-
-func (c *crashable) toggleCrash() {
-	if atomic.AddUint32(&c.crashed, 1<<31) == 0 {
-		log.Println("SIGUSR1 received, device is read-write")
-	} else {
-		log.Println("SIGUSR1 received, device is read-only")
-	}
-}
-
-func (c *crashable) WriteAt(p []byte, offset int64) (n int, err error) {
-	if atomic.LoadUint32(&c.crashed) != 0 {
-		return 0, nbd.Errorf(nbd.EPERM, "write-only")
-	}
-	return c.Device.WriteAt(p, offset)
-}
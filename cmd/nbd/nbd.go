@@ -17,16 +17,30 @@ package main
 import (
 	"context"
 	"flag"
+	"fmt"
+	"log/slog"
 	"os"
 	"strconv"
+	"strings"
 
+	"github.com/Merovius/nbd"
+	"github.com/Merovius/nbd/detect"
 	"github.com/google/subcommands"
 )
 
 var commands []subcommands.Command
 
+var (
+	logFormat = flag.String("log-format", "text", "format of log output: text or json")
+	logLevel  = flag.String("log-level", "info", "minimum level of log output: debug, info, warn or error")
+)
+
 func main() {
 	flag.Parse()
+	if err := setupLogging(*logFormat, *logLevel); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(int(subcommands.ExitUsageError))
+	}
 	flag.VisitAll(func(f *flag.Flag) {
 		subcommands.ImportantFlag(f.Name)
 	})
@@ -37,6 +51,25 @@ func main() {
 	os.Exit(int(subcommands.Execute(context.Background())))
 }
 
+// setupLogging installs the default slog.Logger, which also receives the
+// output of package log, with the given format and level.
+func setupLogging(format, level string) error {
+	var lvl slog.Level
+	if err := lvl.UnmarshalText([]byte(level)); err != nil {
+		return fmt.Errorf("invalid -log-level %q", level)
+	}
+	opts := &slog.HandlerOptions{Level: lvl}
+	switch format {
+	case "text":
+		slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, opts)))
+	case "json":
+		slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stderr, opts)))
+	default:
+		return fmt.Errorf("invalid -log-format %q", format)
+	}
+	return nil
+}
+
 type indexFlag struct {
 	set bool
 	val uint32
@@ -70,3 +103,56 @@ func (f *indexFlag) Set(s string) error {
 	f.val = uint32(v)
 	return nil
 }
+
+// openImage opens the image at path, which has the given format. If format
+// is "auto", it is detected.
+func openImage(path, format string) (detect.Image, error) {
+	if format == "auto" {
+		img, _, err := detect.Open(path)
+		return img, err
+	}
+	return detect.OpenFormat(path, detect.Format(format))
+}
+
+// throttleFlags are the flags throttling a Device, shared by commands.
+type throttleFlags nbd.ThrottleOpts
+
+func (t *throttleFlags) register(fs *flag.FlagSet) {
+	fs.Float64Var(&t.ReadBps, "throttle-read-bps", 0, "Limit reads to this many bytes per second. If zero, reads are not limited")
+	fs.Float64Var(&t.WriteBps, "throttle-write-bps", 0, "Limit writes to this many bytes per second. If zero, writes are not limited")
+	fs.Float64Var(&t.IOPS, "throttle-iops", 0, "Limit operations to this many per second. If zero, operations are not limited")
+}
+
+// wrap returns d throttled, if any limit is set.
+func (t *throttleFlags) wrap(d nbd.Device) nbd.Device {
+	if t.ReadBps <= 0 && t.WriteBps <= 0 && t.IOPS <= 0 {
+		return d
+	}
+	return nbd.Throttle(d, nbd.ThrottleOpts(*t))
+}
+
+// isSet returns whether the flag with the given name was set explicitly.
+func isSet(fs *flag.FlagSet, name string) bool {
+	set := false
+	fs.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
+}
+
+// splitAddr splits an address given as [network:]addr, where network is tcp
+// or unix (e.g. unix:/run/nbd.sock). Addresses without such a prefix (like
+// localhost:10809) use the network def.
+func splitAddr(addr, def string) (network, a string) {
+	for _, n := range []string{"tcp", "unix"} {
+		if strings.HasPrefix(addr, n+":") {
+			return n, addr[len(n)+1:]
+		}
+	}
+	return def, addr
+}
+
+// defaultVsockPort is the port used, if -vsock is given without -addr.
+const defaultVsockPort = 10809
@@ -1,5 +1,3 @@
-// +build linux
-
 // Copyright 2018 Axel Wagner
 //
 // Licensed under the Apache License, Version 2.0 (the "License");
@@ -18,13 +16,33 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"expvar"
 	"flag"
+	"fmt"
 	"log"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
 	"os"
-	"path/filepath"
+	"os/signal"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/Merovius/nbd"
+	"github.com/Merovius/nbd/detect"
+	"github.com/Merovius/nbd/dirty"
+	"github.com/Merovius/nbd/httprange"
+	"github.com/Merovius/nbd/metrics"
+	"github.com/Merovius/nbd/nbduri"
+	"github.com/Merovius/nbd/nbdws"
+	"github.com/Merovius/nbd/uring"
 	"github.com/google/subcommands"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 func init() {
@@ -32,8 +50,41 @@ func init() {
 }
 
 type serveCmd struct {
-	addr string
-	unix bool
+	addr        string
+	name        string
+	unix        bool
+	vsock       bool
+	metricsAddr string
+	healthAddr  string
+	wsAddr      string
+	auditLog    string
+	format      string
+	tlsCert     string
+	tlsKey      string
+	tlsRequired bool
+	clientCA    string
+	allowCert   certFlag
+	allowCertRO certFlag
+	readOnly    bool
+	allow       prefixFlag
+	allowRO     prefixFlag
+	slow        time.Duration
+	idle        time.Duration
+	reqTimeout  time.Duration
+	workers     int
+
+	httpChunk    int
+	httpParallel int
+	httpPrefetch int
+
+	encryptKeys   string
+	encryptKeyEnv string
+
+	dirtyBitmap    string
+	dirtyBlockSize int
+
+	ioUring  bool
+	throttle throttleFlags
 }
 
 func (cmd *serveCmd) Name() string {
@@ -41,54 +92,435 @@ func (cmd *serveCmd) Name() string {
 }
 
 func (cmd *serveCmd) Synopsis() string {
-	return "serve a file as a block device"
+	return "serve files as block devices"
 }
 
 func (cmd *serveCmd) Usage() string {
-	return `Usage: nbd serve <file>
+	return `Usage: nbd serve [<name>=]<file>...
+
+Serve files over NBD as block devices. Each file is served as an export of
+the given name, which defaults to the base name of the file (or, if a single
+file is served, to -name). The first file is the default export. The format
+of the files is detected automatically, unless given with -format. The
+address to listen on is given with -addr (or its alias -listen).
+
+With -unix or an address like unix:/run/nbd.sock, the files are served on a
+unix domain socket, e.g. to provide disks to co-located virtual machines
+without exposing a network port. A stale socket left behind by an earlier
+server is replaced.
+
+A file can also be an http:// or https:// URL of a raw image, which is
+served read-only using HTTP range requests. The server has to support them.
+Sequential reads are read ahead by -http-prefetch bytes, so booting from a
+remote image does not wait for one request at a time.
+
+With -encrypt-keys or -encrypt-key-env, the files are stored encrypted with
+AES-XTS. The data key of each file is wrapped with the given key-encryption
+key and stored next to it, with the suffix .dek. It is created when a file
+is first served, whose previous contents are then unreadable, so this is
+meant for new (e.g. empty sparse) files.
+
+With -read-only, clients can not modify the files. With -allow and
+-allow-read-only, only clients from the given networks (e.g. 10.0.0.0/8) can
+use the files, read-write or read-only respectively. Clients connected over a
+unix domain socket are then refused.
 
-Serve a file as over NBD as a block device.
+With -throttle-read-bps, -throttle-write-bps and -throttle-iops, each file is
+throttled on its own, across all clients, e.g. to protect a shared backend.
+
+With -workers, the requests on each connection are executed concurrently and
+replied to as they complete, so a slow request (e.g. to a URL) does not hold
+up the ones queued behind it.
+
+With -io-uring, raw files are read and written using io_uring (see package
+uring), which gives a higher throughput on fast storage. Trims and block
+status are then not supported. If io_uring is not available, pread and
+pwrite are used.
+
+With -dirty-bitmap, the blocks written to each file are tracked in a bitmap
+stored next to it, with the suffix .dirty. Clients can query it with
+NBD_CMD_BLOCK_STATUS as the metadata context qemu:dirty-bitmap:<name>, e.g.
+to make incremental backups with qemu. The bitmap is only written when the
+server exits; after a crash, all blocks are reported as dirty. To start a new
+increment, remove the .dirty file while the server is stopped.
+
+With -tls-cert and -tls-key, clients can upgrade connections to TLS. With
+-tls-required, clients not doing so are refused. With -tls-client-ca, clients
+have to use TLS and present a certificate signed by the given CA. With
+-allow-cert and -allow-cert-read-only, the exports a client can use are then
+restricted by the common name of its certificate, e.g.
+-allow-cert tenant1=disk1,disk2 (or tenant1=* for all exports).
+
+With -vsock, the file is served over AF_VSOCK (Linux only), e.g. to provide
+disks to virtual machines without a network device.
+
+When started by systemd socket activation, the server accepts connections on
+the sockets passed by systemd instead of listening on -addr. With
+-idle-timeout, it exits once no client was connected for that long, to be
+started again on demand.
+
+Sending SIGUSR2 dumps the state of the server and all goroutines to stderr
+(not on Windows). If -metrics-addr is set, the state is also available under /debug/nbd (add
+?goroutines=1 to include goroutines).
 `
 }
 
 func (cmd *serveCmd) SetFlags(fs *flag.FlagSet) {
-	fs.StringVar(&cmd.addr, "addr", "localhost:10809", "Address to listen on")
+	fs.StringVar(&cmd.addr, "addr", "localhost:10809", "Address to listen on. A unix: prefix selects a unix domain socket")
+	fs.StringVar(&cmd.addr, "listen", "localhost:10809", "Alias for -addr")
+	fs.StringVar(&cmd.name, "name", "", "Name of the export, if a single file without a name is served")
 	fs.BoolVar(&cmd.unix, "unix", false, "Serve on a unix domain socket")
+	fs.BoolVar(&cmd.vsock, "vsock", false, "Serve on AF_VSOCK. -addr is [cid:]port and defaults to the local CID and port 10809")
+	fs.StringVar(&cmd.format, "format", "auto", "Format of the files (raw, thin, compressed or auto)")
+	fs.IntVar(&cmd.httpChunk, "http-chunk-size", httprange.DefaultChunkSize, "Maximum size of a single range request for URLs")
+	fs.IntVar(&cmd.httpParallel, "http-parallel", httprange.DefaultParallel, "Maximum number of range requests in flight per read for URLs")
+	fs.IntVar(&cmd.httpPrefetch, "http-prefetch", 4<<20, "Number of bytes to read ahead of sequential reads for URLs. If zero, no reads are done ahead")
+	fs.StringVar(&cmd.encryptKeys, "encrypt-keys", "", "Encrypt files, with key-encryption keys from this file (see package encrypt)")
+	fs.StringVar(&cmd.encryptKeyEnv, "encrypt-key-env", "", "Encrypt files, with the hex-encoded key-encryption key in this environment variable")
+	fs.BoolVar(&cmd.readOnly, "read-only", false, "Serve all exports read-only")
+	fs.Var(&cmd.allow, "allow", "Comma-separated networks of clients allowed to read and write the exports. Can be given multiple times. If neither -allow nor -allow-read-only is given, all clients are allowed")
+	fs.Var(&cmd.allowRO, "allow-read-only", "Comma-separated networks of clients allowed to read the exports. Can be given multiple times")
+	fs.IntVar(&cmd.workers, "workers", 1, "Number of requests per connection executed concurrently")
+	fs.StringVar(&cmd.dirtyBitmap, "dirty-bitmap", "", "Name of a bitmap tracking the blocks written to each file. If empty, writes are not tracked")
+	fs.IntVar(&cmd.dirtyBlockSize, "dirty-block-size", 64<<10, "Granularity of -dirty-bitmap in bytes")
+	fs.BoolVar(&cmd.ioUring, "io-uring", false, "Read and write raw files using io_uring (Linux only)")
+	cmd.throttle.register(fs)
+	fs.StringVar(&cmd.tlsCert, "tls-cert", "", "PEM encoded certificate to offer TLS with")
+	fs.StringVar(&cmd.tlsKey, "tls-key", "", "PEM encoded private key of -tls-cert")
+	fs.BoolVar(&cmd.tlsRequired, "tls-required", false, "Refuse clients not using TLS. Requires -tls-cert")
+	fs.StringVar(&cmd.clientCA, "tls-client-ca", "", "PEM encoded CA certificates to verify client certificates with. Implies -tls-required")
+	fs.Var(&cmd.allowCert, "allow-cert", "Allow clients with a certificate of the given common name to read and write the given exports, as <name>=<export>[,<export>...]. Can be given multiple times. Requires -tls-client-ca")
+	fs.Var(&cmd.allowCertRO, "allow-cert-read-only", "Like -allow-cert, but only allow reading the exports")
+	fs.StringVar(&cmd.auditLog, "audit-log", "", "File to append an audit trail of connections and privileged operations to, as JSON lines. If empty, no audit trail is written")
+	fs.DurationVar(&cmd.idle, "idle-timeout", 0, "Exit after no client was connected for this long. If zero, the server does not exit on its own")
+	fs.DurationVar(&cmd.reqTimeout, "request-timeout", 0, "Fail requests with EIO, if the file does not complete them within this time. If zero, requests do not time out")
+	fs.DurationVar(&cmd.slow, "slow-request", 0, "Log requests taking longer than this. If zero, slow requests are not logged")
+	fs.StringVar(&cmd.healthAddr, "health-addr", "", "Address to serve health checks (under /healthz) on. If empty, health checks are not served")
+	fs.StringVar(&cmd.wsAddr, "ws-addr", "", "Address to additionally serve NBD over WebSocket (under /nbd) on. If empty, WebSocket is not served")
+	fs.StringVar(&cmd.metricsAddr, "metrics-addr", "", "Address to serve Prometheus metrics (under /metrics) and expvars (under /debug/vars) on. If empty, metrics are not exported")
 }
 
 func (cmd *serveCmd) Execute(ctx context.Context, fs *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
-	if fs.NArg() != 1 {
+	if fs.NArg() == 0 {
 		log.Print(cmd.Usage())
 		return subcommands.ExitUsageError
 	}
 
-	f, err := os.OpenFile(fs.Arg(0), os.O_RDWR, 0)
-	if err != nil {
-		log.Println(err)
-		return subcommands.ExitFailure
+	network := "tcp"
+	if cmd.unix {
+		network = "unix"
 	}
-	defer f.Close()
+	network, addr := splitAddr(cmd.addr, network)
 
-	fi, err := f.Stat()
+	srv := &nbd.Server{
+		Logger:         slog.Default(),
+		SlowRequest:    cmd.slow,
+		RequestTimeout: cmd.reqTimeout,
+		IdleTimeout:    cmd.idle,
+		ReadOnly:       cmd.readOnly,
+		Workers:        cmd.workers,
+	}
+	if cmd.tlsCert != "" || cmd.tlsKey != "" {
+		cert, err := tls.LoadX509KeyPair(cmd.tlsCert, cmd.tlsKey)
+		if err != nil {
+			log.Println(err)
+			return subcommands.ExitFailure
+		}
+		srv.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+	}
+	if cmd.tlsRequired || cmd.clientCA != "" {
+		if srv.TLSConfig == nil {
+			log.Println("-tls-required and -tls-client-ca need -tls-cert and -tls-key")
+			return subcommands.ExitUsageError
+		}
+		srv.TLSRequired = true
+	}
+	if cmd.clientCA != "" {
+		pem, err := os.ReadFile(cmd.clientCA)
+		if err != nil {
+			log.Println(err)
+			return subcommands.ExitFailure
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			log.Printf("no certificates found in %s", cmd.clientCA)
+			return subcommands.ExitFailure
+		}
+		srv.TLSConfig.ClientCAs = pool
+		srv.TLSConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	if len(cmd.allowCert) > 0 || len(cmd.allowCertRO) > 0 {
+		if cmd.clientCA == "" {
+			log.Println("-allow-cert and -allow-cert-read-only need -tls-client-ca")
+			return subcommands.ExitUsageError
+		}
+		srv.Authorizer = cmd.authorizeCert
+	}
+	if cmd.auditLog != "" {
+		f, err := os.OpenFile(cmd.auditLog, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+		if err != nil {
+			log.Println(err)
+			return subcommands.ExitFailure
+		}
+		defer f.Close()
+		srv.Audit = nbd.JSONAuditor(f, func(err error) {
+			log.Println("writing audit log:", err)
+		})
+	}
+	if cmd.encryptKeys != "" && cmd.encryptKeyEnv != "" {
+		log.Println("-encrypt-keys and -encrypt-key-env are mutually exclusive")
+		return subcommands.ExitUsageError
+	}
+	if cmd.dirtyBlockSize <= 0 {
+		log.Println("-dirty-block-size must be positive")
+		return subcommands.ExitUsageError
+	}
+	var acl *nbd.ACL
+	if len(cmd.allow) > 0 || len(cmd.allowRO) > 0 {
+		acl = &nbd.ACL{ReadWrite: cmd.allow, ReadOnly: cmd.allowRO}
+	}
+	if cmd.ioUring {
+		detect.Register(detect.Raw, func(path string) (detect.Image, error) {
+			return uring.Open(path, nil)
+		})
+	}
+	kp := cmd.keyProvider()
+	for _, arg := range fs.Args() {
+		spec, err := nbduri.ParseExport(arg)
+		if err != nil {
+			log.Println(err)
+			return subcommands.ExitUsageError
+		}
+		if cmd.name != "" && !strings.Contains(arg, "=") {
+			if fs.NArg() > 1 {
+				log.Println("-name can only be used with a single file")
+				return subcommands.ExitUsageError
+			}
+			spec.Name = cmd.name
+		}
+		if strings.HasPrefix(spec.Path, "http://") || strings.HasPrefix(spec.Path, "https://") {
+			d, err := httprange.Open(ctx, spec.Path, &httprange.Options{ChunkSize: cmd.httpChunk, Parallel: cmd.httpParallel})
+			if err != nil {
+				log.Println(err)
+				return subcommands.ExitFailure
+			}
+			defer d.Close()
+			var dev nbd.Device = d
+			if cmd.httpPrefetch > 0 {
+				p := nbd.NewPrefetcher(d, d.Size(), &nbd.PrefetchOptions{BlockSize: cmd.httpChunk, Window: int64(cmd.httpPrefetch)})
+				defer p.Close()
+				dev = p
+			}
+			srv.Exports = append(srv.Exports, nbd.Export{
+				Name:   spec.Name,
+				Size:   d.Size(),
+				Flags:  nbd.FlagReadOnly,
+				Device: cmd.throttle.wrap(dev),
+				ACL:    acl,
+			})
+			continue
+		}
+		img, err := openImage(spec.Path, cmd.format)
+		if err != nil {
+			log.Println(err)
+			return subcommands.ExitFailure
+		}
+		defer img.Close()
+		var d nbd.Device = img
+		if kp != nil {
+			if d, err = openEncrypted(ctx, kp, img, spec.Path); err != nil {
+				log.Printf("%s: %v", spec.Path, err)
+				return subcommands.ExitFailure
+			}
+		}
+		if cmd.dirtyBitmap != "" {
+			t, err := dirty.TrackFile(d, img.Size(), cmd.dirtyBlockSize, spec.Path+".dirty")
+			if err != nil {
+				log.Println(err)
+				return subcommands.ExitFailure
+			}
+			defer t.Close()
+			t.Name = cmd.dirtyBitmap
+			d = t
+		}
+
+		fi, err := os.Stat(spec.Path)
+		if err != nil {
+			log.Println(err)
+			return subcommands.ExitFailure
+		}
+		srv.Exports = append(srv.Exports, nbd.Export{
+			Name:        spec.Name,
+			Description: "",
+			Size:        img.Size(),
+			BlockSizes:  blockSize(fi),
+			Device:      cmd.throttle.wrap(d),
+			ACL:         acl,
+		})
+	}
+	if cmd.metricsAddr != "" {
+		c := metrics.New()
+		reg := prometheus.NewRegistry()
+		reg.MustRegister(c, prometheus.NewGoCollector(), prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}))
+		srv.Observer = c
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", promhttp.HandlerFor(reg, promhttp.HandlerOpts{}))
+		srv.Publish("nbd")
+		mux.Handle("/debug/vars", expvar.Handler())
+		mux.HandleFunc("/debug/nbd", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			srv.Dump(w, r.FormValue("goroutines") != "")
+		})
+		go func() {
+			log.Println(http.ListenAndServe(cmd.metricsAddr, mux))
+		}()
+	}
+
+	if cmd.healthAddr != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/healthz", srv.HealthHandler())
+		go func() {
+			log.Println(http.ListenAndServe(cmd.healthAddr, mux))
+		}()
+	}
+
+	if cmd.wsAddr != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/nbd", nbdws.Handler(srv))
+		go func() {
+			log.Println(http.ListenAndServe(cmd.wsAddr, mux))
+		}()
+	}
+
+	// Dump the server state on SIGUSR2, to help debugging hangs.
+	dump := make(chan os.Signal, 1)
+	notifyDump(dump)
+	defer signal.Stop(dump)
+	go func() {
+		for range dump {
+			srv.Dump(os.Stderr, true)
+		}
+	}()
+
+	ls, err := activationListeners()
 	if err != nil {
 		log.Println(err)
 		return subcommands.ExitFailure
 	}
-	network := "tcp"
-	if cmd.unix {
-		network = "unix"
+	switch {
+	case len(ls) > 0:
+		err = srv.Serve(ctx, mergeListeners(ls))
+	case cmd.vsock:
+		if !isSet(fs, "addr") && !isSet(fs, "listen") {
+			addr = strconv.Itoa(defaultVsockPort)
+		}
+		var l net.Listener
+		if l, err = listenVsock(addr); err == nil {
+			err = srv.Serve(ctx, l)
+		}
+	default:
+		if network == "unix" {
+			if err := removeStaleSocket(addr); err != nil {
+				log.Println(err)
+				return subcommands.ExitFailure
+			}
+		}
+		err = srv.ListenAndServe(ctx, network, addr)
 	}
-
-	err = nbd.ListenAndServe(ctx, network, cmd.addr, nbd.Export{
-		Name:        filepath.Base(fs.Arg(0)),
-		Description: "",
-		Size:        uint64(fi.Size()),
-		BlockSizes:  blockSize(fi),
-		Device:      f,
-	})
-	if err != nil {
+	if err != nil && err != nbd.ErrIdle {
 		log.Println(err)
 		return subcommands.ExitFailure
 	}
 	return subcommands.ExitSuccess
 }
+
+// authorizeCert returns the access of the client connected via c to export,
+// by the common name of its verified certificate.
+func (cmd *serveCmd) authorizeCert(c net.Conn, export string) (nbd.Access, error) {
+	cert := nbd.ClientCertificate(c)
+	if cert == nil {
+		return nbd.AccessDenied, nil
+	}
+	name := cert.Subject.CommonName
+	switch {
+	case cmd.allowCert.allows(name, export):
+		return nbd.AccessReadWrite, nil
+	case cmd.allowCertRO.allows(name, export):
+		return nbd.AccessReadOnly, nil
+	default:
+		return nbd.AccessDenied, nil
+	}
+}
+
+// certFlag maps certificate common names to the exports they may use, given
+// as <name>=<export>[,<export>...]. The export * matches all exports. It can
+// be given multiple times.
+type certFlag map[string][]string
+
+func (f *certFlag) String() string {
+	var s []string
+	for name, exports := range *f {
+		s = append(s, name+"="+strings.Join(exports, ","))
+	}
+	return strings.Join(s, " ")
+}
+
+func (f *certFlag) Set(s string) error {
+	name, exports, ok := strings.Cut(s, "=")
+	if !ok || name == "" || exports == "" {
+		return fmt.Errorf("invalid certificate mapping %q, want <name>=<export>[,<export>...]", s)
+	}
+	if *f == nil {
+		*f = make(certFlag)
+	}
+	(*f)[name] = append((*f)[name], strings.Split(exports, ",")...)
+	return nil
+}
+
+// allows returns whether name may use export.
+func (f certFlag) allows(name, export string) bool {
+	for _, e := range f[name] {
+		if e == "*" || e == export {
+			return true
+		}
+	}
+	return false
+}
+
+// prefixFlag is a flag of comma-separated networks, which can be given
+// multiple times.
+type prefixFlag []netip.Prefix
+
+func (f *prefixFlag) String() string {
+	var s []string
+	for _, p := range *f {
+		s = append(s, p.String())
+	}
+	return strings.Join(s, ",")
+}
+
+func (f *prefixFlag) Set(s string) error {
+	for _, v := range strings.Split(s, ",") {
+		p, err := netip.ParsePrefix(strings.TrimSpace(v))
+		if err != nil {
+			return err
+		}
+		*f = append(*f, p)
+	}
+	return nil
+}
+
+// removeStaleSocket removes the unix domain socket at path, if no server is
+// listening on it anymore. Other files are left alone, so listening fails.
+func removeStaleSocket(path string) error {
+	fi, err := os.Lstat(path)
+	if err != nil || fi.Mode()&os.ModeSocket == 0 {
+		return nil
+	}
+	c, err := net.Dial("unix", path)
+	if err == nil {
+		c.Close()
+		return fmt.Errorf("%s is in use by another server", path)
+	}
+	return os.Remove(path)
+}
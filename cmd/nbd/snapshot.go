@@ -0,0 +1,199 @@
+// +build linux
+
+// Copyright 2018 Axel Wagner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/Merovius/nbd/backup"
+	"github.com/Merovius/nbd/quiesce"
+	"github.com/Merovius/nbd/thin"
+	"github.com/google/subcommands"
+)
+
+func init() {
+	commands = append(commands, &snapshotCmd{})
+}
+
+type snapshotCmd struct {
+	freeze    listFlag
+	pre       string
+	post      string
+	blockSize int
+}
+
+func (cmd *snapshotCmd) Name() string {
+	return "snapshot"
+}
+
+func (cmd *snapshotCmd) Synopsis() string {
+	return "take a consistent snapshot of a block device or manage snapshots of a thin image"
+}
+
+func (cmd *snapshotCmd) Usage() string {
+	return `Usage: nbd snapshot [-freeze <dir>]... [-pre <cmd>] [-post <cmd>] <device> <out>
+       nbd snapshot create [-freeze <dir>]... [-pre <cmd>] [-post <cmd>] <image> <name>
+       nbd snapshot list <image>
+       nbd snapshot delete <image> <name>
+       nbd snapshot revert <image> <name>
+
+Write a full backup of a block device or image file to out. Without any hooks,
+the snapshot is only crash-consistent. To make it filesystem-consistent, pass
+the mount point of the filesystem on the device with -freeze. The -pre and
+-post commands are run with sh -c before and after the snapshot, e.g. to
+notify an application using the device.
+
+The create, list, delete and revert subcommands manage point-in-time snapshots
+of a thin image (see package thin), which are stored next to it as
+<image>@<name>. Creating a snapshot takes constant time: the current contents
+of the image are sealed and new writes go to a new, empty image on top of
+them. Deleting a snapshot merges its data into the next newer one. Reverting
+discards all data written after a snapshot, including later snapshots.
+
+The image must not be served by another process while its snapshots are
+managed; servers embedding package nbd can call the methods of thin.Image
+instead, which are safe to use on a live export.
+`
+}
+
+func (cmd *snapshotCmd) SetFlags(fs *flag.FlagSet) {
+	fs.Var(&cmd.freeze, "freeze", "Mount point of a filesystem to freeze during the snapshot (can be repeated)")
+	fs.StringVar(&cmd.pre, "pre", "", "Command to run before the snapshot")
+	fs.StringVar(&cmd.post, "post", "", "Command to run after the snapshot")
+	fs.IntVar(&cmd.blockSize, "block-size", 64<<10, "Block size of the backup")
+}
+
+func (cmd *snapshotCmd) Execute(ctx context.Context, fs *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
+	switch fs.Arg(0) {
+	case "create", "list", "delete", "revert":
+		return cmd.manage(ctx, fs)
+	}
+	if fs.NArg() != 2 || cmd.blockSize <= 0 {
+		fs.Usage()
+		return subcommands.ExitUsageError
+	}
+	dev, err := os.Open(fs.Arg(0))
+	if err != nil {
+		log.Println(err)
+		return subcommands.ExitFailure
+	}
+	defer dev.Close()
+	size, err := dev.Seek(0, io.SeekEnd)
+	if err != nil {
+		log.Println(err)
+		return subcommands.ExitFailure
+	}
+	out, err := os.Create(fs.Arg(1))
+	if err != nil {
+		log.Println(err)
+		return subcommands.ExitFailure
+	}
+
+	var hooks []quiesce.Hook
+	if cmd.pre != "" || cmd.post != "" {
+		hooks = append(hooks, quiesce.Exec(shell(cmd.pre), shell(cmd.post)))
+	}
+	for _, dir := range cmd.freeze {
+		hooks = append(hooks, quiesce.Filesystem(dir))
+	}
+	err = quiesce.Do(ctx, func() error {
+		return backup.Full(out, dev, uint64(size), cmd.blockSize)
+	}, hooks...)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		log.Println(err)
+		os.Remove(fs.Arg(1))
+		return subcommands.ExitFailure
+	}
+	return subcommands.ExitSuccess
+}
+
+// manage runs one of the subcommands managing the snapshots of a thin
+// image.
+func (cmd *snapshotCmd) manage(ctx context.Context, fs *flag.FlagSet) subcommands.ExitStatus {
+	verb, args := fs.Arg(0), fs.Args()[1:]
+	want := 2
+	if verb == "list" {
+		want = 1
+	}
+	if len(args) != want {
+		fs.Usage()
+		return subcommands.ExitUsageError
+	}
+	img, err := thin.Open(args[0])
+	if err != nil {
+		log.Println(err)
+		return subcommands.ExitFailure
+	}
+	switch verb {
+	case "create":
+		var hooks []quiesce.Hook
+		if cmd.pre != "" || cmd.post != "" {
+			hooks = append(hooks, quiesce.Exec(shell(cmd.pre), shell(cmd.post)))
+		}
+		for _, dir := range cmd.freeze {
+			hooks = append(hooks, quiesce.Filesystem(dir))
+		}
+		err = quiesce.Do(ctx, func() error {
+			return img.Snapshot(args[1])
+		}, hooks...)
+	case "list":
+		for _, s := range img.Snapshots() {
+			fmt.Printf("%s\t%d\t%s\n", s.Name, s.Allocated, s.Path)
+		}
+	case "delete":
+		err = img.DeleteSnapshot(args[1])
+	case "revert":
+		err = img.Revert(args[1])
+	}
+	if cerr := img.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		log.Println(err)
+		return subcommands.ExitFailure
+	}
+	return subcommands.ExitSuccess
+}
+
+// shell returns the arguments to run cmd with sh, or nil if cmd is empty.
+func shell(cmd string) []string {
+	if cmd == "" {
+		return nil
+	}
+	return []string{"sh", "-c", cmd}
+}
+
+// listFlag is a flag, which can be given multiple times.
+type listFlag []string
+
+func (f *listFlag) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *listFlag) Set(s string) error {
+	*f = append(*f, s)
+	return nil
+}
@@ -0,0 +1,104 @@
+// +build linux
+
+// Copyright 2018 Axel Wagner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/mdlayher/vsock"
+	"golang.org/x/sys/unix"
+)
+
+// parseVsockAddr parses a vsock address of the form [cid:]port. The CID can
+// also be given as "host", "hypervisor" or "local". ok is false, if no CID
+// is given.
+func parseVsockAddr(addr string) (cid, port uint32, ok bool, err error) {
+	if i := strings.LastIndexByte(addr, ':'); i >= 0 {
+		switch s := addr[:i]; s {
+		case "":
+		case "host":
+			cid, ok = vsock.Host, true
+		case "hypervisor":
+			cid, ok = vsock.Hypervisor, true
+		case "local":
+			cid, ok = vsock.Local, true
+		default:
+			n, err := strconv.ParseUint(s, 10, 32)
+			if err != nil {
+				return 0, 0, false, fmt.Errorf("invalid vsock CID %q", s)
+			}
+			cid, ok = uint32(n), true
+		}
+		addr = addr[i+1:]
+	}
+	n, err := strconv.ParseUint(addr, 10, 32)
+	if err != nil {
+		return 0, 0, false, fmt.Errorf("invalid vsock port %q", addr)
+	}
+	return cid, uint32(n), ok, nil
+}
+
+// listenVsock listens on the given vsock address. If no CID is given, the
+// CID of the local machine is used.
+func listenVsock(addr string) (net.Listener, error) {
+	cid, port, ok, err := parseVsockAddr(addr)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return vsock.Listen(port, nil)
+	}
+	return vsock.ListenContextID(cid, port, nil)
+}
+
+// dialVsock connects to the given vsock address. If no CID is given, the
+// host is used. It also returns a duplicate of the socket, to pass to the
+// kernel.
+func dialVsock(addr string) (net.Conn, *os.File, error) {
+	cid, port, ok, err := parseVsockAddr(addr)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !ok {
+		cid = vsock.Host
+	}
+	c, err := vsock.Dial(cid, port, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	rc, err := c.SyscallConn()
+	if err != nil {
+		c.Close()
+		return nil, nil, err
+	}
+	var fd int
+	cerr := rc.Control(func(sfd uintptr) {
+		fd, err = unix.Dup(int(sfd))
+	})
+	if cerr != nil {
+		err = cerr
+	}
+	if err != nil {
+		c.Close()
+		return nil, nil, err
+	}
+	return c, os.NewFile(uintptr(fd), "vsock"), nil
+}
@@ -0,0 +1,162 @@
+// Copyright 2018 Axel Wagner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nbd
+
+import (
+	"sync"
+	"time"
+)
+
+// CoalesceWrites returns a Device that merges contiguous writes to d, which
+// are received within window of each other, into a single call to d.WriteAt
+// of at most max bytes. This is useful for backends with a high cost per
+// operation.
+//
+// A write only returns after the merged write containing it has been written
+// to d, so coalescing only has an effect if writes are issued concurrently
+// (e.g. by setting Server.Workers). Writes of at least max bytes are passed
+// through unchanged. Sync writes out any pending writes and waits for them to
+// finish before calling d.Sync, so a flush is never merged across.
+//
+// If d implements WriterAtVec, merged writes are passed to it without copying
+// them into a contiguous buffer.
+func CoalesceWrites(d Device, window time.Duration, max int) Device {
+	return &coalescer{
+		Device:   d,
+		window:   window,
+		max:      max,
+		inflight: make(map[*writeBatch]bool),
+	}
+}
+
+type coalescer struct {
+	Device
+	window time.Duration
+	max    int
+
+	mu sync.Mutex
+	// pending is the batch currently accepting writes, if any.
+	pending *writeBatch
+	// inflight is the set of batches currently being written to Device.
+	inflight map[*writeBatch]bool
+}
+
+// writeBatch is a set of contiguous writes, which are written to the
+// underlying Device together.
+type writeBatch struct {
+	off int64
+	// bufs are the buffers of the merged writes, in order. They are owned
+	// by the blocked callers of WriteAt and can be used until done is
+	// closed.
+	bufs  [][]byte
+	n     int
+	timer *time.Timer
+	done  chan struct{}
+	err   error
+}
+
+func (c *coalescer) WriteAt(p []byte, off int64) (int, error) {
+	c.mu.Lock()
+	if len(p) >= c.max {
+		c.startLocked()
+		c.mu.Unlock()
+		return c.Device.WriteAt(p, off)
+	}
+
+	b := c.pending
+	switch {
+	case b != nil && b.n+len(p) <= c.max && off == b.off+int64(b.n):
+		b.bufs = append(b.bufs, p)
+		b.n += len(p)
+	case b != nil && b.n+len(p) <= c.max && off+int64(len(p)) == b.off:
+		b.bufs = append([][]byte{p}, b.bufs...)
+		b.n += len(p)
+		b.off = off
+	default:
+		c.startLocked()
+		b = &writeBatch{
+			off:  off,
+			bufs: [][]byte{p},
+			n:    len(p),
+			done: make(chan struct{}),
+		}
+		b.timer = time.AfterFunc(c.window, func() {
+			c.mu.Lock()
+			if c.pending == b {
+				c.startLocked()
+			}
+			c.mu.Unlock()
+		})
+		c.pending = b
+	}
+	if b.n >= c.max {
+		c.startLocked()
+	}
+	c.mu.Unlock()
+
+	<-b.done
+	if b.err != nil {
+		return 0, b.err
+	}
+	return len(p), nil
+}
+
+// startLocked starts writing out the pending batch, if any. c.mu must be
+// held.
+func (c *coalescer) startLocked() {
+	b := c.pending
+	if b == nil {
+		return
+	}
+	c.pending = nil
+	b.timer.Stop()
+	c.inflight[b] = true
+	go func() {
+		_, b.err = c.write(b)
+		c.mu.Lock()
+		delete(c.inflight, b)
+		c.mu.Unlock()
+		close(b.done)
+	}()
+}
+
+// write writes out b.
+func (c *coalescer) write(b *writeBatch) (int, error) {
+	if len(b.bufs) == 1 {
+		return c.Device.WriteAt(b.bufs[0], b.off)
+	}
+	if v, ok := c.Device.(WriterAtVec); ok {
+		return v.WriteAtVec(b.bufs, b.off)
+	}
+	buf := make([]byte, 0, b.n)
+	for _, p := range b.bufs {
+		buf = append(buf, p...)
+	}
+	return c.Device.WriteAt(buf, b.off)
+}
+
+func (c *coalescer) Sync() error {
+	c.mu.Lock()
+	c.startLocked()
+	var wait []*writeBatch
+	for b := range c.inflight {
+		wait = append(wait, b)
+	}
+	c.mu.Unlock()
+	for _, b := range wait {
+		<-b.done
+	}
+	return c.Device.Sync()
+}
@@ -0,0 +1,445 @@
+// Copyright 2018 Axel Wagner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package compressed implements compressed images: a Device, whose data is
+// stored in chunks in a container file, each compressed with zstd. Chunks
+// are decompressed on read and recompressed on write.
+//
+// Modified chunks are appended to the file and the space of their previous
+// version is not reused, so images which are written to a lot grow. Copying
+// an image with Convert (or "nbd compress") reclaims the space.
+//
+// # Format
+//
+// An image starts with a header, followed by the index and the data area.
+// All integers are big-endian.
+//
+//	header (4096 bytes):
+//		magic      [8]byte  "NBDZSTD\x00"
+//		version    uint32   1
+//		chunkSize  uint32   a power of two, at least 4096
+//		size       uint64   virtual size of the image
+//	index (at offset 4096):
+//		offset     uint64   for every virtual chunk: the offset of its
+//		                    compressed data, or 0 if it only contains zeros
+//		length     uint32   the length of the compressed data
+//		reserved   uint32
+//	data (after the index):
+//		zstd frames
+//
+// The data of a chunk is written (and synced by Sync) before its index
+// entry, so a crash never exposes partially written data.
+package compressed
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/Merovius/nbd"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Magic is the magic number at the start of every image.
+const Magic = "NBDZSTD\x00"
+
+// DefaultChunkSize is the chunk size used, if Create is passed 0. Smaller
+// chunks make small writes cheaper, larger ones compress better.
+const DefaultChunkSize = 64 << 10
+
+const (
+	version    = 1
+	headerSize = 4096
+	entrySize  = 16
+)
+
+// The encoder and decoder are safe for concurrent use of EncodeAll and
+// DecodeAll.
+var (
+	encoder, _ = zstd.NewWriter(nil)
+	decoder, _ = zstd.NewReader(nil)
+)
+
+// entry is an index entry.
+type entry struct {
+	off    uint64
+	length uint32
+}
+
+// Image is a compressed Device stored in a file. It is safe for concurrent
+// use.
+type Image struct {
+	f         *os.File
+	size      uint64
+	chunkSize int64
+
+	mu    sync.RWMutex
+	index []entry
+	// end is the end of the data area, where chunks are appended.
+	end int64
+	// stored is the number of bytes referenced by the index.
+	stored int64
+}
+
+// Create creates a new, empty image of the given virtual size at path.
+// chunkSize must be a power of two of at least 4096; if it is 0,
+// DefaultChunkSize is used.
+func Create(path string, size uint64, chunkSize int) (*Image, error) {
+	if chunkSize == 0 {
+		chunkSize = DefaultChunkSize
+	}
+	if chunkSize < 4096 || chunkSize&(chunkSize-1) != 0 {
+		return nil, fmt.Errorf("invalid chunk size %d", chunkSize)
+	}
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return nil, err
+	}
+	var h [headerSize]byte
+	copy(h[:], Magic)
+	binary.BigEndian.PutUint32(h[8:], version)
+	binary.BigEndian.PutUint32(h[12:], uint32(chunkSize))
+	binary.BigEndian.PutUint64(h[16:], size)
+	img := newImage(f, size, int64(chunkSize))
+	if _, err := f.WriteAt(h[:], 0); err == nil {
+		err = f.Truncate(img.end)
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if err != nil {
+		f.Close()
+		os.Remove(path)
+		return nil, err
+	}
+	return img, nil
+}
+
+func newImage(f *os.File, size uint64, chunkSize int64) *Image {
+	n := int64((size + uint64(chunkSize) - 1) / uint64(chunkSize))
+	return &Image{
+		f:         f,
+		size:      size,
+		chunkSize: chunkSize,
+		index:     make([]entry, n),
+		end:       headerSize + entrySize*n,
+	}
+}
+
+// Open opens the image at path.
+func Open(path string) (*Image, error) {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+	img, err := open(f)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return img, nil
+}
+
+func open(f *os.File) (*Image, error) {
+	var h [headerSize]byte
+	if _, err := io.ReadFull(io.NewSectionReader(f, 0, headerSize), h[:]); err != nil {
+		return nil, err
+	}
+	if string(h[:8]) != Magic {
+		return nil, errors.New("not a compressed image")
+	}
+	if v := binary.BigEndian.Uint32(h[8:]); v != version {
+		return nil, fmt.Errorf("unsupported version %d", v)
+	}
+	chunkSize := int64(binary.BigEndian.Uint32(h[12:]))
+	if chunkSize < 4096 || chunkSize&(chunkSize-1) != 0 {
+		return nil, fmt.Errorf("invalid chunk size %d", chunkSize)
+	}
+	img := newImage(f, binary.BigEndian.Uint64(h[16:]), chunkSize)
+	m := make([]byte, entrySize*len(img.index))
+	if _, err := io.ReadFull(io.NewSectionReader(f, headerSize, int64(len(m))), m); err != nil {
+		return nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	dataOff := img.end
+	if fi.Size() > img.end {
+		img.end = fi.Size()
+	}
+	for i := range img.index {
+		e := entry{binary.BigEndian.Uint64(m[entrySize*i:]), binary.BigEndian.Uint32(m[entrySize*i+8:])}
+		if e.off != 0 && (int64(e.off) < dataOff || int64(e.off)+int64(e.length) > img.end) {
+			return nil, fmt.Errorf("corrupt index entry for chunk %d", i)
+		}
+		img.index[i] = e
+		img.stored += int64(e.length)
+	}
+	return img, nil
+}
+
+// Size returns the virtual size of the image.
+func (img *Image) Size() uint64 {
+	return img.size
+}
+
+// Close closes the image file.
+func (img *Image) Close() error {
+	return img.f.Close()
+}
+
+// chunkLen returns the length of virtual chunk c, which is shorter than the
+// chunk size for the last chunk of an image with an unaligned size.
+func (img *Image) chunkLen(c int64) int64 {
+	if rest := int64(img.size) - c*img.chunkSize; rest < img.chunkSize {
+		return rest
+	}
+	return img.chunkSize
+}
+
+// readChunk decompresses chunk c into b, which has the length of the chunk.
+// img.mu must be held.
+func (img *Image) readChunk(c int64, b []byte) error {
+	e := img.index[c]
+	if e.off == 0 {
+		zero(b)
+		return nil
+	}
+	z := make([]byte, e.length)
+	if _, err := img.f.ReadAt(z, int64(e.off)); err != nil {
+		return err
+	}
+	d, err := decoder.DecodeAll(z, b[:0])
+	if err != nil {
+		return nbd.Errorf(nbd.EIO, "chunk %d: %v", c, err)
+	}
+	if len(d) != len(b) {
+		return nbd.Errorf(nbd.EIO, "chunk %d: decompressed to %d bytes, want %d", c, len(d), len(b))
+	}
+	return nil
+}
+
+// writeChunk stores b as the new contents of chunk c. img.mu must be held
+// for writing.
+func (img *Image) writeChunk(c int64, b []byte) error {
+	var e entry
+	if !isZero(b) {
+		z := encoder.EncodeAll(b, nil)
+		if _, err := img.f.WriteAt(z, img.end); err != nil {
+			return err
+		}
+		e = entry{uint64(img.end), uint32(len(z))}
+		img.end += int64(len(z))
+	}
+	var p [entrySize]byte
+	binary.BigEndian.PutUint64(p[:], e.off)
+	binary.BigEndian.PutUint32(p[8:], e.length)
+	if _, err := img.f.WriteAt(p[:], headerSize+entrySize*c); err != nil {
+		return err
+	}
+	img.stored += int64(e.length) - int64(img.index[c].length)
+	img.index[c] = e
+	return nil
+}
+
+// ReadAt implements nbd.Device.
+func (img *Image) ReadAt(b []byte, off int64) (int, error) {
+	if off < 0 || uint64(off)+uint64(len(b)) > img.size {
+		return 0, nbd.Errorf(nbd.EINVAL, "read past end of image")
+	}
+	img.mu.RLock()
+	defer img.mu.RUnlock()
+	var buf []byte
+	n := 0
+	for n < len(b) {
+		c, co := (off+int64(n))/img.chunkSize, (off+int64(n))%img.chunkSize
+		l := int(img.chunkSize - co)
+		if l > len(b)-n {
+			l = len(b) - n
+		}
+		p := b[n : n+l]
+		if co == 0 && int64(l) == img.chunkLen(c) {
+			if err := img.readChunk(c, p); err != nil {
+				return n, err
+			}
+		} else {
+			if buf == nil {
+				buf = make([]byte, img.chunkSize)
+			}
+			if err := img.readChunk(c, buf[:img.chunkLen(c)]); err != nil {
+				return n, err
+			}
+			copy(p, buf[co:])
+		}
+		n += l
+	}
+	return n, nil
+}
+
+// WriteAt implements nbd.Device. Chunks only containing zeros afterwards are
+// not stored.
+func (img *Image) WriteAt(b []byte, off int64) (int, error) {
+	if off < 0 || uint64(off)+uint64(len(b)) > img.size {
+		return 0, nbd.Errorf(nbd.ENOSPC, "write past end of image")
+	}
+	img.mu.Lock()
+	defer img.mu.Unlock()
+	var buf []byte
+	n := 0
+	for n < len(b) {
+		c, co := (off+int64(n))/img.chunkSize, (off+int64(n))%img.chunkSize
+		l := int(img.chunkSize - co)
+		if l > len(b)-n {
+			l = len(b) - n
+		}
+		p := b[n : n+l]
+		if co == 0 && int64(l) == img.chunkLen(c) {
+			if err := img.writeChunk(c, p); err != nil {
+				return n, err
+			}
+		} else {
+			if buf == nil {
+				buf = make([]byte, img.chunkSize)
+			}
+			cb := buf[:img.chunkLen(c)]
+			if err := img.readChunk(c, cb); err != nil {
+				return n, err
+			}
+			copy(cb[co:], p)
+			if err := img.writeChunk(c, cb); err != nil {
+				return n, err
+			}
+		}
+		n += l
+	}
+	return n, nil
+}
+
+// Trim implements nbd.Trimmer. Chunks only containing zeros afterwards are
+// dropped.
+func (img *Image) Trim(off, length int64) error {
+	if off < 0 || length < 0 || uint64(off)+uint64(length) > img.size {
+		return nbd.Errorf(nbd.EINVAL, "trim past end of image")
+	}
+	for length > 0 {
+		l := img.chunkSize - off%img.chunkSize
+		if l > length {
+			l = length
+		}
+		if _, err := img.WriteAt(make([]byte, l), off); err != nil {
+			return err
+		}
+		off, length = off+l, length-l
+	}
+	return nil
+}
+
+// Extents implements nbd.Extenter. Chunks which are not stored are reported
+// as holes.
+func (img *Image) Extents(off, length int64) ([]nbd.Extent, error) {
+	if off < 0 || length < 0 || uint64(off)+uint64(length) > img.size {
+		return nil, nbd.Errorf(nbd.EINVAL, "block status past end of image")
+	}
+	img.mu.RLock()
+	defer img.mu.RUnlock()
+	var ext []nbd.Extent
+	for length > 0 {
+		l := img.chunkSize - off%img.chunkSize
+		if l > length {
+			l = length
+		}
+		hole := img.index[off/img.chunkSize].off == 0
+		if n := len(ext); n > 0 && ext[n-1].Hole == hole {
+			ext[n-1].Length += l
+		} else {
+			ext = append(ext, nbd.Extent{Length: l, Hole: hole, Zero: hole})
+		}
+		off, length = off+l, length-l
+	}
+	return ext, nil
+}
+
+// Sync implements nbd.Device.
+func (img *Image) Sync() error {
+	return img.f.Sync()
+}
+
+// Stats describes the space used by an image.
+type Stats struct {
+	// Size is the virtual size of the image.
+	Size uint64
+	// Stored is the number of bytes of compressed data referenced by the
+	// index.
+	Stored int64
+	// Garbage is the number of bytes of compressed data of chunks, which
+	// were overwritten since.
+	Garbage int64
+}
+
+// Stats returns the space used by img.
+func (img *Image) Stats() Stats {
+	img.mu.RLock()
+	defer img.mu.RUnlock()
+	data := img.end - headerSize - entrySize*int64(len(img.index))
+	return Stats{Size: img.size, Stored: img.stored, Garbage: data - img.stored}
+}
+
+// Convert creates a compressed image at path with the contents of the size
+// bytes of r. Ranges only containing zeros are not stored. chunkSize is
+// passed to Create.
+func Convert(path string, r io.ReaderAt, size uint64, chunkSize int) (*Image, error) {
+	img, err := Create(path, size, chunkSize)
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, img.chunkSize)
+	for c := range img.index {
+		b := buf[:img.chunkLen(int64(c))]
+		if n, err := r.ReadAt(b, int64(c)*img.chunkSize); err != nil && !(err == io.EOF && n == len(b)) {
+			img.Close()
+			os.Remove(path)
+			return nil, err
+		}
+		if _, err := img.WriteAt(b, int64(c)*img.chunkSize); err != nil {
+			img.Close()
+			os.Remove(path)
+			return nil, err
+		}
+	}
+	if err := img.Sync(); err != nil {
+		img.Close()
+		os.Remove(path)
+		return nil, err
+	}
+	return img, nil
+}
+
+func isZero(b []byte) bool {
+	for _, c := range b {
+		if c != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func zero(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
@@ -0,0 +1,329 @@
+// Copyright 2018 Axel Wagner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package crashtest helps testing the crash-resilience of applications and
+// filesystems.
+//
+// A Device wraps an nbd.Device and simulates a crash, when its Schedule says
+// so: from then on, all writes are denied, so the state of the underlying
+// Device is frozen. The application under test can then be stopped and the
+// filesystem unmounted and remounted (possibly from a Snapshot) to check
+// whether the invariants of the application survived the crash.
+//
+// A typical test on Linux looks like this:
+//
+//	d := &crashtest.Device{
+//		Device:   crashtest.Memory(make([]byte, size)),
+//		Size:     size,
+//		Schedule: crashtest.AfterOps(1000),
+//		Capture:  true,
+//	}
+//	// mkfs and run the application on d, e.g. using crashtest.Mount.
+//	snap, err := d.Snapshot()
+//	for i := 0; i <= len(snap.Unsynced); i++ {
+//		err := crashtest.Mount(ctx, crashtest.Memory(snap.State(i)), size, "ext4", "", checkInvariants)
+//		// …
+//	}
+package crashtest
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/Merovius/nbd"
+)
+
+// Op describes a modifying operation on a Device.
+type Op struct {
+	// N is the number of the operation, starting at 1. Reads are not counted.
+	N uint64
+	// Write is true for writes and false for syncs.
+	Write  bool
+	Offset int64
+	Length int
+	// Time is the time at which the operation started.
+	Time time.Time
+}
+
+// Schedule determines when a Device crashes. It is called before every write
+// and sync and should return true, if the Device should crash before
+// executing op. Once a Schedule returned true, it is not called again until
+// the Device is restarted.
+//
+// Schedules are called with a lock held, so they don't need to be safe for
+// concurrent use, but must not call methods of the Device.
+type Schedule func(op Op) bool
+
+// Never is a Schedule which never crashes. The Device can still be crashed
+// manually.
+func Never(Op) bool {
+	return false
+}
+
+// AfterOps returns a Schedule crashing the Device after n writes and syncs.
+func AfterOps(n uint64) Schedule {
+	return func(op Op) bool {
+		return op.N > n
+	}
+}
+
+// At returns a Schedule crashing the Device at time t.
+func At(t time.Time) Schedule {
+	return func(op Op) bool {
+		return !op.Time.Before(t)
+	}
+}
+
+// Any returns a Schedule crashing the Device as soon as one of s does.
+func Any(s ...Schedule) Schedule {
+	return func(op Op) bool {
+		for _, s := range s {
+			if s(op) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// Write is a write which was executed on a Device.
+type Write struct {
+	Offset int64
+	// Data is the data written.
+	Data []byte
+	// Old is the data which was overwritten.
+	Old []byte
+}
+
+// Snapshot is the state of a Device at the time of a crash.
+type Snapshot struct {
+	// Time is the time of the crash.
+	Time time.Time
+	// Ops is the number of writes and syncs executed before the crash.
+	Ops uint64
+	// Data is the contents of the Device at the time of the crash.
+	Data []byte
+	// Unsynced are the writes since the last successful sync, in the order
+	// they were executed. They are contained in Data, but might have been
+	// lost, if the crash was real.
+	Unsynced []Write
+}
+
+// State returns the contents of the Device, if only the first n of the
+// unsynced writes had made it to disk. In particular, State(0) are the
+// contents as of the last sync and State(len(s.Unsynced)) is s.Data.
+func (s *Snapshot) State(n int) []byte {
+	b := append([]byte(nil), s.Data...)
+	for i := len(s.Unsynced) - 1; i >= n; i-- {
+		w := s.Unsynced[i]
+		copy(b[w.Offset:], w.Old)
+	}
+	return b
+}
+
+// ErrCrashed is returned by writes to a crashed Device.
+var ErrCrashed = nbd.Errorf(nbd.EPERM, "device crashed")
+
+// Device wraps an nbd.Device to simulate crashes. After a crash, writes are
+// denied with ErrCrashed, while reads and syncs are passed through.
+type Device struct {
+	nbd.Device
+
+	// Size is the size of the Device. It is only needed if Capture is true.
+	Size int64
+	// Schedule determines when the Device crashes. If nil, it only crashes
+	// when Crash is called.
+	Schedule Schedule
+	// Capture enables capturing Snapshots at a crash. This requires keeping
+	// the old contents of all unsynced writes in memory.
+	Capture bool
+	// OnCrash, if not nil, is called after the Device crashed.
+	OnCrash func()
+	// Now returns the current time. If nil, time.Now is used.
+	Now func() time.Time
+
+	mu       sync.Mutex
+	ops      uint64
+	crashed  bool
+	unsynced []Write
+	snap     *Snapshot
+	err      error
+}
+
+func (d *Device) now() time.Time {
+	if d.Now != nil {
+		return d.Now()
+	}
+	return time.Now()
+}
+
+// WriteAt implements nbd.Device. Writes and syncs are serialized, so their
+// order is well-defined.
+func (d *Device) WriteAt(p []byte, off int64) (int, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.tickLocked(true, off, len(p)) {
+		return 0, ErrCrashed
+	}
+	if !d.Capture {
+		return d.Device.WriteAt(p, off)
+	}
+	old := make([]byte, len(p))
+	m, err := d.Device.ReadAt(old, off)
+	if err != nil && err != io.EOF {
+		return 0, err
+	}
+	n, err := d.Device.WriteAt(p, off)
+	if n > 0 {
+		d.unsynced = append(d.unsynced, Write{
+			Offset: off,
+			Data:   append([]byte(nil), p[:n]...),
+			Old:    old[:m],
+		})
+	}
+	return n, err
+}
+
+// Sync implements nbd.Device.
+func (d *Device) Sync() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	crashed := d.tickLocked(false, 0, 0)
+	if err := d.Device.Sync(); err != nil || crashed {
+		return err
+	}
+	d.unsynced = nil
+	return nil
+}
+
+// tickLocked counts an operation and consults the Schedule. It returns
+// whether the Device is crashed. d.mu must be held.
+func (d *Device) tickLocked(write bool, off int64, length int) bool {
+	if d.crashed {
+		return true
+	}
+	d.ops++
+	if d.Schedule == nil || !d.Schedule(Op{d.ops, write, off, length, d.now()}) {
+		return false
+	}
+	d.ops--
+	d.crashLocked()
+	return true
+}
+
+// Crash crashes the Device immediately. It is a no-op, if the Device is
+// already crashed.
+func (d *Device) Crash() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if !d.crashed {
+		d.crashLocked()
+	}
+}
+
+// crashLocked crashes the Device. d.mu must be held.
+func (d *Device) crashLocked() {
+	d.crashed = true
+	if d.Capture {
+		d.snap, d.err = d.captureLocked()
+	}
+	if d.OnCrash != nil {
+		// Called asynchronously, to allow it to call methods of d.
+		go d.OnCrash()
+	}
+}
+
+func (d *Device) captureLocked() (*Snapshot, error) {
+	if d.Size <= 0 {
+		return nil, errors.New("crashtest: Size must be set to capture snapshots")
+	}
+	s := &Snapshot{
+		Time:     d.now(),
+		Ops:      d.ops,
+		Data:     make([]byte, d.Size),
+		Unsynced: d.unsynced,
+	}
+	n, err := d.Device.ReadAt(s.Data, 0)
+	if err != nil && !(err == io.EOF && int64(n) == d.Size) {
+		return nil, fmt.Errorf("crashtest: capturing snapshot: %v", err)
+	}
+	d.unsynced = nil
+	return s, nil
+}
+
+// Crashed returns whether the Device is crashed.
+func (d *Device) Crashed() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.crashed
+}
+
+// Snapshot returns the Snapshot captured at the last crash. It returns nil,
+// if the Device did not crash yet or Capture is false, and an error, if
+// capturing the Snapshot failed.
+func (d *Device) Snapshot() (*Snapshot, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.snap, d.err
+}
+
+// Restart resumes normal operation of a crashed Device. The operation count
+// is reset, so the Schedule starts over.
+func (d *Device) Restart() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.crashed = false
+	d.ops = 0
+	d.unsynced = nil
+}
+
+// Memory returns a Device backed by b. Writes beyond the end of b fail with
+// ENOSPC.
+func Memory(b []byte) nbd.Device {
+	return &memDevice{buf: b}
+}
+
+type memDevice struct {
+	mu  sync.RWMutex
+	buf []byte
+}
+
+func (d *memDevice) ReadAt(p []byte, off int64) (int, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if off >= int64(len(d.buf)) {
+		return 0, io.EOF
+	}
+	n := copy(p, d.buf[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (d *memDevice) WriteAt(p []byte, off int64) (int, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if off+int64(len(p)) > int64(len(d.buf)) {
+		return 0, nbd.Errorf(nbd.ENOSPC, "write past end of device")
+	}
+	return copy(d.buf[off:], p), nil
+}
+
+func (d *memDevice) Sync() error {
+	return nil
+}
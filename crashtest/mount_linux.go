@@ -0,0 +1,81 @@
+// +build linux
+
+// Copyright 2018 Axel Wagner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package crashtest
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/Merovius/nbd"
+	"github.com/Merovius/nbd/nbdnl"
+	"golang.org/x/sys/unix"
+)
+
+// Mount connects d to an NBD device, mounts the filesystem on it to a
+// temporary directory and calls f with the path of that directory. The
+// filesystem is unmounted and the device disconnected once f returns. fstype
+// and data are passed to mount(2).
+//
+// This can be used to run the application under test on a Device and, after
+// a crash, to check its invariants on the remounted Device or a Snapshot.
+//
+// This is a Linux-only API and requires root privileges and the nbd kernel
+// module.
+func Mount(ctx context.Context, d nbd.Device, size uint64, fstype, data string, f func(dir string) error) error {
+	return WithDevice(ctx, d, size, func(dev string) (err error) {
+		dir, err := os.MkdirTemp("", "crashtest")
+		if err != nil {
+			return err
+		}
+		defer os.Remove(dir)
+
+		if err := unix.Mount(dev, dir, fstype, 0, data); err != nil {
+			return fmt.Errorf("mounting %s: %v", dev, err)
+		}
+		defer func() {
+			if e := unix.Unmount(dir, 0); e != nil && err == nil {
+				err = fmt.Errorf("unmounting %s: %v", dev, e)
+			}
+		}()
+		return f(dir)
+	})
+}
+
+// WithDevice connects d to an NBD device and calls f with the path of the
+// device node (e.g. to create a filesystem on it). The device is disconnected
+// once f returns.
+//
+// This is a Linux-only API and requires root privileges and the nbd kernel
+// module.
+func WithDevice(ctx context.Context, d nbd.Device, size uint64, f func(dev string) error) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	idx, wait, err := nbd.Loopback(ctx, d, size)
+	if err != nil {
+		return err
+	}
+	err = f(fmt.Sprintf("/dev/nbd%d", idx))
+	if e := nbdnl.Disconnect(idx); e != nil && err == nil {
+		err = e
+	}
+	cancel()
+	if e := wait(); e != nil && e != context.Canceled && err == nil {
+		err = e
+	}
+	return err
+}
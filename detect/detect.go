@@ -0,0 +1,202 @@
+// Copyright 2018 Axel Wagner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package detect detects the format of disk images and opens them as
+// Devices.
+//
+// Detect recognizes raw, qcow2, VHD, VHDX and LUKS images, as well as thin
+// images of package thin and compressed images of package compressed. Open
+// detects the format of a file and opens it with the Opener registered for
+// the format. Openers for raw, thin and compressed images are registered by
+// default; other formats can be added with Register. Images of
+// a recognized format without an Opener are refused, instead of being served
+// as raw data.
+package detect
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/Merovius/nbd"
+	"github.com/Merovius/nbd/compressed"
+	"github.com/Merovius/nbd/thin"
+)
+
+// Format is an image format.
+type Format string
+
+// Formats recognized by Detect.
+const (
+	Raw        Format = "raw"
+	QCOW2      Format = "qcow2"
+	VHD        Format = "vhd"
+	VHDX       Format = "vhdx"
+	LUKS       Format = "luks"
+	Thin       Format = "thin"
+	Compressed Format = "compressed"
+)
+
+// magics are the formats identified by a magic number at the start of the
+// image.
+var magics = []struct {
+	f     Format
+	magic []byte
+}{
+	{QCOW2, []byte("QFI\xfb")},
+	{VHDX, []byte("vhdxfile")},
+	{LUKS, []byte("LUKS\xba\xbe")},
+	{VHD, []byte("conectix")},
+	{Thin, []byte(thin.Magic)},
+	{Compressed, []byte(compressed.Magic)},
+}
+
+// vhdFooter is the size of the footer of a VHD image, which contains its
+// magic number. Fixed VHD images have no copy of it at the start.
+const vhdFooter = 512
+
+// Detect returns the format of the image read from r, which has the given
+// size. An image without a known magic number is Raw.
+func Detect(r io.ReaderAt, size int64) (Format, error) {
+	var b [16]byte
+	n, err := r.ReadAt(b[:], 0)
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+	for _, m := range magics {
+		if bytes.HasPrefix(b[:n], m.magic) {
+			return m.f, nil
+		}
+	}
+	if size >= vhdFooter {
+		n, err := r.ReadAt(b[:8], size-vhdFooter)
+		if err != nil && err != io.EOF {
+			return "", err
+		}
+		if string(b[:n]) == "conectix" {
+			return VHD, nil
+		}
+	}
+	return Raw, nil
+}
+
+// Image is an opened image.
+type Image interface {
+	nbd.Device
+	// Size returns the virtual size of the image.
+	Size() uint64
+	Close() error
+}
+
+// Opener opens the image at path for reading and writing.
+type Opener func(path string) (Image, error)
+
+var (
+	mu      sync.RWMutex
+	openers = map[Format]Opener{
+		Raw:        openRaw,
+		Thin:       openThin,
+		Compressed: openCompressed,
+	}
+)
+
+// Register registers o to open images of format f, replacing any previous
+// Opener.
+func Register(f Format, o Opener) {
+	mu.Lock()
+	defer mu.Unlock()
+	openers[f] = o
+}
+
+// Lookup returns the Opener for f. It returns an error, if no Opener is
+// registered.
+func Lookup(f Format) (Opener, error) {
+	mu.RLock()
+	defer mu.RUnlock()
+	o, ok := openers[f]
+	if !ok {
+		return nil, fmt.Errorf("image format %s is not supported", f)
+	}
+	return o, nil
+}
+
+// Open detects the format of the image at path and opens it.
+func Open(path string) (Image, Format, error) {
+	format, err := detectFile(path)
+	if err != nil {
+		return nil, "", err
+	}
+	img, err := OpenFormat(path, format)
+	return img, format, err
+}
+
+func detectFile(path string) (Format, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	size, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return "", err
+	}
+	format, err := Detect(f, size)
+	if err != nil {
+		return "", fmt.Errorf("%s: %v", path, err)
+	}
+	return format, nil
+}
+
+// OpenFormat opens the image at path, which has the given format.
+func OpenFormat(path string, f Format) (Image, error) {
+	o, err := Lookup(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return o(path)
+}
+
+// rawImage is a raw image. Its size is determined by seeking, so block
+// devices have the correct size.
+type rawImage struct {
+	*os.File
+	size uint64
+}
+
+func (r *rawImage) Size() uint64 {
+	return r.size
+}
+
+func openRaw(path string) (Image, error) {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+	size, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &rawImage{f, uint64(size)}, nil
+}
+
+func openThin(path string) (Image, error) {
+	return thin.Open(path)
+}
+
+func openCompressed(path string) (Image, error) {
+	return compressed.Open(path)
+}
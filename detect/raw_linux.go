@@ -0,0 +1,87 @@
+// +build linux
+
+// Copyright 2018 Axel Wagner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package detect
+
+import (
+	"github.com/Merovius/nbd"
+	"golang.org/x/sys/unix"
+)
+
+// Trim implements nbd.Trimmer, by punching a hole into the file. The size of
+// the file does not change and the range reads as zeros afterwards. As
+// trimming is only advisory, Trim does nothing on file systems not supporting
+// holes.
+func (r *rawImage) Trim(off, length int64) error {
+	err := unix.Fallocate(int(r.Fd()), unix.FALLOC_FL_PUNCH_HOLE|unix.FALLOC_FL_KEEP_SIZE, off, length)
+	if err == unix.EOPNOTSUPP {
+		return nil
+	}
+	return err
+}
+
+// WriteZeroes implements nbd.ZeroWriter. Unless noHole is set, it punches a
+// hole, otherwise it zeroes the range in place. File systems not supporting
+// either fall back to writing zeros.
+func (r *rawImage) WriteZeroes(off, length int64, noHole bool) error {
+	mode := uint32(unix.FALLOC_FL_PUNCH_HOLE | unix.FALLOC_FL_KEEP_SIZE)
+	if noHole {
+		mode = unix.FALLOC_FL_ZERO_RANGE | unix.FALLOC_FL_KEEP_SIZE
+	}
+	err := unix.Fallocate(int(r.Fd()), mode, off, length)
+	if err == unix.EOPNOTSUPP {
+		return nbd.WriteZeroes(r.File, off, length, noHole)
+	}
+	return err
+}
+
+// Extents implements nbd.Extenter, with SEEK_DATA and SEEK_HOLE. If the file
+// system does not support them, the range is reported as allocated.
+func (r *rawImage) Extents(off, length int64) ([]nbd.Extent, error) {
+	fd := int(r.Fd())
+	end := off + length
+	var ext []nbd.Extent
+	for off < end {
+		data, err := unix.Seek(fd, off, unix.SEEK_DATA)
+		switch {
+		case err == unix.ENXIO:
+			// No data after off.
+			data = end
+		case err == unix.EINVAL:
+			return append(ext, nbd.Extent{Length: end - off}), nil
+		case err != nil:
+			return nil, err
+		}
+		if data > end {
+			data = end
+		}
+		if data > off {
+			ext = append(ext, nbd.Extent{Length: data - off, Hole: true, Zero: true})
+			off = data
+			continue
+		}
+		hole, err := unix.Seek(fd, off, unix.SEEK_HOLE)
+		if err != nil {
+			return nil, err
+		}
+		if hole > end {
+			hole = end
+		}
+		ext = append(ext, nbd.Extent{Length: hole - off})
+		off = hole
+	}
+	return ext, nil
+}
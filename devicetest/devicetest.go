@@ -0,0 +1,484 @@
+// Copyright 2018 Axel Wagner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package devicetest implements conformance tests for nbd.Device
+// implementations.
+//
+// Authors of a Device call TestDevice from a test of their package:
+//
+//	func TestDevice(t *testing.T) {
+//		devicetest.TestDevice(t, func(size int64) (nbd.Device, devicetest.Reopen, error) {
+//			d, err := mydevice.New(size)
+//			return d, nil, err
+//		})
+//	}
+package devicetest
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math/rand"
+	"sync"
+	"testing"
+
+	"github.com/Merovius/nbd"
+	"github.com/Merovius/nbd/crashtest"
+)
+
+// Size is the size of the Devices created for tests.
+const Size = 1 << 20
+
+// Reopen simulates a crash of a Device: the Device is discarded without
+// being synced or closed and a new one is returned, using the same storage.
+// All data written before the last successful call to Sync must be visible in
+// the new Device.
+type Reopen func() (nbd.Device, error)
+
+// MakeDevice creates a new Device of the given size to be tested. If
+// creating it fails, the test is aborted. If the Device implements io.Closer,
+// it is closed after the test.
+//
+// If crashes can be simulated for the Device, MakeDevice should also return
+// a Reopen function, which is used to test that data is durable after a
+// Sync. Otherwise, it should return nil.
+type MakeDevice func(size int64) (nbd.Device, Reopen, error)
+
+// TestDevice tests that the Devices created by mk behave correctly. Each
+// aspect is run as a separate subtest, using a new Device. Optional
+// interfaces implemented by the Device are tested as well.
+func TestDevice(t *testing.T, mk MakeDevice) {
+	t.Run("ReadWrite", func(t *testing.T) { testReadWrite(t, mk) })
+	t.Run("Misaligned", func(t *testing.T) { testMisaligned(t, mk) })
+	t.Run("EndOfDevice", func(t *testing.T) { testEndOfDevice(t, mk) })
+	t.Run("Concurrent", func(t *testing.T) { testConcurrent(t, mk) })
+	t.Run("Sync", func(t *testing.T) { testSync(t, mk) })
+	t.Run("Vectored", func(t *testing.T) { testVectored(t, mk) })
+	t.Run("Trim", func(t *testing.T) { testTrim(t, mk) })
+	t.Run("WriteZeroes", func(t *testing.T) { testWriteZeroes(t, mk, false) })
+	t.Run("WriteZeroesNoHole", func(t *testing.T) { testWriteZeroes(t, mk, true) })
+	t.Run("Extents", func(t *testing.T) { testExtents(t, mk) })
+	t.Run("Durability", func(t *testing.T) { testDurability(t, mk) })
+}
+
+// model is a Device under test, together with a copy of the contents it
+// should have.
+type model struct {
+	t      *testing.T
+	d      nbd.Device
+	reopen Reopen
+	want   []byte
+	rnd    *rand.Rand
+}
+
+func newModel(t *testing.T, mk MakeDevice) *model {
+	t.Helper()
+	d, reopen, err := mk(Size)
+	if err != nil {
+		t.Fatalf("creating Device: %v", err)
+	}
+	m := &model{
+		t:      t,
+		d:      d,
+		reopen: reopen,
+		want:   make([]byte, Size),
+		rnd:    rand.New(rand.NewSource(1)),
+	}
+	t.Cleanup(func() { m.close() })
+	// Initialize the Device, so its contents are known.
+	m.write(0, Size)
+	return m
+}
+
+func (m *model) close() {
+	if c, ok := m.d.(io.Closer); ok {
+		if err := c.Close(); err != nil {
+			m.t.Errorf("Close() = %v", err)
+		}
+	}
+}
+
+// data returns n bytes of random data.
+func (m *model) data(n int) []byte {
+	b := make([]byte, n)
+	m.rnd.Read(b)
+	return b
+}
+
+// write writes n bytes of random data at off and checks the result.
+func (m *model) write(off int64, n int) {
+	m.t.Helper()
+	p := m.data(n)
+	if got, err := m.d.WriteAt(p, off); err != nil || got != n {
+		m.t.Fatalf("WriteAt(<%d bytes>, %d) = %d, %v, want %d, <nil>", n, off, got, err, n)
+	}
+	copy(m.want[off:], p)
+}
+
+// check reads n bytes at off and compares them to the expected contents.
+func (m *model) check(off int64, n int) {
+	m.t.Helper()
+	p := make([]byte, n)
+	got, err := m.d.ReadAt(p, off)
+	if got != n || (err != nil && err != io.EOF) {
+		m.t.Fatalf("ReadAt(<%d bytes>, %d) = %d, %v, want %d, <nil>", n, off, got, err, n)
+	}
+	if want := m.want[off : off+int64(n)]; !bytes.Equal(p, want) {
+		m.t.Fatalf("ReadAt(<%d bytes>, %d) returned wrong data at offset %d", n, off, off+int64(diff(p, want)))
+	}
+}
+
+// zero writes n zero bytes at off with z and checks the result.
+func (m *model) zero(z nbd.ZeroWriter, off int64, n int, noHole bool) {
+	m.t.Helper()
+	if err := z.WriteZeroes(off, int64(n), noHole); err != nil {
+		m.t.Fatalf("WriteZeroes(%d, %d, %v) = %v", off, n, noHole, err)
+	}
+	copy(m.want[off:off+int64(n)], make([]byte, n))
+}
+
+// trim trims n bytes at off with tr. As the contents of the range are
+// unspecified afterwards, they are read back as the new expected contents.
+func (m *model) trim(tr nbd.Trimmer, off int64, n int) {
+	m.t.Helper()
+	if err := tr.Trim(off, int64(n)); err != nil {
+		m.t.Fatalf("Trim(%d, %d) = %v", off, n, err)
+	}
+	p := m.want[off : off+int64(n)]
+	if got, err := m.d.ReadAt(p, off); got != n || (err != nil && err != io.EOF) {
+		m.t.Fatalf("ReadAt(<%d bytes>, %d) after Trim = %d, %v, want %d, <nil>", n, off, got, err, n)
+	}
+}
+
+// diff returns the first index at which a and b differ.
+func diff(a, b []byte) int {
+	for i := range a {
+		if a[i] != b[i] {
+			return i
+		}
+	}
+	return len(a)
+}
+
+func testReadWrite(t *testing.T, mk MakeDevice) {
+	m := newModel(t, mk)
+	m.check(0, Size)
+	for _, n := range []int{512, 4096, 64 << 10} {
+		for off := int64(0); off+int64(n) <= Size; off += 3 * int64(n) {
+			m.write(off, n)
+		}
+	}
+	m.check(0, Size)
+}
+
+func testMisaligned(t *testing.T, mk MakeDevice) {
+	m := newModel(t, mk)
+	offs := []int64{1, 3, 511, 513, 4095, 4097, 65537}
+	lens := []int{1, 2, 7, 511, 513, 4095, 4097, 8193}
+	for _, off := range offs {
+		for _, n := range lens {
+			m.write(off, n)
+			m.check(off-1, n+2)
+		}
+	}
+	m.check(0, Size)
+}
+
+func testEndOfDevice(t *testing.T, mk MakeDevice) {
+	m := newModel(t, mk)
+	m.write(Size-4096, 4096)
+	m.check(Size-1, 1)
+
+	p := make([]byte, 2)
+	n, err := m.d.ReadAt(p, Size-1)
+	if n > 1 || (n < 2 && err == nil) {
+		t.Errorf("ReadAt(<2 bytes>, Size-1) = %d, %v, want 1, <non-nil>", n, err)
+	}
+	if n == 1 && p[0] != m.want[Size-1] {
+		t.Errorf("ReadAt(<2 bytes>, Size-1) returned wrong data")
+	}
+	if n, err := m.d.ReadAt(p, Size); n != 0 || err == nil {
+		t.Errorf("ReadAt(<2 bytes>, Size) = %d, %v, want 0, <non-nil>", n, err)
+	}
+	// Some Devices (like files) grow on writes past the end, so only check
+	// that such writes don't corrupt the data before it.
+	m.d.WriteAt(m.data(4096), Size-2048)
+	m.check(0, Size-2048)
+}
+
+func testConcurrent(t *testing.T, mk MakeDevice) {
+	m := newModel(t, mk)
+	const (
+		workers = 8
+		chunk   = Size / workers
+		block   = 4096
+	)
+	var (
+		bufs [workers][]byte
+		wg   sync.WaitGroup
+		errs = make(chan error, workers)
+	)
+	for i := range bufs {
+		bufs[i] = m.data(chunk)
+	}
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			base := int64(i * chunk)
+			p := make([]byte, block)
+			for off := 0; off < chunk; off += block {
+				want := bufs[i][off : off+block]
+				if _, err := m.d.WriteAt(want, base+int64(off)); err != nil {
+					errs <- fmt.Errorf("WriteAt(<%d bytes>, %d) = %v", block, base+int64(off), err)
+					return
+				}
+				if _, err := m.d.ReadAt(p, base+int64(off)); err != nil && err != io.EOF {
+					errs <- fmt.Errorf("ReadAt(<%d bytes>, %d) = %v", block, base+int64(off), err)
+					return
+				}
+				if !bytes.Equal(p, want) {
+					errs <- fmt.Errorf("ReadAt(<%d bytes>, %d) returned data not written", block, base+int64(off))
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+	for i := range bufs {
+		copy(m.want[i*chunk:], bufs[i])
+	}
+	m.check(0, Size)
+}
+
+func testSync(t *testing.T, mk MakeDevice) {
+	m := newModel(t, mk)
+	if err := m.d.Sync(); err != nil {
+		t.Fatalf("Sync() = %v", err)
+	}
+	m.write(4096, 8192)
+	if err := m.d.Sync(); err != nil {
+		t.Fatalf("Sync() = %v", err)
+	}
+	m.check(0, Size)
+	if m.reopen == nil {
+		return
+	}
+
+	// Writes after the last Sync may or may not survive the crash.
+	m.d.WriteAt(m.data(4096), Size-4096)
+	d, err := m.reopen()
+	if err != nil {
+		t.Fatalf("reopening Device: %v", err)
+	}
+	m.d = d
+	m.check(0, Size-4096)
+}
+
+func testVectored(t *testing.T, mk MakeDevice) {
+	m := newModel(t, mk)
+	r, rok := m.d.(nbd.ReaderAtVec)
+	w, wok := m.d.(nbd.WriterAtVec)
+	if !rok && !wok {
+		t.Skip("Device does not implement ReaderAtVec or WriterAtVec")
+	}
+	split := func(p []byte, sizes ...int) [][]byte {
+		var bufs [][]byte
+		for _, n := range sizes {
+			bufs = append(bufs, p[:n])
+			p = p[n:]
+		}
+		return bufs
+	}
+	sizes := []int{1, 4095, 0, 4096, 513}
+	const total, off = 1 + 4095 + 4096 + 513, 1000
+	if wok {
+		p := m.data(total)
+		if n, err := w.WriteAtVec(split(p, sizes...), off); n != total || err != nil {
+			t.Fatalf("WriteAtVec(<%d bytes>, %d) = %d, %v, want %d, <nil>", total, off, n, err, total)
+		}
+		copy(m.want[off:], p)
+		m.check(0, Size)
+	}
+	if rok {
+		p := make([]byte, total)
+		if n, err := r.ReadAtVec(split(p, sizes...), off); n != total || (err != nil && err != io.EOF) {
+			t.Fatalf("ReadAtVec(<%d bytes>, %d) = %d, %v, want %d, <nil>", total, off, n, err, total)
+		}
+		if want := m.want[off : off+total]; !bytes.Equal(p, want) {
+			t.Fatalf("ReadAtVec(<%d bytes>, %d) returned wrong data at offset %d", total, off, off+diff(p, want))
+		}
+	}
+}
+
+func testTrim(t *testing.T, mk MakeDevice) {
+	m := newModel(t, mk)
+	var tr nbd.Trimmer
+	if !nbd.As(m.d, &tr) {
+		t.Skip("Device does not implement Trimmer")
+	}
+	ranges := []struct {
+		off int64
+		n   int
+	}{{0, 4096}, {64 << 10, 128 << 10}, {1000, 5000}, {Size - 4097, 4097}}
+	for _, r := range ranges {
+		m.trim(tr, r.off, r.n)
+		m.check(0, Size)
+	}
+	// Trimmed ranges must be usable again, both for data and zeros.
+	for _, r := range ranges {
+		m.write(r.off, r.n)
+	}
+	m.check(0, Size)
+	var z nbd.ZeroWriter
+	if !nbd.As(m.d, &z) {
+		return
+	}
+	for _, r := range ranges {
+		m.trim(tr, r.off, r.n)
+		m.zero(z, r.off, r.n, false)
+	}
+	m.check(0, Size)
+}
+
+func testWriteZeroes(t *testing.T, mk MakeDevice, noHole bool) {
+	m := newModel(t, mk)
+	var z nbd.ZeroWriter
+	if !nbd.As(m.d, &z) {
+		t.Skip("Device does not implement ZeroWriter")
+	}
+	offs := []int64{0, 1, 4095, 4096, 65537}
+	lens := []int{1, 511, 4096, 8193, 128 << 10}
+	for _, off := range offs {
+		for _, n := range lens {
+			m.zero(z, off, n, noHole)
+			m.check(0, Size)
+			// Writes into the zeroed range must not be lost.
+			m.write(off+int64(n/2), n/2+1)
+			m.check(0, Size)
+		}
+	}
+	m.zero(z, Size-8192, 8192, noHole)
+	m.check(0, Size)
+}
+
+func testExtents(t *testing.T, mk MakeDevice) {
+	m := newModel(t, mk)
+	var x nbd.Extenter
+	if !nbd.As(m.d, &x) {
+		t.Skip("Device does not implement Extenter")
+	}
+	var (
+		tr nbd.Trimmer
+		z  nbd.ZeroWriter
+	)
+	if nbd.As(m.d, &tr) {
+		m.trim(tr, 0, 64<<10)
+		m.trim(tr, 300<<10, 5000)
+	}
+	if nbd.As(m.d, &z) {
+		m.zero(z, 128<<10, 64<<10, false)
+		m.zero(z, 512<<10, 4096, true)
+	}
+	m.write(256<<10, 4096)
+	for _, start := range []int64{0, 1, 4095, 128 << 10, Size - 1} {
+		off := start
+		for off < Size {
+			ext, err := x.Extents(off, Size-off)
+			if err != nil {
+				t.Fatalf("Extents(%d, %d) = %v", off, Size-off, err)
+			}
+			if len(ext) == 0 {
+				t.Fatalf("Extents(%d, %d) returned no extents", off, Size-off)
+			}
+			for _, e := range ext {
+				if e.Length <= 0 {
+					t.Fatalf("Extents(%d, %d) returned extent of length %d", off, Size-off, e.Length)
+				}
+				n := e.Length
+				if n > Size-off {
+					n = Size - off
+				}
+				if e.Zero {
+					if i := diff(m.want[off:off+n], make([]byte, n)); int64(i) < n {
+						t.Fatalf("Extents reported [%d, %d) as zero, but offset %d is not", off, off+n, off+int64(i))
+					}
+				}
+				off += n
+				if off >= Size {
+					break
+				}
+			}
+		}
+	}
+	m.check(0, Size)
+}
+
+func testDurability(t *testing.T, mk MakeDevice) {
+	m := newModel(t, mk)
+	d := &crashtest.Device{Device: m.d, Size: Size, Capture: true}
+	d.Sync()
+	write := func(off int64, n int) error {
+		p := m.data(n)
+		if _, err := d.WriteAt(p, off); err != nil {
+			return err
+		}
+		copy(m.want[off:], p)
+		return nil
+	}
+	if err := write(4096, 8192); err != nil {
+		t.Fatalf("WriteAt(<8192 bytes>, 4096) = %v", err)
+	}
+	if err := d.Sync(); err != nil {
+		t.Fatalf("Sync() = %v", err)
+	}
+	synced := append([]byte(nil), m.want...)
+	if err := write(Size-4096, 4096); err != nil {
+		t.Fatalf("WriteAt(<4096 bytes>, %d) = %v", Size-4096, err)
+	}
+	d.Crash()
+	if err := write(0, 4096); err != crashtest.ErrCrashed {
+		t.Fatalf("WriteAt after crash = %v, want %v", err, crashtest.ErrCrashed)
+	}
+	snap, err := d.Snapshot()
+	if err != nil {
+		t.Fatalf("Snapshot() = %v", err)
+	}
+	// The Device must contain all executed writes, and the state as of the
+	// last Sync must only differ by the unsynced one.
+	if i := diff(snap.Data, m.want); i < Size {
+		t.Fatalf("Device contents differ from the writes at offset %d", i)
+	}
+	if len(snap.Unsynced) != 1 {
+		t.Fatalf("got %d unsynced writes, want 1", len(snap.Unsynced))
+	}
+	if i := diff(snap.State(0), synced); i < Size {
+		t.Fatalf("synced state differs at offset %d", i)
+	}
+	if m.reopen == nil {
+		return
+	}
+	nd, err := m.reopen()
+	if err != nil {
+		t.Fatalf("reopening Device: %v", err)
+	}
+	// Only the synced writes have to survive the crash.
+	m.d = nd
+	m.want = synced
+	m.check(0, Size-4096)
+}
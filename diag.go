@@ -0,0 +1,208 @@
+// Copyright 2018 Axel Wagner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nbd
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"runtime/pprof"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Diagnostics is a snapshot of the state of a Server, meant to help debugging
+// hung or slow exports.
+type Diagnostics struct {
+	// Time is when the snapshot was taken.
+	Time time.Time
+	// Conns are the connections in transmission phase, oldest first.
+	Conns []ConnDiagnostics
+	// Stats are the statistics of the Server.
+	Stats Stats
+}
+
+// ConnDiagnostics describes a single connection.
+type ConnDiagnostics struct {
+	Remote string
+	// Client is the identity of the client (see Server.Identify).
+	Client string
+	Export string
+	// Since is when the connection entered transmission phase.
+	Since time.Time
+	// Queued is the number of requests received, but not yet picked up by a
+	// worker.
+	Queued int
+	// Limit is the current limit of Server.AdaptiveConcurrency, or 0 if it
+	// is not set.
+	Limit int
+	// InFlight are the requests currently executed, oldest first.
+	InFlight []InFlightRequest
+}
+
+// InFlightRequest describes a request currently executed.
+type InFlightRequest struct {
+	RequestInfo
+	// Age is the time since the request started executing.
+	Age time.Duration
+}
+
+// Diagnostics returns a snapshot of the state of s. It is safe to call
+// concurrently with serving.
+func (s *Server) Diagnostics() Diagnostics {
+	now := time.Now()
+	d := Diagnostics{
+		Time:  now,
+		Stats: s.Stats(),
+	}
+	s.conns.each(func(c *serverConn) {
+		d.Conns = append(d.Conns, c.diagnostics(now))
+	})
+	sort.Slice(d.Conns, func(i, j int) bool {
+		return d.Conns[i].Since.Before(d.Conns[j].Since)
+	})
+	return d
+}
+
+// Dump writes a human readable description of Diagnostics to w. If
+// goroutines is true, the stacks of all goroutines are appended.
+func (s *Server) Dump(w io.Writer, goroutines bool) error {
+	bw := bufio.NewWriter(w)
+	d := s.Diagnostics()
+	fmt.Fprintf(bw, "nbd server state at %v\n", d.Time.Format(time.RFC3339Nano))
+	c := d.Stats.Counters
+	fmt.Fprintf(bw, "uptime=%v requests=%d errors=%d in_flight=%d bytes_read=%d bytes_written=%d\n", d.Stats.Uptime, c.Requests, c.Errors, c.InFlight, c.BytesRead, c.BytesWritten)
+	fmt.Fprintf(bw, "\n%d connections\n", len(d.Conns))
+	for _, c := range d.Conns {
+		fmt.Fprintf(bw, "\n%s client=%q export=%q age=%v queued=%d in_flight=%d limit=%d\n", c.Remote, c.Client, c.Export, d.Time.Sub(c.Since), c.Queued, len(c.InFlight), c.Limit)
+		for _, r := range c.InFlight {
+			fmt.Fprintf(bw, "\tid=%d handle=%d %v offset=%d length=%d age=%v\n", r.ID, r.Handle, r.Command, r.Offset, r.Length, r.Age)
+		}
+	}
+	fmt.Fprintf(bw, "\nlatency\n")
+	cmds := make([]string, 0, len(d.Stats.Latency))
+	for cmd := range d.Stats.Latency {
+		cmds = append(cmds, cmd)
+	}
+	sort.Strings(cmds)
+	for _, cmd := range cmds {
+		l := d.Stats.Latency[cmd]
+		fmt.Fprintf(bw, "\t%s count=%d p50=%v p95=%v p99=%v\n", cmd, l.Count, l.P50, l.P95, l.P99)
+	}
+	if goroutines {
+		fmt.Fprintf(bw, "\ngoroutines\n")
+		if err := pprof.Lookup("goroutine").WriteTo(bw, 2); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+// connSet is the set of connections of a Server in transmission phase.
+type connSet struct {
+	mu sync.Mutex
+	m  map[*serverConn]bool
+}
+
+func (s *connSet) add(c *serverConn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.m == nil {
+		s.m = make(map[*serverConn]bool)
+	}
+	s.m[c] = true
+}
+
+func (s *connSet) remove(c *serverConn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.m, c)
+}
+
+func (s *connSet) len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.m)
+}
+
+func (s *connSet) each(f func(*serverConn)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for c := range s.m {
+		f(c)
+	}
+}
+
+// inFlight tracks the requests executed by a connection.
+type inFlight struct {
+	mu sync.Mutex
+	m  map[uint64]inFlightEntry
+}
+
+type inFlightEntry struct {
+	info  RequestInfo
+	start time.Time
+}
+
+func (f *inFlight) add(info RequestInfo, start time.Time) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.m == nil {
+		f.m = make(map[uint64]inFlightEntry)
+	}
+	f.m[info.ID] = inFlightEntry{info, start}
+}
+
+func (f *inFlight) remove(id uint64) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.m, id)
+}
+
+// connInfo is the static information about a serverConn, used for
+// diagnostics.
+type connInfo struct {
+	remote net.Addr
+	since  time.Time
+	// queue is the channel requests are queued on for workers. It is nil if
+	// requests are executed by the reading goroutine.
+	queue chan *request
+}
+
+func (c *serverConn) diagnostics(now time.Time) ConnDiagnostics {
+	d := ConnDiagnostics{
+		Client: c.client.id,
+		Export: c.p.Export.Name,
+		Since:  c.info.since,
+		Queued: len(c.info.queue),
+	}
+	if c.lim != nil {
+		d.Limit = c.lim.current()
+	}
+	if c.info.remote != nil {
+		d.Remote = c.info.remote.String()
+	}
+	c.inFlight.mu.Lock()
+	for _, e := range c.inFlight.m {
+		d.InFlight = append(d.InFlight, InFlightRequest{e.info, now.Sub(e.start)})
+	}
+	c.inFlight.mu.Unlock()
+	sort.Slice(d.InFlight, func(i, j int) bool {
+		return d.InFlight[i].Age > d.InFlight[j].Age
+	})
+	return d
+}
@@ -0,0 +1,277 @@
+// Copyright 2018 Axel Wagner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package dirty tracks the blocks of a Device modified by writes (changed
+// block tracking).
+//
+// A Tracker wraps a Device and marks every block written in a Bitmap. Swap
+// atomically returns the blocks written since the last call and starts a new
+// Bitmap, which is the basis for incremental copies: copy the blocks of one
+// Bitmap while the next one records the writes happening concurrently.
+//
+// A Tracker with a Name also exposes its Bitmap to NBD clients, as the
+// metadata context qemu:dirty-bitmap:<Name>, so incremental backup tools can
+// query the changed blocks with NBD_CMD_BLOCK_STATUS. TrackFile persists the
+// Bitmap in a file, so it survives restarts of the server.
+package dirty
+
+import (
+	"math/bits"
+	"os"
+	"sync"
+
+	"github.com/Merovius/nbd"
+)
+
+// Bitmap is a set of blocks of a Device.
+type Bitmap struct {
+	size      uint64
+	blockSize uint64
+	words     []uint64
+}
+
+// NewBitmap returns an empty Bitmap for a Device of the given size. blockSize
+// must be positive.
+func NewBitmap(size uint64, blockSize int) *Bitmap {
+	b := &Bitmap{size: size, blockSize: uint64(blockSize)}
+	b.words = make([]uint64, (b.Blocks()+63)/64)
+	return b
+}
+
+// Size returns the size of the Device in bytes.
+func (b *Bitmap) Size() uint64 {
+	return b.size
+}
+
+// BlockSize returns the size of the blocks in bytes.
+func (b *Bitmap) BlockSize() int {
+	return int(b.blockSize)
+}
+
+// Blocks returns the number of blocks of the Device. The last block might be
+// shorter than BlockSize.
+func (b *Bitmap) Blocks() int {
+	return int((b.size + b.blockSize - 1) / b.blockSize)
+}
+
+// Mark adds all blocks overlapping the n bytes at off to b.
+func (b *Bitmap) Mark(off int64, n int) {
+	if n <= 0 || off < 0 || uint64(off) >= b.size {
+		return
+	}
+	first := uint64(off) / b.blockSize
+	last := (uint64(off) + uint64(n) - 1) / b.blockSize
+	if max := uint64(b.Blocks()) - 1; last > max {
+		last = max
+	}
+	for i := first; i <= last; i++ {
+		b.words[i/64] |= 1 << (i % 64)
+	}
+}
+
+// MarkAll adds all blocks to b.
+func (b *Bitmap) MarkAll() {
+	if len(b.words) == 0 {
+		return
+	}
+	for i := range b.words {
+		b.words[i] = ^uint64(0)
+	}
+	b.words[len(b.words)-1] &= b.tailMask()
+}
+
+// tailMask is the mask of the valid bits in the last word.
+func (b *Bitmap) tailMask() uint64 {
+	if n := b.Blocks() % 64; n != 0 {
+		return 1<<uint(n) - 1
+	}
+	return ^uint64(0)
+}
+
+// Test returns whether block i is in b.
+func (b *Bitmap) Test(i int) bool {
+	return b.words[i/64]&(1<<(uint(i)%64)) != 0
+}
+
+// Count returns the number of blocks in b.
+func (b *Bitmap) Count() int {
+	var n int
+	for _, w := range b.words {
+		n += bits.OnesCount64(w)
+	}
+	return n
+}
+
+// Or adds all blocks of o to b. o must be for the same size and block size.
+func (b *Bitmap) Or(o *Bitmap) {
+	for i, w := range o.words {
+		b.words[i] |= w
+	}
+}
+
+// Clone returns a copy of b.
+func (b *Bitmap) Clone() *Bitmap {
+	c := *b
+	c.words = append([]uint64(nil), b.words...)
+	return &c
+}
+
+// Range is a range of bytes of a Device.
+type Range struct {
+	Offset int64
+	Length int64
+}
+
+// Ranges returns the blocks of b as byte ranges, merging adjacent blocks
+// into ranges of at most max bytes. If max is <= 0, ranges are not limited.
+// The last range is clipped to the size of the Device.
+func (b *Bitmap) Ranges(max int64) []Range {
+	var (
+		out []Range
+		cur Range
+	)
+	bs := int64(b.blockSize)
+	for i, n := 0, b.Blocks(); i < n; i++ {
+		if !b.Test(i) {
+			continue
+		}
+		off := int64(i) * bs
+		l := bs
+		if rest := int64(b.size) - off; rest < l {
+			l = rest
+		}
+		if cur.Length > 0 && cur.Offset+cur.Length == off && (max <= 0 || cur.Length+l <= max) {
+			cur.Length += l
+			continue
+		}
+		if cur.Length > 0 {
+			out = append(out, cur)
+		}
+		cur = Range{off, l}
+	}
+	if cur.Length > 0 {
+		out = append(out, cur)
+	}
+	return out
+}
+
+// Tracker is a Device, which tracks the blocks written to the underlying
+// Device. It is safe for concurrent use, if the underlying Device is.
+type Tracker struct {
+	nbd.Device
+
+	// Name, if not empty, is the name of the bitmap exposed to clients, as
+	// the metadata context qemu:dirty-bitmap:<Name>. It must not be changed
+	// while t is served.
+	Name string
+
+	mu sync.Mutex
+	bm *Bitmap
+	// f is the file the bitmap is persisted in, if it was created by
+	// TrackFile.
+	f *os.File
+}
+
+// Track returns a Tracker for d, which has the given size, tracking writes in
+// blocks of blockSize bytes.
+func Track(d nbd.Device, size uint64, blockSize int) *Tracker {
+	return &Tracker{Device: d, bm: NewBitmap(size, blockSize)}
+}
+
+// WriteAt implements Device. The written blocks are marked once the write
+// returned, even if it failed, so a block copied after a call to Swap
+// observes all writes not recorded in the next Bitmap.
+func (t *Tracker) WriteAt(p []byte, off int64) (int, error) {
+	n, err := t.Device.WriteAt(p, off)
+	t.mu.Lock()
+	t.bm.Mark(off, len(p))
+	t.mu.Unlock()
+	return n, err
+}
+
+// Dirty returns a copy of the blocks written since the last call to Swap.
+func (t *Tracker) Dirty() *Bitmap {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.bm.Clone()
+}
+
+// Swap returns the blocks written since the last call to Swap and starts
+// tracking in a new, empty Bitmap.
+func (t *Tracker) Swap() *Bitmap {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	bm := t.bm
+	t.bm = NewBitmap(bm.size, int(bm.blockSize))
+	return bm
+}
+
+// Merge adds the blocks of bm to the blocks tracked by t. It can be used to
+// give back the result of Swap, if copying the blocks failed.
+func (t *Tracker) Merge(bm *Bitmap) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.bm.Or(bm)
+}
+
+// DirtyBitmaps implements nbd.DirtyBitmapper. It returns Name, if it is not
+// empty.
+func (t *Tracker) DirtyBitmaps() []string {
+	if t.Name == "" {
+		return nil
+	}
+	return []string{t.Name}
+}
+
+// DirtyExtents implements nbd.DirtyBitmapper, reporting the blocks written
+// since the last call to Swap as dirty.
+func (t *Tracker) DirtyExtents(name string, off, length int64) ([]nbd.DirtyExtent, error) {
+	if name != t.Name || name == "" {
+		return nil, nbd.Errorf(nbd.EINVAL, "unknown dirty bitmap %q", name)
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.bm.extents(off, length), nil
+}
+
+// Extents implements nbd.Extenter, if the underlying Device does. Otherwise,
+// the range is reported as allocated.
+func (t *Tracker) Extents(off, length int64) ([]nbd.Extent, error) {
+	if x, ok := t.Device.(nbd.Extenter); ok {
+		return x.Extents(off, length)
+	}
+	return []nbd.Extent{{Length: length}}, nil
+}
+
+// extents returns the extents of length bytes at off, which are marked in b
+// or not.
+func (b *Bitmap) extents(off, length int64) []nbd.DirtyExtent {
+	var out []nbd.DirtyExtent
+	bs := int64(b.blockSize)
+	for end := off + length; off < end && uint64(off) < b.size; {
+		i := off / bs
+		l := (i+1)*bs - off
+		if l > end-off {
+			l = end - off
+		}
+		d := b.Test(int(i))
+		if n := len(out); n > 0 && out[n-1].Dirty == d {
+			out[n-1].Length += l
+		} else {
+			out = append(out, nbd.DirtyExtent{Length: l, Dirty: d})
+		}
+		off += l
+	}
+	return out
+}
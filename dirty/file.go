@@ -0,0 +1,144 @@
+// Copyright 2018 Axel Wagner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dirty
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/Merovius/nbd"
+)
+
+// A bitmap file starts with a header, followed by the words of the Bitmap:
+//
+//	magic      [8]byte  "NBDDIRTY"
+//	version    uint32   1
+//	flags      uint32   flagInUse, while the file is used by a Tracker
+//	size       uint64   size of the Device
+//	blockSize  uint64
+//	words      [(blocks+63)/64]uint64
+//
+// All integers are big-endian.
+const (
+	fileMagic   = "NBDDIRTY"
+	fileVersion = 1
+	fileHeader  = 32
+)
+
+// flagInUse is set in the header of a bitmap file, while a Tracker uses it.
+// If it is still set when the file is opened, the Tracker was not closed and
+// the writes since the file was last written are unknown.
+const flagInUse = 1 << 0
+
+// TrackFile returns a Tracker for d, which has the given size, tracking writes
+// in blocks of blockSize bytes in a Bitmap persisted in the file at path.
+// If the file exists, the Bitmap is loaded from it and must have the same
+// size and block size; otherwise it is created empty.
+//
+// The Bitmap is written to the file by Close. If the process crashes before,
+// all blocks are marked when the file is opened next, as the blocks written
+// in the meantime are unknown.
+func TrackFile(d nbd.Device, size uint64, blockSize int, path string) (*Tracker, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	t := Track(d, size, blockSize)
+	t.f = f
+	if err := t.load(); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	if err := t.save(flagInUse); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return t, nil
+}
+
+// load reads the Bitmap from the file of t, if it is not empty.
+func (t *Tracker) load() error {
+	fi, err := t.f.Stat()
+	if err != nil || fi.Size() == 0 {
+		return err
+	}
+	var h [fileHeader]byte
+	if _, err := io.ReadFull(io.NewSectionReader(t.f, 0, fileHeader), h[:]); err != nil {
+		return err
+	}
+	if string(h[:8]) != fileMagic {
+		return errors.New("not a dirty bitmap")
+	}
+	if v := binary.BigEndian.Uint32(h[8:]); v != fileVersion {
+		return fmt.Errorf("unsupported version %d", v)
+	}
+	size, bs := binary.BigEndian.Uint64(h[16:]), binary.BigEndian.Uint64(h[24:])
+	if size != t.bm.size || bs != t.bm.blockSize {
+		return fmt.Errorf("bitmap is for size %d and block size %d, not %d and %d", size, bs, t.bm.size, t.bm.blockSize)
+	}
+	if binary.BigEndian.Uint32(h[12:])&flagInUse != 0 {
+		t.bm.MarkAll()
+		return nil
+	}
+	b := make([]byte, 8*len(t.bm.words))
+	if _, err := io.ReadFull(io.NewSectionReader(t.f, fileHeader, int64(len(b))), b); err != nil {
+		return err
+	}
+	for i := range t.bm.words {
+		t.bm.words[i] = binary.BigEndian.Uint64(b[8*i:])
+	}
+	if n := len(t.bm.words); n > 0 {
+		t.bm.words[n-1] &= t.bm.tailMask()
+	}
+	return nil
+}
+
+// save writes the Bitmap of t to its file, with the given flags, and syncs
+// it.
+func (t *Tracker) save(flags uint32) error {
+	b := make([]byte, fileHeader+8*len(t.bm.words))
+	copy(b, fileMagic)
+	binary.BigEndian.PutUint32(b[8:], fileVersion)
+	binary.BigEndian.PutUint32(b[12:], flags)
+	binary.BigEndian.PutUint64(b[16:], t.bm.size)
+	binary.BigEndian.PutUint64(b[24:], t.bm.blockSize)
+	for i, w := range t.bm.words {
+		binary.BigEndian.PutUint64(b[fileHeader+8*i:], w)
+	}
+	if _, err := t.f.WriteAt(b, 0); err != nil {
+		return err
+	}
+	return t.f.Sync()
+}
+
+// Close writes the Bitmap to the file of a Tracker created by TrackFile and
+// closes it. It does not close the underlying Device, which must not be
+// written to anymore. Close does nothing for other Trackers.
+func (t *Tracker) Close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.f == nil {
+		return nil
+	}
+	err := t.save(0)
+	if cerr := t.f.Close(); err == nil {
+		err = cerr
+	}
+	t.f = nil
+	return err
+}
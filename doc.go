@@ -28,34 +28,48 @@
 // can be used to list the exports a server provides and their respective
 // capabilities. Its Go method enters transmission phase. The returned Export
 // can then be passed to Configure (linux only) to hook it up to an NBD device
-// (/dev/nbdX).
+// (/dev/nbdX). Alternatively, its Open method returns a Conn, which issues
+// reads, writes, flushes and trims to the export directly from Go. Conns
+// understand structured replies, which can be negotiated with
+// StructuredReplies before, as well as extended headers (negotiated with
+// ExtendedHeaders), which lift the 4GiB limit of trims, write zeroes and block
+// status queries. With structured replies, SetMetaContext can select
+// MetaContextAllocation, to query which ranges are allocated with
+// Conn.Extents; a Server answers such queries with Devices implementing
+// Extenter. Devices implementing DirtyBitmapper additionally provide the
+// qemu:dirty-bitmap: contexts used for incremental backups.
 //
 // The server side combines both handshake and transmission phase into the
-// Serve or ListenAndServe functions. The user is expected to implement the
-// Device interface to serve actual reads/writes. Under linux, the Loopback
-// function serves as a convenient way to use a given Device as a block device.
+// Serve or ListenAndServe functions. The Server type can be used to further
+// configure how requests are executed, e.g. concurrently. The user is expected
+// to implement the Device interface to serve actual reads/writes; Devices
+// implementing DeviceContext can abort reads and writes whose results are no
+// longer needed. Server.Shutdown stops a server gracefully, after answering
+// the requests in flight. Under linux, the Loopback
+// function serves as a convenient way to use a given Device as a block device,
+// which Drain disconnects gracefully.
+// Devices can be wrapped with Middlewares (e.g. for caching or throttling),
+// which are combined with Chain; wrappers implementing Unwrapper keep the
+// optional interfaces of the Device they wrap.
+//
+// Connections can be encrypted with TLS: Server.TLSConfig allows clients to
+// upgrade with NBD_OPT_STARTTLS (or, with Server.TLSRequired, forces them to)
+// and Client.StartTLS does the upgrade on the client side. Connections using
+// TLS can not be passed to the kernel. Export.ACL and Server.Authorizer
+// restrict which clients may use an export, and whether they may write it.
+//
+// Neither side assumes a particular transport: the server accepts connections
+// from any net.Listener and the client works on any net.Conn, e.g. one
+// established by a Dialer. Streams without deadlines (SSH channels, pipes) can
+// be adapted with StreamConn and passed to the server with ChanListener.
+//
+// Only Configure, Loopback and LoopbackFile (and package nbdnl) depend on the
+// Linux kernel. The client, the server and all Device wrappers work on any
+// platform supported by Go; FDListener and SendConn need unix sockets.
 package nbd
 
-// BUG(1): BlockSizeConstraints are not yet enforced by the server.
-
-// BUG(2): The server does not yet support FUA for direct IO.
-
-// BUG(3): StartTLS is not supported yet.
-
-// BUG(4): There is no way to declare a preferred block size for Loopback yet.
-
-// BUG(5): Server flags are not yet set (or used) correctly.
-
-// BUG(6): Structured replies are not yet supported.
-
-// BUG(7): CMD_TRIM is not yet supported.
-
 // BUG(8): Lame-duck mode (ESHUTDOWN) is not yet implemented.
 
-// BUG(9): CMD_WRITE_ZEROES is not yet supported.
-
-// BUG(10): Metadata querying is not yet supported.
-
 // BUG(11): FLAG_ROTATIONAL is not yet supported.
 
 // BUG(12): CMD_CACHE is not yet supported.
@@ -0,0 +1,187 @@
+// Copyright 2018 Axel Wagner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package encrypt implements a Device encrypting all data stored on an
+// underlying Device, using AES-XTS.
+//
+// The data key used to encrypt a Device is never stored in plain text.
+// Instead, it is wrapped (encrypted) by a key-encryption key held by a
+// KeyProvider, e.g. a KMS or HSM reached via an external command. Only the
+// wrapped data key has to be stored alongside the Device:
+//
+//	dek, wrapped, err := encrypt.NewKey(ctx, provider)
+//	// store wrapped
+//	d, err := encrypt.New(backing, dek, 0)
+//
+//	// later
+//	d, err := encrypt.Open(ctx, backing, provider, wrapped, 0)
+//
+// Rotating the key-encryption key with KeyProvider.Rotate and re-wrapping the
+// data key with Rewrap does not require re-encrypting the Device.
+package encrypt
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/Merovius/nbd"
+	"golang.org/x/crypto/xts"
+)
+
+// KeySize is the size of a data key (AES-256-XTS).
+const KeySize = 64
+
+// DefaultSectorSize is the size of the encrypted sectors, if New is passed 0.
+const DefaultSectorSize = 4096
+
+// NewKey generates a new random data key and wraps it with p.
+func NewKey(ctx context.Context, p KeyProvider) (dek, wrapped []byte, err error) {
+	dek = make([]byte, KeySize)
+	if _, err := io.ReadFull(rand.Reader, dek); err != nil {
+		return nil, nil, err
+	}
+	if wrapped, err = p.Wrap(ctx, dek); err != nil {
+		return nil, nil, err
+	}
+	return dek, wrapped, nil
+}
+
+// Device is an encrypted nbd.Device. Every sector is encrypted separately,
+// with its number as the tweak, so the size of the data is unchanged. Reads
+// and writes not aligned to sectors are supported, but need to read (and
+// re-encrypt) the partial sectors at their ends. Sectors never written
+// through the Device read as random data, so a new Device should be zeroed
+// (or formatted) through it first.
+//
+// Device is safe for concurrent use, if the underlying Device is.
+type Device struct {
+	d          nbd.Device
+	c          *xts.Cipher
+	sectorSize int64
+
+	// mu is held for reading by aligned writes and for writing by unaligned
+	// ones, so the read-modify-write of a partial sector does not race with
+	// other writes.
+	mu sync.RWMutex
+}
+
+// New returns a Device encrypting d with the data key dek, which must be
+// KeySize bytes. sectorSize must be a multiple of 16; if it is 0,
+// DefaultSectorSize is used. The size of d must be a multiple of the sector
+// size. The same key and sector size must be used every time d is opened.
+func New(d nbd.Device, dek []byte, sectorSize int) (*Device, error) {
+	if len(dek) != KeySize {
+		return nil, fmt.Errorf("invalid key size %d, need %d", len(dek), KeySize)
+	}
+	if sectorSize == 0 {
+		sectorSize = DefaultSectorSize
+	}
+	if sectorSize < 16 || sectorSize%16 != 0 {
+		return nil, fmt.Errorf("invalid sector size %d", sectorSize)
+	}
+	c, err := xts.NewCipher(aes.NewCipher, dek)
+	if err != nil {
+		return nil, err
+	}
+	return &Device{d: d, c: c, sectorSize: int64(sectorSize)}, nil
+}
+
+// Open unwraps the data key wrapped with p and returns a Device encrypting d
+// with it.
+func Open(ctx context.Context, d nbd.Device, p KeyProvider, wrapped []byte, sectorSize int) (*Device, error) {
+	dek, err := p.Unwrap(ctx, wrapped)
+	if err != nil {
+		return nil, err
+	}
+	return New(d, dek, sectorSize)
+}
+
+// span returns the sector aligned range covering n bytes at off.
+func (d *Device) span(off int64, n int) (start, end int64) {
+	start = off - off%d.sectorSize
+	end = off + int64(n)
+	if r := end % d.sectorSize; r != 0 {
+		end += d.sectorSize - r
+	}
+	return start, end
+}
+
+// ReadAt implements nbd.Device.
+func (d *Device) ReadAt(p []byte, off int64) (int, error) {
+	start, end := d.span(off, len(p))
+	buf := p
+	if start != off || end != off+int64(len(p)) {
+		buf = make([]byte, end-start)
+	}
+	if n, err := d.d.ReadAt(buf, start); err != nil && !(err == io.EOF && n == len(buf)) {
+		return 0, err
+	}
+	d.decrypt(buf, start)
+	if len(buf) != len(p) {
+		copy(p, buf[off-start:])
+	}
+	return len(p), nil
+}
+
+// WriteAt implements nbd.Device.
+func (d *Device) WriteAt(p []byte, off int64) (int, error) {
+	start, end := d.span(off, len(p))
+	if start == off && end == off+int64(len(p)) {
+		d.mu.RLock()
+		defer d.mu.RUnlock()
+		buf := make([]byte, len(p))
+		d.encrypt(buf, p, start)
+		if _, err := d.d.WriteAt(buf, start); err != nil {
+			return 0, err
+		}
+		return len(p), nil
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	buf := make([]byte, end-start)
+	if n, err := d.d.ReadAt(buf, start); err != nil && !(err == io.EOF && n == len(buf)) {
+		return 0, err
+	}
+	d.decrypt(buf, start)
+	copy(buf[off-start:], p)
+	d.encrypt(buf, buf, start)
+	if _, err := d.d.WriteAt(buf, start); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Sync implements nbd.Device.
+func (d *Device) Sync() error {
+	return d.d.Sync()
+}
+
+func (d *Device) encrypt(dst, src []byte, off int64) {
+	ss := d.sectorSize
+	for i := int64(0); i < int64(len(src)); i += ss {
+		d.c.Encrypt(dst[i:i+ss], src[i:i+ss], uint64((off+i)/ss))
+	}
+}
+
+func (d *Device) decrypt(b []byte, off int64) {
+	ss := d.sectorSize
+	for i := int64(0); i < int64(len(b)); i += ss {
+		d.c.Decrypt(b[i:i+ss], b[i:i+ss], uint64((off+i)/ss))
+	}
+}
@@ -0,0 +1,337 @@
+// Copyright 2018 Axel Wagner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package encrypt
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// KeyProvider manages the key-encryption keys used to wrap data keys. The
+// wrapped form of a data key is opaque, but must identify the key-encryption
+// key used, so data keys wrapped before a rotation can still be unwrapped.
+type KeyProvider interface {
+	// Wrap encrypts dek with the current key-encryption key.
+	Wrap(ctx context.Context, dek []byte) (wrapped []byte, err error)
+	// Unwrap fetches the key-encryption key wrapped was created with and
+	// returns the data key.
+	Unwrap(ctx context.Context, wrapped []byte) (dek []byte, err error)
+	// Rotate creates a new key-encryption key, which is used by all
+	// following calls to Wrap. Older keys stay available to Unwrap.
+	Rotate(ctx context.Context) error
+}
+
+// Rewrap unwraps a data key and wraps it again with the current
+// key-encryption key of p, e.g. after a call to Rotate. The encrypted Device
+// is unaffected, but the stored wrapped key has to be replaced by the result.
+func Rewrap(ctx context.Context, p KeyProvider, wrapped []byte) ([]byte, error) {
+	dek, err := p.Unwrap(ctx, wrapped)
+	if err != nil {
+		return nil, err
+	}
+	return p.Wrap(ctx, dek)
+}
+
+// FileKeyProvider is a KeyProvider storing key-encryption keys in a file,
+// which should only be readable by the owner. Every line of the file
+// contains a version number and a hex-encoded 256 bit AES key, separated by
+// a space. The key with the highest version is the current one. Data keys
+// are wrapped with AES-GCM.
+//
+// The file is read on every call, so keys rotated by other processes are
+// picked up. If the file does not exist, Rotate creates it.
+type FileKeyProvider struct {
+	// Path is the path of the key file.
+	Path string
+
+	mu sync.Mutex
+}
+
+// Wrap implements KeyProvider.
+func (p *FileKeyProvider) Wrap(ctx context.Context, dek []byte) ([]byte, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	keys, cur, err := p.load()
+	if err != nil {
+		return nil, err
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("%s: no keys, use Rotate to create one", p.Path)
+	}
+	return wrapKey(keys, cur, dek)
+}
+
+// Unwrap implements KeyProvider.
+func (p *FileKeyProvider) Unwrap(ctx context.Context, wrapped []byte) ([]byte, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	keys, _, err := p.load()
+	if err != nil {
+		return nil, err
+	}
+	return unwrapKey(p.Path, keys, wrapped)
+}
+
+// Rotate implements KeyProvider. It appends a new random key to the file.
+func (p *FileKeyProvider) Rotate(ctx context.Context) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	keys, cur, err := p.load()
+	if err != nil {
+		return err
+	}
+	k := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, k); err != nil {
+		return err
+	}
+	v := cur + 1
+	if len(keys) == 0 {
+		v = 1
+	}
+	f, err := os.OpenFile(p.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(f, "%d %x\n", v, k); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// load reads the key file and returns all keys by version and the current
+// version. A missing file contains no keys.
+func (p *FileKeyProvider) load() (map[uint32][]byte, uint32, error) {
+	keys := make(map[uint32][]byte)
+	f, err := os.Open(p.Path)
+	if os.IsNotExist(err) {
+		return keys, 0, nil
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	defer f.Close()
+	var cur uint32
+	s := bufio.NewScanner(f)
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, 0, fmt.Errorf("%s:%d: invalid line", p.Path, n)
+		}
+		v, err := strconv.ParseUint(fields[0], 10, 32)
+		if err != nil {
+			return nil, 0, fmt.Errorf("%s:%d: invalid version %q", p.Path, n, fields[0])
+		}
+		k, err := hex.DecodeString(fields[1])
+		if err != nil || len(k) != 32 {
+			return nil, 0, fmt.Errorf("%s:%d: invalid key", p.Path, n)
+		}
+		keys[uint32(v)] = k
+		if uint32(v) > cur {
+			cur = uint32(v)
+		}
+	}
+	return keys, cur, s.Err()
+}
+
+// wrapKey wraps dek with AES-GCM, using the key with version cur of keys. The
+// version is prepended to the result.
+func wrapKey(keys map[uint32][]byte, cur uint32, dek []byte) ([]byte, error) {
+	aead, err := newGCM(keys[cur])
+	if err != nil {
+		return nil, err
+	}
+	out := make([]byte, 4+aead.NonceSize(), 4+aead.NonceSize()+len(dek)+aead.Overhead())
+	binary.BigEndian.PutUint32(out, cur)
+	if _, err := io.ReadFull(rand.Reader, out[4:]); err != nil {
+		return nil, err
+	}
+	return aead.Seal(out, out[4:], dek, out[:4]), nil
+}
+
+// unwrapKey unwraps a key wrapped by wrapKey. src describes where keys came
+// from, for error messages.
+func unwrapKey(src string, keys map[uint32][]byte, wrapped []byte) ([]byte, error) {
+	if len(wrapped) < 4 {
+		return nil, errors.New("invalid wrapped key")
+	}
+	v := binary.BigEndian.Uint32(wrapped)
+	k, ok := keys[v]
+	if !ok {
+		return nil, fmt.Errorf("%s: no key with version %d", src, v)
+	}
+	aead, err := newGCM(k)
+	if err != nil {
+		return nil, err
+	}
+	if len(wrapped) < 4+aead.NonceSize() {
+		return nil, errors.New("invalid wrapped key")
+	}
+	nonce := wrapped[4 : 4+aead.NonceSize()]
+	dek, err := aead.Open(nil, nonce, wrapped[4+aead.NonceSize():], wrapped[:4])
+	if err != nil {
+		return nil, fmt.Errorf("could not unwrap key: %v", err)
+	}
+	return dek, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	b, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(b)
+}
+
+// EnvKeyProvider is a KeyProvider using a single key-encryption key from an
+// environment variable, containing a hex-encoded 256 bit AES key (as in the
+// lines of a FileKeyProvider). It uses the same format as a FileKeyProvider,
+// with the key as version 1. Keys can not be rotated.
+type EnvKeyProvider struct {
+	// Name is the name of the environment variable.
+	Name string
+}
+
+func (p *EnvKeyProvider) keys() (map[uint32][]byte, error) {
+	v, ok := os.LookupEnv(p.Name)
+	if !ok {
+		return nil, fmt.Errorf("$%s is not set", p.Name)
+	}
+	k, err := hex.DecodeString(strings.TrimSpace(v))
+	if err != nil || len(k) != 32 {
+		return nil, fmt.Errorf("$%s is not a hex-encoded 256 bit key", p.Name)
+	}
+	return map[uint32][]byte{1: k}, nil
+}
+
+// Wrap implements KeyProvider.
+func (p *EnvKeyProvider) Wrap(ctx context.Context, dek []byte) ([]byte, error) {
+	keys, err := p.keys()
+	if err != nil {
+		return nil, err
+	}
+	return wrapKey(keys, 1, dek)
+}
+
+// Unwrap implements KeyProvider.
+func (p *EnvKeyProvider) Unwrap(ctx context.Context, wrapped []byte) ([]byte, error) {
+	keys, err := p.keys()
+	if err != nil {
+		return nil, err
+	}
+	return unwrapKey("$"+p.Name, keys, wrapped)
+}
+
+// Rotate implements KeyProvider. It always fails.
+func (p *EnvKeyProvider) Rotate(ctx context.Context) error {
+	return errors.New("key rotation not supported")
+}
+
+// FuncKeyProvider is a KeyProvider calling functions, e.g. wrapping the
+// client library of a KMS.
+type FuncKeyProvider struct {
+	WrapFunc   func(ctx context.Context, dek []byte) ([]byte, error)
+	UnwrapFunc func(ctx context.Context, wrapped []byte) ([]byte, error)
+	// RotateFunc may be nil, if the KMS rotates keys itself. Rotate then
+	// returns an error.
+	RotateFunc func(ctx context.Context) error
+}
+
+// Wrap implements KeyProvider.
+func (p *FuncKeyProvider) Wrap(ctx context.Context, dek []byte) ([]byte, error) {
+	return p.WrapFunc(ctx, dek)
+}
+
+// Unwrap implements KeyProvider.
+func (p *FuncKeyProvider) Unwrap(ctx context.Context, wrapped []byte) ([]byte, error) {
+	return p.UnwrapFunc(ctx, wrapped)
+}
+
+// Rotate implements KeyProvider.
+func (p *FuncKeyProvider) Rotate(ctx context.Context) error {
+	if p.RotateFunc == nil {
+		return errors.New("key rotation not supported")
+	}
+	return p.RotateFunc(ctx)
+}
+
+// ExecKeyProvider is a KeyProvider delegating to external commands, e.g.
+// the CLI of a KMS or a script talking to an HSM. Each command is given as
+// the program and its arguments. Wrap and Unwrap get their input on stdin
+// and must write their result to stdout. The commands are run with the
+// context passed to the methods.
+type ExecKeyProvider struct {
+	WrapCommand   []string
+	UnwrapCommand []string
+	// RotateCommand may be empty, if the KMS rotates keys itself. Rotate
+	// then returns an error.
+	RotateCommand []string
+}
+
+// Wrap implements KeyProvider.
+func (p *ExecKeyProvider) Wrap(ctx context.Context, dek []byte) ([]byte, error) {
+	return runKeyCommand(ctx, p.WrapCommand, dek)
+}
+
+// Unwrap implements KeyProvider.
+func (p *ExecKeyProvider) Unwrap(ctx context.Context, wrapped []byte) ([]byte, error) {
+	return runKeyCommand(ctx, p.UnwrapCommand, wrapped)
+}
+
+// Rotate implements KeyProvider.
+func (p *ExecKeyProvider) Rotate(ctx context.Context) error {
+	if len(p.RotateCommand) == 0 {
+		return errors.New("key rotation not supported")
+	}
+	_, err := runKeyCommand(ctx, p.RotateCommand, nil)
+	return err
+}
+
+func runKeyCommand(ctx context.Context, argv []string, in []byte) ([]byte, error) {
+	if len(argv) == 0 {
+		return nil, errors.New("no key command given")
+	}
+	var out, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, argv[0], argv[1:]...)
+	cmd.Stdin = bytes.NewReader(in)
+	cmd.Stdout = &out
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("%s: %v: %s", argv[0], err, bytes.TrimSpace(stderr.Bytes()))
+	}
+	return out.Bytes(), nil
+}
@@ -0,0 +1,152 @@
+// Copyright 2018 Axel Wagner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nbd
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"sync/atomic"
+)
+
+var errExportRemoved = errors.New("export was removed")
+
+// snapshot returns the exports currently served and their state. The
+// returned slices must not be modified.
+func (s *Server) snapshot() ([]Export, []*exportState) {
+	s.once.Do(s.init)
+	s.emu.RLock()
+	defer s.emu.RUnlock()
+	return s.list, s.exports
+}
+
+// ListExports returns the exports currently served by s. The first one is
+// the default export. It is safe to call concurrently with serving.
+func (s *Server) ListExports() []Export {
+	list, _ := s.snapshot()
+	return append([]Export(nil), list...)
+}
+
+// AddExport adds e to the exports served by s. Clients can negotiate it from
+// then on. It returns an error, if s already serves an export of the same
+// name. It is safe to call concurrently with serving.
+func (s *Server) AddExport(e Export) error {
+	s.once.Do(s.init)
+	s.emu.Lock()
+	defer s.emu.Unlock()
+	for _, x := range s.list {
+		if x.Name == e.Name {
+			err := fmt.Errorf("export %q already exists", e.Name)
+			s.audit(nil, NewAuditEvent(AuditAddExport, e.Name, err))
+			return err
+		}
+	}
+	s.list = append(s.list[:len(s.list):len(s.list)], e)
+	s.exports = append(s.exports[:len(s.exports):len(s.exports)], newExportState(e))
+	s.audit(nil, NewAuditEvent(AuditAddExport, e.Name, nil))
+	return nil
+}
+
+// Resizer is an optional interface a Device can implement, to allow clients
+// to resize it with NBD_CMD_RESIZE (see FlagSendResize). Resize must change
+// the size of the Device to size, e.g. by truncating its backing file.
+type Resizer interface {
+	Resize(size uint64) error
+}
+
+// ResizeExport changes the size of the export with the given name, e.g. after
+// its Device was grown. Requests of connected clients are checked against the
+// new size from then on and new clients are told the new size. The protocol
+// has no way to notify connected clients, so they keep assuming the size
+// negotiated during their handshake, until they reconnect (for the kernel,
+// see LoopbackDevice.Resize). Clients can resize exports themselves, if the
+// Device implements Resizer. It is safe to call concurrently with serving.
+func (s *Server) ResizeExport(name string, size uint64) error {
+	s.once.Do(s.init)
+	s.emu.Lock()
+	defer s.emu.Unlock()
+	for i, x := range s.list {
+		if x.Name != name {
+			continue
+		}
+		list := append([]Export(nil), s.list...)
+		list[i].Size = size
+		s.list = list
+		atomic.StoreUint64(&s.exports[i].size, size)
+		s.auditResize(name, size, nil)
+		return nil
+	}
+	err := fmt.Errorf("export %q does not exist", name)
+	s.auditResize(name, size, err)
+	return err
+}
+
+// resizeState changes the size of the export with the state st to size. The
+// export might have been removed concurrently.
+func (s *Server) resizeState(st *exportState, size uint64) {
+	s.once.Do(s.init)
+	s.emu.Lock()
+	defer s.emu.Unlock()
+	atomic.StoreUint64(&st.size, size)
+	for i, x := range s.exports {
+		if x == st {
+			list := append([]Export(nil), s.list...)
+			list[i].Size = size
+			s.list = list
+			return
+		}
+	}
+}
+
+func (s *Server) auditResize(name string, size uint64, err error) {
+	e := NewAuditEvent(AuditResize, name, err)
+	e.Detail = "size=" + strconv.FormatUint(size, 10)
+	s.audit(nil, e)
+}
+
+// RemoveExport removes the export with the given name from s and disconnects
+// all clients using it. If the default export is removed, the next export
+// becomes the default. It is safe to call concurrently with serving.
+func (s *Server) RemoveExport(name string) error {
+	s.once.Do(s.init)
+	s.emu.Lock()
+	i := -1
+	for j, x := range s.list {
+		if x.Name == name {
+			i = j
+			break
+		}
+	}
+	if i < 0 {
+		s.emu.Unlock()
+		err := fmt.Errorf("export %q does not exist", name)
+		s.audit(nil, NewAuditEvent(AuditRemoveExport, name, err))
+		return err
+	}
+	st := s.exports[i]
+	s.list = append(append([]Export(nil), s.list[:i]...), s.list[i+1:]...)
+	s.exports = append(append([]*exportState(nil), s.exports[:i]...), s.exports[i+1:]...)
+	atomic.StoreInt32(&st.removed, 1)
+	s.emu.Unlock()
+	s.audit(nil, NewAuditEvent(AuditRemoveExport, name, nil))
+
+	s.conns.each(func(c *serverConn) {
+		if c.exp == st {
+			c.log.Info("disconnecting client of removed export")
+			c.cancel()
+		}
+	})
+	return nil
+}
@@ -0,0 +1,389 @@
+// Copyright 2018 Axel Wagner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package faultdev provides a Device injecting faults, to test how clients
+// and filesystems cope with misbehaving storage.
+//
+// A Device wraps an nbd.Device and applies a set of Rules to every read,
+// write and sync. A Rule matches operations of some types on a region of the
+// Device, with some probability, and then fails them with an error (e.g. EIO
+// or ENOSPC), delays them, tears writes (only a prefix is written before
+// failing) or silently drops writes. Rules can be added and removed while
+// the Device is in use, either with its methods or over HTTP using Handler,
+// e.g. on a unix domain socket:
+//
+//	d := faultdev.New(dev, 1)
+//	l, err := net.Listen("unix", "/run/faults.sock")
+//	go http.Serve(l, d.Handler())
+//	// curl --unix-socket /run/faults.sock -d '{"name":"bad","kind":"error","offset":4096,"length":4096}' http://faults/rules
+//
+// Unlike package crashtest, which freezes a Device to simulate a crash, and
+// package nbdsim, which uses a virtual clock, faultdev operates in real time
+// and the Device keeps working around the injected faults.
+package faultdev
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/Merovius/nbd"
+)
+
+// Op is the type of an operation on a Device.
+type Op string
+
+// Types of operations.
+const (
+	Read  Op = "read"
+	Write Op = "write"
+	Sync  Op = "sync"
+)
+
+// Kind is the kind of fault injected by a Rule.
+type Kind string
+
+// Kinds of faults.
+const (
+	// Error fails the operation with Rule.Errno, without executing it.
+	Error Kind = "error"
+	// Delay delays the operation by a duration drawn from Rule.Latency.
+	Delay Kind = "delay"
+	// Torn writes a random prefix of whole sectors of the data and fails
+	// the write with Rule.Errno, as if the Device lost power while writing.
+	Torn Kind = "torn"
+	// Drop reports the write as successful, without executing it.
+	Drop Kind = "drop"
+)
+
+// sectorSize is the granularity of torn writes.
+const sectorSize = 512
+
+// Dist is a probability distribution of latencies.
+type Dist string
+
+// Distributions of latencies.
+const (
+	// Fixed always returns Latency.Mean.
+	Fixed Dist = "fixed"
+	// Uniform returns latencies uniformly distributed in
+	// [Mean-Spread, Mean+Spread].
+	Uniform Dist = "uniform"
+	// Exponential returns exponentially distributed latencies with the
+	// given Mean, which models a long tail of slow operations.
+	Exponential Dist = "exponential"
+	// Normal returns normally distributed latencies with the given Mean and
+	// a standard deviation of Spread.
+	Normal Dist = "normal"
+)
+
+// Latency describes the latencies injected by a Delay Rule. Negative latencies
+// drawn are treated as zero.
+type Latency struct {
+	// Dist is the distribution. If it is empty, Fixed is used.
+	Dist   Dist          `json:"dist,omitempty"`
+	Mean   time.Duration `json:"mean"`
+	Spread time.Duration `json:"spread,omitempty"`
+}
+
+// draw returns a latency drawn from l.
+func (l Latency) draw(r *rand.Rand) time.Duration {
+	var d float64
+	switch l.Dist {
+	case Uniform:
+		d = float64(l.Mean) + (2*r.Float64()-1)*float64(l.Spread)
+	case Exponential:
+		d = r.ExpFloat64() * float64(l.Mean)
+	case Normal:
+		d = float64(l.Mean) + r.NormFloat64()*float64(l.Spread)
+	default:
+		d = float64(l.Mean)
+	}
+	if d < 0 {
+		return 0
+	}
+	return time.Duration(d)
+}
+
+// Rule describes a fault injected into matching operations.
+type Rule struct {
+	// Name identifies the Rule. It must be unique among the Rules of a
+	// Device.
+	Name string `json:"name"`
+	Kind Kind   `json:"kind"`
+	// Ops are the types of operations the Rule matches. If it is empty,
+	// all operations the Kind applies to match (Torn and Drop only apply
+	// to writes).
+	Ops []Op `json:"ops,omitempty"`
+	// Offset and Length are the region of the Device the Rule matches.
+	// Reads and writes match, if they overlap it. If Length is 0, the
+	// whole Device matches. Syncs match regardless of the region.
+	Offset int64 `json:"offset,omitempty"`
+	Length int64 `json:"length,omitempty"`
+	// Probability is the probability with which a matching operation is
+	// affected. If it is 0, all matching operations are.
+	Probability float64 `json:"probability,omitempty"`
+	// Count, if positive, is the number of operations affected, after
+	// which the Rule is removed.
+	Count int `json:"count,omitempty"`
+	// Errno is the error returned by Error and Torn Rules. If it is 0,
+	// nbd.EIO is used.
+	Errno nbd.Errno `json:"errno,omitempty"`
+	// Latency is the latency injected by Delay Rules.
+	Latency Latency `json:"latency"`
+}
+
+// validate returns an error, if r is invalid.
+func (r *Rule) validate() error {
+	if r.Name == "" {
+		return errors.New("rule has no name")
+	}
+	switch r.Kind {
+	case Error, Delay, Torn, Drop:
+	default:
+		return fmt.Errorf("rule %q has invalid kind %q", r.Name, r.Kind)
+	}
+	for _, op := range r.Ops {
+		switch op {
+		case Read, Write, Sync:
+		default:
+			return fmt.Errorf("rule %q has invalid op %q", r.Name, op)
+		}
+	}
+	switch r.Latency.Dist {
+	case "", Fixed, Uniform, Exponential, Normal:
+	default:
+		return fmt.Errorf("rule %q has invalid distribution %q", r.Name, r.Latency.Dist)
+	}
+	if r.Offset < 0 || r.Length < 0 || r.Probability < 0 || r.Probability > 1 {
+		return fmt.Errorf("rule %q has invalid region or probability", r.Name)
+	}
+	return nil
+}
+
+// matches returns whether r matches an operation of type op on length bytes
+// at off.
+func (r *Rule) matches(op Op, off int64, length int) bool {
+	if (r.Kind == Torn || r.Kind == Drop) && op != Write {
+		return false
+	}
+	if len(r.Ops) > 0 {
+		found := false
+		for _, o := range r.Ops {
+			found = found || o == op
+		}
+		if !found {
+			return false
+		}
+	}
+	if op == Sync || r.Length == 0 {
+		return true
+	}
+	return off < r.Offset+r.Length && r.Offset < off+int64(length)
+}
+
+// errno returns the error injected by r.
+func (r *Rule) errno() error {
+	if r.Errno == 0 {
+		return nbd.Errorf(nbd.EIO, "injected fault %q", r.Name)
+	}
+	return nbd.Errorf(r.Errno, "injected fault %q", r.Name)
+}
+
+// Stats counts the faults injected by a Device, by Rule name.
+type Stats map[string]uint64
+
+// Device wraps an nbd.Device and injects faults into operations matching its
+// Rules. It is safe for concurrent use, if the underlying Device is.
+type Device struct {
+	nbd.Device
+
+	mu    sync.Mutex
+	rand  *rand.Rand
+	rules []Rule
+	stats Stats
+}
+
+// New returns a Device wrapping d without any Rules. seed seeds the random
+// decisions of the Device, so a test can reproduce them.
+func New(d nbd.Device, seed int64) *Device {
+	return &Device{
+		Device: d,
+		rand:   rand.New(rand.NewSource(seed)),
+		stats:  make(Stats),
+	}
+}
+
+// Add adds r to the Rules of d. It fails, if r is invalid or d already has a
+// Rule of the same name.
+func (d *Device) Add(r Rule) error {
+	if err := r.validate(); err != nil {
+		return err
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, o := range d.rules {
+		if o.Name == r.Name {
+			return fmt.Errorf("rule %q already exists", r.Name)
+		}
+	}
+	r.Ops = append([]Op(nil), r.Ops...)
+	d.rules = append(d.rules, r)
+	return nil
+}
+
+// Remove removes the Rule with the given name and returns whether it existed.
+func (d *Device) Remove(name string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.remove(name)
+}
+
+// remove removes the Rule with the given name. d.mu must be held.
+func (d *Device) remove(name string) bool {
+	for i, r := range d.rules {
+		if r.Name == name {
+			d.rules = append(d.rules[:i:i], d.rules[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// Clear removes all Rules of d.
+func (d *Device) Clear() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.rules = nil
+}
+
+// Rules returns the Rules of d, in the order they were added. The Count of
+// each is the number of operations it still affects.
+func (d *Device) Rules() []Rule {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return append([]Rule(nil), d.rules...)
+}
+
+// Stats returns the number of faults injected by each Rule of d, including
+// removed ones.
+func (d *Device) Stats() Stats {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	st := make(Stats, len(d.stats))
+	for k, v := range d.stats {
+		st[k] = v
+	}
+	return st
+}
+
+// fault is the outcome of the Rules for an operation.
+type fault struct {
+	delay time.Duration
+	// err, if not nil, fails the operation.
+	err error
+	// drop is set, if a write should be dropped.
+	drop bool
+	// torn is the number of bytes of a torn write to execute, before
+	// failing with err.
+	torn int
+}
+
+// apply returns the faults injected into an operation of type op on length
+// bytes at off. Delays of all matching Rules add up; of the other Rules, the
+// first one affecting the operation wins.
+func (d *Device) apply(op Op, off int64, length int) fault {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var (
+		f    fault
+		done bool
+	)
+	for i := 0; i < len(d.rules); i++ {
+		r := &d.rules[i]
+		if (done && r.Kind != Delay) || !r.matches(op, off, length) {
+			continue
+		}
+		if r.Probability > 0 && d.rand.Float64() >= r.Probability {
+			continue
+		}
+		d.stats[r.Name]++
+		switch r.Kind {
+		case Delay:
+			f.delay += r.Latency.draw(d.rand)
+		case Error:
+			f.err, done = r.errno(), true
+		case Torn:
+			f.err, done = r.errno(), true
+			f.torn = d.rand.Intn(length/sectorSize+1) * sectorSize
+		case Drop:
+			f.drop, done = true, true
+		}
+		if r.Count > 0 {
+			if r.Count--; r.Count == 0 {
+				d.remove(r.Name)
+				i--
+			}
+		}
+	}
+	return f
+}
+
+// ReadAt implements nbd.Device.
+func (d *Device) ReadAt(p []byte, off int64) (int, error) {
+	f := d.apply(Read, off, len(p))
+	time.Sleep(f.delay)
+	if f.err != nil {
+		return 0, f.err
+	}
+	return d.Device.ReadAt(p, off)
+}
+
+// WriteAt implements nbd.Device.
+func (d *Device) WriteAt(p []byte, off int64) (int, error) {
+	f := d.apply(Write, off, len(p))
+	time.Sleep(f.delay)
+	switch {
+	case f.drop:
+		return len(p), nil
+	case f.err != nil:
+		if f.torn == 0 {
+			return 0, f.err
+		}
+		n, err := d.Device.WriteAt(p[:f.torn], off)
+		if err != nil {
+			return n, err
+		}
+		return n, f.err
+	}
+	return d.Device.WriteAt(p, off)
+}
+
+// Unwrap implements nbd.Unwrapper, so capabilities of the underlying Device
+// (like trims) are kept. They are not subject to the Rules.
+func (d *Device) Unwrap() nbd.Device {
+	return d.Device
+}
+
+// Sync implements nbd.Device.
+func (d *Device) Sync() error {
+	f := d.apply(Sync, 0, 0)
+	time.Sleep(f.delay)
+	if f.err != nil {
+		return f.err
+	}
+	return d.Device.Sync()
+}
@@ -0,0 +1,71 @@
+// Copyright 2018 Axel Wagner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package faultdev
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// Handler returns an http.Handler to control d at runtime, with JSON
+// encoded Rules:
+//
+//	GET    /rules              list the Rules
+//	POST   /rules              add the Rule in the body
+//	DELETE /rules?name=<name>  remove a Rule, or all without a name
+//	GET    /stats              the number of faults injected by each Rule
+//
+// Durations of latencies are given in nanoseconds.
+func (d *Device) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/rules", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			writeJSON(w, d.Rules())
+		case http.MethodPost:
+			var rule Rule
+			if err := json.NewDecoder(r.Body).Decode(&rule); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if err := d.Add(rule); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			w.WriteHeader(http.StatusCreated)
+		case http.MethodDelete:
+			name := r.FormValue("name")
+			if name == "" {
+				d.Clear()
+			} else if !d.Remove(name) {
+				http.Error(w, "rule not found", http.StatusNotFound)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+	mux.HandleFunc("/stats", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, d.Stats())
+	})
+	return mux
+}
+
+// writeJSON writes v as JSON to w.
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
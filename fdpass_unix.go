@@ -0,0 +1,131 @@
+// +build linux darwin
+
+// Copyright 2018 Axel Wagner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nbd
+
+import (
+	"io"
+	"net"
+	"os"
+	"sync"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// maxPassedFDs is the maximum number of fds passed in a single message
+// (SCM_MAX_FD on Linux).
+const maxPassedFDs = 253
+
+// FDListener returns a net.Listener, which returns connected sockets passed
+// over c by another process via SCM_RIGHTS (e.g. with SendConn). This allows
+// a privileged or socket-activating process to own the listening socket and
+// pass accepted connections on to a Server.
+//
+// Each message received on c can carry any number of sockets; its data is
+// ignored. Passed fds, which are not sockets, are closed and skipped. Accept
+// returns io.EOF once the other end of c is closed. Closing the Listener
+// closes c.
+func FDListener(c *net.UnixConn) net.Listener {
+	return &fdListener{c: c}
+}
+
+type fdListener struct {
+	c *net.UnixConn
+
+	mu      sync.Mutex
+	pending []int
+}
+
+func (l *fdListener) Accept() (net.Conn, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for {
+		for len(l.pending) > 0 {
+			fd := l.pending[0]
+			l.pending = l.pending[1:]
+			f := os.NewFile(uintptr(fd), "passed")
+			c, err := net.FileConn(f)
+			f.Close()
+			if err == nil {
+				return c, nil
+			}
+		}
+		if err := l.recv(); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// recv receives a message from c and adds all passed fds to l.pending.
+func (l *fdListener) recv() error {
+	var (
+		b   [1]byte
+		oob = make([]byte, unix.CmsgSpace(4*maxPassedFDs))
+	)
+	n, oobn, _, _, err := l.c.ReadMsgUnix(b[:], oob)
+	if err != nil {
+		return err
+	}
+	if n == 0 && oobn == 0 {
+		return io.EOF
+	}
+	msgs, err := unix.ParseSocketControlMessage(oob[:oobn])
+	if err != nil {
+		return err
+	}
+	for _, m := range msgs {
+		fds, err := unix.ParseUnixRights(&m)
+		if err != nil {
+			continue
+		}
+		l.pending = append(l.pending, fds...)
+	}
+	return nil
+}
+
+func (l *fdListener) Close() error {
+	err := l.c.Close()
+	l.mu.Lock()
+	for _, fd := range l.pending {
+		unix.Close(fd)
+	}
+	l.pending = nil
+	l.mu.Unlock()
+	return err
+}
+
+func (l *fdListener) Addr() net.Addr {
+	return l.c.LocalAddr()
+}
+
+// SendConn passes the socket of conn over c via SCM_RIGHTS, to be returned by
+// an FDListener at the other end. conn can be closed afterwards; the
+// receiving process keeps its own reference to the socket.
+func SendConn(c *net.UnixConn, conn syscall.Conn) error {
+	rc, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var serr error
+	cerr := rc.Control(func(fd uintptr) {
+		_, _, serr = c.WriteMsgUnix([]byte{0}, unix.UnixRights(int(fd)), nil)
+	})
+	if cerr != nil {
+		return cerr
+	}
+	return serr
+}
@@ -0,0 +1,39 @@
+// Copyright 2018 Axel Wagner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nbd
+
+// Flusher is an optional interface a Device can implement, to declare whether
+// it caches writes in volatile memory.
+//
+// By default, a Server assumes that it does: It advertises FlagSendFlush and
+// FlagSendFUA, calls Sync for NBD_CMD_FLUSH and after every write with
+// NBD_CMD_FLAG_FUA, and so guarantees that acknowledged flushes survive a
+// crash of the server. The kernel then enables its write cache for the
+// device and flushes it as requested by file systems.
+//
+// If NeedsFlush returns false, writes are persisted once WriteAt returns, so
+// neither flag is advertised and clients treat the device as write-through.
+type Flusher interface {
+	NeedsFlush() bool
+}
+
+// needsFlush returns whether d needs to be synced to persist writes.
+func needsFlush(d Device) bool {
+	var f Flusher
+	if As(d, &f) {
+		return f.NeedsFlush()
+	}
+	return true
+}
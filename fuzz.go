@@ -0,0 +1,105 @@
+// +build gofuzz
+
+// Copyright 2018 Axel Wagner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nbd
+
+// This file contains entry points for go-fuzz
+// (https://github.com/dvyukov/go-fuzz). Build with
+//
+//	go-fuzz-build -func FuzzHandshake github.com/Merovius/nbd
+//
+// and similarly for the other functions.
+
+import (
+	"bytes"
+	"io"
+)
+
+// fuzzConn reads from the fuzzer input and discards everything written.
+type fuzzConn struct {
+	io.Reader
+}
+
+func (fuzzConn) Write(p []byte) (int, error) {
+	return len(p), nil
+}
+
+var fuzzExports = []Export{
+	{Name: "foo", Description: "the foo export", Size: 1 << 20},
+	{Name: "bar", Size: 4096, BlockSizes: &BlockSizeConstraints{512, 4096, 1 << 16}},
+}
+
+// FuzzHandshake runs the server side of the handshake with data as the
+// messages sent by the client.
+func FuzzHandshake(data []byte) int {
+	if _, err := serverHandshake(fuzzConn{bytes.NewReader(data)}, fuzzExports, nil, false, nil); err != nil {
+		return 0
+	}
+	return 1
+}
+
+// FuzzOptionReply runs the client side of the handshake with data as the
+// replies sent by the server.
+func FuzzOptionReply(data []byte) int {
+	c := &Client{rw: fuzzConn{bytes.NewReader(data)}}
+	if _, err := c.List(); err != nil {
+		return 0
+	}
+	if _, err := c.Info("foo"); err != nil {
+		return 0
+	}
+	if _, err := c.Go(""); err != nil {
+		return 0
+	}
+	return 1
+}
+
+// FuzzRequest decodes data as a sequence of requests. The lowest bit of the
+// first byte selects extended headers.
+func FuzzRequest(data []byte) int {
+	if len(data) == 0 {
+		return 0
+	}
+	extended := data[0]&1 != 0
+	ret := 0
+	do(fuzzConn{bytes.NewReader(data[1:])}, func(e *encoder) {
+		for {
+			req := new(request)
+			err := req.decodeHeader(e, extended)
+			if derr := req.decodeData(e, nil); err == nil {
+				err = derr
+			}
+			if err == nil {
+				ret = 1
+			}
+		}
+	})
+	return ret
+}
+
+// FuzzStructuredReply decodes data as a sequence of structured and extended
+// replies.
+func FuzzStructuredReply(data []byte) int {
+	ret := 0
+	do(fuzzConn{bytes.NewReader(data)}, func(e *encoder) {
+		for {
+			if err := new(structuredReply).decode(e); err == nil {
+				ret = 1
+			}
+		}
+	})
+	return ret
+}
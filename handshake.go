@@ -16,43 +16,158 @@ package nbd
 
 import (
 	"context"
+	"crypto/tls"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
+	"log/slog"
 	"net"
+	"sort"
+	"time"
 )
 
 // Export specifies the data needed for the NBD network protocol.
 type Export struct {
+	// Name identifies the export in NBD_OPT_EXPORT_NAME and NBD_OPT_GO.
 	Name        string
 	Description string
-	Size        uint64
-	Flags       uint16 // TODO: Determine Flags from Device.
-	BlockSizes  *BlockSizeConstraints
-	Device      Device
+	// Size is the size of the export in bytes. A Server refuses requests
+	// exceeding it.
+	Size uint64
+	// Flags are the transmission flags of the export (see FlagReadOnly
+	// etc.). A Server always adds the flags for the commands it implements
+	// for Device, like FlagHasFlags and FlagSendFlush, so only flags
+	// describing the export itself need to be set. If FlagReadOnly is set,
+	// a Server refuses writes, trims and write zeroes with EPERM.
+	Flags      uint16
+	BlockSizes *BlockSizeConstraints
+	Device     Device
+
+	// Concurrency limits the number of requests executed concurrently against
+	// Device, across all connections. If Concurrency is 1, all requests are
+	// serialized, which is needed for Devices that are not safe for
+	// concurrent use. If it is <= 0, concurrency is not limited.
+	Concurrency int
+
+	// ACL, if not nil, restricts the clients a Server allows to use the
+	// export (see also Server.Authorizer). Denied clients do not see the
+	// export in the list of exports.
+	ACL *ACL
 }
 
 // BlockSizeConstraints optionally specifies possible block sizes for a given
-// export.
+// export. If Export.BlockSizes is nil, they are taken from the Device, if it
+// implements BlockSizer. A Server refuses reads and writes larger than 4MiB
+// with EOVERFLOW, so it never advertises a larger Max.
 type BlockSizeConstraints struct {
 	Min       uint32
 	Preferred uint32
 	Max       uint32
 }
 
-var defaultBlockSizes = BlockSizeConstraints{1, 4096, 0xffffffff}
+var defaultBlockSizes = BlockSizeConstraints{1, 4096, maxPayload}
+
+// Transmission flags of an export.
+const (
+	FlagHasFlags        uint16 = 1 << 0
+	FlagReadOnly        uint16 = 1 << 1
+	FlagSendFlush       uint16 = 1 << 2
+	FlagSendFUA         uint16 = 1 << 3
+	FlagRotational      uint16 = 1 << 4
+	FlagSendTrim        uint16 = 1 << 5
+	FlagSendWriteZeroes uint16 = 1 << 6
+	FlagSendDF          uint16 = 1 << 7
+	FlagCanMultiConn    uint16 = 1 << 8
+	FlagSendResize      uint16 = 1 << 9
+	FlagSendCache       uint16 = 1 << 10
+	FlagSendFastZero    uint16 = 1 << 11
+)
+
+// serverFlags returns the transmission flags a Server sends for e, on a
+// connection which negotiated structured replies, if structured is set.
+func serverFlags(e Export, structured bool) uint16 {
+	f := e.Flags | FlagHasFlags | FlagSendWriteZeroes
+	if needsFlush(e.Device) {
+		f |= FlagSendFlush | FlagSendFUA
+	}
+	if structured {
+		f |= FlagSendDF
+	}
+	var t Trimmer
+	if As(e.Device, &t) {
+		f |= FlagSendTrim
+	}
+	var r Resizer
+	if As(e.Device, &r) && e.Flags&FlagReadOnly == 0 {
+		f |= FlagSendResize
+	}
+	return f
+}
 
 type connParameters struct {
 	Export     Export
 	BlockSizes BlockSizeConstraints
+	// index is the index of Export in the list of exports served.
+	index int
+	// tls is the connection upgraded by NBD_OPT_STARTTLS. It is nil, if TLS
+	// was not negotiated.
+	tls *tls.Conn
+	// structured is set, if the client negotiated structured replies.
+	structured bool
+	// extended is set, if the client negotiated extended headers. It
+	// implies structured.
+	extended bool
+	// meta are the metadata contexts the client negotiated for Export.
+	meta []metaContext
 }
 
-func serverHandshake(rw io.ReadWriter, exp []Export) (connParameters, error) {
+// serverHandshake runs the server side of the handshake over rw. If tc is not
+// nil and rw is a net.Conn, clients can upgrade the connection with
+// NBD_OPT_STARTTLS. If tlsRequired is set, all options but NBD_OPT_STARTTLS
+// and NBD_OPT_ABORT are refused, until TLS has been negotiated. If auth is
+// not nil, it decides the access to each export. As it needs the connection,
+// the handshake fails if rw is not a net.Conn, instead of granting access
+// without asking auth.
+func serverHandshake(rw io.ReadWriter, exp []Export, tc *tls.Config, tlsRequired bool, auth func(net.Conn, Export) (Access, error)) (connParameters, error) {
 	parms := connParameters{
 		BlockSizes: defaultBlockSizes,
 	}
-	return parms, do(rw, func(e *encoder) {
+	conn, ok := rw.(net.Conn)
+	if !ok {
+		if auth != nil {
+			return parms, errors.New("cannot authorize connection which is not a net.Conn")
+		}
+		tc = nil
+	}
+	// access returns the access of the client to exp[i], using the TLS
+	// connection once it was upgraded, so auth can inspect its certificate.
+	access := func(e *encoder, i int) Access {
+		if auth == nil {
+			return AccessReadWrite
+		}
+		c := conn
+		if parms.tls != nil {
+			c = parms.tls
+		}
+		a, err := auth(c, exp[i])
+		e.check(err)
+		return a
+	}
+	// export sets parms.Export to exp[i], as the client is allowed to use it.
+	export := func(i int, a Access) {
+		parms.index = i
+		parms.Export = exp[i]
+		if a == AccessReadOnly {
+			parms.Export.Flags |= FlagReadOnly
+		}
+		parms.Export.Flags = serverFlags(parms.Export, parms.structured)
+	}
+	// metaIndex is the index of the export the metadata contexts meta were
+	// selected for with NBD_OPT_SET_META_CONTEXT, or -1.
+	metaIndex := -1
+	var meta []metaContext
+	err := do(rw, func(e *encoder) {
 		e.writeUint64(nbdMagic)
 		e.writeUint64(optMagic)
 		e.writeUint16(flagDefaults)
@@ -71,13 +186,32 @@ func serverHandshake(rw io.ReadWriter, exp []Export) (connParameters, error) {
 				encodeReply(e, code, &repError{err, ""})
 				continue
 			}
+			if tlsRequired && parms.tls == nil {
+				switch o.(type) {
+				case *optStartTLS, *optAbort:
+				case *optExportName:
+					// See below, there is no error reply to NBD_OPT_EXPORT_NAME.
+					e.check(errors.New("client requested export without TLS"))
+				default:
+					encodeReply(e, code, &repError{errTLSReqd, ""})
+					continue
+				}
+			}
 			switch o := o.(type) {
 			case *optExportName:
-				var ok bool
-				parms.Export, ok = findExport(o.name, exp)
+				idx, ok := findExport(o.name, exp)
 				if !ok {
-					encodeReply(e, code, &repError{errUnknown, ""})
-					continue
+					// NBD_OPT_EXPORT_NAME has no error reply, so the only
+					// way to refuse it is to close the connection.
+					e.check(fmt.Errorf("client requested unknown export %q", o.name))
+				}
+				a := access(e, idx)
+				if a == AccessDenied {
+					e.check(fmt.Errorf("client denied access to export %q", o.name))
+				}
+				export(idx, a)
+				if metaIndex == parms.index {
+					parms.meta = meta
 				}
 				e.writeUint64(parms.Export.Size)
 				e.writeUint16(parms.Export.Flags)
@@ -86,17 +220,82 @@ func serverHandshake(rw io.ReadWriter, exp []Export) (connParameters, error) {
 				encodeReply(e, code, &repAck{})
 				e.check(errors.New("client aborted negotiation"))
 			case *optList:
-				for _, ex := range exp {
-					encodeReply(e, code, &repServer{ex.Name, ""})
+				for i, ex := range exp {
+					if access(e, i) != AccessDenied {
+						encodeReply(e, code, &repServer{ex.Name, ex.Description})
+					}
+				}
+				encodeReply(e, code, &repAck{})
+			case *optStartTLS:
+				if tc == nil {
+					encodeReply(e, code, &repError{errUnsup, ""})
+					continue
+				}
+				if parms.tls != nil {
+					encodeReply(e, code, &repError{errInvalid, ""})
+					continue
+				}
+				encodeReply(e, code, &repAck{})
+				t := tls.Server(conn, tc)
+				if err := t.Handshake(); err != nil {
+					e.check(fmt.Errorf("TLS handshake failed: %w", err))
+				}
+				parms.tls = t
+				e.rw = t
+				// Options negotiated in plain text must not carry over.
+				parms.structured, parms.extended = false, false
+				metaIndex = -1
+			case *optStructuredReply:
+				if parms.extended {
+					encodeReply(e, code, &repError{errExtHeaderReqd, ""})
+					continue
+				}
+				parms.structured = true
+				encodeReply(e, code, &repAck{})
+			case *optExtendedHeaders:
+				if parms.extended {
+					encodeReply(e, code, &repError{errInvalid, ""})
+					continue
+				}
+				parms.structured, parms.extended = true, true
+				encodeReply(e, code, &repAck{})
+			case *optMetaContext:
+				if o.set && !parms.structured {
+					encodeReply(e, code, &repError{errInvalid, ""})
+					continue
+				}
+				if o.set {
+					metaIndex, meta = -1, nil
+				}
+				idx, ok := findExport(o.name, exp)
+				if !ok {
+					encodeReply(e, code, &repError{errUnknown, ""})
+					continue
+				}
+				if access(e, idx) == AccessDenied {
+					encodeReply(e, code, &repError{errPolicy, ""})
+					continue
+				}
+				ms := metaContexts(exp[idx].Device, o.queries, !o.set)
+				if o.set && len(ms) > 0 {
+					metaIndex, meta = idx, ms
+				}
+				for _, m := range ms {
+					encodeReply(e, code, &repMetaContext{m.id, m.name})
 				}
 				encodeReply(e, code, &repAck{})
 			case *optInfo:
-				var ok bool
-				parms.Export, ok = findExport(o.name, exp)
+				idx, ok := findExport(o.name, exp)
 				if !ok {
 					encodeReply(e, code, &repError{errUnknown, ""})
 					continue
 				}
+				a := access(e, idx)
+				if a == AccessDenied {
+					encodeReply(e, code, &repError{errPolicy, ""})
+					continue
+				}
+				export(idx, a)
 				encodeReply(e, code, &infoExport{parms.Export.Size, parms.Export.Flags})
 				for _, r := range o.reqs {
 					switch r {
@@ -107,39 +306,61 @@ func serverHandshake(rw io.ReadWriter, exp []Export) (connParameters, error) {
 					case cInfoDescription:
 						encodeReply(e, code, &infoDescription{parms.Export.Description})
 					case cInfoBlockSize:
-						if parms.Export.BlockSizes == nil {
-							break
+						bs := defaultBlockSizes
+						if c := blockSizes(parms.Export); c != nil {
+							bs = *c
+						}
+						// Larger reads and writes are refused anyway.
+						if bs.Max == 0 || bs.Max > maxPayload {
+							bs.Max = maxPayload
 						}
 						if o.done {
-							parms.BlockSizes = *parms.Export.BlockSizes
+							parms.BlockSizes = bs
 						}
-						encodeReply(e, code, &infoBlockSize{
-							parms.BlockSizes.Min,
-							parms.BlockSizes.Preferred,
-							parms.BlockSizes.Max,
-						})
+						encodeReply(e, code, &infoBlockSize{bs.Min, bs.Preferred, bs.Max})
 					}
 				}
 				encodeReply(e, code, &repAck{})
 				if o.done {
+					if metaIndex == parms.index {
+						parms.meta = meta
+					}
 					return
 				}
 			}
 		}
 	})
+	return parms, err
 }
 
 // Client performs the client-side of the NBD network protocol handshake and
 // can be used to query information about the exports from a server.
 type Client struct {
+	// Logger is used to log unexpected, but recoverable, responses of the
+	// server. It is passed on to the Conn returned by Open, which also logs
+	// failed requests and connection errors. If it is nil, nothing is
+	// logged.
+	Logger *slog.Logger
+	// Observer, if not nil, is passed on to the Conn returned by Open and
+	// notified about every request it sends. RequestInfo.Conn is the ID of
+	// the Conn, which is also used in its logs.
+	Observer Observer
+
+	conn   net.Conn
 	rw     io.ReadWriter
 	closed bool
+	// meta are the metadata contexts selected for metaExport by
+	// SetMetaContext, by name.
+	metaExport string
+	meta       map[string]uint32
+	// extended is set, if extended headers were negotiated.
+	extended bool
 }
 
 // ClientHandshake starts the client-side of the NBD handshake over c.
 func ClientHandshake(ctx context.Context, c net.Conn) (*Client, error) {
 	rw := wrapConn(ctx, c)
-	cl := &Client{rw, false}
+	cl := &Client{conn: c, rw: rw}
 	return cl, do(rw, func(e *encoder) {
 		if e.uint64() != nbdMagic {
 			e.check(errors.New("invalid magic from server"))
@@ -185,6 +406,9 @@ func (c *Client) recv(e *encoder, code uint32) optionReply {
 	}
 	code = e.uint32()
 	length := e.uint32()
+	if length > maxOptionReplyLength {
+		e.check(errors.New("option reply too large"))
+	}
 	var rep optionReply
 	switch code {
 	case cRepAck:
@@ -193,6 +417,8 @@ func (c *Client) recv(e *encoder, code uint32) optionReply {
 		rep = new(repServer)
 	case cRepInfo:
 		return decodeInfo(e, length)
+	case cRepMetaContext:
+		rep = new(repMetaContext)
 	default:
 		if code&(1<<31) != 0 {
 			rep = &repError{errno: errno(code)}
@@ -222,9 +448,141 @@ func (c *Client) Abort() error {
 	})
 }
 
+// ErrNoTLS is returned by StartTLS, if the server does not support TLS. The
+// Client can still be used without TLS.
+var ErrNoTLS = errors.New("server does not support TLS")
+
+// StartTLS upgrades the connection to TLS, using config to configure the
+// client side. It must be called before any other option is requested, as
+// servers requiring TLS refuse them otherwise.
+//
+// If the server does not support TLS, StartTLS returns ErrNoTLS. For
+// opportunistic TLS, the handshake can then continue in plain text. For
+// mandatory TLS, the caller should Abort instead. Any other error is fatal for
+// the connection.
+func (c *Client) StartTLS(config *tls.Config) error {
+	rw, ok := c.rw.(*ctxRW)
+	if !ok {
+		return errors.New("TLS is not supported on this connection")
+	}
+	return do(c.rw, func(e *encoder) {
+		c.send(e, &optStartTLS{})
+		var rep optionReply
+		if err := do(c.rw, func(e *encoder) { rep = c.recv(e, cOptStartTLS) }); err != nil {
+			if re, ok := err.(*repError); ok && (re.errno == errUnsup || re.errno == errPolicy) {
+				err = ErrNoTLS
+			}
+			e.check(err)
+		}
+		if _, ok := rep.(*repAck); !ok {
+			e.check(errors.New("invalid response to starttls request"))
+		}
+		t := tls.Client(c.conn, config)
+		e.check(t.HandshakeContext(rw.ctx))
+		c.conn, rw.c = t, t
+	})
+}
+
+// StructuredReplies negotiates structured replies, which allow the server to
+// split large reads into chunks and to send holes instead of zeros. They only
+// affect Conns opened with Open, which handle both kinds of replies; the kernel
+// does not support them, so StructuredReplies must not be used before
+// Configure. It returns an error, if the server does not support them, in
+// which case c can still be used.
+func (c *Client) StructuredReplies() error {
+	return do(c.rw, func(e *encoder) {
+		c.send(e, &optStructuredReply{})
+		if _, ok := c.recv(e, cOptStructuredReply).(*repAck); !ok {
+			e.check(errors.New("invalid response to structured reply request"))
+		}
+	})
+}
+
+// ExtendedHeaders negotiates extended headers, which allow requests (other
+// than reads and writes) to cover more than 4GiB and imply structured replies.
+// Like StructuredReplies, they only affect Conns opened with Open and must not
+// be used before Configure. It returns an error, if the server does not
+// support them, in which case c can still be used.
+func (c *Client) ExtendedHeaders() error {
+	return do(c.rw, func(e *encoder) {
+		c.send(e, &optExtendedHeaders{})
+		if _, ok := c.recv(e, cOptExtendedHeaders).(*repAck); !ok {
+			e.check(errors.New("invalid response to extended headers request"))
+		}
+		c.extended = true
+	})
+}
+
+// ListMetaContexts returns the names of the metadata contexts the server
+// provides for the given export, that match queries. If no queries are given,
+// all contexts are returned.
+func (c *Client) ListMetaContexts(exportName string, queries ...string) ([]string, error) {
+	m, err := c.metaContexts(&optMetaContext{false, exportName, queries})
+	if err != nil {
+		return nil, err
+	}
+	return metaNames(m), nil
+}
+
+// SetMetaContext selects the metadata contexts named by queries for the given
+// export and returns the names of those the server supports. StructuredReplies
+// must be negotiated first. If the export is then opened with Open, the
+// returned Conn implements Extents with NBD_CMD_BLOCK_STATUS, if
+// MetaContextAllocation is selected, and DirtyExtents for the selected
+// qemu:dirty-bitmap: contexts.
+func (c *Client) SetMetaContext(exportName string, queries ...string) ([]string, error) {
+	m, err := c.metaContexts(&optMetaContext{true, exportName, queries})
+	if err != nil {
+		return nil, err
+	}
+	c.metaExport, c.meta = exportName, m
+	return metaNames(m), nil
+}
+
+// metaNames returns the sorted names of the metadata contexts in m.
+func metaNames(m map[string]uint32) []string {
+	var names []string
+	for n := range m {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// metaContexts sends o and returns the ids of the contexts in the reply, by
+// name.
+func (c *Client) metaContexts(o *optMetaContext) (map[string]uint32, error) {
+	m := make(map[string]uint32)
+	err := do(c.rw, func(e *encoder) {
+		c.send(e, o)
+		for {
+			switch rep := c.recv(e, o.code()).(type) {
+			case *repAck:
+				return
+			case *repMetaContext:
+				m[rep.name] = rep.id
+			default:
+				e.check(errors.New("invalid response to meta context request"))
+			}
+		}
+	})
+	return m, err
+}
+
 // List returns the names of exports the server is providing.
 func (c *Client) List() ([]string, error) {
+	exp, err := c.ListExports()
 	var list []string
+	for _, e := range exp {
+		list = append(list, e.Name)
+	}
+	return list, err
+}
+
+// ListExports returns the exports the server is providing. Only their Name and
+// Description are set; use Info to query the other fields.
+func (c *Client) ListExports() ([]Export, error) {
+	var list []Export
 	err := do(c.rw, func(e *encoder) {
 		c.send(e, &optList{})
 		for {
@@ -233,7 +591,7 @@ func (c *Client) List() ([]string, error) {
 			case *repAck:
 				return
 			case *repServer:
-				list = append(list, rep.name)
+				list = append(list, Export{Name: rep.name, Description: rep.details})
 			default:
 				e.check(errors.New("invalid response to list request"))
 			}
@@ -271,6 +629,9 @@ func (c *Client) info(exportName string, done bool) (Export, error) {
 					Preferred: rep.preferred,
 					Max:       rep.max,
 				}
+			case nil:
+				// Unknown information types must be ignored.
+				orDiscard(c.Logger).Debug("ignoring unknown info reply", "export", exportName)
 			default:
 				e.check(errors.New("invalid response to info request"))
 			}
@@ -287,27 +648,34 @@ func (c *Client) Info(exportName string) (Export, error) {
 
 // Go terminates the handshake phase of the NBD protocol, opening the export
 // identified by exportName. If exportName is the empty string, the default
-// export will be used. c should not be used after Go returns.
+// export will be used. c should not be used after Go returns. The connection
+// is then in transmission phase and can be passed to the kernel with
+// Configure; use Open instead to issue requests from Go.
 func (c *Client) Go(exportName string) (Export, error) {
 	ex, err := c.info(exportName, true)
 	c.closed = true
+	// The handshake sets deadlines on the connection, which must not
+	// affect its use in transmission phase.
+	if rw, ok := c.rw.(*ctxRW); ok {
+		rw.c.SetDeadline(time.Time{})
+	}
 	return ex, err
 }
 
-// findExport searches the list of exports for one with the given name. If name
-// is empty, it returns the first export. findExport performs a linear search,
-// so it doesn't scale to a large number of exports, but we assume for now that
-// that's not a practical problem.
-func findExport(name string, exp []Export) (Export, bool) {
+// findExport searches the list of exports for one with the given name and
+// returns its index. If name is empty, it returns the first export. findExport
+// performs a linear search, so it doesn't scale to a large number of exports,
+// but we assume for now that that's not a practical problem.
+func findExport(name string, exp []Export) (int, bool) {
 	if len(exp) > 0 && name == "" {
-		return exp[0], true
+		return 0, true
 	}
-	for _, e := range exp {
+	for i, e := range exp {
 		if e.Name == name {
-			return e, true
+			return i, true
 		}
 	}
-	return Export{}, false
+	return 0, false
 }
 
 // do wraps rw for easy en-/decoding of binary data. It creates an *encoder and
@@ -346,6 +714,11 @@ func (e *encoder) write(b []byte) {
 		e.buf = append(e.buf, b...)
 		return
 	}
+	if len(b) == 0 {
+		// Some connections (like net.Pipe) block on empty writes, until
+		// the other side reads.
+		return
+	}
 	_, err := e.rw.Write(b)
 	e.check(err)
 }
@@ -355,6 +728,9 @@ func (e *encoder) writeString(s string) {
 		e.buf = append(e.buf, s...)
 		return
 	}
+	if len(s) == 0 {
+		return
+	}
 	var err error
 	if sw, ok := e.rw.(interface{ WriteString(string) (int, error) }); ok {
 		_, err = sw.WriteString(s)
@@ -372,14 +748,14 @@ func (e *encoder) read(b []byte) {
 	e.check(err)
 }
 
-func (e *encoder) discard(n uint32) {
+func (e *encoder) discard(n uint64) {
 	buf := make([]byte, 512)
 	for n > 0 {
-		if n > uint32(len(buf)) {
+		if n < uint64(len(buf)) {
 			buf = buf[:n]
 		}
 		e.read(buf)
-		n -= uint32(len(buf))
+		n -= uint64(len(buf))
 	}
 }
 
@@ -0,0 +1,123 @@
+// Copyright 2018 Axel Wagner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nbd
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// HealthChecker is an optional interface a Device can implement, to report
+// whether its backend is reachable.
+type HealthChecker interface {
+	// CheckHealth returns an error, if the Device can currently not serve
+	// requests. It should return once ctx is done.
+	CheckHealth(ctx context.Context) error
+}
+
+// Health is the health of a Server, as reported by Server.Health.
+type Health struct {
+	// Healthy is true, if all exports are healthy.
+	Healthy bool `json:"healthy"`
+	// Exports contains the health of each export, keyed by name.
+	Exports map[string]ExportHealth `json:"exports"`
+}
+
+// ExportHealth is the health of a single export.
+type ExportHealth struct {
+	// Healthy is true, if the Device does not implement HealthChecker or
+	// its check succeeded.
+	Healthy bool `json:"healthy"`
+	// Error is the error returned by the health check, if any.
+	Error string `json:"error,omitempty"`
+	// Connections is the number of connections in transmission phase.
+	Connections int64 `json:"connections"`
+	// LastIO is the time the last request completed. It is the zero time,
+	// if no request was served yet.
+	LastIO time.Time `json:"last_io"`
+	// Requests is the number of requests served and Errors the number of
+	// those that failed.
+	Requests uint64 `json:"requests"`
+	Errors   uint64 `json:"errors"`
+}
+
+// Health checks the health of all exports of s concurrently. The health
+// checks of the Devices are cancelled, when ctx is done.
+func (s *Server) Health(ctx context.Context) Health {
+	list, states := s.snapshot()
+	h := Health{
+		Healthy: true,
+		Exports: make(map[string]ExportHealth, len(list)),
+	}
+	var (
+		wg sync.WaitGroup
+		mu sync.Mutex
+	)
+	for i, e := range list {
+		st := states[i]
+		c := st.counters.load()
+		eh := ExportHealth{
+			Healthy:     true,
+			Connections: c.Connections,
+			Requests:    c.Requests,
+			Errors:      c.Errors,
+		}
+		if t := atomic.LoadInt64(&st.lastIO); t != 0 {
+			eh.LastIO = time.Unix(0, t)
+		}
+		var hc HealthChecker
+		if !As(e.Device, &hc) {
+			h.Exports[e.Name] = eh
+			continue
+		}
+		wg.Add(1)
+		go func(name string) {
+			defer wg.Done()
+			if err := hc.CheckHealth(ctx); err != nil {
+				eh.Healthy = false
+				eh.Error = err.Error()
+			}
+			mu.Lock()
+			h.Exports[name] = eh
+			h.Healthy = h.Healthy && eh.Healthy
+			mu.Unlock()
+		}(e.Name)
+	}
+	wg.Wait()
+	return h
+}
+
+// healthTimeout is the timeout for health checks done by HealthHandler.
+const healthTimeout = 5 * time.Second
+
+// HealthHandler returns an http.Handler reporting the Health of s as JSON.
+// It responds with status 200 if s is healthy and 503 otherwise, so it can be
+// used for liveness and readiness probes (e.g. by Kubernetes).
+func (s *Server) HealthHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), healthTimeout)
+		defer cancel()
+		h := s.Health(ctx)
+		w.Header().Set("Content-Type", "application/json")
+		if !h.Healthy {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		json.NewEncoder(w).Encode(h)
+	})
+}
@@ -0,0 +1,268 @@
+// Copyright 2018 Axel Wagner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package httprange implements a read-only Device reading a remote image with
+// HTTP range requests. This allows serving a raw image from any web server
+// supporting them, or from an object store via a presigned URL, without
+// copying it first:
+//
+//	d, err := httprange.Open(ctx, "https://example.com/disk.img", nil)
+//	if err != nil {
+//		return err
+//	}
+//	defer d.Close()
+//	srv.AddExport(nbd.Export{
+//		Name:   "disk",
+//		Size:   d.Size(),
+//		Flags:  nbd.FlagReadOnly,
+//		Device: d,
+//	})
+//
+// Reads are split into chunks of at most Options.ChunkSize bytes, which are
+// requested in parallel. Writes fail with EPERM.
+package httprange
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/Merovius/nbd"
+)
+
+// Default values of Options.
+const (
+	DefaultChunkSize = 1 << 20
+	DefaultParallel  = 4
+)
+
+// Options configures a Device.
+type Options struct {
+	// Client is used to issue requests. If it is nil, http.DefaultClient is
+	// used.
+	Client *http.Client
+	// Header is added to all requests, e.g. for authorization.
+	Header http.Header
+	// ChunkSize is the maximum size of a single range request. If it is <= 0,
+	// DefaultChunkSize is used.
+	ChunkSize int
+	// Parallel is the maximum number of range requests in flight for a
+	// single read. If it is <= 0, DefaultParallel is used.
+	Parallel int
+}
+
+// Device is a read-only Device, reading the resource at a URL with HTTP range
+// requests. It is safe for concurrent use.
+type Device struct {
+	url    string
+	client *http.Client
+	header http.Header
+	chunk  int
+	par    int
+	size   uint64
+
+	// ctx is cancelled by Close, aborting requests in flight.
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// Open returns a Device reading url. It determines the size of the resource
+// and checks, that the server supports range requests. opts may be nil.
+func Open(ctx context.Context, url string, opts *Options) (*Device, error) {
+	if opts == nil {
+		opts = new(Options)
+	}
+	d := &Device{
+		url:    url,
+		client: opts.Client,
+		header: opts.Header,
+		chunk:  opts.ChunkSize,
+		par:    opts.Parallel,
+	}
+	if d.client == nil {
+		d.client = http.DefaultClient
+	}
+	if d.chunk <= 0 {
+		d.chunk = DefaultChunkSize
+	}
+	if d.par <= 0 {
+		d.par = DefaultParallel
+	}
+	size, err := d.probe(ctx)
+	if err != nil {
+		return nil, err
+	}
+	d.size = size
+	d.ctx, d.cancel = context.WithCancel(context.Background())
+	return d, nil
+}
+
+// probe returns the size of the resource. A request for its first byte is
+// used instead of HEAD, as presigned URLs are often only valid for GET, and
+// the reply reveals both the size and whether ranges are supported.
+func (d *Device) probe(ctx context.Context) (uint64, error) {
+	resp, err := d.get(ctx, 0, 0)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		return parseContentRange(resp.Header.Get("Content-Range"))
+	case http.StatusRequestedRangeNotSatisfiable:
+		// The resource is empty.
+		return 0, nil
+	case http.StatusOK:
+		return 0, fmt.Errorf("%s: server does not support range requests", d.url)
+	default:
+		return 0, statusError(d.url, resp)
+	}
+}
+
+// parseContentRange returns the complete length of a Content-Range header,
+// like "bytes 0-0/1234".
+func parseContentRange(s string) (uint64, error) {
+	i := strings.LastIndexByte(s, '/')
+	if !strings.HasPrefix(s, "bytes ") || i < 0 {
+		return 0, fmt.Errorf("invalid Content-Range %q", s)
+	}
+	n, err := strconv.ParseUint(s[i+1:], 10, 63)
+	if err != nil {
+		return 0, fmt.Errorf("invalid Content-Range %q", s)
+	}
+	return n, nil
+}
+
+// get requests the bytes first to last (inclusive) of the resource.
+func (d *Device) get(ctx context.Context, first, last int64) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, d.url, nil)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range d.header {
+		req.Header[k] = v
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", first, last))
+	// Transparent compression would make the ranges refer to the compressed
+	// representation.
+	req.Header.Set("Accept-Encoding", "identity")
+	return d.client.Do(req)
+}
+
+func statusError(url string, resp *http.Response) error {
+	return fmt.Errorf("%s: unexpected status %s", url, resp.Status)
+}
+
+// Size returns the size of the resource.
+func (d *Device) Size() uint64 {
+	return d.size
+}
+
+// MaxIOSize implements nbd.MaxIOSizer, with the maximum size of a range
+// request.
+func (d *Device) MaxIOSize() int {
+	return d.chunk
+}
+
+// ReadAt implements nbd.Device.
+func (d *Device) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, nbd.Errorf(nbd.EINVAL, "negative offset")
+	}
+	if uint64(off) >= d.size {
+		return 0, io.EOF
+	}
+	var eof error
+	if rest := int64(d.size) - off; int64(len(p)) > rest {
+		p, eof = p[:rest], io.EOF
+	}
+
+	var (
+		wg    sync.WaitGroup
+		mu    sync.Mutex
+		first error
+		sem   = make(chan struct{}, d.par)
+	)
+	for i := 0; i < len(p); i += d.chunk {
+		b := p[i:]
+		if len(b) > d.chunk {
+			b = b[:d.chunk]
+		}
+		if len(b) == len(p) {
+			// Avoid the goroutine for reads fitting into a single chunk.
+			if err := d.readChunk(b, off); err != nil {
+				return 0, err
+			}
+			return len(p), eof
+		}
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(b []byte, off int64) {
+			defer func() { <-sem; wg.Done() }()
+			if err := d.readChunk(b, off); err != nil {
+				mu.Lock()
+				if first == nil {
+					first = err
+				}
+				mu.Unlock()
+			}
+		}(b, off+int64(i))
+	}
+	wg.Wait()
+	if first != nil {
+		return 0, first
+	}
+	return len(p), eof
+}
+
+// readChunk reads len(b) bytes at off with a single range request.
+func (d *Device) readChunk(b []byte, off int64) error {
+	resp, err := d.get(d.ctx, off, off+int64(len(b))-1)
+	if err != nil {
+		return nbd.Errorf(nbd.EIO, "%v", err)
+	}
+	defer resp.Body.Close()
+	// Servers may reply with the complete resource, if it was requested.
+	whole := resp.StatusCode == http.StatusOK && off == 0 && uint64(len(b)) == d.size
+	if resp.StatusCode != http.StatusPartialContent && !whole {
+		return nbd.Errorf(nbd.EIO, "%v", statusError(d.url, resp))
+	}
+	if _, err := io.ReadFull(resp.Body, b); err != nil {
+		return nbd.Errorf(nbd.EIO, "%s: %v", d.url, err)
+	}
+	return nil
+}
+
+// errReadOnly is returned by WriteAt.
+var errReadOnly = nbd.Errorf(nbd.EPERM, "httprange: device is read-only")
+
+// WriteAt implements nbd.Device. It always fails with EPERM.
+func (d *Device) WriteAt(p []byte, off int64) (int, error) {
+	return 0, errReadOnly
+}
+
+// Sync implements nbd.Device. It does nothing.
+func (d *Device) Sync() error {
+	return nil
+}
+
+// Close aborts all requests in flight. Reads fail afterwards.
+func (d *Device) Close() error {
+	d.cancel()
+	return nil
+}
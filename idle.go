@@ -0,0 +1,83 @@
+// Copyright 2018 Axel Wagner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nbd
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrIdle is returned by Server.Serve, if no connection was open for
+// Server.IdleTimeout.
+var ErrIdle = errors.New("nbd: server idle")
+
+// idleTimer calls a function once no connection was open for a timeout.
+type idleTimer struct {
+	timeout time.Duration
+	t       *time.Timer
+
+	mu     sync.Mutex
+	active int
+	fired  bool
+}
+
+// newIdleTimer returns an idleTimer calling f after timeout, unless a
+// connection is opened before.
+func newIdleTimer(timeout time.Duration, f func()) *idleTimer {
+	it := &idleTimer{timeout: timeout}
+	it.t = time.AfterFunc(timeout, func() {
+		it.mu.Lock()
+		// The timer might have fired concurrently with open.
+		fire := it.active == 0 && !it.fired
+		if fire {
+			it.fired = true
+		}
+		it.mu.Unlock()
+		if fire {
+			f()
+		}
+	})
+	return it
+}
+
+// open records that a connection was opened.
+func (it *idleTimer) open() {
+	it.mu.Lock()
+	defer it.mu.Unlock()
+	it.active++
+	it.t.Stop()
+}
+
+// close records that a connection was closed, restarting the timer after the
+// last one.
+func (it *idleTimer) close() {
+	it.mu.Lock()
+	defer it.mu.Unlock()
+	if it.active--; it.active == 0 && !it.fired {
+		it.t.Reset(it.timeout)
+	}
+}
+
+// expired returns whether the timer fired.
+func (it *idleTimer) expired() bool {
+	it.mu.Lock()
+	defer it.mu.Unlock()
+	return it.fired
+}
+
+func (it *idleTimer) stop() {
+	it.t.Stop()
+}
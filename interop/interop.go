@@ -0,0 +1,410 @@
+// +build interop
+
+// Copyright 2018 Axel Wagner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package interop tests this package against other NBD implementations.
+//
+// The client is run against qemu-nbd and nbdkit and the server is exercised
+// by qemu-io and nbdinfo (from libnbd). Tools which are not installed are
+// skipped. As this requires external programs, the package is only built with
+// the interop build tag. From a test:
+//
+//	// +build interop
+//
+//	func TestInterop(t *testing.T) {
+//		interop.Test(t)
+//	}
+//
+// and run it with
+//
+//	go test -tags interop
+package interop
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"text/tabwriter"
+	"time"
+
+	"github.com/Merovius/nbd"
+)
+
+// exportName is the name of the export used in all tests.
+const exportName = "interop"
+
+// exportSize is the size of the export used in all tests.
+const exportSize = 1 << 20
+
+// Result is the outcome of a single interoperability check.
+type Result struct {
+	// Peer is the implementation tested against.
+	Peer string
+	// Check describes what was tested.
+	Check string
+	// Skipped is true, if Peer is not installed.
+	Skipped bool
+	// Err is the error of the check, if it failed.
+	Err error
+}
+
+// Matrix is a list of Results.
+type Matrix []Result
+
+// WriteTo writes m as a human readable table to w.
+func (m Matrix) WriteTo(w io.Writer) (int64, error) {
+	cw := &countWriter{w: w}
+	tw := tabwriter.NewWriter(cw, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "PEER\tCHECK\tRESULT")
+	for _, r := range m {
+		res := "ok"
+		switch {
+		case r.Skipped:
+			res = "skipped"
+		case r.Err != nil:
+			res = "FAIL: " + strings.Replace(r.Err.Error(), "\n", " ", -1)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", r.Peer, r.Check, res)
+	}
+	err := tw.Flush()
+	return cw.n, err
+}
+
+type countWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (w *countWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	w.n += int64(n)
+	return n, err
+}
+
+// check is a single interoperability check.
+type check struct {
+	peer string
+	// tool is the program required for the check.
+	tool string
+	name string
+	run  func(ctx context.Context, dir string) error
+}
+
+var checks = []check{
+	{"qemu-nbd", "qemu-nbd", "client list", clientList(qemuNBD)},
+	{"qemu-nbd", "qemu-nbd", "client info", clientInfo(qemuNBD)},
+	{"qemu-nbd", "qemu-nbd", "client go", clientGo(qemuNBD)},
+	{"nbdkit", "nbdkit", "client list", clientList(nbdkit)},
+	{"nbdkit", "nbdkit", "client info", clientInfo(nbdkit)},
+	{"nbdkit", "nbdkit", "client go", clientGo(nbdkit)},
+	{"qemu-io", "qemu-io", "server read/write", serverQemuIO},
+	{"libnbd", "nbdinfo", "server info", serverNBDInfo(false)},
+	{"libnbd", "nbdinfo", "server list", serverNBDInfo(true)},
+}
+
+// Run runs all checks and returns their results.
+func Run(ctx context.Context) Matrix {
+	var m Matrix
+	for _, c := range checks {
+		r := Result{Peer: c.peer, Check: c.name}
+		if _, err := exec.LookPath(c.tool); err != nil {
+			r.Skipped = true
+			m = append(m, r)
+			continue
+		}
+		dir, err := os.MkdirTemp("", "nbd-interop")
+		if err != nil {
+			r.Err = err
+			m = append(m, r)
+			continue
+		}
+		cctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+		r.Err = c.run(cctx, dir)
+		cancel()
+		os.RemoveAll(dir)
+		m = append(m, r)
+	}
+	return m
+}
+
+// Test runs all checks as subtests of t and logs the resulting matrix.
+func Test(t *testing.T) {
+	var (
+		mu sync.Mutex
+		m  Matrix
+	)
+	for _, c := range checks {
+		c := c
+		t.Run(c.peer+"/"+strings.Replace(c.name, " ", "_", -1), func(t *testing.T) {
+			r := Result{Peer: c.peer, Check: c.name}
+			defer func() {
+				mu.Lock()
+				m = append(m, r)
+				mu.Unlock()
+			}()
+			if _, err := exec.LookPath(c.tool); err != nil {
+				r.Skipped = true
+				t.Skipf("%s not installed", c.tool)
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			defer cancel()
+			if r.Err = c.run(ctx, t.TempDir()); r.Err != nil {
+				t.Error(r.Err)
+			}
+		})
+	}
+	var b strings.Builder
+	m.WriteTo(&b)
+	t.Log("\n" + b.String())
+}
+
+// peer starts a foreign server listening on addr, using dir for temporary
+// files.
+type peer func(ctx context.Context, dir, addr string) (*exec.Cmd, error)
+
+func qemuNBD(ctx context.Context, dir, addr string) (*exec.Cmd, error) {
+	img := filepath.Join(dir, "disk.img")
+	if err := os.WriteFile(img, make([]byte, exportSize), 0644); err != nil {
+		return nil, err
+	}
+	host, port, _ := net.SplitHostPort(addr)
+	return start(ctx, "qemu-nbd", "--persistent", "--format=raw", "--export-name="+exportName, "--bind="+host, "--port="+port, img)
+}
+
+func nbdkit(ctx context.Context, dir, addr string) (*exec.Cmd, error) {
+	host, port, _ := net.SplitHostPort(addr)
+	return start(ctx, "nbdkit", "--foreground", "--exportname="+exportName, "--ipaddr="+host, "--port="+port, "memory", fmt.Sprint(exportSize))
+}
+
+// start starts a command, which is killed when ctx is done.
+func start(ctx context.Context, name string, args ...string) (*exec.Cmd, error) {
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Stderr = os.Stderr
+	return cmd, cmd.Start()
+}
+
+// freeAddr returns a local TCP address, which is currently unused.
+func freeAddr() (string, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", err
+	}
+	defer l.Close()
+	return l.Addr().String(), nil
+}
+
+// dial connects to addr, retrying until the server is up or ctx is done.
+func dial(ctx context.Context, addr string) (net.Conn, error) {
+	var d net.Dialer
+	for {
+		c, err := d.DialContext(ctx, "tcp", addr)
+		if err == nil {
+			return c, nil
+		}
+		select {
+		case <-ctx.Done():
+			return nil, err
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+}
+
+// withPeer starts p and calls f with a client connected to it.
+func withPeer(ctx context.Context, dir string, p peer, f func(*nbd.Client) error) error {
+	addr, err := freeAddr()
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	cmd, err := p(ctx, dir, addr)
+	if err != nil {
+		return err
+	}
+	defer cmd.Wait()
+	defer cancel()
+	c, err := dial(ctx, addr)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	cl, err := nbd.ClientHandshake(ctx, c)
+	if err != nil {
+		return fmt.Errorf("handshake: %v", err)
+	}
+	return f(cl)
+}
+
+func clientList(p peer) func(context.Context, string) error {
+	return func(ctx context.Context, dir string) error {
+		return withPeer(ctx, dir, p, func(cl *nbd.Client) error {
+			names, err := cl.List()
+			if err != nil {
+				return err
+			}
+			for _, n := range names {
+				if n == exportName {
+					return nil
+				}
+			}
+			return fmt.Errorf("List() = %q, want %q included", names, exportName)
+		})
+	}
+}
+
+func clientInfo(p peer) func(context.Context, string) error {
+	return func(ctx context.Context, dir string) error {
+		return withPeer(ctx, dir, p, func(cl *nbd.Client) error {
+			ex, err := cl.Info(exportName)
+			if err != nil {
+				return err
+			}
+			return checkExport(ex)
+		})
+	}
+}
+
+func clientGo(p peer) func(context.Context, string) error {
+	return func(ctx context.Context, dir string) error {
+		return withPeer(ctx, dir, p, func(cl *nbd.Client) error {
+			ex, err := cl.Go(exportName)
+			if err != nil {
+				return err
+			}
+			return checkExport(ex)
+		})
+	}
+}
+
+func checkExport(ex nbd.Export) error {
+	if ex.Size != exportSize {
+		return fmt.Errorf("export size is %d, want %d", ex.Size, exportSize)
+	}
+	return nil
+}
+
+// memDevice is a Device backed by memory.
+type memDevice struct {
+	mu  sync.Mutex
+	buf []byte
+}
+
+func (d *memDevice) ReadAt(p []byte, off int64) (int, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if off >= int64(len(d.buf)) {
+		return 0, io.EOF
+	}
+	n := copy(p, d.buf[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (d *memDevice) WriteAt(p []byte, off int64) (int, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if off+int64(len(p)) > int64(len(d.buf)) {
+		return 0, nbd.Errorf(nbd.ENOSPC, "write past end of device")
+	}
+	return copy(d.buf[off:], p), nil
+}
+
+func (d *memDevice) Sync() error {
+	return nil
+}
+
+// withServer starts a Server and calls f with its address.
+func withServer(ctx context.Context, f func(addr string) error) error {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return err
+	}
+	srv := &nbd.Server{
+		Exports: []nbd.Export{{
+			Name: exportName,
+			Size: exportSize,
+			Device: &memDevice{
+				buf: make([]byte, exportSize),
+			},
+		}},
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan error, 1)
+	go func() { done <- srv.Serve(ctx, l) }()
+	err = f(l.Addr().String())
+	cancel()
+	<-done
+	return err
+}
+
+// run runs a command and returns its output. If it fails, the output is
+// included in the error.
+func run(ctx context.Context, name string, args ...string) (string, error) {
+	out, err := exec.CommandContext(ctx, name, args...).CombinedOutput()
+	if err != nil {
+		return string(out), fmt.Errorf("%s: %v: %s", name, err, out)
+	}
+	return string(out), nil
+}
+
+func serverQemuIO(ctx context.Context, dir string) error {
+	return withServer(ctx, func(addr string) error {
+		out, err := run(ctx, "qemu-io", "-f", "raw",
+			"-c", "write -P 0x5a 4096 8192",
+			"-c", "read -P 0x5a 4096 8192",
+			"-c", "read -P 0 0 4096",
+			"-c", "flush",
+			"nbd://"+addr+"/"+exportName)
+		if err != nil {
+			return err
+		}
+		if strings.Contains(out, "Pattern verification failed") {
+			return errors.New("qemu-io: " + out)
+		}
+		return nil
+	})
+}
+
+func serverNBDInfo(list bool) func(context.Context, string) error {
+	return func(ctx context.Context, dir string) error {
+		return withServer(ctx, func(addr string) error {
+			args := []string{"nbd://" + addr + "/" + exportName}
+			if list {
+				args = []string{"--list", "nbd://" + addr}
+			}
+			out, err := run(ctx, "nbdinfo", args...)
+			if err != nil {
+				return err
+			}
+			if list && !strings.Contains(out, exportName) {
+				return fmt.Errorf("nbdinfo --list does not include %q: %s", exportName, out)
+			}
+			if !list && !strings.Contains(out, fmt.Sprint(exportSize)) {
+				return fmt.Errorf("nbdinfo does not report size %d: %s", exportSize, out)
+			}
+			return nil
+		})
+	}
+}
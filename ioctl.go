@@ -0,0 +1,134 @@
+// +build linux
+
+// Copyright 2018 Axel Wagner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nbd
+
+import (
+	"context"
+	"net"
+	"os"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// ioctls of the legacy NBD device interface (see linux/nbd.h).
+const (
+	ioctlSetSock    = 0xab00
+	ioctlSetBlksize = 0xab01
+	ioctlSetSize    = 0xab02
+	ioctlDoIt       = 0xab03
+	ioctlClearSock  = 0xab04
+	ioctlClearQue   = 0xab05
+	ioctlDisconnect = 0xab08
+	ioctlSetTimeout = 0xab09
+	ioctlSetFlags   = 0xab0a
+)
+
+func ioctl(f *os.File, req, arg uintptr) error {
+	_, _, errno := unix.Syscall(unix.SYS_IOCTL, f.Fd(), req, arg)
+	if errno != 0 {
+		return os.NewSyscallError("ioctl", errno)
+	}
+	return nil
+}
+
+// LoopbackFile is like Loopback, but connects d to the already opened NBD
+// device dev (i.e. /dev/nbdX), using the ioctl interface instead of netlink.
+// This allows a more privileged process to open the device and pass it on
+// (e.g. via SCM_RIGHTS), and it also works in network namespaces, in which
+// the netlink interface is not available. The process still needs
+// CAP_SYS_ADMIN. Of the LoopbackOptions, Connections and PartitionScan are
+// ignored.
+//
+// dev must not be closed while the device is connected. wait should be
+// called to check for errors from serving the device. It blocks until ctx is
+// cancelled or an error occurs; once ctx is cancelled, the device is
+// disconnected.
+//
+// This is a Linux-only API.
+func LoopbackFile(ctx context.Context, dev *os.File, d Device, size uint64, opts ...LoopbackOption) (wait func() error, err error) {
+	var o LoopbackOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+	sp, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_STREAM, 0)
+	if err != nil {
+		return nil, err
+	}
+	exp := loopbackExport(d, size, &o)
+
+	client, server := os.NewFile(uintptr(sp[0]), "client"), os.NewFile(uintptr(sp[1]), "server")
+	// The kernel keeps its own reference to the socket, once it is passed
+	// with NBD_SET_SOCK.
+	defer client.Close()
+	serverc, err := net.FileConn(server)
+	server.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	// Reset state left over by a previous user of the device.
+	ioctl(dev, ioctlClearSock, 0)
+	cmds := []struct{ req, arg uintptr }{
+		{ioctlSetBlksize, uintptr(exp.BlockSizes.Preferred)},
+		{ioctlSetSize, uintptr(size)},
+		{ioctlSetFlags, uintptr(exp.Flags)},
+		{ioctlSetSock, client.Fd()},
+	}
+	if o.Timeout > 0 {
+		cmds = append(cmds, struct{ req, arg uintptr }{ioctlSetTimeout, uintptr(o.Timeout / time.Second)})
+	}
+	for _, c := range cmds {
+		if err := ioctl(dev, c.req, c.arg); err != nil {
+			ioctl(dev, ioctlClearSock, 0)
+			serverc.Close()
+			return nil, err
+		}
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	ch := make(chan error, 1)
+	doIt := make(chan struct{})
+	go func() {
+		// NBD_DO_IT blocks until the device is disconnected.
+		defer close(doIt)
+		ioctl(dev, ioctlDoIt, 0)
+		ioctl(dev, ioctlClearQue, 0)
+		ioctl(dev, ioctlClearSock, 0)
+		cancel()
+	}()
+	go func() {
+		<-ctx.Done()
+		ioctl(dev, ioctlDisconnect, 0)
+	}()
+	go func() {
+		srv := &Server{Exports: []Export{exp}, Workers: o.Workers, Observer: o.Observer, RequestTimeout: o.RequestTimeout}
+		if o.Logger != nil {
+			srv.Logger = o.Logger.With("device", dev.Name())
+		}
+		_, states := srv.snapshot()
+		err := srv.serve(ctx, serverc, connParameters{Export: exp, BlockSizes: defaultBlockSizes}, states[0])
+		if e := ctx.Err(); e != nil {
+			err = e
+		}
+		cancel()
+		serverc.Close()
+		<-doIt
+		ch <- err
+	}()
+	return func() error { return <-ch }, nil
+}
@@ -0,0 +1,364 @@
+// Copyright 2018 Axel Wagner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package iotrace records the operations on a Device to a compact log and
+// replays them against another Device.
+//
+// A Recorder wraps a Device and appends an Entry for every read, write and
+// sync to a trace: the type of the operation, its offset, length, start time
+// and duration, whether it failed and, optionally, a hash or all of its
+// data. Replay re-issues the operations of a trace, either as fast as
+// possible or with their original timing, e.g. to benchmark a Device with a
+// production workload. If the trace contains data, Replay can also verify
+// that reads return what they returned when recorded, to reproduce
+// corruption reports:
+//
+//	f, err := os.Create("trace")
+//	rec, err := iotrace.Record(dev, f, &iotrace.Options{Data: true})
+//	// serve rec, until the corruption happens
+//	rec.Close()
+//	// later, against a copy of dev from before recording:
+//	f, err = os.Open("trace")
+//	res, err := iotrace.Replay(ctx, other, f, &iotrace.ReplayOptions{Verify: true})
+//
+// A trace starts with a header, followed by the entries:
+//
+//	magic     [8]byte  "NBDTRACE"
+//	version   uint8    1
+//	flags     uint8    flagHash, flagData
+//	start     int64    start of the trace in nanoseconds since the epoch
+//	entry:
+//		op        uint8    opRead, opWrite or opSync, plus opFailed
+//		start     uvarint  start of the operation in nanoseconds after
+//		                   the start of the trace
+//		duration  uvarint  in nanoseconds
+//		offset    uvarint
+//		length    uvarint
+//		hash      [8]byte  with flagHash, the first 8 bytes of the
+//		                   SHA-256 of the data read or written
+//		data      [length]byte
+//		                   with flagData, the data written
+//
+// Fixed size integers are big-endian.
+package iotrace
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/Merovius/nbd"
+)
+
+const (
+	magic   = "NBDTRACE"
+	version = 1
+)
+
+// Flags of a trace.
+const (
+	flagHash = 1 << 0
+	flagData = 1 << 1
+)
+
+// Op is the type of a traced operation.
+type Op uint8
+
+// Types of operations.
+const (
+	Read  Op = 1
+	Write Op = 2
+	Sync  Op = 3
+)
+
+// opFailed is set in the op byte of failed operations.
+const opFailed = 1 << 7
+
+func (o Op) String() string {
+	switch o {
+	case Read:
+		return "read"
+	case Write:
+		return "write"
+	case Sync:
+		return "sync"
+	default:
+		return fmt.Sprintf("Op(%d)", uint8(o))
+	}
+}
+
+// Entry is an operation in a trace.
+type Entry struct {
+	Op Op
+	// Start is the time since the start of the trace at which the
+	// operation started.
+	Start    time.Duration
+	Duration time.Duration
+	Offset   int64
+	Length   int64
+	// Failed is set, if the operation returned an error.
+	Failed bool
+	// Hash is the hash of the data read or written, if the trace contains
+	// hashes.
+	Hash [8]byte
+	// Data is the data written, if the trace contains data.
+	Data []byte
+}
+
+// Options configures what a Recorder records.
+type Options struct {
+	// Hash records a hash of the data of every read and write, which
+	// Replay can verify.
+	Hash bool
+	// Data records the data of every write, so Replay writes the same
+	// data. Otherwise, a pattern derived from the offset is written. It
+	// implies Hash.
+	Data bool
+}
+
+// Recorder is an nbd.Device, which records the operations on the underlying
+// Device. It is safe for concurrent use, if the underlying Device is.
+type Recorder struct {
+	nbd.Device
+
+	start time.Time
+	hash  bool
+	data  bool
+
+	mu sync.Mutex
+	w  *bufio.Writer
+	// err is the first error writing the trace.
+	err error
+}
+
+// Record returns a Recorder for d, writing the trace to w. opts may be nil,
+// to record neither hashes nor data.
+func Record(d nbd.Device, w io.Writer, opts *Options) (*Recorder, error) {
+	if opts == nil {
+		opts = new(Options)
+	}
+	r := &Recorder{
+		Device: d,
+		start:  time.Now(),
+		hash:   opts.Hash || opts.Data,
+		data:   opts.Data,
+		w:      bufio.NewWriter(w),
+	}
+	var h [18]byte
+	copy(h[:], magic)
+	h[8] = version
+	if r.hash {
+		h[9] |= flagHash
+	}
+	if r.data {
+		h[9] |= flagData
+	}
+	binary.BigEndian.PutUint64(h[10:], uint64(r.start.UnixNano()))
+	if _, err := r.w.Write(h[:]); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// ReadAt implements nbd.Device.
+func (r *Recorder) ReadAt(p []byte, off int64) (int, error) {
+	start := time.Now()
+	n, err := r.Device.ReadAt(p, off)
+	r.add(Read, start, off, p, err)
+	return n, err
+}
+
+// WriteAt implements nbd.Device.
+func (r *Recorder) WriteAt(p []byte, off int64) (int, error) {
+	start := time.Now()
+	n, err := r.Device.WriteAt(p, off)
+	r.add(Write, start, off, p, err)
+	return n, err
+}
+
+// Sync implements nbd.Device.
+func (r *Recorder) Sync() error {
+	start := time.Now()
+	err := r.Device.Sync()
+	r.add(Sync, start, 0, nil, err)
+	return err
+}
+
+// Unwrap implements nbd.Unwrapper, so capabilities of the underlying Device
+// (like trims) are kept. Operations using them are not recorded.
+func (r *Recorder) Unwrap() nbd.Device {
+	return r.Device
+}
+
+// add appends an entry for an operation on p at off to the trace.
+func (r *Recorder) add(op Op, start time.Time, off int64, p []byte, err error) {
+	e := Entry{
+		Op:       op,
+		Start:    start.Sub(r.start),
+		Duration: time.Since(start),
+		Offset:   off,
+		Length:   int64(len(p)),
+		Failed:   err != nil,
+	}
+	if r.hash && op != Sync {
+		e.Hash = hash(p)
+	}
+	if r.data && op == Write {
+		e.Data = p
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.err == nil {
+		r.err = r.encode(&e)
+	}
+}
+
+// encode writes e to the trace. r.mu must be held.
+func (r *Recorder) encode(e *Entry) error {
+	var b [1 + 4*binary.MaxVarintLen64 + 8]byte
+	b[0] = byte(e.Op)
+	if e.Failed {
+		b[0] |= opFailed
+	}
+	n := 1
+	for _, v := range []uint64{uint64(e.Start), uint64(e.Duration), uint64(e.Offset), uint64(e.Length)} {
+		n += binary.PutUvarint(b[n:], v)
+	}
+	if r.hash {
+		n += copy(b[n:], e.Hash[:])
+	}
+	if _, err := r.w.Write(b[:n]); err != nil {
+		return err
+	}
+	if r.data && e.Op == Write {
+		_, err := r.w.Write(e.Data)
+		return err
+	}
+	return nil
+}
+
+// Flush writes buffered entries to the underlying io.Writer. It returns the
+// first error writing the trace, if any; once writing failed, no more
+// entries are recorded.
+func (r *Recorder) Flush() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.err == nil {
+		r.err = r.w.Flush()
+	}
+	return r.err
+}
+
+// Close flushes the trace. It does not close the underlying Device or
+// io.Writer.
+func (r *Recorder) Close() error {
+	return r.Flush()
+}
+
+// hash returns the hash of p recorded in a trace.
+func hash(p []byte) [8]byte {
+	var h [8]byte
+	s := sha256.Sum256(p)
+	copy(h[:], s[:])
+	return h
+}
+
+// Reader reads the entries of a trace.
+type Reader struct {
+	// Start is the time the trace was started.
+	Start time.Time
+
+	r    *bufio.Reader
+	hash bool
+	data bool
+}
+
+// NewReader reads the header of the trace in r and returns a Reader for its
+// entries.
+func NewReader(r io.Reader) (*Reader, error) {
+	br := bufio.NewReader(r)
+	var h [18]byte
+	if _, err := io.ReadFull(br, h[:]); err != nil || string(h[:8]) != magic {
+		return nil, errors.New("iotrace: not a trace")
+	}
+	if h[8] != version {
+		return nil, fmt.Errorf("iotrace: unsupported version %d", h[8])
+	}
+	return &Reader{
+		r:     br,
+		Start: time.Unix(0, int64(binary.BigEndian.Uint64(h[10:]))),
+		hash:  h[9]&flagHash != 0,
+		data:  h[9]&flagData != 0,
+	}, nil
+}
+
+// HasHashes returns whether the entries of the trace contain hashes.
+func (r *Reader) HasHashes() bool {
+	return r.hash
+}
+
+// HasData returns whether the write entries of the trace contain data.
+func (r *Reader) HasData() bool {
+	return r.data
+}
+
+// Next returns the next entry of the trace. At the end of the trace, it
+// returns io.EOF.
+func (r *Reader) Next() (Entry, error) {
+	var e Entry
+	op, err := r.r.ReadByte()
+	if err != nil {
+		return e, err
+	}
+	e.Op, e.Failed = Op(op&^opFailed), op&opFailed != 0
+	if e.Op < Read || e.Op > Sync {
+		return e, fmt.Errorf("iotrace: invalid op %d", op)
+	}
+	var v [4]uint64
+	for i := range v {
+		if v[i], err = binary.ReadUvarint(r.r); err != nil {
+			return e, unexpected(err)
+		}
+	}
+	e.Start, e.Duration = time.Duration(v[0]), time.Duration(v[1])
+	e.Offset, e.Length = int64(v[2]), int64(v[3])
+	if e.Offset < 0 || e.Length < 0 {
+		return e, errors.New("iotrace: invalid entry")
+	}
+	if r.hash {
+		if _, err := io.ReadFull(r.r, e.Hash[:]); err != nil {
+			return e, unexpected(err)
+		}
+	}
+	if r.data && e.Op == Write {
+		e.Data = make([]byte, e.Length)
+		if _, err := io.ReadFull(r.r, e.Data); err != nil {
+			return e, unexpected(err)
+		}
+	}
+	return e, nil
+}
+
+// unexpected turns io.EOF into io.ErrUnexpectedEOF, for truncated entries.
+func unexpected(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
@@ -0,0 +1,171 @@
+// Copyright 2018 Axel Wagner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iotrace
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Merovius/nbd"
+)
+
+// ReplayOptions configures Replay.
+type ReplayOptions struct {
+	// Speed, if positive, replays the operations with their original
+	// timing, sped up by this factor (e.g. 2 replays twice as fast).
+	// Operations which overlapped when recorded are then issued
+	// concurrently. If it is 0, the operations are issued one after the
+	// other, in the order they completed when recorded, as fast as
+	// possible.
+	Speed float64
+	// Verify checks the data returned by reads against the hashes in the
+	// trace. This only makes sense, if the trace contains the data of
+	// writes and the Device starts with the contents the traced Device
+	// had.
+	Verify bool
+}
+
+// Mismatch is a read returning different data than when it was recorded.
+type Mismatch struct {
+	// Index is the index of the entry in the trace.
+	Index int
+	Entry Entry
+}
+
+// Result summarizes a replay.
+type Result struct {
+	// Ops is the number of operations replayed and Bytes the number of
+	// bytes read and written by them.
+	Ops   int
+	Bytes int64
+	// Errors is the number of operations which failed during the replay,
+	// but not when recorded.
+	Errors int
+	// Mismatches are the reads returning different data, ordered by
+	// Index.
+	Mismatches []Mismatch
+	Duration   time.Duration
+}
+
+// Replay reads the trace from r and re-issues its operations against d. It
+// stops early, if ctx is done or the trace can not be read, returning the
+// Result so far with the error.
+func Replay(ctx context.Context, d nbd.Device, r io.Reader, opts *ReplayOptions) (*Result, error) {
+	if opts == nil {
+		opts = new(ReplayOptions)
+	}
+	tr, err := NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	if opts.Verify && !tr.HasHashes() {
+		return nil, errors.New("iotrace: trace has no hashes to verify")
+	}
+	var (
+		res   = new(Result)
+		mu    sync.Mutex
+		wg    sync.WaitGroup
+		start = time.Now()
+	)
+	run := func(i int, e Entry) {
+		failed, mismatch := replay(d, &e, opts.Verify)
+		mu.Lock()
+		defer mu.Unlock()
+		res.Ops++
+		res.Bytes += e.Length
+		if failed && !e.Failed {
+			res.Errors++
+		}
+		if mismatch {
+			res.Mismatches = append(res.Mismatches, Mismatch{i, e})
+		}
+	}
+	for i := 0; ; i++ {
+		e, rerr := tr.Next()
+		if rerr == io.EOF {
+			break
+		}
+		if rerr != nil {
+			err = rerr
+			break
+		}
+		if opts.Speed <= 0 {
+			if err = ctx.Err(); err != nil {
+				break
+			}
+			run(i, e)
+			continue
+		}
+		t := time.NewTimer(time.Until(start.Add(time.Duration(float64(e.Start) / opts.Speed))))
+		select {
+		case <-ctx.Done():
+			err = ctx.Err()
+		case <-t.C:
+		}
+		t.Stop()
+		if err != nil {
+			break
+		}
+		wg.Add(1)
+		go func(i int, e Entry) {
+			defer wg.Done()
+			run(i, e)
+		}(i, e)
+	}
+	wg.Wait()
+	res.Duration = time.Since(start)
+	sort.Slice(res.Mismatches, func(i, j int) bool { return res.Mismatches[i].Index < res.Mismatches[j].Index })
+	return res, err
+}
+
+// replay executes e on d. It returns whether the operation failed and, if
+// verify is set, whether a read returned data with a different hash than
+// recorded.
+func replay(d nbd.Device, e *Entry, verify bool) (failed, mismatch bool) {
+	switch e.Op {
+	case Read:
+		buf := make([]byte, e.Length)
+		_, err := d.ReadAt(buf, e.Offset)
+		if err != nil {
+			return true, false
+		}
+		return false, verify && !e.Failed && hash(buf) != e.Hash
+	case Write:
+		p := e.Data
+		if p == nil {
+			p = pattern(e.Offset, e.Length)
+		}
+		_, err := d.WriteAt(p, e.Offset)
+		return err != nil, false
+	default:
+		return d.Sync() != nil, false
+	}
+}
+
+// pattern returns length bytes to write at off, for traces without data:
+// every aligned 8 byte word is its offset, big-endian.
+func pattern(off, length int64) []byte {
+	b := make([]byte, length+16)
+	start := off &^ 7
+	for i := int64(0); i < int64(len(b))-8; i += 8 {
+		binary.BigEndian.PutUint64(b[i:], uint64(start+i))
+	}
+	return b[off-start : off-start+length]
+}
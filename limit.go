@@ -0,0 +1,156 @@
+// Copyright 2018 Axel Wagner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nbd
+
+import (
+	"sync"
+	"time"
+)
+
+// AdaptiveLimit configures an adaptive limit on the number of requests per
+// connection executed concurrently against the Device.
+//
+// The limit is tuned with AIMD: it grows by one for every limit requests
+// completing in time and is cut by Backoff whenever a request fails or is
+// slower than the threshold. This keeps the requests queued in the server,
+// where they can be cancelled, instead of in a slow backend, where they only
+// add to the tail latency.
+type AdaptiveLimit struct {
+	// Min and Max bound the limit. If Min is <= 0, 1 is used. If Max is <=
+	// 0, Server.Workers is used.
+	Min int
+	Max int
+	// Target is the latency above which requests are considered slow. If
+	// Target is <= 0, requests are considered slow if they take longer than
+	// Tolerance times the lowest recently observed latency. If Tolerance is
+	// <= 1, 2 is used.
+	Target    time.Duration
+	Tolerance float64
+	// Backoff is the factor the limit is multiplied with, when a request is
+	// slow or fails. If Backoff is not in (0,1), 0.9 is used.
+	Backoff float64
+}
+
+// limiterWindow is the number of samples after which the baseline latency of
+// a limiter is reset, so it tracks changes of the backend.
+const limiterWindow = 1000
+
+// limiter implements AdaptiveLimit for a single connection.
+type limiter struct {
+	cfg AdaptiveLimit
+
+	mu       sync.Mutex
+	cond     sync.Cond
+	limit    float64
+	inflight int
+	// lastCut is the number of samples since the limit was last decreased.
+	// The limit is decreased at most once per limit samples, so a burst of
+	// slow requests does not collapse it.
+	lastCut int
+	// base is the lowest latency in the current window and prevBase the one
+	// in the previous window.
+	base     time.Duration
+	prevBase time.Duration
+	samples  int
+}
+
+func newLimiter(cfg AdaptiveLimit, workers int) *limiter {
+	if cfg.Min <= 0 {
+		cfg.Min = 1
+	}
+	if cfg.Max <= 0 {
+		cfg.Max = workers
+	}
+	if cfg.Max < cfg.Min {
+		cfg.Max = cfg.Min
+	}
+	if cfg.Tolerance <= 1 {
+		cfg.Tolerance = 2
+	}
+	if cfg.Backoff <= 0 || cfg.Backoff >= 1 {
+		cfg.Backoff = 0.9
+	}
+	l := &limiter{
+		cfg:   cfg,
+		limit: float64(cfg.Max),
+	}
+	l.cond.L = &l.mu
+	return l
+}
+
+// acquire blocks until a request may be executed.
+func (l *limiter) acquire() {
+	l.mu.Lock()
+	for l.inflight >= int(l.limit) {
+		l.cond.Wait()
+	}
+	l.inflight++
+	l.mu.Unlock()
+}
+
+// release must be called when a request acquired with acquire is done,
+// with its latency and error.
+func (l *limiter) release(d time.Duration, err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.inflight--
+	l.cond.Signal()
+
+	l.samples++
+	if l.base == 0 || d < l.base {
+		l.base = d
+	}
+	if l.samples >= limiterWindow {
+		l.prevBase, l.base, l.samples = l.base, 0, 0
+	}
+	l.lastCut++
+
+	if err != nil || d > l.threshold() {
+		if float64(l.lastCut) >= l.limit {
+			l.limit *= l.cfg.Backoff
+			if l.limit < float64(l.cfg.Min) {
+				l.limit = float64(l.cfg.Min)
+			}
+			l.lastCut = 0
+		}
+		return
+	}
+	l.limit += 1 / l.limit
+	if l.limit > float64(l.cfg.Max) {
+		l.limit = float64(l.cfg.Max)
+	}
+	// The limit might have grown by one, so another request can proceed.
+	l.cond.Signal()
+}
+
+// threshold returns the latency above which a request is slow. l.mu must be
+// held.
+func (l *limiter) threshold() time.Duration {
+	if l.cfg.Target > 0 {
+		return l.cfg.Target
+	}
+	base := l.base
+	if l.prevBase != 0 && (base == 0 || l.prevBase < base) {
+		base = l.prevBase
+	}
+	return time.Duration(float64(base) * l.cfg.Tolerance)
+}
+
+// current returns the current limit.
+func (l *limiter) current() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return int(l.limit)
+}
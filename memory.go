@@ -0,0 +1,140 @@
+// Copyright 2018 Axel Wagner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nbd
+
+import (
+	"io"
+	"os"
+	"sync"
+)
+
+// MemDevice is a Device backed by anonymous memory, e.g. for tests or as
+// ephemeral scratch space. On Linux, memory is only allocated when it is
+// written and Trim and WriteZeroes release it again. MemDevice is safe for
+// concurrent use; the contents are lost on Close.
+type MemDevice struct {
+	// mu is held for reading by all operations and for writing by Close, so
+	// the memory is not released while it is in use.
+	mu  sync.RWMutex
+	buf []byte
+}
+
+// NewMemDevice returns a MemDevice of the given size, which reads as zeros.
+func NewMemDevice(size uint64) (*MemDevice, error) {
+	if int64(size) < 0 || uint64(int(size)) != size {
+		return nil, Errorf(EOVERFLOW, "size %d too large", size)
+	}
+	buf, err := allocMem(int(size))
+	if err != nil {
+		return nil, err
+	}
+	return &MemDevice{buf: buf}, nil
+}
+
+// errMemClosed is returned by a MemDevice after Close.
+var errMemClosed = Errorf(ESHUTDOWN, "MemDevice closed")
+
+// Size returns the size of d in bytes.
+func (d *MemDevice) Size() uint64 {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return uint64(len(d.buf))
+}
+
+// ReadAt implements Device.
+func (d *MemDevice) ReadAt(p []byte, off int64) (int, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if d.buf == nil {
+		return 0, errMemClosed
+	}
+	if off < 0 || off >= int64(len(d.buf)) {
+		return 0, io.EOF
+	}
+	n := copy(p, d.buf[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// WriteAt implements Device.
+func (d *MemDevice) WriteAt(p []byte, off int64) (int, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if d.buf == nil {
+		return 0, errMemClosed
+	}
+	if off < 0 || off+int64(len(p)) > int64(len(d.buf)) {
+		return 0, Errorf(ENOSPC, "write past end of device")
+	}
+	return copy(d.buf[off:], p), nil
+}
+
+// Sync implements Device. It does nothing.
+func (d *MemDevice) Sync() error {
+	return nil
+}
+
+// Trim implements Trimmer, releasing the memory of the range. It reads as
+// zeros afterwards.
+func (d *MemDevice) Trim(off, length int64) error {
+	return d.WriteZeroes(off, length, false)
+}
+
+// WriteZeroes implements ZeroWriter. The memory of whole pages in the range
+// is released, even if noHole is set, as it is allocated again on the next
+// write anyway.
+func (d *MemDevice) WriteZeroes(off, length int64, noHole bool) error {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if d.buf == nil {
+		return errMemClosed
+	}
+	if off < 0 || length < 0 || off+length > int64(len(d.buf)) {
+		return Errorf(ENOSPC, "write past end of device")
+	}
+	// Only whole pages can be released, the rest is cleared.
+	start := (off + pageSize - 1) / pageSize * pageSize
+	end := (off + length) / pageSize * pageSize
+	if start >= end || releaseMem(d.buf[start:end]) != nil {
+		zero(d.buf[off : off+length])
+		return nil
+	}
+	zero(d.buf[off:start])
+	zero(d.buf[end : off+length])
+	return nil
+}
+
+// pageSize is the granularity in which memory can be released.
+var pageSize = int64(os.Getpagesize())
+
+func zero(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
+
+// Close releases the memory of d.
+func (d *MemDevice) Close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.buf == nil {
+		return nil
+	}
+	err := freeMem(d.buf)
+	d.buf = nil
+	return err
+}
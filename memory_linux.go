@@ -0,0 +1,42 @@
+// +build linux
+
+// Copyright 2018 Axel Wagner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nbd
+
+import "golang.org/x/sys/unix"
+
+// allocMem returns n bytes of zeroed anonymous memory, which is only
+// allocated when written.
+func allocMem(n int) ([]byte, error) {
+	if n == 0 {
+		return []byte{}, nil
+	}
+	return unix.Mmap(-1, 0, n, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_PRIVATE|unix.MAP_ANONYMOUS|unix.MAP_NORESERVE)
+}
+
+// releaseMem releases the memory of the whole pages b, which read as zeros
+// afterwards.
+func releaseMem(b []byte) error {
+	return unix.Madvise(b, unix.MADV_DONTNEED)
+}
+
+// freeMem frees memory returned by allocMem.
+func freeMem(b []byte) error {
+	if len(b) == 0 {
+		return nil
+	}
+	return unix.Munmap(b)
+}
@@ -0,0 +1,33 @@
+// +build !linux
+
+// Copyright 2018 Axel Wagner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nbd
+
+// allocMem returns n bytes of zeroed memory.
+func allocMem(n int) ([]byte, error) {
+	return make([]byte, n), nil
+}
+
+// releaseMem clears b. The memory can not be released to the system.
+func releaseMem(b []byte) error {
+	zero(b)
+	return nil
+}
+
+// freeMem frees memory returned by allocMem.
+func freeMem(b []byte) error {
+	return nil
+}
@@ -0,0 +1,168 @@
+// Copyright 2018 Axel Wagner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package metrics exports Prometheus metrics for an nbd.Server.
+//
+// A Collector is both an nbd.Observer and a prometheus.Collector. To use it,
+// register it with a registry and set it as the Observer of a Server:
+//
+//	c := metrics.New()
+//	prometheus.MustRegister(c)
+//	srv := &nbd.Server{Exports: exp, Observer: c}
+//
+// It can also be set as the Observer of nbd.LoopbackOptions, to collect
+// metrics about the requests of the kernel to a loopback device.
+package metrics
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/Merovius/nbd"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Collector collects per-export metrics about requests processed by a
+// Server.
+type Collector struct {
+	requests *prometheus.CounterVec
+	bytes    *prometheus.CounterVec
+	inflight *prometheus.GaugeVec
+	errors   *prometheus.CounterVec
+	latency  *prometheus.HistogramVec
+	perConn  bool
+}
+
+// Options configures a Collector.
+type Options struct {
+	// PerConnection adds a "conn" label to all metrics but
+	// requests_in_flight, with the ID of the connection (see
+	// nbd.RequestInfo.Conn). As every connection creates new series, which
+	// are kept after it is closed, this is only suitable for servers with
+	// few, long-lived connections, like loopback devices.
+	PerConnection bool
+}
+
+// New returns a new Collector.
+func New() *Collector {
+	return NewWithOptions(nil)
+}
+
+// NewWithOptions returns a new Collector configured by opts. If opts is nil,
+// the defaults are used.
+func NewWithOptions(opts *Options) *Collector {
+	if opts == nil {
+		opts = new(Options)
+	}
+	// labels returns the given labels, plus "conn" if enabled.
+	labels := func(l ...string) []string {
+		if opts.PerConnection {
+			l = append(l, "conn")
+		}
+		return l
+	}
+	return &Collector{
+		perConn: opts.PerConnection,
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "nbd",
+			Name:      "requests_total",
+			Help:      "Number of requests received.",
+		}, labels("export", "command")),
+		bytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "nbd",
+			Name:      "bytes_total",
+			Help:      "Number of bytes affected by requests.",
+		}, labels("export", "command")),
+		inflight: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: "nbd",
+			Name:      "requests_in_flight",
+			Help:      "Number of requests currently being processed.",
+		}, []string{"export"}),
+		errors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "nbd",
+			Name:      "errors_total",
+			Help:      "Number of requests that failed, by error number.",
+		}, labels("export", "command", "errno")),
+		latency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: "nbd",
+			Name:      "request_duration_seconds",
+			Help:      "Time taken to execute requests.",
+			Buckets:   prometheus.ExponentialBuckets(10e-6, 4, 10),
+		}, labels("export", "command")),
+	}
+}
+
+// Describe implements prometheus.Collector.
+func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
+	c.requests.Describe(ch)
+	c.bytes.Describe(ch)
+	c.inflight.Describe(ch)
+	c.errors.Describe(ch)
+	c.latency.Describe(ch)
+}
+
+// Collect implements prometheus.Collector.
+func (c *Collector) Collect(ch chan<- prometheus.Metric) {
+	c.requests.Collect(ch)
+	c.bytes.Collect(ch)
+	c.inflight.Collect(ch)
+	c.errors.Collect(ch)
+	c.latency.Collect(ch)
+}
+
+// Start implements nbd.Observer.
+func (c *Collector) Start(r nbd.RequestInfo) func(error) {
+	cmd := r.Command.String()
+	// values returns the given label values, plus the connection if
+	// enabled.
+	values := func(v ...string) []string {
+		if c.perConn {
+			v = append(v, strconv.FormatUint(r.Conn, 10))
+		}
+		return v
+	}
+	c.requests.WithLabelValues(values(r.Export, cmd)...).Inc()
+	c.bytes.WithLabelValues(values(r.Export, cmd)...).Add(float64(r.Length))
+	inflight := c.inflight.WithLabelValues(r.Export)
+	inflight.Inc()
+	start := time.Now()
+	return func(err error) {
+		c.latency.WithLabelValues(values(r.Export, cmd)...).Observe(time.Since(start).Seconds())
+		inflight.Dec()
+		if err != nil {
+			c.errors.WithLabelValues(values(r.Export, cmd, errnoName(nbd.ErrnoOf(err)))...).Inc()
+		}
+	}
+}
+
+func errnoName(e nbd.Errno) string {
+	switch e {
+	case nbd.EPERM:
+		return "EPERM"
+	case nbd.EIO:
+		return "EIO"
+	case nbd.ENOMEM:
+		return "ENOMEM"
+	case nbd.EINVAL:
+		return "EINVAL"
+	case nbd.ENOSPC:
+		return "ENOSPC"
+	case nbd.EOVERFLOW:
+		return "EOVERFLOW"
+	case nbd.ESHUTDOWN:
+		return "ESHUTDOWN"
+	default:
+		return strconv.FormatUint(uint64(e), 10)
+	}
+}
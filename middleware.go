@@ -0,0 +1,83 @@
+// Copyright 2018 Axel Wagner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nbd
+
+import "reflect"
+
+// Middleware wraps a Device to add behavior, like a cache, throttling,
+// metrics or fault injection, similar to middleware wrapping an
+// http.Handler.
+type Middleware func(Device) Device
+
+// Chain returns a Middleware applying mw in order: the first Middleware is
+// the outermost one, which sees requests first. That is,
+// Chain(a, b, c)(d) is a(b(c(d))). nil Middlewares are skipped.
+func Chain(mw ...Middleware) Middleware {
+	return func(d Device) Device {
+		for i := len(mw) - 1; i >= 0; i-- {
+			if mw[i] != nil {
+				d = mw[i](d)
+			}
+		}
+		return d
+	}
+}
+
+// Wrap wraps d with mw, the first Middleware being the outermost one. It is
+// short for Chain(mw...)(d).
+func Wrap(d Device, mw ...Middleware) Device {
+	return Chain(mw...)(d)
+}
+
+// Unwrapper is an optional interface a Device wrapping another one can
+// implement, to pass the optional interfaces of the wrapped Device through.
+// Wrappers usually embed the Device they wrap, which hides all methods but
+// those of Device, so e.g. a Server would stop advertising trims.
+//
+// By implementing Unwrapper, a wrapper declares that the capability
+// interfaces of the wrapped Device, which it does not implement itself, can
+// be used directly, bypassing it: Trimmer, Extenter, DirtyBitmapper,
+// Flusher, BlockSizer and HealthChecker. A Server finds them with As.
+// Wrappers which need to see every modification, like caches, must not
+// implement Unwrapper. Interfaces which only optimize requests the Device
+// methods can do too (ReaderAtVec, WriterAtVec and ZeroWriter) are never
+// passed through, so a wrapper always sees all data read and written.
+type Unwrapper interface {
+	Unwrap() Device
+}
+
+// As finds the first Device in the chain of d and the Devices it wraps (as
+// returned by Unwrapper), which implements the interface target points to,
+// and sets target to it. It returns whether one was found. Like errors.As, it
+// panics if target is not a non-nil pointer to an interface type.
+func As(d Device, target interface{}) bool {
+	v := reflect.ValueOf(target)
+	if v.Kind() != reflect.Ptr || v.IsNil() || v.Elem().Kind() != reflect.Interface {
+		panic("nbd: target must be a non-nil pointer to an interface")
+	}
+	typ := v.Elem().Type()
+	for d != nil {
+		if reflect.TypeOf(d).Implements(typ) {
+			v.Elem().Set(reflect.ValueOf(d))
+			return true
+		}
+		u, ok := d.(Unwrapper)
+		if !ok {
+			return false
+		}
+		d = u.Unwrap()
+	}
+	return false
+}
@@ -0,0 +1,263 @@
+// Copyright 2018 Axel Wagner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package migrate implements live migration of an export to another Device,
+// e.g. one served by a different server.
+//
+// A Source wraps the Device of the export, tracking the blocks written by
+// clients. Migrate then copies the whole Device to the destination while it
+// is in use, and iteratively copies the blocks written in the meantime, until
+// few enough are left. For the final pass, writes are paused briefly, the
+// remaining blocks are copied and the destination is synced. Then the
+// Options.Switch hook is called and from then on, the Source forwards all
+// requests to the destination. So already connected clients (including the
+// kernel) keep working and can be moved over at leisure, for example by
+// removing the export from the source server, so clients reconnect to the
+// destination:
+//
+//	src := migrate.NewSource(d, size, 0)
+//	srv.AddExport(nbd.Export{Name: "disk", Size: size, Device: src})
+//	// …
+//	err := src.Migrate(ctx, dst, &migrate.Options{
+//		Switch: func(ctx context.Context) error {
+//			return announceDestination(ctx)
+//		},
+//	})
+package migrate
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+
+	"github.com/Merovius/nbd"
+	"github.com/Merovius/nbd/dirty"
+)
+
+// DefaultBlockSize is the granularity of tracking dirty blocks, if NewSource
+// is passed 0.
+const DefaultBlockSize = 64 << 10
+
+// Options configures Migrate.
+type Options struct {
+	// Threshold is the number of dirty bytes, below which the final pass is
+	// started, pausing writes. If it is <= 0, 16 MiB are used.
+	Threshold int64
+	// MaxPasses limits the number of passes while writes are not paused. If
+	// the threshold is not reached after that many passes (because clients
+	// write faster than the Device can be copied), the final pass is started
+	// nonetheless. If MaxPasses is <= 0, 10 passes are done at most.
+	MaxPasses int
+	// ChunkSize is the maximum size of a single copy. If it is <= 0, 1 MiB is
+	// used.
+	ChunkSize int
+	// Switch is called after the destination contains all data of the
+	// source and is synced, while writes are paused. It should redirect
+	// clients to the destination. If it returns an error, the migration is
+	// aborted and the Source keeps using the original Device. Switch may be
+	// nil.
+	Switch func(ctx context.Context) error
+	// Progress, if not nil, is called after every copied chunk.
+	Progress func(Progress)
+}
+
+// Progress describes the progress of a migration.
+type Progress struct {
+	// Pass is the number of the current pass, starting at 1. It is -1 for
+	// the final pass.
+	Pass int
+	// Copied is the number of bytes copied in this pass and Remaining the
+	// number left to copy.
+	Copied    int64
+	Remaining int64
+}
+
+// Source is a Device, which can be migrated to another Device. It is safe for
+// concurrent use, if the underlying Device is.
+type Source struct {
+	t *dirty.Tracker
+
+	// mu is held for reading by requests and for writing to pause them.
+	mu       sync.RWMutex
+	dst      nbd.Device
+	migrated bool
+	running  bool
+}
+
+// NewSource returns a Source forwarding to d, which has the given size.
+// blockSize is the granularity with which writes are tracked; if it is <= 0,
+// DefaultBlockSize is used.
+func NewSource(d nbd.Device, size uint64, blockSize int) *Source {
+	if blockSize <= 0 {
+		blockSize = DefaultBlockSize
+	}
+	return &Source{t: dirty.Track(d, size, blockSize)}
+}
+
+// ReadAt implements nbd.Device.
+func (s *Source) ReadAt(p []byte, off int64) (int, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.migrated {
+		return s.dst.ReadAt(p, off)
+	}
+	return s.t.ReadAt(p, off)
+}
+
+// WriteAt implements nbd.Device. Writes block, while the final pass of a
+// migration is running.
+func (s *Source) WriteAt(p []byte, off int64) (int, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.migrated {
+		return s.dst.WriteAt(p, off)
+	}
+	return s.t.WriteAt(p, off)
+}
+
+// Sync implements nbd.Device.
+func (s *Source) Sync() error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.migrated {
+		return s.dst.Sync()
+	}
+	return s.t.Sync()
+}
+
+// Migrated returns whether s was successfully migrated and now forwards to
+// the destination.
+func (s *Source) Migrated() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.migrated
+}
+
+// Migrate copies s to dst, which must have the same size, and switches s to
+// forward to dst (see the package documentation). It can only be called once
+// successfully. If ctx is cancelled or an error occurs, s keeps using the
+// original Device and Migrate can be called again.
+func (s *Source) Migrate(ctx context.Context, dst nbd.Device, opts *Options) error {
+	if opts == nil {
+		opts = new(Options)
+	}
+	s.mu.Lock()
+	if s.migrated || s.running {
+		s.mu.Unlock()
+		return errors.New("migration already done or in progress")
+	}
+	s.running = true
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		s.running = false
+		s.mu.Unlock()
+	}()
+
+	threshold := opts.Threshold
+	if threshold <= 0 {
+		threshold = 16 << 20
+	}
+	maxPasses := opts.MaxPasses
+	if maxPasses <= 0 {
+		maxPasses = 10
+	}
+	chunk := opts.ChunkSize
+	if chunk <= 0 {
+		chunk = 1 << 20
+	}
+	c := &copier{src: s.t, dst: dst, chunk: chunk, progress: opts.Progress}
+
+	// Everything written from now on is recopied in the next pass.
+	bm := s.t.Swap()
+	bm.MarkAll()
+	for pass := 1; ; pass++ {
+		if err := c.copy(ctx, bm, pass); err != nil {
+			s.t.Merge(bm)
+			return err
+		}
+		bm = s.t.Swap()
+		if dirtyBytes(bm) <= threshold || pass >= maxPasses {
+			break
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	bm.Or(s.t.Swap())
+	if err := c.copy(ctx, bm, -1); err != nil {
+		s.t.Merge(bm)
+		return err
+	}
+	if err := dst.Sync(); err != nil {
+		s.t.Merge(bm)
+		return err
+	}
+	if opts.Switch != nil {
+		if err := opts.Switch(ctx); err != nil {
+			// Writes resume on the original Device, so the destination has to
+			// be brought up to date again by the next attempt.
+			s.t.Merge(bm)
+			return err
+		}
+	}
+	s.dst = dst
+	s.migrated = true
+	return nil
+}
+
+// dirtyBytes returns the approximate number of bytes in bm.
+func dirtyBytes(bm *dirty.Bitmap) int64 {
+	return int64(bm.Count()) * int64(bm.BlockSize())
+}
+
+// copier copies dirty ranges from src to dst.
+type copier struct {
+	src      nbd.Device
+	dst      nbd.Device
+	chunk    int
+	progress func(Progress)
+	buf      []byte
+}
+
+func (c *copier) copy(ctx context.Context, bm *dirty.Bitmap, pass int) error {
+	ranges := bm.Ranges(int64(c.chunk))
+	var total int64
+	for _, r := range ranges {
+		total += r.Length
+	}
+	var copied int64
+	for _, r := range ranges {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		// A single block can be larger than chunk.
+		if int64(len(c.buf)) < r.Length {
+			c.buf = make([]byte, r.Length)
+		}
+		b := c.buf[:r.Length]
+		if n, err := c.src.ReadAt(b, r.Offset); err != nil && !(err == io.EOF && n == len(b)) {
+			return err
+		}
+		if _, err := c.dst.WriteAt(b, r.Offset); err != nil {
+			return err
+		}
+		copied += r.Length
+		if c.progress != nil {
+			c.progress(Progress{Pass: pass, Copied: copied, Remaining: total - copied})
+		}
+	}
+	return nil
+}
@@ -0,0 +1,347 @@
+// Copyright 2018 Axel Wagner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package nbdbench implements load generation for nbd.Devices.
+//
+// It is intended for authors of Device implementations, to compare them or
+// to guard against performance regressions. A Workload describes the load to
+// generate, Run executes it and returns a Result. Benchmark integrates with
+// the testing package:
+//
+//	func BenchmarkRandomRead(b *testing.B) {
+//		nbdbench.Benchmark(b, newDevice(), nbdbench.Workload{
+//			Size:      1 << 30,
+//			BlockSize: 4096,
+//			Pattern:   nbdbench.Random,
+//			Reads:     1,
+//		})
+//	}
+package nbdbench
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Merovius/nbd"
+)
+
+// Pattern determines the offsets accessed by a Workload.
+type Pattern int
+
+const (
+	// Sequential accesses consecutive blocks, wrapping around at the end of
+	// the region. All workers share a single cursor.
+	Sequential Pattern = iota
+	// Random accesses uniformly distributed, block aligned offsets.
+	Random
+)
+
+func (p Pattern) String() string {
+	switch p {
+	case Sequential:
+		return "sequential"
+	case Random:
+		return "random"
+	default:
+		return fmt.Sprintf("Pattern(%d)", int(p))
+	}
+}
+
+// Workload describes the load to generate.
+type Workload struct {
+	// Offset and Size describe the region of the Device that is accessed.
+	// Size must be at least BlockSize.
+	Offset int64
+	Size   int64
+	// BlockSize is the size of each read and write. If zero, 4096 is used.
+	BlockSize int
+	// Pattern determines the accessed offsets.
+	Pattern Pattern
+	// Reads is the fraction of operations that are reads, between 0 and 1.
+	// The remaining operations are writes.
+	Reads float64
+	// Concurrency is the number of operations issued in parallel. If zero,
+	// 1 is used.
+	Concurrency int
+	// Ops is the total number of reads and writes to issue. If zero, the
+	// Workload runs until Duration has passed.
+	Ops int64
+	// Duration limits the runtime of the Workload, if non-zero. One of Ops
+	// and Duration must be set.
+	Duration time.Duration
+	// SyncEvery makes each worker call Sync after that many writes. If zero,
+	// Sync is never called.
+	SyncEvery int
+	// Seed seeds the generation of offsets, operations and written data, so
+	// that runs are reproducible.
+	Seed int64
+}
+
+// Result summarizes the run of a Workload.
+type Result struct {
+	Reads  OpStats
+	Writes OpStats
+	Syncs  OpStats
+	// Elapsed is the wall time of the run.
+	Elapsed time.Duration
+}
+
+// OpStats summarizes one kind of operation.
+type OpStats struct {
+	Count uint64
+	Bytes int64
+	// Latency percentiles. They are exact, as all latencies are recorded.
+	P50 time.Duration
+	P95 time.Duration
+	P99 time.Duration
+	Max time.Duration
+}
+
+// Ops returns the total number of reads and writes.
+func (r Result) Ops() uint64 {
+	return r.Reads.Count + r.Writes.Count
+}
+
+// IOPS returns the number of reads and writes per second.
+func (r Result) IOPS() float64 {
+	if r.Elapsed <= 0 {
+		return 0
+	}
+	return float64(r.Ops()) / r.Elapsed.Seconds()
+}
+
+// Throughput returns the number of bytes read and written per second.
+func (r Result) Throughput() float64 {
+	if r.Elapsed <= 0 {
+		return 0
+	}
+	return float64(r.Reads.Bytes+r.Writes.Bytes) / r.Elapsed.Seconds()
+}
+
+func (r Result) String() string {
+	return fmt.Sprintf("%d ops in %v (%.0f IOPS, %.2f MiB/s); read p50=%v p99=%v; write p50=%v p99=%v",
+		r.Ops(), r.Elapsed, r.IOPS(), r.Throughput()/(1<<20),
+		r.Reads.P50, r.Reads.P99, r.Writes.P50, r.Writes.P99)
+}
+
+func (w Workload) withDefaults() (Workload, error) {
+	if w.BlockSize == 0 {
+		w.BlockSize = 4096
+	}
+	if w.Concurrency == 0 {
+		w.Concurrency = 1
+	}
+	switch {
+	case w.BlockSize < 0 || w.Concurrency < 0 || w.Offset < 0 || w.SyncEvery < 0 || w.Ops < 0 || w.Duration < 0:
+		return w, errors.New("nbdbench: negative parameter in Workload")
+	case w.Size < int64(w.BlockSize):
+		return w, errors.New("nbdbench: Workload.Size is smaller than BlockSize")
+	case w.Reads < 0 || w.Reads > 1:
+		return w, errors.New("nbdbench: Workload.Reads must be between 0 and 1")
+	case w.Ops == 0 && w.Duration == 0:
+		return w, errors.New("nbdbench: one of Workload.Ops and Workload.Duration must be set")
+	}
+	return w, nil
+}
+
+// Run executes w against d. It returns early with an error if ctx is
+// cancelled or any operation fails.
+func Run(ctx context.Context, d nbd.Device, w Workload) (Result, error) {
+	w, err := w.withDefaults()
+	if err != nil {
+		return Result{}, err
+	}
+	if w.Duration > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, w.Duration)
+		defer cancel()
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	r := &run{
+		d:      d,
+		w:      w,
+		blocks: w.Size / int64(w.BlockSize),
+		left:   w.Ops,
+	}
+	workers := make([]*worker, w.Concurrency)
+	var (
+		wg   sync.WaitGroup
+		once sync.Once
+		ferr error
+	)
+	start := time.Now()
+	for i := range workers {
+		wk := &worker{
+			run: r,
+			rnd: rand.New(rand.NewSource(w.Seed + int64(i))),
+			buf: make([]byte, w.BlockSize),
+		}
+		wk.rnd.Read(wk.buf)
+		workers[i] = wk
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := wk.loop(ctx); err != nil {
+				once.Do(func() {
+					ferr = err
+					cancel()
+				})
+			}
+		}()
+	}
+	wg.Wait()
+	res := Result{Elapsed: time.Since(start)}
+	if ferr != nil {
+		return res, ferr
+	}
+	// Running out of time is the expected way for a Workload with a
+	// Duration to end.
+	if err := ctx.Err(); err != nil && (w.Duration == 0 || time.Since(start) < w.Duration) {
+		return res, err
+	}
+
+	var reads, writes, syncs []time.Duration
+	for _, wk := range workers {
+		reads = append(reads, wk.reads...)
+		writes = append(writes, wk.writes...)
+		syncs = append(syncs, wk.syncs...)
+	}
+	res.Reads = summarize(reads, int64(w.BlockSize))
+	res.Writes = summarize(writes, int64(w.BlockSize))
+	res.Syncs = summarize(syncs, 0)
+	return res, nil
+}
+
+// run is the state shared by all workers.
+type run struct {
+	d      nbd.Device
+	w      Workload
+	blocks int64
+	// left is the number of operations left to issue, if w.Ops is set.
+	left int64
+	// next is the next block for sequential access.
+	next int64
+}
+
+// take reserves an operation. It returns false if the Workload is done.
+func (r *run) take() bool {
+	if r.w.Ops == 0 {
+		return true
+	}
+	return atomic.AddInt64(&r.left, -1) >= 0
+}
+
+type worker struct {
+	*run
+	rnd *rand.Rand
+	buf []byte
+
+	writesSinceSync int
+	reads           []time.Duration
+	writes          []time.Duration
+	syncs           []time.Duration
+}
+
+func (wk *worker) loop(ctx context.Context) error {
+	for ctx.Err() == nil && wk.take() {
+		var block int64
+		if wk.w.Pattern == Random {
+			block = wk.rnd.Int63n(wk.blocks)
+		} else {
+			block = (atomic.AddInt64(&wk.next, 1) - 1) % wk.blocks
+		}
+		off := wk.w.Offset + block*int64(wk.w.BlockSize)
+
+		if wk.rnd.Float64() < wk.w.Reads {
+			t := time.Now()
+			if _, err := wk.d.ReadAt(wk.buf, off); err != nil {
+				return fmt.Errorf("read at %d: %v", off, err)
+			}
+			wk.reads = append(wk.reads, time.Since(t))
+			continue
+		}
+		t := time.Now()
+		if _, err := wk.d.WriteAt(wk.buf, off); err != nil {
+			return fmt.Errorf("write at %d: %v", off, err)
+		}
+		wk.writes = append(wk.writes, time.Since(t))
+		if wk.w.SyncEvery == 0 {
+			continue
+		}
+		if wk.writesSinceSync++; wk.writesSinceSync < wk.w.SyncEvery {
+			continue
+		}
+		wk.writesSinceSync = 0
+		t = time.Now()
+		if err := wk.d.Sync(); err != nil {
+			return fmt.Errorf("sync: %v", err)
+		}
+		wk.syncs = append(wk.syncs, time.Since(t))
+	}
+	return nil
+}
+
+func summarize(lat []time.Duration, size int64) OpStats {
+	s := OpStats{
+		Count: uint64(len(lat)),
+		Bytes: int64(len(lat)) * size,
+	}
+	if len(lat) == 0 {
+		return s
+	}
+	sort.Slice(lat, func(i, j int) bool { return lat[i] < lat[j] })
+	p := func(q float64) time.Duration {
+		return lat[int(q*float64(len(lat)-1))]
+	}
+	s.P50, s.P95, s.P99, s.Max = p(0.5), p(0.95), p(0.99), lat[len(lat)-1]
+	return s
+}
+
+// Benchmark runs w against d as part of a Go benchmark. The number of
+// operations is set to b.N, w.Ops and w.Duration are ignored. Besides the
+// usual metrics, it reports the latency percentiles of reads and writes.
+func Benchmark(b *testing.B, d nbd.Device, w Workload) {
+	b.Helper()
+	w.Ops = int64(b.N)
+	w.Duration = 0
+	if w.BlockSize == 0 {
+		w.BlockSize = 4096
+	}
+	b.SetBytes(int64(w.BlockSize))
+	b.ResetTimer()
+	res, err := Run(context.Background(), d, w)
+	b.StopTimer()
+	if err != nil {
+		b.Fatal(err)
+	}
+	report := func(s OpStats, name string) {
+		if s.Count == 0 {
+			return
+		}
+		b.ReportMetric(float64(s.P50.Nanoseconds()), name+"-p50-ns")
+		b.ReportMetric(float64(s.P99.Nanoseconds()), name+"-p99-ns")
+	}
+	report(res.Reads, "read")
+	report(res.Writes, "write")
+	b.ReportMetric(res.IOPS(), "iops")
+}
@@ -0,0 +1,117 @@
+// +build linux
+
+// Copyright 2018 Axel Wagner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nbdctl
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+
+	"github.com/Merovius/nbd"
+	"github.com/Merovius/nbd/nbdnl"
+	"golang.org/x/sys/unix"
+)
+
+// Attach connects the export with the given name to a kernel NBD device over
+// a private socket and returns the index of the device chosen by the kernel.
+// The connection is served by the Server like any other, so it is subject to
+// the same limits and counted in the statistics. ctx only bounds the
+// handshake; the device stays attached until Detach is called or the
+// connection terminates (e.g. because the export is removed).
+//
+// This is a Linux-only API.
+func (c *Controller) Attach(ctx context.Context, name string) (uint32, error) {
+	idx, err := c.attach(ctx, name)
+	e := nbd.NewAuditEvent(nbd.AuditAttach, name, err)
+	if err == nil {
+		e.Detail = fmt.Sprintf("device=/dev/nbd%d", idx)
+	}
+	c.audit(e)
+	return idx, err
+}
+
+func (c *Controller) attach(ctx context.Context, name string) (uint32, error) {
+	sp, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_STREAM, 0)
+	if err != nil {
+		return 0, err
+	}
+	client, server := os.NewFile(uintptr(sp[0]), "client"), os.NewFile(uintptr(sp[1]), "server")
+	defer client.Close()
+	serverc, err := net.FileConn(server)
+	server.Close()
+	if err != nil {
+		return 0, err
+	}
+	clientc, err := net.FileConn(client)
+	if err != nil {
+		serverc.Close()
+		return 0, err
+	}
+	defer clientc.Close()
+
+	sctx, cancel := context.WithCancel(context.Background())
+	d := &device{export: name, cancel: cancel, done: make(chan struct{})}
+	go func() {
+		defer close(d.done)
+		c.Server.ServeConn(sctx, serverc)
+		serverc.Close()
+	}()
+	fail := func(err error) (uint32, error) {
+		cancel()
+		<-d.done
+		return 0, err
+	}
+
+	cl, err := nbd.ClientHandshake(ctx, clientc)
+	if err != nil {
+		return fail(err)
+	}
+	exp, err := cl.Go(name)
+	if err != nil {
+		return fail(err)
+	}
+	idx, err := nbd.Configure(exp, client)
+	if err != nil {
+		return fail(err)
+	}
+	c.add(idx, d, nbdnl.Disconnect)
+	return idx, nil
+}
+
+// Detach disconnects the kernel NBD device with the given index, which must
+// have been attached by c, and waits for its connection to terminate.
+//
+// This is a Linux-only API.
+func (c *Controller) Detach(idx uint32) error {
+	d, err := c.get(idx)
+	if err != nil {
+		return err
+	}
+	err = nbdnl.Disconnect(idx)
+	e := nbd.NewAuditEvent(nbd.AuditDetach, d.export, err)
+	e.Detail = fmt.Sprintf("device=/dev/nbd%d", idx)
+	c.audit(e)
+	d.cancel()
+	<-d.done
+	c.mu.Lock()
+	if c.devices[idx] == d {
+		delete(c.devices, idx)
+	}
+	c.mu.Unlock()
+	return err
+}
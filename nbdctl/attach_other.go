@@ -0,0 +1,34 @@
+// +build !linux
+
+// Copyright 2018 Axel Wagner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nbdctl
+
+import (
+	"context"
+	"errors"
+)
+
+var errNotSupported = errors.New("attaching kernel NBD devices is only supported on Linux")
+
+// Attach is only supported on Linux.
+func (c *Controller) Attach(ctx context.Context, name string) (uint32, error) {
+	return 0, errNotSupported
+}
+
+// Detach is only supported on Linux.
+func (c *Controller) Detach(idx uint32) error {
+	return errNotSupported
+}
@@ -0,0 +1,179 @@
+// Copyright 2018 Axel Wagner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package nbdctl provides an API to manage a running nbd.Server.
+//
+// A Controller lists, adds and removes exports, attaches exports to kernel
+// NBD devices (on Linux) and reports statistics and diagnostics. It is meant
+// for daemons embedding the nbd package, which want to manage their exports
+// programmatically instead of shelling out to cmd/nbd.
+//
+// nbdctl.proto contains a gRPC service definition mirroring Controller, for
+// daemons exposing it over the network. Generated code is not included, as
+// the Device backing a new export can not be transmitted; a daemon
+// implementing the service has to map the backing given in the request to a
+// Device itself.
+package nbdctl
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/Merovius/nbd"
+)
+
+// Controller manages a Server. Its methods are safe for concurrent use.
+type Controller struct {
+	// Server is the managed Server. It must not be nil.
+	Server *nbd.Server
+
+	mu      sync.Mutex
+	devices map[uint32]*device
+}
+
+// device is a kernel NBD device attached to an export.
+type device struct {
+	export string
+	cancel func()
+	// done is closed, once the connection of the device terminated.
+	done chan struct{}
+}
+
+// ExportInfo describes an export of the Server.
+type ExportInfo struct {
+	Name        string
+	Description string
+	Size        uint64
+	Flags       uint16
+	// Counters are the statistics of the export.
+	Counters nbd.Counters
+	// Devices are the indices of the kernel NBD devices attached to the
+	// export (i.e. /dev/nbdX).
+	Devices []uint32
+}
+
+// DeviceInfo describes a kernel NBD device attached by a Controller.
+type DeviceInfo struct {
+	// Index is the index of the device (i.e. /dev/nbdX).
+	Index  uint32
+	Export string
+}
+
+// Exports returns the exports of the Server. The first one is the default
+// export.
+func (c *Controller) Exports() []ExportInfo {
+	st := c.Server.Stats()
+	devs := make(map[string][]uint32)
+	for _, d := range c.Devices() {
+		devs[d.Export] = append(devs[d.Export], d.Index)
+	}
+	var out []ExportInfo
+	for _, e := range c.Server.ListExports() {
+		out = append(out, ExportInfo{
+			Name:        e.Name,
+			Description: e.Description,
+			Size:        e.Size,
+			Flags:       e.Flags,
+			Counters:    st.Exports[e.Name],
+			Devices:     devs[e.Name],
+		})
+	}
+	return out
+}
+
+// AddExport adds e to the exports of the Server.
+func (c *Controller) AddExport(e nbd.Export) error {
+	if e.Device == nil {
+		return errors.New("export has no Device")
+	}
+	return c.Server.AddExport(e)
+}
+
+// RemoveExport removes the export with the given name from the Server and
+// disconnects its clients. It fails, if kernel NBD devices are attached to
+// the export; they have to be detached first.
+func (c *Controller) RemoveExport(name string) error {
+	for _, d := range c.Devices() {
+		if d.Export == name {
+			err := fmt.Errorf("export %q is attached to /dev/nbd%d", name, d.Index)
+			c.audit(nbd.NewAuditEvent(nbd.AuditRemoveExport, name, err))
+			return err
+		}
+	}
+	return c.Server.RemoveExport(name)
+}
+
+// Devices returns the kernel NBD devices attached by c, ordered by index.
+func (c *Controller) Devices() []DeviceInfo {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var out []DeviceInfo
+	for idx, d := range c.devices {
+		out = append(out, DeviceInfo{idx, d.export})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Index < out[j].Index })
+	return out
+}
+
+// Stats returns the statistics of the Server.
+func (c *Controller) Stats() nbd.Stats {
+	return c.Server.Stats()
+}
+
+// Snapshot returns a snapshot of the state of the Server, including all
+// connections and requests in flight.
+func (c *Controller) Snapshot() nbd.Diagnostics {
+	return c.Server.Diagnostics()
+}
+
+// add registers d as attached with the given index. It also starts a
+// goroutine, which unregisters d once its connection terminates.
+func (c *Controller) add(idx uint32, d *device, disconnect func(uint32) error) {
+	c.mu.Lock()
+	if c.devices == nil {
+		c.devices = make(map[uint32]*device)
+	}
+	c.devices[idx] = d
+	c.mu.Unlock()
+
+	go func() {
+		<-d.done
+		disconnect(idx)
+		c.mu.Lock()
+		if c.devices[idx] == d {
+			delete(c.devices, idx)
+		}
+		c.mu.Unlock()
+	}()
+}
+
+// audit records e with the Auditor of the Server, if it has one.
+func (c *Controller) audit(e nbd.AuditEvent) {
+	if c.Server.Audit != nil {
+		c.Server.Audit.Audit(e)
+	}
+}
+
+// get returns the device with the given index.
+func (c *Controller) get(idx uint32) (*device, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	d, ok := c.devices[idx]
+	if !ok {
+		return nil, fmt.Errorf("/dev/nbd%d is not attached", idx)
+	}
+	return d, nil
+}
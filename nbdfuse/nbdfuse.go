@@ -0,0 +1,188 @@
+// +build linux darwin
+
+// Copyright 2018 Axel Wagner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package nbdfuse exposes a Device as a file in a FUSE filesystem.
+//
+// Unlike Loopback, this does not need root privileges or the nbd kernel
+// module: the file can be used with ordinary file tools (or as a disk image)
+// by unprivileged users, if FUSE is available. All Device wrappers can be
+// used as with the NBD server.
+//
+//	srv, err := nbdfuse.Mount(dir, "disk.img", d, size, nil)
+//	if err != nil {
+//		return err
+//	}
+//	defer srv.Unmount()
+//	srv.Wait()
+package nbdfuse
+
+import (
+	"context"
+	"io"
+	"syscall"
+
+	"github.com/Merovius/nbd"
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// Options configures Mount.
+type Options struct {
+	// ReadOnly rejects all writes to the file.
+	ReadOnly bool
+	// AllowOther allows other users to access the filesystem. This requires
+	// user_allow_other to be set in /etc/fuse.conf.
+	AllowOther bool
+	// DirectIO bypasses the page cache of the kernel, which is needed if the
+	// Device can be modified by others (e.g. a shared export).
+	DirectIO bool
+}
+
+// Mount mounts a filesystem at dir, which contains a single file of the
+// given name and size, backed by d. opts may be nil, to use the defaults.
+// The filesystem is served in the background, until it is unmounted.
+//
+// Reads and writes are passed to d, an fsync of the file calls d.Sync. The
+// size of the file can not be changed.
+func Mount(dir, name string, d nbd.Device, size int64, opts *Options) (*fuse.Server, error) {
+	if opts == nil {
+		opts = new(Options)
+	}
+	root := &rootNode{
+		name: name,
+		file: &fileNode{d: d, size: size, opts: *opts},
+	}
+	return fs.Mount(dir, root, &fs.Options{
+		MountOptions: fuse.MountOptions{
+			AllowOther: opts.AllowOther,
+			FsName:     name,
+			Name:       "nbd",
+		},
+	})
+}
+
+type rootNode struct {
+	fs.Inode
+	name string
+	file *fileNode
+}
+
+func (r *rootNode) OnAdd(ctx context.Context) {
+	ch := r.NewPersistentInode(ctx, r.file, fs.StableAttr{Mode: syscall.S_IFREG})
+	r.AddChild(r.name, ch, false)
+}
+
+type fileNode struct {
+	fs.Inode
+	d    nbd.Device
+	size int64
+	opts Options
+}
+
+func (f *fileNode) Getattr(ctx context.Context, fh fs.FileHandle, out *fuse.AttrOut) syscall.Errno {
+	out.Mode = syscall.S_IFREG | 0644
+	if f.opts.ReadOnly {
+		out.Mode = syscall.S_IFREG | 0444
+	}
+	out.Size = uint64(f.size)
+	out.Blocks = (uint64(f.size) + 511) / 512
+	return 0
+}
+
+func (f *fileNode) Setattr(ctx context.Context, fh fs.FileHandle, in *fuse.SetAttrIn, out *fuse.AttrOut) syscall.Errno {
+	if sz, ok := in.GetSize(); ok && int64(sz) != f.size {
+		return syscall.EPERM
+	}
+	// Other attributes (like mode or times) are not stored.
+	return f.Getattr(ctx, fh, out)
+}
+
+func (f *fileNode) Open(ctx context.Context, flags uint32) (fs.FileHandle, uint32, syscall.Errno) {
+	if f.opts.ReadOnly && flags&syscall.O_ACCMODE != syscall.O_RDONLY {
+		return nil, 0, syscall.EROFS
+	}
+	var fuseFlags uint32
+	if f.opts.DirectIO {
+		fuseFlags |= fuse.FOPEN_DIRECT_IO
+	}
+	return nil, fuseFlags, 0
+}
+
+func (f *fileNode) Read(ctx context.Context, fh fs.FileHandle, dest []byte, off int64) (fuse.ReadResult, syscall.Errno) {
+	if off >= f.size {
+		return fuse.ReadResultData(nil), 0
+	}
+	if int64(len(dest)) > f.size-off {
+		dest = dest[:f.size-off]
+	}
+	n, err := f.d.ReadAt(dest, off)
+	if err != nil && !(err == io.EOF && n == len(dest)) {
+		return nil, errno(err)
+	}
+	return fuse.ReadResultData(dest[:n]), 0
+}
+
+func (f *fileNode) Write(ctx context.Context, fh fs.FileHandle, data []byte, off int64) (uint32, syscall.Errno) {
+	if f.opts.ReadOnly {
+		return 0, syscall.EROFS
+	}
+	if off >= f.size {
+		return 0, syscall.EFBIG
+	}
+	if int64(len(data)) > f.size-off {
+		data = data[:f.size-off]
+	}
+	n, err := f.d.WriteAt(data, off)
+	if err != nil {
+		return uint32(n), errno(err)
+	}
+	return uint32(n), 0
+}
+
+func (f *fileNode) Fsync(ctx context.Context, fh fs.FileHandle, flags uint32) syscall.Errno {
+	if err := f.d.Sync(); err != nil {
+		return errno(err)
+	}
+	return 0
+}
+
+func (f *fileNode) Flush(ctx context.Context, fh fs.FileHandle) syscall.Errno {
+	return 0
+}
+
+// errno converts an error returned by a Device to an error number.
+func errno(err error) syscall.Errno {
+	e, ok := err.(nbd.Error)
+	if !ok {
+		return syscall.EIO
+	}
+	switch e.Errno() {
+	case nbd.EPERM:
+		return syscall.EPERM
+	case nbd.ENOMEM:
+		return syscall.ENOMEM
+	case nbd.EINVAL:
+		return syscall.EINVAL
+	case nbd.ENOSPC:
+		return syscall.ENOSPC
+	case nbd.EOVERFLOW:
+		return syscall.EOVERFLOW
+	case nbd.ESHUTDOWN:
+		return syscall.ESHUTDOWN
+	default:
+		return syscall.EIO
+	}
+}
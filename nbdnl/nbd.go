@@ -117,6 +117,15 @@ func WithBlockSize(n uint64) ConnectOption {
 	}
 }
 
+// WithSize sets the size of the device to n bytes. It can be passed to
+// Reconfigure, to resize a connected device; Connect takes the size as an
+// argument instead.
+func WithSize(n uint64) ConnectOption {
+	return func(e *netlink.AttributeEncoder) {
+		e.Uint64(attrSizeBytes, n)
+	}
+}
+
 // WithTimeout sets the read-timeout for the NBD client to d.
 func WithTimeout(d time.Duration) ConnectOption {
 	return func(e *netlink.AttributeEncoder) {
@@ -227,9 +236,17 @@ func Connect(idx uint32, socks []*os.File, size uint64, cf ClientFlags, sf Serve
 	return idx, nil
 }
 
-// Reconfigure reconfigures the given device. The arguments are equivalent to
-// Configure, except that IndexAny is invalid for Reconfigure and WithBlockSize
-// is ignored.
+// Reconfigure reconfigures the given, connected device, without disconnecting
+// it. The arguments are equivalent to Connect, except that IndexAny is invalid
+// for Reconfigure and WithBlockSize and sf are ignored by the kernel.
+//
+// Each of socks replaces a dead connection of the device, i.e. one whose
+// server went away, so the kernel resumes sending requests over it. If there
+// are less dead connections than sockets, Reconfigure fails with ENOSPC; new
+// connections can not be added. Requests are only held back for dead
+// connections (instead of failing), if the device was connected with
+// WithDeadconnTimeout, so that is needed to transparently restart a server.
+// socks may be empty, to only change timeouts or client flags.
 func Reconfigure(idx uint32, socks []*os.File, cf ClientFlags, sf ServerFlags, opts ...ConnectOption) error {
 	if err := dial(); err != nil {
 		return err
@@ -237,15 +254,17 @@ func Reconfigure(idx uint32, socks []*os.File, cf ClientFlags, sf ServerFlags, o
 
 	e := netlink.NewAttributeEncoder()
 	e.Uint32(attrIndex, idx)
-	var sl []uint32
-	for _, s := range socks {
-		sl = append(sl, uint32(s.Fd()))
-	}
-	buf, err := encodeSockList(sl)
-	if err != nil {
-		return err
+	if len(socks) > 0 {
+		var sl []uint32
+		for _, s := range socks {
+			sl = append(sl, uint32(s.Fd()))
+		}
+		buf, err := encodeSockList(sl)
+		if err != nil {
+			return err
+		}
+		e.Bytes(attrSockets, buf)
 	}
-	e.Bytes(attrSockets, buf)
 	e.Uint64(attrClientFlags, uint64(cf))
 	e.Uint64(attrServerFlags, uint64(sf))
 	for _, o := range opts {
@@ -377,13 +396,32 @@ func status(idx uint32) ([]DeviceStatus, error) {
 	sort.Slice(out, func(i, j int) bool {
 		return out[i].Index < out[j].Index
 	})
+	for i := range out {
+		if out[i].Connected {
+			out[i].Connections = connections(out[i].Index)
+		}
+	}
 	return out, nil
 }
 
+// connections returns the number of connections of the given device. The
+// kernel does not report it via netlink, but uses one hardware queue per
+// connection, which are listed in sysfs.
+func connections(idx uint32) int {
+	ents, err := os.ReadDir(fmt.Sprintf("/sys/block/nbd%d/mq", idx))
+	if err != nil {
+		return 0
+	}
+	return len(ents)
+}
+
 // DeviceStatus is the status of an NBD device.
 type DeviceStatus struct {
 	Index     uint32
 	Connected bool
+	// Connections is the number of connections of a connected device. It is
+	// 0, if it could not be determined (e.g. because sysfs is not mounted).
+	Connections int
 }
 
 func decodeDeviceList(b []byte) ([]DeviceStatus, error) {
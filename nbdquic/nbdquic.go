@@ -0,0 +1,241 @@
+// Copyright 2018 Axel Wagner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package nbdquic implements an experimental QUIC transport for NBD.
+//
+// Every bidirectional QUIC stream carries one NBD connection. A client can
+// open several streams on the same QUIC connection (e.g. one per queue), to
+// use multiple NBD connections without additional handshakes and without
+// head-of-line blocking between them. TLS is part of QUIC, so no separate
+// TLS negotiation happens in the NBD handshake.
+//
+// A Listener can be passed to nbd.Server.Serve:
+//
+//	l, err := nbdquic.Listen("localhost:10809", tlsConfig, nil)
+//	if err != nil {
+//		return err
+//	}
+//	return srv.Serve(ctx, l)
+//
+// and clients open streams on a Conn:
+//
+//	qc, err := nbdquic.Dial(ctx, "localhost:10809", tlsConfig, nil)
+//	if err != nil {
+//		return err
+//	}
+//	defer qc.Close()
+//	c, err := qc.Open(ctx)
+//	if err != nil {
+//		return err
+//	}
+//	cl, err := nbd.ClientHandshake(ctx, c)
+//
+// As QUIC streams are only announced to the peer once data is sent on them,
+// but the NBD server speaks first, the client starts every stream with a
+// single zero byte.
+//
+// The wire format and API of this package are not stable.
+package nbdquic
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+// ALPN is the TLS application protocol used, if the tls.Config passed to
+// Listen or Dial does not set NextProtos.
+const ALPN = "nbd"
+
+// preambleTimeout is the time a new stream has to send its preamble.
+const preambleTimeout = 10 * time.Second
+
+// withALPN returns c, with NextProtos set to ALPN if empty.
+func withALPN(c *tls.Config) *tls.Config {
+	if c == nil {
+		c = new(tls.Config)
+	}
+	if len(c.NextProtos) > 0 {
+		return c
+	}
+	c = c.Clone()
+	c.NextProtos = []string{ALPN}
+	return c
+}
+
+// Listener is a net.Listener accepting NBD connections over QUIC. Every
+// stream opened by a client is returned as a separate net.Conn.
+type Listener struct {
+	l      *quic.Listener
+	ctx    context.Context
+	cancel context.CancelFunc
+	conns  chan net.Conn
+
+	mu  sync.Mutex
+	err error
+}
+
+// Listen listens for QUIC connections on the given UDP address. tlsConfig
+// must contain a certificate. conf may be nil, to use the defaults of
+// quic-go.
+func Listen(addr string, tlsConfig *tls.Config, conf *quic.Config) (*Listener, error) {
+	ql, err := quic.ListenAddr(addr, withALPN(tlsConfig), conf)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	l := &Listener{
+		l:      ql,
+		ctx:    ctx,
+		cancel: cancel,
+		conns:  make(chan net.Conn),
+	}
+	go l.run()
+	return l, nil
+}
+
+func (l *Listener) run() {
+	for {
+		qc, err := l.l.Accept(l.ctx)
+		if err != nil {
+			l.mu.Lock()
+			if l.err == nil {
+				l.err = err
+			}
+			l.mu.Unlock()
+			l.cancel()
+			return
+		}
+		go l.streams(qc)
+	}
+}
+
+// streams accepts the streams of qc.
+func (l *Listener) streams(qc quic.Connection) {
+	for {
+		s, err := qc.AcceptStream(l.ctx)
+		if err != nil {
+			if l.ctx.Err() != nil {
+				qc.CloseWithError(0, "listener closed")
+			}
+			return
+		}
+		go l.accept(qc, s)
+	}
+}
+
+// accept reads the preamble of s and passes it on to Accept.
+func (l *Listener) accept(qc quic.Connection, s quic.Stream) {
+	c := &streamConn{s, qc}
+	var b [1]byte
+	s.SetReadDeadline(time.Now().Add(preambleTimeout))
+	if _, err := io.ReadFull(s, b[:]); err != nil || b[0] != 0 {
+		c.Close()
+		return
+	}
+	s.SetReadDeadline(time.Time{})
+	select {
+	case l.conns <- c:
+	case <-l.ctx.Done():
+		c.Close()
+	}
+}
+
+// Accept implements net.Listener.
+func (l *Listener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case <-l.ctx.Done():
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		return nil, l.err
+	}
+}
+
+// Close implements net.Listener. It also closes all QUIC connections
+// accepted by l.
+func (l *Listener) Close() error {
+	l.mu.Lock()
+	if l.err == nil {
+		l.err = net.ErrClosed
+	}
+	l.mu.Unlock()
+	l.cancel()
+	return l.l.Close()
+}
+
+// Addr implements net.Listener.
+func (l *Listener) Addr() net.Addr {
+	return l.l.Addr()
+}
+
+// Conn is a QUIC connection to an NBD server, which can carry multiple NBD
+// connections.
+type Conn struct {
+	qc quic.Connection
+}
+
+// Dial connects to the NBD server at the given UDP address. If tlsConfig is
+// nil, the default configuration is used. conf may be nil, to use the
+// defaults of quic-go.
+func Dial(ctx context.Context, addr string, tlsConfig *tls.Config, conf *quic.Config) (*Conn, error) {
+	qc, err := quic.DialAddr(ctx, addr, withALPN(tlsConfig), conf)
+	if err != nil {
+		return nil, err
+	}
+	return &Conn{qc}, nil
+}
+
+// Open opens a new stream and returns it as a net.Conn, which is in the
+// handshake phase of the protocol. It blocks, if the server does not allow
+// opening more streams.
+func (c *Conn) Open(ctx context.Context) (net.Conn, error) {
+	s, err := c.qc.OpenStreamSync(ctx)
+	if err != nil {
+		return nil, err
+	}
+	sc := &streamConn{s, c.qc}
+	if _, err := s.Write([]byte{0}); err != nil {
+		sc.Close()
+		return nil, err
+	}
+	return sc, nil
+}
+
+// Close closes the QUIC connection and all streams opened on it.
+func (c *Conn) Close() error {
+	return c.qc.CloseWithError(0, "")
+}
+
+// streamConn is a net.Conn for a QUIC stream.
+type streamConn struct {
+	quic.Stream
+	qc quic.Connection
+}
+
+func (c *streamConn) LocalAddr() net.Addr  { return c.qc.LocalAddr() }
+func (c *streamConn) RemoteAddr() net.Addr { return c.qc.RemoteAddr() }
+
+// Close closes both directions of the stream. Closing a quic.Stream only
+// closes the sending direction.
+func (c *streamConn) Close() error {
+	c.Stream.CancelRead(0)
+	return c.Stream.Close()
+}
@@ -0,0 +1,288 @@
+// Copyright 2018 Axel Wagner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package nbdsim provides a deterministic simulation environment for testing
+// code using package nbd.
+//
+// All time in a simulation is virtual: it is kept by a Clock, which only
+// advances when the test says so. Latencies injected by a Device, deadlines
+// of connections created by Pipe and crash schedules using the Clock
+// therefore don't depend on the speed of the machine running the test and
+// tests take no longer than the computation they do. A test can, for
+// example, check what happens when a connection times out during a slow
+// flush:
+//
+//	clock := nbdsim.NewClock(time.Time{})
+//	d := &nbdsim.Device{
+//		Device: dev,
+//		Clock:  clock,
+//		Latency: func(op nbdsim.Op) time.Duration {
+//			if op.Type == nbdsim.Sync {
+//				return time.Minute
+//			}
+//			return 0
+//		},
+//	}
+//	c1, c2 := nbdsim.Pipe(clock)
+//	// Serve d on c1, connect a client on c2 and issue a flush.
+//	clock.BlockUntil(1) // wait for the flush to sleep
+//	c2.SetDeadline(clock.Now().Add(time.Second))
+//	clock.Advance(time.Second) // c2 times out
+//
+// crashtest.Device can use the Clock by setting its Now field to clock.Now.
+package nbdsim
+
+import (
+	"container/heap"
+	"sync"
+	"time"
+)
+
+// Clock is a virtual clock. Time only passes when Advance, AdvanceTo or Next
+// is called. A Clock is safe for concurrent use.
+type Clock struct {
+	mu     sync.Mutex
+	cond   sync.Cond
+	now    time.Time
+	seq    uint64
+	timers timerHeap
+	// pending is the number of timers, which are not internal.
+	pending int
+}
+
+// NewClock returns a Clock starting at the given time.
+func NewClock(start time.Time) *Clock {
+	c := &Clock{now: start}
+	c.cond.L = &c.mu
+	return c
+}
+
+// Now returns the current virtual time.
+func (c *Clock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// Since returns the virtual time elapsed since t.
+func (c *Clock) Since(t time.Time) time.Duration {
+	return c.Now().Sub(t)
+}
+
+// Sleep blocks until the Clock advanced by at least d.
+func (c *Clock) Sleep(d time.Duration) {
+	if d <= 0 {
+		return
+	}
+	<-c.NewTimer(d).C
+}
+
+// After waits for the Clock to advance by d and then sends the current time
+// on the returned channel.
+func (c *Clock) After(d time.Duration) <-chan time.Time {
+	return c.NewTimer(d).C
+}
+
+// NewTimer creates a Timer, which sends the current time on its channel,
+// once the Clock advanced by d.
+func (c *Clock) NewTimer(d time.Duration) *Timer {
+	ch := make(chan time.Time, 1)
+	t := &Timer{C: ch, c: c, ch: ch, idx: -1}
+	c.start(t, d)
+	return t
+}
+
+// AfterFunc creates a Timer, which calls f once the Clock advanced by d. f is
+// called synchronously by the goroutine advancing the Clock, so it must not
+// block and must not advance the Clock itself.
+func (c *Clock) AfterFunc(d time.Duration, f func()) *Timer {
+	t := &Timer{c: c, f: f, idx: -1}
+	c.start(t, d)
+	return t
+}
+
+// afterFunc is like AfterFunc, but the Timer is not counted by Pending and
+// BlockUntil.
+func (c *Clock) afterFunc(d time.Duration, f func()) *Timer {
+	t := &Timer{c: c, f: f, idx: -1, internal: true}
+	c.start(t, d)
+	return t
+}
+
+func (c *Clock) start(t *Timer, d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.seq++
+	t.when, t.seq = c.now.Add(d), c.seq
+	heap.Push(&c.timers, t)
+	if !t.internal {
+		c.pending++
+	}
+	c.cond.Broadcast()
+}
+
+// Advance advances the Clock by d, firing all timers which expire in that
+// time.
+func (c *Clock) Advance(d time.Duration) {
+	c.AdvanceTo(c.Now().Add(d))
+}
+
+// AdvanceTo advances the Clock to t, firing all timers which expire until
+// then. Timers are fired one at a time, in the order of their expiry and
+// creation, with the Clock set to their expiry time. If t is before the
+// current time, AdvanceTo only fires expired timers.
+func (c *Clock) AdvanceTo(t time.Time) {
+	for c.fireNext(t) {
+	}
+	c.mu.Lock()
+	if t.After(c.now) {
+		c.now = t
+	}
+	c.mu.Unlock()
+}
+
+// Next advances the Clock to the expiry of the next timer and fires it (and
+// all other timers expiring at the same time). It returns false, if there is
+// no pending timer.
+func (c *Clock) Next() bool {
+	c.mu.Lock()
+	if len(c.timers) == 0 {
+		c.mu.Unlock()
+		return false
+	}
+	when := c.timers[0].when
+	c.mu.Unlock()
+	c.AdvanceTo(when)
+	return true
+}
+
+// fireNext fires the next timer expiring no later than t. It returns false,
+// if there is none.
+func (c *Clock) fireNext(t time.Time) bool {
+	c.mu.Lock()
+	if len(c.timers) == 0 || c.timers[0].when.After(t) {
+		c.mu.Unlock()
+		return false
+	}
+	tm := heap.Pop(&c.timers).(*Timer)
+	if !tm.internal {
+		c.pending--
+	}
+	if tm.when.After(c.now) {
+		c.now = tm.when
+	}
+	now := c.now
+	c.cond.Broadcast()
+	c.mu.Unlock()
+
+	if tm.f != nil {
+		tm.f()
+	} else {
+		select {
+		case tm.ch <- now:
+		default:
+		}
+	}
+	return true
+}
+
+// Pending returns the number of timers which have not fired yet. Deadlines of
+// connections created by Pipe are not counted.
+func (c *Clock) Pending() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.pending
+}
+
+// BlockUntil blocks until at least n timers are pending, as reported by
+// Pending. It can be used to wait for the code under test to reach a Sleep,
+// before advancing the Clock.
+func (c *Clock) BlockUntil(n int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for c.pending < n {
+		c.cond.Wait()
+	}
+}
+
+// Timer is a timer of a Clock. It behaves like a time.Timer.
+type Timer struct {
+	C <-chan time.Time
+
+	c    *Clock
+	ch   chan time.Time
+	f    func()
+	when time.Time
+	seq  uint64
+	idx  int
+
+	internal bool
+}
+
+// Stop prevents the Timer from firing. It returns false, if the Timer
+// already fired or was stopped.
+func (t *Timer) Stop() bool {
+	t.c.mu.Lock()
+	defer t.c.mu.Unlock()
+	if t.idx < 0 {
+		return false
+	}
+	heap.Remove(&t.c.timers, t.idx)
+	if !t.internal {
+		t.c.pending--
+	}
+	t.c.cond.Broadcast()
+	return true
+}
+
+// Reset changes the Timer to expire after d. It returns true, if the Timer
+// was pending.
+func (t *Timer) Reset(d time.Duration) bool {
+	active := t.Stop()
+	t.c.start(t, d)
+	return active
+}
+
+// timerHeap implements heap.Interface, ordering timers by expiry and
+// creation.
+type timerHeap []*Timer
+
+func (h timerHeap) Len() int { return len(h) }
+
+func (h timerHeap) Less(i, j int) bool {
+	if !h[i].when.Equal(h[j].when) {
+		return h[i].when.Before(h[j].when)
+	}
+	return h[i].seq < h[j].seq
+}
+
+func (h timerHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].idx, h[j].idx = i, j
+}
+
+func (h *timerHeap) Push(x interface{}) {
+	t := x.(*Timer)
+	t.idx = len(*h)
+	*h = append(*h, t)
+}
+
+func (h *timerHeap) Pop() interface{} {
+	old := *h
+	t := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	t.idx = -1
+	return t
+}
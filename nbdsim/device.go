@@ -0,0 +1,114 @@
+// Copyright 2018 Axel Wagner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nbdsim
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/Merovius/nbd"
+)
+
+// OpType is the type of an operation on a Device.
+type OpType int
+
+// Types of operations.
+const (
+	Read OpType = iota
+	Write
+	Sync
+)
+
+func (t OpType) String() string {
+	switch t {
+	case Read:
+		return "read"
+	case Write:
+		return "write"
+	case Sync:
+		return "sync"
+	default:
+		return "invalid"
+	}
+}
+
+// Op describes an operation on a Device.
+type Op struct {
+	Type OpType
+	// N is the number of the operation, starting at 1. All types of
+	// operations are counted.
+	N      uint64
+	Offset int64
+	Length int
+	// Time is the virtual time at which the operation started.
+	Time time.Time
+}
+
+// Device wraps an nbd.Device to inject latency and faults, using a virtual
+// Clock.
+type Device struct {
+	nbd.Device
+	Clock *Clock
+
+	// Latency, if not nil, returns the latency of op. The operation sleeps
+	// on the Clock for that duration before it is executed.
+	Latency func(op Op) time.Duration
+	// Fault, if not nil, is called after the latency passed. If it returns
+	// an error, op fails with that error instead of being executed.
+	Fault func(op Op) error
+
+	n uint64
+}
+
+// ReadAt implements nbd.Device.
+func (d *Device) ReadAt(p []byte, off int64) (int, error) {
+	if err := d.op(Read, off, len(p)); err != nil {
+		return 0, err
+	}
+	return d.Device.ReadAt(p, off)
+}
+
+// WriteAt implements nbd.Device.
+func (d *Device) WriteAt(p []byte, off int64) (int, error) {
+	if err := d.op(Write, off, len(p)); err != nil {
+		return 0, err
+	}
+	return d.Device.WriteAt(p, off)
+}
+
+// Sync implements nbd.Device.
+func (d *Device) Sync() error {
+	if err := d.op(Sync, 0, 0); err != nil {
+		return err
+	}
+	return d.Device.Sync()
+}
+
+func (d *Device) op(typ OpType, off int64, length int) error {
+	op := Op{
+		Type:   typ,
+		N:      atomic.AddUint64(&d.n, 1),
+		Offset: off,
+		Length: length,
+		Time:   d.Clock.Now(),
+	}
+	if d.Latency != nil {
+		d.Clock.Sleep(d.Latency(op))
+	}
+	if d.Fault != nil {
+		return d.Fault(op)
+	}
+	return nil
+}
@@ -0,0 +1,186 @@
+// Copyright 2018 Axel Wagner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nbdsim
+
+import (
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// Pipe creates an in-memory, full duplex connection, whose deadlines use the
+// virtual time of c. Unlike net.Pipe, writes are buffered and never block, so
+// a single goroutine can write a request and then read the reply.
+//
+// A Server notices the cancellation of its context by polling with deadlines
+// in real time. As the Clock should start at a time long before that (like
+// the zero time), these deadlines don't expire on a Pipe and connections
+// served on it must be closed to stop serving them.
+func Pipe(c *Clock) (net.Conn, net.Conn) {
+	p := &pipe{clock: c}
+	p.cond.L = &p.mu
+	a := &pipeConn{p: p, id: 0}
+	b := &pipeConn{p: p, id: 1}
+	return a, b
+}
+
+// pipe is the state shared by both ends of a Pipe.
+type pipe struct {
+	clock *Clock
+
+	mu   sync.Mutex
+	cond sync.Cond
+	// buf[i] is the data written by end i, which was not read yet.
+	buf    [2][]byte
+	closed [2]bool
+}
+
+type pipeConn struct {
+	p  *pipe
+	id int
+
+	// Protected by p.mu.
+	rdl, wdl deadline
+}
+
+// deadline is a deadline on the virtual clock.
+type deadline struct {
+	t       *Timer
+	expired bool
+}
+
+// set sets the deadline to t. p.mu must be held.
+func (d *deadline) set(p *pipe, t time.Time) {
+	if d.t != nil {
+		d.t.Stop()
+		d.t = nil
+	}
+	d.expired = false
+	if t.IsZero() {
+		return
+	}
+	dur := t.Sub(p.clock.Now())
+	if dur <= 0 {
+		d.expired = true
+		p.cond.Broadcast()
+		return
+	}
+	var tm *Timer
+	tm = p.clock.afterFunc(dur, func() {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		// The deadline might have been changed concurrently.
+		if d.t == tm {
+			d.expired = true
+			p.cond.Broadcast()
+		}
+	})
+	d.t = tm
+}
+
+func (c *pipeConn) Read(b []byte) (int, error) {
+	p := c.p
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for {
+		switch {
+		case p.closed[c.id]:
+			return 0, net.ErrClosed
+		case c.rdl.expired:
+			return 0, timeoutError{}
+		case len(p.buf[1-c.id]) > 0:
+			n := copy(b, p.buf[1-c.id])
+			p.buf[1-c.id] = p.buf[1-c.id][n:]
+			return n, nil
+		case p.closed[1-c.id]:
+			return 0, io.EOF
+		}
+		p.cond.Wait()
+	}
+}
+
+func (c *pipeConn) Write(b []byte) (int, error) {
+	p := c.p
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	switch {
+	case p.closed[c.id]:
+		return 0, net.ErrClosed
+	case c.wdl.expired:
+		return 0, timeoutError{}
+	case p.closed[1-c.id]:
+		return 0, io.ErrClosedPipe
+	}
+	p.buf[c.id] = append(p.buf[c.id], b...)
+	p.cond.Broadcast()
+	return len(b), nil
+}
+
+func (c *pipeConn) Close() error {
+	p := c.p
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed[c.id] {
+		return net.ErrClosed
+	}
+	p.closed[c.id] = true
+	c.rdl.set(p, time.Time{})
+	c.wdl.set(p, time.Time{})
+	p.cond.Broadcast()
+	return nil
+}
+
+func (c *pipeConn) LocalAddr() net.Addr  { return pipeAddr(c.id) }
+func (c *pipeConn) RemoteAddr() net.Addr { return pipeAddr(1 - c.id) }
+
+func (c *pipeConn) SetDeadline(t time.Time) error {
+	c.p.mu.Lock()
+	defer c.p.mu.Unlock()
+	c.rdl.set(c.p, t)
+	c.wdl.set(c.p, t)
+	return nil
+}
+
+func (c *pipeConn) SetReadDeadline(t time.Time) error {
+	c.p.mu.Lock()
+	defer c.p.mu.Unlock()
+	c.rdl.set(c.p, t)
+	return nil
+}
+
+func (c *pipeConn) SetWriteDeadline(t time.Time) error {
+	c.p.mu.Lock()
+	defer c.p.mu.Unlock()
+	c.wdl.set(c.p, t)
+	return nil
+}
+
+type pipeAddr int
+
+func (pipeAddr) Network() string { return "nbdsim" }
+
+func (a pipeAddr) String() string {
+	if a == 0 {
+		return "nbdsim:0"
+	}
+	return "nbdsim:1"
+}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
@@ -0,0 +1,67 @@
+// Copyright 2018 Axel Wagner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nbdtest
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/Merovius/nbd"
+)
+
+// Pair serves d as an export of the given size and returns a Device
+// accessing it through the NBD protocol, over an in-process connection. This
+// allows testing Devices and wrappers end to end, without sockets, root
+// privileges or the kernel module. The server is stopped at the end of the
+// test.
+func Pair(tb testing.TB, d nbd.Device, size uint64) nbd.Device {
+	tb.Helper()
+	srv := &nbd.Server{
+		Exports: []nbd.Export{{
+			Size:   size,
+			Device: d,
+		}},
+	}
+	return PairServer(tb, srv, "")
+}
+
+// PairServer is like Pair, but uses srv and opens the export with the given
+// name. If name is empty, the default export is opened.
+func PairServer(tb testing.TB, srv *nbd.Server, name string) nbd.Device {
+	tb.Helper()
+	sc, cc := net.Pipe()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- srv.ServeConn(ctx, sc)
+		sc.Close()
+	}()
+	tb.Cleanup(func() {
+		cancel()
+		cc.Close()
+		<-done
+	})
+
+	cl, err := nbd.ClientHandshake(ctx, cc)
+	if err != nil {
+		tb.Fatalf("handshake failed: %v", err)
+	}
+	c, err := cl.Open(name)
+	if err != nil {
+		tb.Fatalf("opening export %q failed: %v", name, err)
+	}
+	return c
+}
@@ -0,0 +1,364 @@
+// Copyright 2018 Axel Wagner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package nbdtest provides utilities for testing code using package nbd.
+package nbdtest
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// Event is a chunk of data transferred over a recorded connection.
+type Event struct {
+	// Write is true, if the data was written by the recorded side and false,
+	// if it was read.
+	Write bool
+	Data  []byte
+}
+
+// Recording is the sequence of data transferred over a connection.
+// Consecutive chunks transferred in the same direction are merged.
+type Recording []Event
+
+// recordingMagic starts every encoded Recording.
+const recordingMagic = "NBDREC1\n"
+
+// WriteTo writes an encoded form of r to w, which can be read back with
+// ReadRecording. This can be used to store recordings as test data.
+func (r Recording) WriteTo(w io.Writer) (int64, error) {
+	var buf bytes.Buffer
+	buf.WriteString(recordingMagic)
+	for _, ev := range r {
+		dir := byte('r')
+		if ev.Write {
+			dir = 'w'
+		}
+		var hdr [5]byte
+		hdr[0] = dir
+		binary.BigEndian.PutUint32(hdr[1:], uint32(len(ev.Data)))
+		buf.Write(hdr[:])
+		buf.Write(ev.Data)
+	}
+	return buf.WriteTo(w)
+}
+
+// ReadRecording reads a Recording written by Recording.WriteTo.
+func ReadRecording(r io.Reader) (Recording, error) {
+	br := bufio.NewReader(r)
+	magic := make([]byte, len(recordingMagic))
+	if _, err := io.ReadFull(br, magic); err != nil || string(magic) != recordingMagic {
+		return nil, errors.New("nbdtest: not a recording")
+	}
+	var rec Recording
+	for {
+		var hdr [5]byte
+		if _, err := io.ReadFull(br, hdr[:]); err == io.EOF {
+			return rec, nil
+		} else if err != nil {
+			return nil, err
+		}
+		if hdr[0] != 'r' && hdr[0] != 'w' {
+			return nil, fmt.Errorf("nbdtest: invalid direction %q in recording", hdr[0])
+		}
+		data := make([]byte, binary.BigEndian.Uint32(hdr[1:]))
+		if _, err := io.ReadFull(br, data); err != nil {
+			return nil, err
+		}
+		rec = append(rec, Event{hdr[0] == 'w', data})
+	}
+}
+
+// Recorder is a net.Conn recording all data transferred over it.
+type Recorder struct {
+	net.Conn
+
+	mu  sync.Mutex
+	rec Recording
+}
+
+// Record returns a Recorder wrapping c.
+func Record(c net.Conn) *Recorder {
+	return &Recorder{Conn: c}
+}
+
+func (r *Recorder) Read(p []byte) (int, error) {
+	n, err := r.Conn.Read(p)
+	r.add(false, p[:n])
+	return n, err
+}
+
+func (r *Recorder) Write(p []byte) (int, error) {
+	n, err := r.Conn.Write(p)
+	r.add(true, p[:n])
+	return n, err
+}
+
+func (r *Recorder) add(write bool, p []byte) {
+	if len(p) == 0 {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if n := len(r.rec); n > 0 && r.rec[n-1].Write == write {
+		r.rec[n-1].Data = append(r.rec[n-1].Data, p...)
+		return
+	}
+	r.rec = append(r.rec, Event{write, append([]byte(nil), p...)})
+}
+
+// Recording returns the data transferred so far.
+func (r *Recorder) Recording() Recording {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	rec := make(Recording, len(r.rec))
+	for i, ev := range r.rec {
+		rec[i] = Event{ev.Write, append([]byte(nil), ev.Data...)}
+	}
+	return rec
+}
+
+// MismatchError is returned by a Replayer, if data is written which differs
+// from the Recording.
+type MismatchError struct {
+	// Offset is the offset into the stream of written data, at which the
+	// mismatch occurred.
+	Offset int64
+	Want   []byte
+	Got    []byte
+}
+
+func (e *MismatchError) Error() string {
+	return fmt.Sprintf("nbdtest: replay mismatch at write offset %d: got %x, want %x", e.Offset, e.Got, e.Want)
+}
+
+// Replayer is a net.Conn replaying a Recording. It takes the place of the
+// recorded side's connection: reads return the data read in the recording
+// and writes are compared to the data written in it.
+//
+// Data which was read after some data was written in the recording is only
+// returned once that data was written, so the interleaving is reproduced
+// deterministically. This requires the code under test to behave
+// deterministically (e.g. a Server must not execute requests concurrently).
+type Replayer struct {
+	mu  sync.Mutex
+	rec Recording
+	// i is the index of the current event and off the offset into it.
+	i   int
+	off int
+	// written is the number of bytes written so far.
+	written int64
+	err     error
+	closed  bool
+	rdl     time.Time
+	wdl     time.Time
+	// changed is closed and replaced whenever the state changes.
+	changed chan struct{}
+}
+
+// Replay returns a Replayer for rec.
+func Replay(rec Recording) *Replayer {
+	return &Replayer{
+		rec:     rec,
+		changed: make(chan struct{}),
+	}
+}
+
+// Err returns the first mismatch of the written data, if any.
+func (r *Replayer) Err() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.err
+}
+
+// Done returns whether the Recording was replayed entirely.
+func (r *Replayer) Done() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.i == len(r.rec)
+}
+
+// notifyLocked wakes up blocked calls. r.mu must be held.
+func (r *Replayer) notifyLocked() {
+	close(r.changed)
+	r.changed = make(chan struct{})
+}
+
+// advanceLocked moves to the next event, if the current one is done. r.mu
+// must be held.
+func (r *Replayer) advanceLocked() {
+	for r.i < len(r.rec) && r.off == len(r.rec[r.i].Data) {
+		r.i, r.off = r.i+1, 0
+	}
+	r.notifyLocked()
+}
+
+// waitLocked waits until the state of r changes or the deadline dl passes.
+// r.mu must be held.
+func (r *Replayer) waitLocked(dl time.Time) error {
+	ch := r.changed
+	var timeout <-chan time.Time
+	if !dl.IsZero() {
+		d := time.Until(dl)
+		if d <= 0 {
+			return timeoutError{}
+		}
+		t := time.NewTimer(d)
+		defer t.Stop()
+		timeout = t.C
+	}
+	r.mu.Unlock()
+	defer r.mu.Lock()
+	select {
+	case <-ch:
+		return nil
+	case <-timeout:
+		return timeoutError{}
+	}
+}
+
+func (r *Replayer) Read(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for {
+		switch {
+		case r.closed:
+			return 0, net.ErrClosed
+		case r.err != nil:
+			return 0, r.err
+		case r.i == len(r.rec):
+			return 0, io.EOF
+		case !r.rec[r.i].Write:
+			n := copy(p, r.rec[r.i].Data[r.off:])
+			r.off += n
+			r.advanceLocked()
+			return n, nil
+		}
+		if err := r.waitLocked(r.rdl); err != nil {
+			return 0, err
+		}
+	}
+}
+
+func (r *Replayer) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var n int
+	for n < len(p) {
+		switch {
+		case r.closed:
+			return n, net.ErrClosed
+		case r.err != nil:
+			return n, r.err
+		case r.i == len(r.rec):
+			r.err = &MismatchError{Offset: r.written, Got: append([]byte(nil), p[n:]...)}
+			r.notifyLocked()
+			return n, r.err
+		case r.rec[r.i].Write:
+			want := r.rec[r.i].Data[r.off:]
+			got := p[n:]
+			if len(got) > len(want) {
+				got = got[:len(want)]
+			}
+			if i := mismatch(got, want); i >= 0 {
+				r.err = &MismatchError{
+					Offset: r.written + int64(i),
+					Got:    append([]byte(nil), got[i:]...),
+					Want:   append([]byte(nil), want[i:len(got)]...),
+				}
+				r.notifyLocked()
+				return n, r.err
+			}
+			n += len(got)
+			r.off += len(got)
+			r.written += int64(len(got))
+			r.advanceLocked()
+			continue
+		}
+		if err := r.waitLocked(r.wdl); err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// mismatch returns the first index at which got and want differ, or -1.
+func mismatch(got, want []byte) int {
+	for i := range got {
+		if got[i] != want[i] {
+			return i
+		}
+	}
+	return -1
+}
+
+// Close closes r. Blocked reads and writes return an error.
+func (r *Replayer) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.closed = true
+	r.notifyLocked()
+	return nil
+}
+
+// LocalAddr implements net.Conn.
+func (r *Replayer) LocalAddr() net.Addr { return replayAddr{} }
+
+// RemoteAddr implements net.Conn.
+func (r *Replayer) RemoteAddr() net.Addr { return replayAddr{} }
+
+// SetDeadline implements net.Conn.
+func (r *Replayer) SetDeadline(t time.Time) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.rdl, r.wdl = t, t
+	r.notifyLocked()
+	return nil
+}
+
+// SetReadDeadline implements net.Conn.
+func (r *Replayer) SetReadDeadline(t time.Time) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.rdl = t
+	r.notifyLocked()
+	return nil
+}
+
+// SetWriteDeadline implements net.Conn.
+func (r *Replayer) SetWriteDeadline(t time.Time) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.wdl = t
+	r.notifyLocked()
+	return nil
+}
+
+type replayAddr struct{}
+
+func (replayAddr) Network() string { return "replay" }
+func (replayAddr) String() string  { return "replay" }
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
@@ -0,0 +1,307 @@
+// Copyright 2018 Axel Wagner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package nbduri parses and formats NBD URIs and export specifications.
+//
+// NBD URIs are specified in
+// https://github.com/NetworkBlockDevice/nbd/blob/master/doc/uri.md and are
+// also understood by qemu, nbdkit and libnbd. Examples are
+//
+//	nbd://example.com/disk
+//	nbds://example.com:10810/disk?tls-certificates=/etc/pki/nbd
+//	nbd+unix:///disk?socket=/run/nbd.sock
+//	nbd+vsock://2:10809/disk
+//
+// An empty export name (e.g. nbd://example.com) selects the default export.
+package nbduri
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// DefaultPort is the port used, if a URI does not specify one.
+const DefaultPort = 10809
+
+// Networks of a URI.
+const (
+	TCP   = "tcp"
+	Unix  = "unix"
+	Vsock = "vsock"
+)
+
+// Query parameters with a dedicated field in URI.
+const (
+	paramSocket          = "socket"
+	paramTLSCertificates = "tls-certificates"
+	paramTLSPSKFile      = "tls-psk-file"
+	paramTLSHostname     = "tls-hostname"
+	paramTLSVerifyPeer   = "tls-verify-peer"
+)
+
+// URI is a parsed NBD URI.
+type URI struct {
+	// TLS is true, if the connection must use TLS (nbds schemes).
+	TLS bool
+	// Network is one of TCP, Unix or Vsock.
+	Network string
+	// Addr is the address of the server: host:port for TCP, the path of the
+	// socket for Unix and cid:port for Vsock.
+	Addr string
+	// Export is the name of the export. If it is empty, the default export is
+	// used.
+	Export string
+
+	// TLSCertificates is a directory containing certificates (in the layout
+	// used by qemu and nbdkit) to use for TLS.
+	TLSCertificates string
+	// TLSPSKFile is a file containing pre-shared keys to use for TLS.
+	TLSPSKFile string
+	// TLSHostname overrides the hostname used to verify the certificate of
+	// the server.
+	TLSHostname string
+	// TLSSkipVerify disables verification of the server certificate
+	// (tls-verify-peer=false).
+	TLSSkipVerify bool
+
+	// Query contains all other query parameters.
+	Query url.Values
+}
+
+// Parse parses an NBD URI.
+func Parse(s string) (*URI, error) {
+	pu, err := url.Parse(s)
+	if err != nil {
+		return nil, err
+	}
+	u := new(URI)
+	scheme := pu.Scheme
+	if strings.HasPrefix(scheme, "nbds") {
+		u.TLS = true
+		scheme = "nbd" + scheme[len("nbds"):]
+	}
+	switch scheme {
+	case "nbd":
+		u.Network = TCP
+	case "nbd+unix":
+		u.Network = Unix
+	case "nbd+vsock":
+		u.Network = Vsock
+	default:
+		return nil, fmt.Errorf("invalid NBD URI %q: unknown scheme %q", s, pu.Scheme)
+	}
+	if pu.User != nil || pu.Opaque != "" || pu.Fragment != "" {
+		return nil, fmt.Errorf("invalid NBD URI %q", s)
+	}
+	if p := pu.Path; p != "" {
+		if p[0] != '/' {
+			return nil, fmt.Errorf("invalid NBD URI %q: path must be absolute", s)
+		}
+		u.Export = p[1:]
+	}
+
+	q := pu.Query()
+	switch u.Network {
+	case TCP:
+		if pu.Hostname() == "" {
+			return nil, fmt.Errorf("invalid NBD URI %q: missing host", s)
+		}
+		port := pu.Port()
+		if port == "" {
+			port = strconv.Itoa(DefaultPort)
+		}
+		u.Addr = net.JoinHostPort(pu.Hostname(), port)
+	case Unix:
+		if pu.Host != "" {
+			return nil, fmt.Errorf("invalid NBD URI %q: unix URIs must not have a host", s)
+		}
+		if u.Addr = q.Get(paramSocket); u.Addr == "" {
+			return nil, fmt.Errorf("invalid NBD URI %q: missing socket parameter", s)
+		}
+	case Vsock:
+		cid, err := strconv.ParseUint(pu.Hostname(), 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid NBD URI %q: invalid CID %q", s, pu.Hostname())
+		}
+		port := uint64(DefaultPort)
+		if p := pu.Port(); p != "" {
+			if port, err = strconv.ParseUint(p, 10, 32); err != nil {
+				return nil, fmt.Errorf("invalid NBD URI %q: invalid port %q", s, p)
+			}
+		}
+		u.Addr = fmt.Sprintf("%d:%d", cid, port)
+	}
+	q.Del(paramSocket)
+
+	u.TLSCertificates = q.Get(paramTLSCertificates)
+	u.TLSPSKFile = q.Get(paramTLSPSKFile)
+	u.TLSHostname = q.Get(paramTLSHostname)
+	if v := q.Get(paramTLSVerifyPeer); v != "" {
+		verify, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid NBD URI %q: invalid %s %q", s, paramTLSVerifyPeer, v)
+		}
+		u.TLSSkipVerify = !verify
+	}
+	for _, k := range []string{paramTLSCertificates, paramTLSPSKFile, paramTLSHostname, paramTLSVerifyPeer} {
+		q.Del(k)
+	}
+	if len(q) > 0 {
+		u.Query = q
+	}
+	return u, nil
+}
+
+// String formats u as an NBD URI. It is the inverse of Parse.
+func (u *URI) String() string {
+	pu := &url.URL{
+		Scheme: "nbd",
+		Path:   "/" + u.Export,
+	}
+	if u.Export == "" {
+		pu.Path = ""
+	}
+	if u.TLS {
+		pu.Scheme = "nbds"
+	}
+	q := make(url.Values)
+	for k, v := range u.Query {
+		q[k] = v
+	}
+	switch u.Network {
+	case Unix:
+		pu.Scheme += "+unix"
+		pu.Path = "/" + u.Export
+		q.Set(paramSocket, u.Addr)
+	case Vsock:
+		pu.Scheme += "+vsock"
+		pu.Host = u.Addr
+	default:
+		pu.Host = u.Addr
+	}
+	if u.TLSCertificates != "" {
+		q.Set(paramTLSCertificates, u.TLSCertificates)
+	}
+	if u.TLSPSKFile != "" {
+		q.Set(paramTLSPSKFile, u.TLSPSKFile)
+	}
+	if u.TLSHostname != "" {
+		q.Set(paramTLSHostname, u.TLSHostname)
+	}
+	if u.TLSSkipVerify {
+		q.Set(paramTLSVerifyPeer, "false")
+	}
+	pu.RawQuery = q.Encode()
+	return pu.String()
+}
+
+// Dial connects to the server addressed by u. Vsock is not supported, as the
+// standard library can not dial it.
+func (u *URI) Dial(ctx context.Context) (net.Conn, error) {
+	switch u.Network {
+	case TCP, Unix:
+		return new(net.Dialer).DialContext(ctx, u.Network, u.Addr)
+	case Vsock:
+		return nil, errors.New("dialing vsock is not supported by nbduri")
+	default:
+		return nil, fmt.Errorf("unknown network %q", u.Network)
+	}
+}
+
+// TLSConfig returns the client configuration for connecting to u with TLS.
+// If TLSCertificates is set, the CA certificate and the (optional) client
+// certificate are read from it, using the file names of qemu and nbdkit:
+// ca-cert.pem, client-cert.pem and client-key.pem. Otherwise, the system
+// roots are used. Pre-shared keys are not supported by crypto/tls, so
+// TLSConfig fails if TLSPSKFile is set.
+func (u *URI) TLSConfig() (*tls.Config, error) {
+	if u.TLSPSKFile != "" {
+		return nil, errors.New("TLS with pre-shared keys is not supported")
+	}
+	c := &tls.Config{
+		ServerName:         u.TLSHostname,
+		InsecureSkipVerify: u.TLSSkipVerify,
+	}
+	if c.ServerName == "" && u.Network == TCP {
+		host, _, err := net.SplitHostPort(u.Addr)
+		if err != nil {
+			return nil, err
+		}
+		c.ServerName = host
+	}
+	if u.TLSCertificates == "" {
+		return c, nil
+	}
+	ca, err := os.ReadFile(filepath.Join(u.TLSCertificates, "ca-cert.pem"))
+	if err != nil {
+		return nil, err
+	}
+	c.RootCAs = x509.NewCertPool()
+	if !c.RootCAs.AppendCertsFromPEM(ca) {
+		return nil, fmt.Errorf("no certificates found in %s", filepath.Join(u.TLSCertificates, "ca-cert.pem"))
+	}
+	certFile := filepath.Join(u.TLSCertificates, "client-cert.pem")
+	if _, err := os.Stat(certFile); err == nil {
+		cert, err := tls.LoadX509KeyPair(certFile, filepath.Join(u.TLSCertificates, "client-key.pem"))
+		if err != nil {
+			return nil, err
+		}
+		c.Certificates = []tls.Certificate{cert}
+	}
+	return c, nil
+}
+
+// ExportSpec specifies an export to be served, in the form [name=]path.
+type ExportSpec struct {
+	// Name is the name of the export.
+	Name string
+	// Path is the path of the file backing the export.
+	Path string
+}
+
+// ParseExport parses an export specification of the form [name=]path. If no
+// name is given, the base name of the path is used. The path can also be a
+// URL, in which case a "=" in its query does not separate a name.
+func ParseExport(s string) (ExportSpec, error) {
+	var e ExportSpec
+	if i := strings.IndexByte(s, '='); i >= 0 && !strings.Contains(s[:i], "://") {
+		e.Name, e.Path = s[:i], s[i+1:]
+	} else if pu, err := url.Parse(s); err == nil && pu.Scheme != "" && pu.Host != "" {
+		e.Name, e.Path = path.Base(pu.Path), s
+	} else {
+		e.Name, e.Path = filepath.Base(s), s
+	}
+	if e.Path == "" {
+		return ExportSpec{}, fmt.Errorf("invalid export %q: missing path", s)
+	}
+	return e, nil
+}
+
+// String formats e as an export specification.
+func (e ExportSpec) String() string {
+	if e.Name == filepath.Base(e.Path) && !strings.Contains(e.Path, "=") {
+		return e.Path
+	}
+	return e.Name + "=" + e.Path
+}
@@ -0,0 +1,155 @@
+// Copyright 2018 Axel Wagner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package nbdws tunnels NBD connections over WebSocket.
+//
+// This allows serving exports through HTTP(S)-only ingresses and proxies. The
+// NBD stream is sent unmodified in binary messages, which may be split at
+// arbitrary points. A server is added to an HTTP server with Handler:
+//
+//	http.Handle("/nbd", nbdws.Handler(srv))
+//
+// and clients connect with Dial:
+//
+//	c, err := nbdws.Dial(ctx, "wss://example.com/nbd", nil)
+//	if err != nil {
+//		return err
+//	}
+//	cl, err := nbd.ClientHandshake(ctx, c)
+//
+// Connections tunneled over WebSocket can not be passed to the kernel.
+package nbdws
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/Merovius/nbd"
+	"golang.org/x/net/websocket"
+)
+
+// Protocol is the WebSocket subprotocol requested by Dial.
+const Protocol = "nbd"
+
+// Handler returns an http.Handler serving NBD over WebSocket, using srv. The
+// connection is served until the client disconnects or the request context
+// is cancelled. The Origin of requests is not checked.
+func Handler(srv *nbd.Server) http.Handler {
+	return websocket.Server{
+		Handshake: handshake,
+		Handler: func(ws *websocket.Conn) {
+			ws.PayloadType = websocket.BinaryFrame
+			c := &serverConn{Conn: ws}
+			ctx := ws.Request().Context()
+			stop := c.closeOnDone(ctx)
+			defer stop()
+			srv.ServeConn(ctx, c)
+		},
+	}
+}
+
+// handshake selects Protocol, if the client offered it. Clients not
+// requesting any subprotocol are accepted as well.
+func handshake(config *websocket.Config, r *http.Request) error {
+	for _, p := range config.Protocol {
+		if p == Protocol {
+			config.Protocol = []string{Protocol}
+			return nil
+		}
+	}
+	config.Protocol = nil
+	return nil
+}
+
+// serverConn is a WebSocket connection served by an nbd.Server.
+//
+// The Server polls for cancellation using read deadlines and continues
+// reading after a timeout. A timeout in the middle of a frame header would
+// corrupt the WebSocket stream, so deadlines are ignored and the connection
+// is closed when the context is cancelled instead.
+type serverConn struct {
+	*websocket.Conn
+	once sync.Once
+}
+
+func (c *serverConn) closeOnDone(ctx context.Context) (stop func()) {
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			c.Close()
+		case <-done:
+		}
+	}()
+	return func() { close(done) }
+}
+
+func (c *serverConn) Close() error {
+	var err error
+	c.once.Do(func() { err = c.Conn.Close() })
+	return err
+}
+
+// RemoteAddr returns the address of the HTTP client. websocket.Conn returns
+// the Origin instead, which NBD clients usually don't set.
+func (c *serverConn) RemoteAddr() net.Addr {
+	return httpAddr(c.Request().RemoteAddr)
+}
+
+func (c *serverConn) SetDeadline(t time.Time) error      { return nil }
+func (c *serverConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *serverConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// httpAddr is the network address of an HTTP client.
+type httpAddr string
+
+func (httpAddr) Network() string  { return "tcp" }
+func (a httpAddr) String() string { return string(a) }
+
+// Dial connects to the NBD server at the given WebSocket URL (with scheme ws
+// or wss). If tlsConfig is not nil, it is used for wss connections. The
+// returned connection is in the handshake phase of the protocol.
+//
+// As with Handler, a timeout in the middle of a frame can corrupt the
+// connection, so it should be discarded after a timeout error.
+func Dial(ctx context.Context, rawurl string, tlsConfig *tls.Config) (net.Conn, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	origin := *u
+	switch u.Scheme {
+	case "wss":
+		origin.Scheme = "https"
+	default:
+		origin.Scheme = "http"
+	}
+	config, err := websocket.NewConfig(rawurl, origin.String())
+	if err != nil {
+		return nil, err
+	}
+	config.Protocol = []string{Protocol}
+	config.TlsConfig = tlsConfig
+	ws, err := config.DialContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	ws.PayloadType = websocket.BinaryFrame
+	return ws, nil
+}
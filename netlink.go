@@ -18,8 +18,13 @@ package nbd
 
 import (
 	"context"
+	"fmt"
+	"log/slog"
 	"net"
 	"os"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/Merovius/nbd/nbdnl"
 	"golang.org/x/sys/unix"
@@ -34,60 +39,381 @@ import (
 //
 // This is a Linux-only API.
 func Configure(e Export, socks ...*os.File) (uint32, error) {
-	var opts []nbdnl.ConnectOption
+	return configure(e, socks)
+}
+
+// loopbacks are the devices served by Loopback, by device index, so Resize
+// and Drain can find them.
+var loopbacks = struct {
+	sync.Mutex
+	m map[uint32]*LoopbackDevice
+}{m: make(map[uint32]*LoopbackDevice)}
+
+// LoopbackDevice is a device connected by LoopbackWithOptions.
+//
+// This is a Linux-only API.
+type LoopbackDevice struct {
+	// Index is the device-number chosen by the kernel, the device is
+	// /dev/nbd<Index>.
+	Index uint32
+
+	d    Device
+	srv  *Server
+	st   *exportState
+	wait func() error
+}
+
+// Wait blocks until the context passed to LoopbackWithOptions is cancelled or
+// an error occurs serving the device, which it returns (so it behaves like
+// Serve).
+func (l *LoopbackDevice) Wait() error {
+	return l.wait()
+}
+
+// Resize changes the size of the device to size, without disconnecting it.
+// If the Device implements Resizer, it is resized as well. Otherwise, it must
+// already accommodate the new size (e.g. its backing file must have been
+// grown). The kernel's view of the device is updated via netlink.
+func (l *LoopbackDevice) Resize(size uint64) error {
+	var r Resizer
+	hasResizer := As(l.d, &r)
+	// Grow the Device and export before the kernel's device and shrink them
+	// afterwards, so the kernel never sends requests beyond their end.
+	old := atomic.LoadUint64(&l.st.size)
+	if size > old {
+		if hasResizer {
+			if err := r.Resize(size); err != nil {
+				return err
+			}
+		}
+		l.srv.resizeState(l.st, size)
+	}
+	if err := nbdnl.Reconfigure(l.Index, nil, 0, 0, nbdnl.WithSize(size)); err != nil {
+		if size > old {
+			l.srv.resizeState(l.st, old)
+		}
+		return err
+	}
+	if size < old {
+		l.srv.resizeState(l.st, size)
+		if hasResizer {
+			return r.Resize(size)
+		}
+	}
+	return nil
+}
+
+// Resize changes the size of the connected device idx to size, without
+// disconnecting it. If the device was connected by Loopback in this process,
+// it is like LoopbackDevice.Resize. Otherwise, the server has to be resized
+// separately, e.g. with Server.ResizeExport.
+//
+// This is a Linux-only API.
+func Resize(idx uint32, size uint64) error {
+	loopbacks.Lock()
+	l := loopbacks.m[idx]
+	loopbacks.Unlock()
+	if l != nil {
+		return l.Resize(size)
+	}
+	return nbdnl.Reconfigure(idx, nil, 0, 0, nbdnl.WithSize(size))
+}
+
+// Reconfigure passes new sockets to the kernel for the device idx, connected
+// with Configure, without disconnecting it. Each socket replaces a connection
+// to a server which went away, e.g. because it was restarted. socks must be
+// connected to a server providing the same export and be in transmission
+// phase. See nbdnl.Reconfigure for details.
+//
+// This is a Linux-only API.
+func Reconfigure(idx uint32, e Export, socks ...*os.File) error {
+	return nbdnl.Reconfigure(idx, socks, 0, nbdnl.ServerFlags(e.Flags))
+}
+
+// configure is like Configure, but passes additional options to the kernel.
+func configure(e Export, socks []*os.File, opts ...nbdnl.ConnectOption) (uint32, error) {
 	if e.BlockSizes != nil {
 		opts = append(opts, nbdnl.WithBlockSize(uint64(e.BlockSizes.Preferred)))
 	}
 	return nbdnl.Connect(nbdnl.IndexAny, socks, e.Size, 0, nbdnl.ServerFlags(e.Flags), opts...)
 }
 
-// Loopback serves d on a private socket, passing the other end to the kernel
+// LoopbackOptions configures Loopback and LoopbackFile. The zero value uses
+// the defaults.
+type LoopbackOptions struct {
+	// BlockSize is the logical block size of the block device. It must be a
+	// power of two between 512 and the page size. If it is 0, 4096 is
+	// used.
+	BlockSize uint32
+	// Timeout is the time after which the kernel fails requests, which were
+	// not answered. If it is 0, the kernel default is used.
+	Timeout time.Duration
+	// RequestTimeout is the time after which requests still being executed
+	// by d fail, like Server.RequestTimeout. It should be shorter than
+	// Timeout, so the kernel gets an error instead of giving up on the
+	// connection.
+	RequestTimeout time.Duration
+	// Connections is the number of connections the kernel uses to the
+	// Device, which are serviced in parallel (the kernel uses one per
+	// hardware queue). d must then be safe for concurrent use. If it is <=
+	// 0, a single connection is used. LoopbackFile always uses a single
+	// connection.
+	Connections int
+	// Workers is the number of requests of each connection which are
+	// executed concurrently, like Server.Workers. The kernel keeps many
+	// requests in flight, so this hides the latency of Devices backed by
+	// e.g. the network. If it is > 1, d must be safe for concurrent use.
+	// If it is <= 1, the requests of a connection are executed serially.
+	Workers int
+	// ReadOnly serves d read-only. The kernel then marks the block device
+	// read-only, so file systems on it are mounted read-only by default, and
+	// writes fail with EPERM.
+	ReadOnly bool
+	// PartitionScan makes the kernel scan the device for partitions once it
+	// is connected, creating /dev/nbdXpY. This requires the nbd module to be
+	// loaded with max_part > 0.
+	PartitionScan bool
+	// Observer, if not nil, is notified about all requests of the kernel,
+	// like Server.Observer. The export has an empty name.
+	Observer Observer
+	// Logger, if not nil, is used like Server.Logger. Its records have the
+	// device as an additional "device" attribute: The index for Loopback,
+	// the path for LoopbackFile.
+	Logger *slog.Logger
+}
+
+// LoopbackOption configures Loopback.
+type LoopbackOption func(*LoopbackOptions)
+
+// LoopbackConnections sets LoopbackOptions.Connections to n.
+func LoopbackConnections(n int) LoopbackOption {
+	return func(o *LoopbackOptions) {
+		o.Connections = n
+	}
+}
+
+// LoopbackWorkers sets LoopbackOptions.Workers to n.
+func LoopbackWorkers(n int) LoopbackOption {
+	return func(o *LoopbackOptions) {
+		o.Workers = n
+	}
+}
+
+// LoopbackReadOnly sets LoopbackOptions.ReadOnly.
+func LoopbackReadOnly() LoopbackOption {
+	return func(o *LoopbackOptions) {
+		o.ReadOnly = true
+	}
+}
+
+// LoopbackLogger sets LoopbackOptions.Logger to l.
+func LoopbackLogger(l *slog.Logger) LoopbackOption {
+	return func(o *LoopbackOptions) {
+		o.Logger = l
+	}
+}
+
+// loopbackExport returns the export to serve d as, configured by o.
+func loopbackExport(d Device, size uint64, o *LoopbackOptions) Export {
+	bs := defaultBlockSizes
+	if o.BlockSize != 0 {
+		bs.Preferred = o.BlockSize
+	}
+	exp := Export{
+		Size:       size,
+		Device:     d,
+		BlockSizes: &bs,
+	}
+	exp.Flags = serverFlags(exp, false)
+	if o.ReadOnly {
+		exp.Flags |= FlagReadOnly
+	}
+	return exp
+}
+
+// deviceIndex is a slog.LogValuer for the index of a loopback device, which is
+// -1 until it is known.
+type deviceIndex struct {
+	idx int64
+}
+
+func (d *deviceIndex) LogValue() slog.Value {
+	if idx := atomic.LoadInt64(&d.idx); idx >= 0 {
+		return slog.Int64Value(idx)
+	}
+	return slog.StringValue("unknown")
+}
+
+// Drain gracefully disconnects the device idx connected by Loopback: Its
+// connections stop reading requests, answer the requests in flight and flush
+// the Device (see Server.Shutdown), before the device is disconnected with
+// nbdnl.Disconnect. Unlike disconnecting right away, this does not race with
+// writes being executed. Requests the kernel sends after the connections
+// stopped reading fail. If ctx is done before the connections are drained,
+// they are closed abruptly and ctx.Err is returned, after disconnecting the
+// device. Otherwise, the wait function returned by Loopback returns nil,
+// unless flushing failed.
+//
+// Devices not connected by Loopback in this process are disconnected right
+// away.
+//
+// This is a Linux-only API.
+func Drain(ctx context.Context, idx uint32) error {
+	loopbacks.Lock()
+	l := loopbacks.m[idx]
+	loopbacks.Unlock()
+	var err error
+	if l != nil {
+		err = l.srv.Shutdown(ctx)
+	}
+	if derr := nbdnl.Disconnect(idx); err == nil {
+		err = derr
+	}
+	return err
+}
+
+// scanPartitions asks the kernel to scan /dev/nbd<idx> for partitions.
+func scanPartitions(idx uint32) error {
+	f, err := os.Open(fmt.Sprintf("/dev/nbd%d", idx))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return ioctl(f, unix.BLKRRPART, 0)
+}
+
+// Loopback serves d on private sockets, passing the other ends to the kernel
 // to connect to an NBD device. It returns the device-number that the kernel
 // chose. wait should be called to check for errors from serving the device. It
 // blocks until ctx is cancelled or an error occurs (so it behaves like Serve).
 //
 // This is a Linux-only API.
-func Loopback(ctx context.Context, d Device, size uint64) (idx uint32, wait func() error, err error) {
-	sp, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_STREAM, 0)
+func Loopback(ctx context.Context, d Device, size uint64, opts ...LoopbackOption) (idx uint32, wait func() error, err error) {
+	var o LoopbackOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+	l, err := LoopbackWithOptions(ctx, d, size, &o)
 	if err != nil {
 		return 0, nil, err
 	}
-	exp := Export{
-		Size:       size,
-		Device:     d,
-		BlockSizes: &defaultBlockSizes,
-		Flags:      uint16(nbdnl.FlagHasFlags | nbdnl.FlagSendFlush),
+	return l.Index, l.Wait, nil
+}
+
+// LoopbackWithOptions is like Loopback, but configured by o. If o is nil, the
+// defaults are used. It returns the connected device.
+//
+// This is a Linux-only API.
+func LoopbackWithOptions(ctx context.Context, d Device, size uint64, o *LoopbackOptions) (*LoopbackDevice, error) {
+	if o == nil {
+		o = new(LoopbackOptions)
+	}
+	conns := o.Connections
+	if conns < 1 {
+		conns = 1
+	}
+	exp := loopbackExport(d, size, o)
+	if conns > 1 {
+		// All connections share the Device, so a flush on one of them
+		// persists the writes completed on all.
+		exp.Flags |= FlagCanMultiConn
 	}
 
-	client, server := os.NewFile(uintptr(sp[0]), "client"), os.NewFile(uintptr(sp[1]), "server")
-	serverc, err := net.FileConn(server)
-	server.Close()
-	if err != nil {
-		client.Close()
-		return 0, nil, err
+	var clients []*os.File
+	var servers []net.Conn
+	closeAll := func() {
+		for _, c := range clients {
+			c.Close()
+		}
+		for _, c := range servers {
+			c.Close()
+		}
+	}
+	for i := 0; i < conns; i++ {
+		sp, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_STREAM, 0)
+		if err != nil {
+			closeAll()
+			return nil, err
+		}
+		client, server := os.NewFile(uintptr(sp[0]), "client"), os.NewFile(uintptr(sp[1]), "server")
+		clients = append(clients, client)
+		serverc, err := net.FileConn(server)
+		server.Close()
+		if err != nil {
+			closeAll()
+			return nil, err
+		}
+		servers = append(servers, serverc)
 	}
 
 	ctx, cancel := context.WithCancel(ctx)
-	ch := make(chan error, 1)
 	go func() {
 		<-ctx.Done()
-		client.Close()
+		for _, c := range clients {
+			c.Close()
+		}
 	}()
-	go func() {
-		err := serve(ctx, serverc, connParameters{exp, defaultBlockSizes})
-		if e := ctx.Err(); e != nil {
-			err = e
+	// The index is only known once the device is connected, but the
+	// connections are already served before.
+	dev := &deviceIndex{idx: -1}
+	srv := &Server{Exports: []Export{exp}, Workers: o.Workers, Observer: o.Observer, RequestTimeout: o.RequestTimeout}
+	if o.Logger != nil {
+		srv.Logger = o.Logger.With("device", dev)
+	}
+	_, states := srv.snapshot()
+	ch := make(chan error, len(servers))
+	for _, serverc := range servers {
+		go func(serverc net.Conn) {
+			err := srv.serve(ctx, serverc, connParameters{Export: exp, BlockSizes: defaultBlockSizes}, states[0])
+			if e := ctx.Err(); e != nil {
+				err = e
+			}
+			// If one connection fails, the device is unusable. Drained
+			// connections leave the others to finish their requests.
+			if err != nil || !srv.shuttingDown() {
+				cancel()
+			}
+			ch <- err
+			serverc.Close()
+		}(serverc)
+	}
+	wait := func() error {
+		err := <-ch
+		for i := 1; i < len(servers); i++ {
+			<-ch
 		}
 		cancel()
-		ch <- err
-		serverc.Close()
-	}()
-	wait = func() error { return <-ch }
+		return err
+	}
 
-	idx, err = Configure(exp, client)
+	var copts []nbdnl.ConnectOption
+	if o.Timeout > 0 {
+		copts = append(copts, nbdnl.WithTimeout(o.Timeout))
+	}
+	idx, err := configure(exp, clients, copts...)
 	if err != nil {
 		cancel()
-		return 0, nil, err
+		return nil, err
 	}
-	return idx, wait, nil
+	atomic.StoreInt64(&dev.idx, int64(idx))
+	orDiscard(srv.Logger).Debug("device connected")
+	if o.PartitionScan {
+		if err := scanPartitions(idx); err != nil {
+			cancel()
+			return nil, err
+		}
+	}
+	l := &LoopbackDevice{Index: idx, d: d, srv: srv, st: states[0], wait: wait}
+	loopbacks.Lock()
+	loopbacks.m[idx] = l
+	loopbacks.Unlock()
+	go func() {
+		<-ctx.Done()
+		loopbacks.Lock()
+		if loopbacks.m[idx] == l {
+			delete(loopbacks.m, idx)
+		}
+		loopbacks.Unlock()
+	}()
+	return l, nil
 }
@@ -0,0 +1,554 @@
+// Copyright 2018 Axel Wagner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package objstore implements a Device stored as fixed-size chunks in an
+// object store bucket, like Amazon S3 or Google Cloud Storage.
+//
+// Chunks are read into a local cache on first use. Writes only modify the
+// cache and the modified chunks are uploaded in the background, so writes
+// are as fast as local memory, as long as the uploads keep up. Sync waits
+// for all uploads to finish. Chunks, which are never written or only contain
+// zeros, are not stored at all, so a new Device does not need any objects.
+//
+//	s := &objstore.S3{
+//		Endpoint:  "https://s3.eu-central-1.amazonaws.com",
+//		Region:    "eu-central-1",
+//		Bucket:    "disks",
+//		AccessKey: os.Getenv("AWS_ACCESS_KEY_ID"),
+//		SecretKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+//	}
+//	d := objstore.New(s, 100<<30, &objstore.Options{Prefix: "vm1/"})
+//	defer d.Close()
+//	srv.AddExport(nbd.Export{Name: "vm1", Size: 100 << 30, Device: d})
+//
+// A Device must only be used by a single process at a time, as the cache is
+// not coherent with the bucket.
+package objstore
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/Merovius/nbd"
+	"golang.org/x/time/rate"
+)
+
+// ErrNotExist is returned by Store.Get, if the object does not exist.
+var ErrNotExist = errors.New("object does not exist")
+
+// Store is a bucket of an object store.
+type Store interface {
+	// Get returns the contents of the object with the given key. If it does
+	// not exist, it returns ErrNotExist.
+	Get(ctx context.Context, key string) ([]byte, error)
+	// Put creates or replaces the object with the given key.
+	Put(ctx context.Context, key string, data []byte) error
+	// Delete removes the object with the given key. Deleting an object,
+	// which does not exist, is not an error.
+	Delete(ctx context.Context, key string) error
+}
+
+// Default values of Options.
+const (
+	DefaultChunkSize = 4 << 20
+	DefaultCacheSize = 64
+	DefaultUploaders = 4
+)
+
+// Options configures a Device.
+type Options struct {
+	// Prefix is prepended to the keys of the chunks, so several Devices can
+	// share a bucket.
+	Prefix string
+	// ChunkSize is the size of the chunks. It must not be changed for an
+	// existing Device. If it is <= 0, DefaultChunkSize is used.
+	ChunkSize int
+	// CacheSize is the maximum number of chunks held in the cache. Writes
+	// block, if all of them are modified and not uploaded yet. If it is <=
+	// 0, DefaultCacheSize is used.
+	CacheSize int
+	// Uploaders is the number of concurrent background uploads. If it is
+	// <= 0, DefaultUploaders is used.
+	Uploaders int
+}
+
+// Device is a Device stored in a Store. It is safe for concurrent use.
+type Device struct {
+	s         Store
+	prefix    string
+	size      int64
+	chunkSize int64
+	cacheSize int
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	mu   sync.Mutex
+	cond *sync.Cond
+	// chunks are the cached chunks, by index. lru orders them by last use,
+	// most recent first.
+	chunks map[int64]*chunk
+	lru    *list.List
+	// queue are the modified chunks waiting to be uploaded.
+	queue     []*chunk
+	uploading int
+	// err is the first error of a background upload since the last Sync.
+	err    error
+	closed bool
+}
+
+// chunk is a cached chunk.
+type chunk struct {
+	idx  int64
+	elem *list.Element
+
+	// The following fields are protected by Device.mu.
+
+	// loading is set, while the chunk is read from the Store.
+	loading bool
+	// refs is the number of operations using the chunk. It is not evicted
+	// while it is in use.
+	refs int
+	// dirty is set, if the chunk is in Device.queue.
+	dirty     bool
+	uploading bool
+	// stored is set, if the chunk was last known to exist in the Store.
+	stored bool
+
+	// mu protects data.
+	mu   sync.RWMutex
+	data []byte
+}
+
+// New returns a Device of the given size, stored in s. opts may be nil.
+func New(s Store, size uint64, opts *Options) *Device {
+	if opts == nil {
+		opts = new(Options)
+	}
+	d := &Device{
+		s:         s,
+		prefix:    opts.Prefix,
+		size:      int64(size),
+		chunkSize: int64(opts.ChunkSize),
+		cacheSize: opts.CacheSize,
+		chunks:    make(map[int64]*chunk),
+		lru:       list.New(),
+	}
+	if d.chunkSize <= 0 {
+		d.chunkSize = DefaultChunkSize
+	}
+	if d.cacheSize <= 0 {
+		d.cacheSize = DefaultCacheSize
+	}
+	uploaders := opts.Uploaders
+	if uploaders <= 0 {
+		uploaders = DefaultUploaders
+	}
+	d.cond = sync.NewCond(&d.mu)
+	d.ctx, d.cancel = context.WithCancel(context.Background())
+	for i := 0; i < uploaders; i++ {
+		d.wg.Add(1)
+		go d.upload()
+	}
+	return d
+}
+
+// errClosed is returned by a Device after Close.
+var errClosed = nbd.Errorf(nbd.ESHUTDOWN, "objstore: device closed")
+
+// key returns the key of chunk idx.
+func (d *Device) key(idx int64) string {
+	return fmt.Sprintf("%s%016x", d.prefix, idx)
+}
+
+// acquire returns chunk idx, reading it from the Store if it is not cached.
+// If load is false, a chunk which is not cached is not read, but zeroed, as
+// the caller overwrites it completely. The chunk must be released after use.
+func (d *Device) acquire(idx int64, load bool) (*chunk, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for {
+		if d.closed {
+			return nil, errClosed
+		}
+		c := d.chunks[idx]
+		if c != nil && c.loading {
+			d.cond.Wait()
+			continue
+		}
+		if c != nil {
+			c.refs++
+			d.lru.MoveToFront(c.elem)
+			return c, nil
+		}
+		if !d.evict() {
+			// All cached chunks are in use or waiting to be uploaded.
+			d.cond.Wait()
+			continue
+		}
+		c = &chunk{idx: idx, refs: 1}
+		c.elem = d.lru.PushFront(c)
+		d.chunks[idx] = c
+		if !load {
+			c.data = make([]byte, d.chunkSize)
+			return c, nil
+		}
+		c.loading = true
+		d.mu.Unlock()
+		data, stored, err := d.load(idx)
+		d.mu.Lock()
+		c.loading, c.stored = false, stored
+		d.cond.Broadcast()
+		if err != nil {
+			d.lru.Remove(c.elem)
+			delete(d.chunks, idx)
+			return nil, err
+		}
+		c.data = data
+		return c, nil
+	}
+}
+
+// evict makes room for a new chunk in the cache, if necessary, by removing
+// the least recently used chunk, which is unused and not modified. It
+// returns false, if there is no such chunk.
+func (d *Device) evict() bool {
+	if len(d.chunks) < d.cacheSize {
+		return true
+	}
+	for e := d.lru.Back(); e != nil; e = e.Prev() {
+		c := e.Value.(*chunk)
+		if c.refs == 0 && !c.loading && !c.dirty && !c.uploading {
+			d.lru.Remove(e)
+			delete(d.chunks, c.idx)
+			return true
+		}
+	}
+	return false
+}
+
+// release releases a chunk returned by acquire. If modified is set, it is
+// queued for upload.
+func (d *Device) release(c *chunk, modified bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	c.refs--
+	if modified && !c.dirty {
+		c.dirty = true
+		d.queue = append(d.queue, c)
+	}
+	d.cond.Broadcast()
+}
+
+// load reads chunk idx from the Store and returns whether it exists. Chunks
+// which do not exist are zero.
+func (d *Device) load(idx int64) ([]byte, bool, error) {
+	data, err := d.s.Get(d.ctx, d.key(idx))
+	if err == ErrNotExist {
+		return make([]byte, d.chunkSize), false, nil
+	}
+	if err != nil {
+		return nil, false, nbd.Errorf(nbd.EIO, "reading chunk %d: %v", idx, err)
+	}
+	if int64(len(data)) != d.chunkSize {
+		return nil, false, nbd.Errorf(nbd.EIO, "chunk %d has size %d, want %d", idx, len(data), d.chunkSize)
+	}
+	return data, true, nil
+}
+
+// upload uploads queued chunks, until the Device is closed.
+func (d *Device) upload() {
+	defer d.wg.Done()
+	var buf []byte
+	for {
+		d.mu.Lock()
+		for len(d.queue) == 0 && !d.closed {
+			d.cond.Wait()
+		}
+		if d.closed {
+			d.mu.Unlock()
+			return
+		}
+		c := d.queue[0]
+		d.queue = d.queue[1:]
+		c.dirty, c.uploading = false, true
+		d.uploading++
+		d.mu.Unlock()
+
+		// Writes during the upload queue the chunk again.
+		c.mu.RLock()
+		buf = append(buf[:0], c.data...)
+		c.mu.RUnlock()
+		var err error
+		stored := !isZero(buf)
+		if stored {
+			err = d.s.Put(d.ctx, d.key(c.idx), buf)
+		} else {
+			err = d.s.Delete(d.ctx, d.key(c.idx))
+		}
+
+		d.mu.Lock()
+		c.uploading = false
+		d.uploading--
+		if err != nil {
+			if d.err == nil {
+				d.err = nbd.Errorf(nbd.EIO, "writing chunk %d: %v", c.idx, err)
+			}
+			if !c.dirty {
+				c.dirty = true
+				d.queue = append(d.queue, c)
+			}
+		} else {
+			c.stored = stored
+		}
+		d.cond.Broadcast()
+		d.mu.Unlock()
+		if err != nil {
+			// Back off, to not hammer a failing Store.
+			select {
+			case <-time.After(time.Second):
+			case <-d.ctx.Done():
+			}
+		}
+	}
+}
+
+func isZero(b []byte) bool {
+	for _, c := range b {
+		if c != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// do calls f for the parts of the n bytes at off in each chunk, with the
+// chunk, the offset in it and the offset in the range. If write is set, the
+// chunks are marked as modified.
+func (d *Device) do(off, n int64, write bool, f func(c *chunk, coff, i int64) int64) error {
+	for i := int64(0); i < n; {
+		idx, coff := (off+i)/d.chunkSize, (off+i)%d.chunkSize
+		// A chunk overwritten completely does not have to be read.
+		load := !write || coff != 0 || n-i < d.chunkSize
+		c, err := d.acquire(idx, load)
+		if err != nil {
+			return err
+		}
+		m := f(c, coff, i)
+		d.release(c, write)
+		i += m
+	}
+	return nil
+}
+
+// Size returns the size of d.
+func (d *Device) Size() uint64 {
+	return uint64(d.size)
+}
+
+// MaxIOSize implements nbd.MaxIOSizer. Reads and writes of whole chunks are
+// the most efficient.
+func (d *Device) MaxIOSize() int {
+	return int(d.chunkSize)
+}
+
+// ReadAt implements nbd.Device.
+func (d *Device) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, nbd.Errorf(nbd.EINVAL, "negative offset")
+	}
+	if off >= d.size {
+		return 0, io.EOF
+	}
+	var eof error
+	if rest := d.size - off; int64(len(p)) > rest {
+		p, eof = p[:rest], io.EOF
+	}
+	err := d.do(off, int64(len(p)), false, func(c *chunk, coff, i int64) int64 {
+		c.mu.RLock()
+		defer c.mu.RUnlock()
+		return int64(copy(p[i:], c.data[coff:]))
+	})
+	if err != nil {
+		return 0, err
+	}
+	return len(p), eof
+}
+
+// WriteAt implements nbd.Device.
+func (d *Device) WriteAt(p []byte, off int64) (int, error) {
+	if off < 0 || off+int64(len(p)) > d.size {
+		return 0, nbd.Errorf(nbd.ENOSPC, "write past end of device")
+	}
+	err := d.do(off, int64(len(p)), true, func(c *chunk, coff, i int64) int64 {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		return int64(copy(c.data[coff:], p[i:]))
+	})
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// WriteZeroes implements nbd.ZeroWriter. Chunks which only contain zeros
+// afterwards are deleted from the Store.
+func (d *Device) WriteZeroes(off, length int64, noHole bool) error {
+	if off < 0 || length < 0 || off+length > d.size {
+		return nbd.Errorf(nbd.ENOSPC, "write past end of device")
+	}
+	return d.do(off, length, true, func(c *chunk, coff, i int64) int64 {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		b := c.data[coff:]
+		if int64(len(b)) > length-i {
+			b = b[:length-i]
+		}
+		for j := range b {
+			b[j] = 0
+		}
+		return int64(len(b))
+	})
+}
+
+// Trim implements nbd.Trimmer, by writing zeros.
+func (d *Device) Trim(off, length int64) error {
+	return d.WriteZeroes(off, length, false)
+}
+
+// Sync implements nbd.Device. It waits until all modified chunks are
+// uploaded. If a background upload failed since the last call, it returns
+// the error; the upload is retried nonetheless.
+func (d *Device) Sync() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for (len(d.queue) > 0 || d.uploading > 0) && d.err == nil {
+		d.cond.Wait()
+	}
+	err := d.err
+	d.err = nil
+	return err
+}
+
+// Close uploads all modified chunks and releases the cache. If an upload
+// fails, the modifications not uploaded yet are lost.
+func (d *Device) Close() error {
+	err := d.Sync()
+	d.mu.Lock()
+	if d.closed {
+		d.mu.Unlock()
+		return nil
+	}
+	d.closed = true
+	d.cond.Broadcast()
+	d.mu.Unlock()
+	d.cancel()
+	d.wg.Wait()
+	return err
+}
+
+// CompactOptions configures Compact.
+type CompactOptions struct {
+	// BytesPerSecond limits the rate of data read by Compact, so it does not
+	// starve clients of the Device. If it is <= 0, the rate is not limited.
+	BytesPerSecond float64
+	// Progress, if not nil, is called after every chunk processed.
+	Progress func(CompactProgress)
+}
+
+// CompactProgress describes the progress of Compact.
+type CompactProgress struct {
+	// Scanned is the number of chunks checked for zeros out of Total.
+	Scanned, Total int
+	// Freed is the number of chunks deleted from the Store, because they
+	// only contained zeros.
+	Freed int
+}
+
+// Compact reclaims space in the Store: it deletes stored chunks, which only
+// contain zeros (e.g. written by an older version or another tool). Chunks
+// zeroed or trimmed through d are deleted by their upload anyway. Every
+// chunk is read through the cache, so Compact should be throttled with
+// opts.BytesPerSecond on a busy Device. If ctx is cancelled, Compact stops,
+// leaving the Device consistent.
+func (d *Device) Compact(ctx context.Context, opts *CompactOptions) error {
+	if opts == nil {
+		opts = new(CompactOptions)
+	}
+	var lim *rate.Limiter
+	if opts.BytesPerSecond > 0 {
+		burst := int(d.chunkSize)
+		if opts.BytesPerSecond > float64(burst) {
+			burst = int(opts.BytesPerSecond)
+		}
+		lim = rate.NewLimiter(rate.Limit(opts.BytesPerSecond), burst)
+	}
+	pr := CompactProgress{Total: int((d.size + d.chunkSize - 1) / d.chunkSize)}
+	for idx := int64(0); idx < int64(pr.Total); idx++ {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if lim != nil {
+			if err := lim.WaitN(ctx, int(d.chunkSize)); err != nil {
+				return err
+			}
+		}
+		freed, err := d.freeZero(ctx, idx)
+		if err != nil {
+			return err
+		}
+		pr.Scanned++
+		if freed {
+			pr.Freed++
+		}
+		if opts.Progress != nil {
+			opts.Progress(pr)
+		}
+	}
+	return nil
+}
+
+// freeZero deletes chunk idx from the Store, if it is stored and only
+// contains zeros. It returns whether it was deleted.
+func (d *Device) freeZero(ctx context.Context, idx int64) (bool, error) {
+	c, err := d.acquire(idx, true)
+	if err != nil {
+		return false, err
+	}
+	defer d.release(c, false)
+	// Holding c.mu blocks writes to the chunk, so it can not be queued for
+	// upload while it is deleted.
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	d.mu.Lock()
+	// Modified chunks are deleted by their upload, if they are zero.
+	skip := !c.stored || c.dirty || c.uploading
+	d.mu.Unlock()
+	if skip || !isZero(c.data) {
+		return false, nil
+	}
+	if err := d.s.Delete(ctx, d.key(idx)); err != nil {
+		return false, nbd.Errorf(nbd.EIO, "deleting chunk %d: %v", idx, err)
+	}
+	d.mu.Lock()
+	c.stored = false
+	d.mu.Unlock()
+	return true, nil
+}
@@ -0,0 +1,195 @@
+// Copyright 2018 Axel Wagner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nbd
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// Observer is notified about requests processed by a Server or sent by a
+// Conn (see Client.Observer). This can be used to collect metrics or log
+// requests. Its methods are called on the request path, so they must be safe
+// for concurrent use and should return quickly.
+type Observer interface {
+	// Start is called when a request was received, before it is executed.
+	// The returned function is called once the request is done, with the
+	// error returned by the Device, if any. On a Conn, Start is called
+	// before the request is sent and the function once its reply was
+	// received, with the error the request failed with.
+	Start(r RequestInfo) (done func(error))
+}
+
+// NegotiationObserver is an optional interface an Observer can implement, to
+// be notified about the handshake phase of connections.
+type NegotiationObserver interface {
+	// StartNegotiation is called when a connection enters the handshake
+	// phase. The returned function is called once the handshake is done,
+	// with the name of the negotiated export and the error that terminated
+	// the handshake, if any.
+	StartNegotiation(remote net.Addr) (done func(export string, err error))
+}
+
+// Phase is a phase of the lifecycle of a request in a Server.
+type Phase int
+
+// Phases of a request.
+const (
+	// PhaseReceive lasts from reading the header of a request until it is
+	// executed, including reading its payload and waiting for a worker.
+	PhaseReceive Phase = iota
+	// PhaseExecute is the execution of the request by the Device.
+	PhaseExecute
+	// PhaseReply is sending the reply to the client.
+	PhaseReply
+)
+
+func (p Phase) String() string {
+	switch p {
+	case PhaseReceive:
+		return "receive"
+	case PhaseExecute:
+		return "execute"
+	case PhaseReply:
+		return "reply"
+	default:
+		return "phase_" + strconv.Itoa(int(p))
+	}
+}
+
+// TraceObserver is an optional interface an Observer can implement, to trace
+// the lifecycle of connections and requests in detail, e.g. with spans.
+type TraceObserver interface {
+	// StartConn is called when the connection with the given ID (see
+	// RequestInfo.Conn) enters transmission phase. The returned function
+	// is called once it is closed, with the error that terminated it, if
+	// any.
+	StartConn(id uint64, remote net.Addr, export string) (done func(error))
+	// EndPhase is called once request r, for which Start was called,
+	// finished phase p, which began at start. err is the error of the
+	// phase, if any. PhaseReply is the last phase, which ends after the
+	// function returned by Start was called.
+	EndPhase(r RequestInfo, p Phase, start time.Time, err error)
+}
+
+// RequestInfo describes a request received by a Server.
+type RequestInfo struct {
+	// ID identifies the request uniquely within the process. It is also used
+	// in logs and attached to contexts with WithRequestID, so a request can
+	// be followed through all layers handling it.
+	ID uint64
+	// Conn identifies the connection the request was received on, uniquely
+	// within the process.
+	Conn uint64
+	// Handle is the handle the client chose for the request. It correlates
+	// the request with the client side (e.g. the kernel).
+	Handle uint64
+	// Export is the name of the export the request is for.
+	Export string
+	// Command is the type of the request.
+	Command Command
+	// Offset and Length describe the range of the export the request
+	// affects.
+	Offset uint64
+	Length uint64
+	// Received is the time the header of the request was read. It is zero
+	// for requests sent by a Conn.
+	Received time.Time
+}
+
+// Command is the type of an NBD request.
+type Command uint16
+
+// Commands that can be observed.
+const (
+	CmdRead        Command = cmdRead
+	CmdWrite       Command = cmdWrite
+	CmdDisc        Command = cmdDisc
+	CmdFlush       Command = cmdFlush
+	CmdTrim        Command = cmdTrim
+	CmdCache       Command = cmdCache
+	CmdWriteZeroes Command = cmdWriteZeroes
+	CmdBlockStatus Command = cmdBlockStatus
+	CmdResize      Command = cmdResize
+)
+
+func (c Command) String() string {
+	switch c {
+	case CmdRead:
+		return "read"
+	case CmdWrite:
+		return "write"
+	case CmdDisc:
+		return "disc"
+	case CmdFlush:
+		return "flush"
+	case CmdTrim:
+		return "trim"
+	case CmdCache:
+		return "cache"
+	case CmdWriteZeroes:
+		return "write_zeroes"
+	case CmdBlockStatus:
+		return "block_status"
+	case CmdResize:
+		return "resize"
+	default:
+		return "cmd_" + strconv.Itoa(int(c))
+	}
+}
+
+// lastRequestID is the last ID assigned to a request.
+var lastRequestID uint64
+
+// nextRequestID returns a new, unique request ID.
+func nextRequestID() uint64 {
+	return atomic.AddUint64(&lastRequestID, 1)
+}
+
+// lastConnID is the last ID assigned to a connection.
+var lastConnID uint64
+
+// nextConnID returns a new, unique connection ID.
+func nextConnID() uint64 {
+	return atomic.AddUint64(&lastConnID, 1)
+}
+
+type requestIDKey struct{}
+
+// WithRequestID returns a context carrying the given request ID.
+func WithRequestID(ctx context.Context, id uint64) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// RequestIDFromContext returns the request ID carried by ctx, if any.
+func RequestIDFromContext(ctx context.Context) (id uint64, ok bool) {
+	id, ok = ctx.Value(requestIDKey{}).(uint64)
+	return id, ok
+}
+
+// ErrnoOf returns the error number sent to clients for err. If err does not
+// implement Error, it is EIO. If err is nil, it is 0.
+func ErrnoOf(err error) Errno {
+	if err == nil {
+		return 0
+	}
+	if e, ok := err.(Error); ok {
+		return e.Errno()
+	}
+	return EIO
+}
@@ -0,0 +1,256 @@
+// Copyright 2018 Axel Wagner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package otelnbd provides OpenTelemetry tracing for NBD clients and servers.
+//
+// On the server side, set the result of NewObserver as the Observer of an
+// nbd.Server, to create a span for the handshake of every connection, a span
+// for its transmission phase and, as its children, a span for every request.
+// Each request span has child spans for its phases (see nbd.Phase): receiving
+// it, executing it on the Device and sending the reply. On the client side,
+// use Negotiate to trace the handshake and set the result of
+// NewClientObserver as the Observer of an nbd.Client, to create a span for
+// every request sent by the nbd.Conn it opens.
+package otelnbd
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/Merovius/nbd"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const instrumentationName = "github.com/Merovius/nbd/otelnbd"
+
+// Attribute keys used on spans.
+const (
+	RequestIDKey = attribute.Key("nbd.request_id")
+	HandleKey    = attribute.Key("nbd.handle")
+	ExportKey    = attribute.Key("nbd.export")
+	CommandKey   = attribute.Key("nbd.command")
+	OffsetKey    = attribute.Key("nbd.offset")
+	LengthKey    = attribute.Key("nbd.length")
+	ErrnoKey     = attribute.Key("nbd.errno")
+	ConnKey      = attribute.Key("nbd.conn")
+)
+
+// NewObserver returns an nbd.Observer creating spans using tp. If tp is nil,
+// the global TracerProvider is used.
+func NewObserver(tp trace.TracerProvider) nbd.Observer {
+	if tp == nil {
+		tp = otel.GetTracerProvider()
+	}
+	return &observer{
+		t:     tp.Tracer(instrumentationName),
+		conns: make(map[uint64]context.Context),
+		reqs:  make(map[uint64]trace.Span),
+	}
+}
+
+type observer struct {
+	t trace.Tracer
+
+	mu sync.Mutex
+	// conns contains the context of the span of every open connection, by
+	// its ID.
+	conns map[uint64]context.Context
+	// reqs contains the spans of requests which have not been replied to
+	// yet, by their ID.
+	reqs map[uint64]trace.Span
+}
+
+// StartConn implements nbd.TraceObserver.
+func (o *observer) StartConn(id uint64, remote net.Addr, export string) func(error) {
+	attrs := []attribute.KeyValue{ConnKey.Int64(int64(id)), ExportKey.String(export)}
+	if remote != nil {
+		attrs = append(attrs, attribute.String("net.peer.address", remote.String()))
+	}
+	ctx, span := o.t.Start(context.Background(), "nbd.connection",
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(attrs...),
+	)
+	o.mu.Lock()
+	o.conns[id] = ctx
+	o.mu.Unlock()
+	return func(err error) {
+		o.mu.Lock()
+		delete(o.conns, id)
+		o.mu.Unlock()
+		end(span, err)
+	}
+}
+
+// Start implements nbd.Observer.
+func (o *observer) Start(r nbd.RequestInfo) func(error) {
+	o.mu.Lock()
+	ctx, ok := o.conns[r.Conn]
+	o.mu.Unlock()
+	if !ok {
+		ctx = context.Background()
+	}
+	opts := []trace.SpanStartOption{trace.WithSpanKind(trace.SpanKindServer)}
+	if !r.Received.IsZero() {
+		opts = append(opts, trace.WithTimestamp(r.Received))
+	}
+	_, span := o.t.Start(ctx, "nbd."+r.Command.String(), append(opts,
+		trace.WithAttributes(
+			RequestIDKey.Int64(int64(r.ID)),
+			ConnKey.Int64(int64(r.Conn)),
+			HandleKey.Int64(int64(r.Handle)),
+			ExportKey.String(r.Export),
+			CommandKey.String(r.Command.String()),
+			OffsetKey.Int64(int64(r.Offset)),
+			LengthKey.Int64(int64(r.Length)),
+		),
+	)...)
+	if !ok {
+		// Without a connection span, the Server does not call EndPhase, so
+		// the span has to end when the request is done.
+		return func(err error) {
+			if err != nil {
+				span.SetAttributes(ErrnoKey.Int64(int64(nbd.ErrnoOf(err))))
+			}
+			end(span, err)
+		}
+	}
+	o.mu.Lock()
+	o.reqs[r.ID] = span
+	o.mu.Unlock()
+	return func(err error) {
+		if err != nil {
+			span.SetAttributes(ErrnoKey.Int64(int64(nbd.ErrnoOf(err))))
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+	}
+}
+
+// EndPhase implements nbd.TraceObserver. The span of the request ends with
+// nbd.PhaseReply, so it includes sending the reply.
+func (o *observer) EndPhase(r nbd.RequestInfo, p nbd.Phase, start time.Time, err error) {
+	o.mu.Lock()
+	span, ok := o.reqs[r.ID]
+	if ok && p == nbd.PhaseReply {
+		delete(o.reqs, r.ID)
+	}
+	o.mu.Unlock()
+	if !ok {
+		return
+	}
+	ctx := trace.ContextWithSpan(context.Background(), span)
+	_, ps := o.t.Start(ctx, "nbd."+p.String(), trace.WithTimestamp(start))
+	if err != nil {
+		ps.RecordError(err)
+		ps.SetStatus(codes.Error, err.Error())
+	}
+	ps.End()
+	if p == nbd.PhaseReply {
+		span.End()
+	}
+}
+
+// StartNegotiation implements nbd.NegotiationObserver.
+func (o *observer) StartNegotiation(remote net.Addr) func(string, error) {
+	var attrs []attribute.KeyValue
+	if remote != nil {
+		attrs = append(attrs, attribute.String("net.peer.address", remote.String()))
+	}
+	_, span := o.t.Start(context.Background(), "nbd.negotiate",
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(attrs...),
+	)
+	return func(export string, err error) {
+		span.SetAttributes(ExportKey.String(export))
+		end(span, err)
+	}
+}
+
+// Negotiate performs the client side of the handshake on c and opens the
+// given export (see nbd.Client.Go), recording it as a span with tp. The span
+// is a child of any span in ctx. If tp is nil, the global TracerProvider is
+// used.
+func Negotiate(ctx context.Context, tp trace.TracerProvider, c net.Conn, export string) (nbd.Export, error) {
+	if tp == nil {
+		tp = otel.GetTracerProvider()
+	}
+	ctx, span := tp.Tracer(instrumentationName).Start(ctx, "nbd.negotiate",
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			ExportKey.String(export),
+			attribute.String("net.peer.address", c.RemoteAddr().String()),
+		),
+	)
+	cl, err := nbd.ClientHandshake(ctx, c)
+	if err != nil {
+		end(span, err)
+		return nbd.Export{}, err
+	}
+	exp, err := cl.Go(export)
+	end(span, err)
+	return exp, err
+}
+
+// NewClientObserver returns an nbd.Observer for an nbd.Client, creating a
+// client span for every request sent by its nbd.Conn, using tp. The spans
+// last until the reply was received. If tp is nil, the global TracerProvider
+// is used.
+func NewClientObserver(tp trace.TracerProvider) nbd.Observer {
+	if tp == nil {
+		tp = otel.GetTracerProvider()
+	}
+	return clientObserver{tp.Tracer(instrumentationName)}
+}
+
+type clientObserver struct {
+	t trace.Tracer
+}
+
+// Start implements nbd.Observer.
+func (o clientObserver) Start(r nbd.RequestInfo) func(error) {
+	_, span := o.t.Start(context.Background(), "nbd."+r.Command.String(),
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			RequestIDKey.Int64(int64(r.ID)),
+			ConnKey.Int64(int64(r.Conn)),
+			HandleKey.Int64(int64(r.Handle)),
+			ExportKey.String(r.Export),
+			CommandKey.String(r.Command.String()),
+			OffsetKey.Int64(int64(r.Offset)),
+			LengthKey.Int64(int64(r.Length)),
+		),
+	)
+	return func(err error) {
+		// Only errors replied by the server have an errno. Others, like
+		// connection failures, are just recorded.
+		if e, ok := err.(nbd.Error); ok {
+			span.SetAttributes(ErrnoKey.Int64(int64(e.Errno())))
+		}
+		end(span, err)
+	}
+}
+
+// end records err on span and ends it.
+func end(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
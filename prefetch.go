@@ -0,0 +1,279 @@
+// Copyright 2018 Axel Wagner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nbd
+
+import (
+	"container/list"
+	"io"
+	"sync"
+)
+
+// PrefetchOptions configures a Prefetcher.
+type PrefetchOptions struct {
+	// BlockSize is the size of the reads done ahead. If it is <= 0, 128 KiB
+	// are used.
+	BlockSize int
+	// Window is the number of bytes read ahead of a sequential stream of
+	// reads. If it is <= 0, 2 MiB are used.
+	Window int64
+	// CacheSize is the maximum number of bytes cached. It should be a few
+	// times the window, so blocks read ahead are not evicted before being
+	// read. If it is <= 0, eight times the window is used.
+	CacheSize int64
+	// Parallel is the maximum number of reads ahead in flight. If it is <=
+	// 0, 4 are used.
+	Parallel int
+}
+
+// maxStreams is the number of sequential streams of reads a Prefetcher
+// detects at the same time, e.g. of different files read by a booting
+// system.
+const maxStreams = 8
+
+// Prefetcher is a Device, which detects sequential reads from another Device
+// and reads ahead of them into an in-memory cache. It is meant for Devices
+// with a high latency, like the remote ones in packages httprange, objstore
+// and cas, which would otherwise be read one request at a time.
+//
+// Unlike Server.Readahead, which works per connection, a Prefetcher sees the
+// reads of all connections and detects several interleaved streams. Writes
+// go directly to the Device and invalidate the cached blocks they overlap.
+type Prefetcher struct {
+	d         Device
+	size      int64
+	blockSize int64
+	window    int64
+	maxBlocks int
+	sem       chan struct{}
+
+	mu     sync.Mutex
+	blocks map[int64]*pfBlock
+	// lru contains the *pfBlock in blocks, least recently used first.
+	lru     list.List
+	streams [maxStreams]pfStream
+	// victim is the stream replaced by the next new stream.
+	victim int
+	closed bool
+	wg     sync.WaitGroup
+}
+
+// pfStream is a sequential stream of reads.
+type pfStream struct {
+	// next is the offset the next read of the stream is expected at.
+	next int64
+	// seq is the number of sequential reads seen in a row.
+	seq int
+}
+
+// pfBlock is a block read ahead. done is closed once buf and err are set.
+type pfBlock struct {
+	i    int64
+	buf  []byte
+	err  error
+	done chan struct{}
+	elem *list.Element
+}
+
+// NewPrefetcher returns a Prefetcher for d, which has the given size. opts
+// may be nil.
+func NewPrefetcher(d Device, size uint64, opts *PrefetchOptions) *Prefetcher {
+	if opts == nil {
+		opts = new(PrefetchOptions)
+	}
+	p := &Prefetcher{
+		d:         d,
+		size:      int64(size),
+		blockSize: int64(opts.BlockSize),
+		window:    opts.Window,
+		blocks:    make(map[int64]*pfBlock),
+	}
+	if p.blockSize <= 0 {
+		p.blockSize = 128 << 10
+	}
+	if p.window <= 0 {
+		p.window = 2 << 20
+	}
+	cacheSize := opts.CacheSize
+	if cacheSize <= 0 {
+		cacheSize = 8 * p.window
+	}
+	if p.maxBlocks = int(cacheSize / p.blockSize); p.maxBlocks < 1 {
+		p.maxBlocks = 1
+	}
+	parallel := opts.Parallel
+	if parallel <= 0 {
+		parallel = 4
+	}
+	p.sem = make(chan struct{}, parallel)
+	for i := range p.streams {
+		p.streams[i].next = -1
+	}
+	return p
+}
+
+// ReadAt implements Device. Reads entirely covered by blocks read ahead are
+// served from the cache, all others from the Device.
+func (p *Prefetcher) ReadAt(b []byte, off int64) (int, error) {
+	if off < 0 || off >= p.size || len(b) == 0 {
+		return p.d.ReadAt(b, off)
+	}
+	end := off + int64(len(b))
+	if end > p.size {
+		end = p.size
+	}
+
+	p.mu.Lock()
+	if p.sequentialLocked(off, end) {
+		p.prefetchLocked(end)
+	}
+	var blocks []*pfBlock
+	for i := off / p.blockSize; i*p.blockSize < end; i++ {
+		blk := p.blocks[i]
+		if blk == nil {
+			blocks = nil
+			break
+		}
+		p.lru.MoveToBack(blk.elem)
+		blocks = append(blocks, blk)
+	}
+	p.mu.Unlock()
+
+	if blocks == nil {
+		return p.d.ReadAt(b, off)
+	}
+	for _, blk := range blocks {
+		<-blk.done
+		if blk.err != nil {
+			return p.d.ReadAt(b, off)
+		}
+	}
+	n := 0
+	for _, blk := range blocks {
+		if o := off + int64(n) - blk.i*p.blockSize; o < int64(len(blk.buf)) {
+			n += copy(b[n:], blk.buf[o:])
+		}
+	}
+	if n < len(b) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// sequentialLocked records a read of the range [off, end) and reports
+// whether it continues a sequential stream. p.mu must be held.
+func (p *Prefetcher) sequentialLocked(off, end int64) bool {
+	for i := range p.streams {
+		s := &p.streams[i]
+		if s.next == off {
+			s.next = end
+			s.seq++
+			return s.seq >= minSequential
+		}
+	}
+	p.streams[p.victim] = pfStream{next: end}
+	p.victim = (p.victim + 1) % maxStreams
+	return false
+}
+
+// prefetchLocked starts reading ahead the blocks of the window after off,
+// which are not cached yet. p.mu must be held.
+func (p *Prefetcher) prefetchLocked(off int64) {
+	if p.closed {
+		return
+	}
+	end := off + p.window
+	if end > p.size {
+		end = p.size
+	}
+	for i := off / p.blockSize; i*p.blockSize < end; i++ {
+		if p.blocks[i] != nil {
+			continue
+		}
+		blk := &pfBlock{i: i, done: make(chan struct{})}
+		blk.elem = p.lru.PushBack(blk)
+		p.blocks[i] = blk
+		for len(p.blocks) > p.maxBlocks {
+			old := p.lru.Remove(p.lru.Front()).(*pfBlock)
+			delete(p.blocks, old.i)
+		}
+		p.wg.Add(1)
+		go p.fetch(blk)
+	}
+}
+
+// fetch reads blk from the Device.
+func (p *Prefetcher) fetch(blk *pfBlock) {
+	defer p.wg.Done()
+	defer close(blk.done)
+	p.sem <- struct{}{}
+	defer func() { <-p.sem }()
+	off := blk.i * p.blockSize
+	n := p.blockSize
+	if rest := p.size - off; rest < n {
+		n = rest
+	}
+	buf := make([]byte, n)
+	if m, err := p.d.ReadAt(buf, off); err != nil && !(err == io.EOF && m == len(buf)) {
+		blk.err = err
+		return
+	}
+	blk.buf = buf
+}
+
+// invalidate removes the cached blocks overlapping the length bytes at off.
+// It must be called after modifying them, so blocks read ahead concurrently
+// with the modification are not used.
+func (p *Prefetcher) invalidate(off, length int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for i := off / p.blockSize; i*p.blockSize < off+length; i++ {
+		if blk := p.blocks[i]; blk != nil {
+			p.lru.Remove(blk.elem)
+			delete(p.blocks, i)
+		}
+	}
+}
+
+// WriteAt implements Device.
+func (p *Prefetcher) WriteAt(b []byte, off int64) (int, error) {
+	n, err := p.d.WriteAt(b, off)
+	p.invalidate(off, int64(len(b)))
+	return n, err
+}
+
+// WriteZeroes implements ZeroWriter, using the Device if it implements
+// ZeroWriter and writing zeros otherwise.
+func (p *Prefetcher) WriteZeroes(off, length int64, noHole bool) error {
+	err := WriteZeroes(p.d, off, length, noHole)
+	p.invalidate(off, length)
+	return err
+}
+
+// Sync implements Device.
+func (p *Prefetcher) Sync() error {
+	return p.d.Sync()
+}
+
+// Close stops reading ahead and waits for reads in flight to finish. It does
+// not close the Device.
+func (p *Prefetcher) Close() error {
+	p.mu.Lock()
+	p.closed = true
+	p.blocks = make(map[int64]*pfBlock)
+	p.lru.Init()
+	p.mu.Unlock()
+	p.wg.Wait()
+	return nil
+}
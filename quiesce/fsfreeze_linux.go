@@ -0,0 +1,54 @@
+// +build linux
+
+// Copyright 2018 Axel Wagner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package quiesce
+
+import (
+	"context"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// ioctls to freeze and thaw a filesystem (see linux/fs.h).
+const (
+	ioctlFIFreeze = 0xc0045877
+	ioctlFIThaw   = 0xc0045878
+)
+
+// Filesystem returns a Hook freezing the filesystem mounted at dir, like
+// fsfreeze(8). Freezing flushes all dirty data to the Device and blocks all
+// writes to the filesystem, until it is thawed. It needs CAP_SYS_ADMIN.
+//
+// This is a Linux-only API.
+func Filesystem(dir string) Hook {
+	return Funcs{
+		Pre:  func(context.Context) error { return fsIoctl(dir, ioctlFIFreeze) },
+		Post: func(context.Context) error { return fsIoctl(dir, ioctlFIThaw) },
+	}
+}
+
+func fsIoctl(dir string, req uintptr) error {
+	f, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, _, errno := unix.Syscall(unix.SYS_IOCTL, f.Fd(), req, 0); errno != 0 {
+		return &os.PathError{Op: "ioctl", Path: dir, Err: errno}
+	}
+	return nil
+}
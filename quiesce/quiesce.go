@@ -0,0 +1,116 @@
+// Copyright 2018 Axel Wagner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package quiesce provides hooks to bring the users of a Device into a
+// consistent state, before a snapshot or backup of it is taken.
+//
+// Without quiescing, a backup is only crash-consistent: it looks like the
+// Device after a power failure. Freezing the filesystem on the Device (e.g.
+// mounted via Loopback) or notifying the application using it makes it
+// filesystem- or application-consistent instead:
+//
+//	err := quiesce.Do(ctx, func() error {
+//		return backup.Incremental(w, tracker, false)
+//	}, quiesce.Filesystem("/mnt/data"), quiesce.Exec([]string{"app-ctl", "pause"}, []string{"app-ctl", "resume"}))
+package quiesce
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+)
+
+// Hook quiesces the users of a Device.
+type Hook interface {
+	// Freeze is called before the snapshot is taken. Once it returns, no
+	// more writes must be issued to the Device, until Thaw is called.
+	Freeze(ctx context.Context) error
+	// Thaw is called after the snapshot is taken, to resume writes. It is
+	// only called if Freeze succeeded.
+	Thaw(ctx context.Context) error
+}
+
+// Funcs is a Hook calling the given functions. Either may be nil.
+type Funcs struct {
+	Pre  func(ctx context.Context) error
+	Post func(ctx context.Context) error
+}
+
+// Freeze implements Hook.
+func (f Funcs) Freeze(ctx context.Context) error {
+	if f.Pre == nil {
+		return nil
+	}
+	return f.Pre(ctx)
+}
+
+// Thaw implements Hook.
+func (f Funcs) Thaw(ctx context.Context) error {
+	if f.Post == nil {
+		return nil
+	}
+	return f.Post(ctx)
+}
+
+// Exec returns a Hook running the command pre to freeze and post to thaw.
+// Either can be empty, to not run a command. A command exiting with a
+// non-zero status is an error.
+func Exec(pre, post []string) Hook {
+	return Funcs{
+		Pre:  func(ctx context.Context) error { return run(ctx, pre) },
+		Post: func(ctx context.Context) error { return run(ctx, post) },
+	}
+}
+
+func run(ctx context.Context, argv []string) error {
+	if len(argv) == 0 {
+		return nil
+	}
+	out, err := exec.CommandContext(ctx, argv[0], argv[1:]...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s: %v: %s", argv[0], err, out)
+	}
+	return nil
+}
+
+// Do freezes all hooks in order, calls f and then thaws them in reverse
+// order. If freezing a hook fails, the hooks already frozen are thawed and f
+// is not called. The hooks are thawed even if f fails. The first error
+// encountered is returned.
+func Do(ctx context.Context, f func() error, hooks ...Hook) (err error) {
+	for i, h := range hooks {
+		if err := h.Freeze(ctx); err != nil {
+			thaw(ctx, hooks[:i])
+			return err
+		}
+	}
+	err = f()
+	if terr := thaw(ctx, hooks); err == nil {
+		err = terr
+	}
+	return err
+}
+
+// thaw thaws hooks in reverse order and returns the first error.
+func thaw(ctx context.Context, hooks []Hook) error {
+	var first error
+	for i := len(hooks) - 1; i >= 0; i-- {
+		// Thawing must happen even if ctx is already done, as the users of
+		// the Device would be blocked otherwise.
+		if err := hooks[i].Thaw(context.Background()); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
@@ -0,0 +1,165 @@
+// Copyright 2018 Axel Wagner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nbd
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// Quota limits the resources used by a single client, across all of its
+// connections.
+type Quota struct {
+	// BytesPerSecond limits the number of bytes read and written per
+	// second, allowing bursts of BurstBytes. If BytesPerSecond is <= 0, the
+	// number of bytes is not limited. If BurstBytes is <= 0, BytesPerSecond
+	// is used. Requests larger than BurstBytes wait for their bytes in
+	// several steps, or exceed the quota with Disconnect.
+	BytesPerSecond float64
+	BurstBytes     int
+	// IOPS limits the number of requests per second, allowing bursts of
+	// BurstIOPS. If IOPS is <= 0, the number of requests is not limited. If
+	// BurstIOPS is <= 0, 1 is used.
+	IOPS      float64
+	BurstIOPS int
+	// Disconnect makes the Server disconnect clients exceeding their quota.
+	// Otherwise, their requests are delayed until they are within quota
+	// again.
+	Disconnect bool
+}
+
+// errQuota is returned when a client exceeds its quota.
+var errQuota = errors.New("client exceeded quota")
+
+// ClientStats returns the counters of every client seen by s, keyed by
+// identity (see Server.Identify).
+func (s *Server) ClientStats() map[string]Counters {
+	s.clients.mu.Lock()
+	defer s.clients.mu.Unlock()
+	m := make(map[string]Counters, len(s.clients.m))
+	for id, c := range s.clients.m {
+		m[id] = c.counters.load()
+	}
+	return m
+}
+
+// identify returns the client identity for c.
+func (s *Server) identify(c net.Conn) string {
+	if s.Identify != nil {
+		return s.Identify(c)
+	}
+	if c.RemoteAddr() == nil {
+		return ""
+	}
+	addr := c.RemoteAddr().String()
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
+
+// clientState is the state kept for a client identity.
+type clientState struct {
+	// counters must be first, to be 64-bit aligned.
+	counters Counters
+	id       string
+	// bytes and ops enforce the quota of the client. They are nil, if the
+	// respective resource is not limited.
+	bytes      *rate.Limiter
+	ops        *rate.Limiter
+	disconnect bool
+}
+
+// clientSet is the set of clients seen by a Server. Entries are never
+// removed, so accounting persists across connections.
+type clientSet struct {
+	mu sync.Mutex
+	m  map[string]*clientState
+}
+
+// get returns the state of the client with the given identity, creating it
+// using quota, if necessary.
+func (s *clientSet) get(id string, quota func(string) *Quota) *clientState {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if c := s.m[id]; c != nil {
+		return c
+	}
+	c := &clientState{id: id}
+	if quota != nil {
+		if q := quota(id); q != nil {
+			if q.BytesPerSecond > 0 {
+				burst := q.BurstBytes
+				if burst <= 0 {
+					burst = int(q.BytesPerSecond)
+				}
+				c.bytes = rate.NewLimiter(rate.Limit(q.BytesPerSecond), burst)
+			}
+			if q.IOPS > 0 {
+				burst := q.BurstIOPS
+				if burst <= 0 {
+					burst = 1
+				}
+				c.ops = rate.NewLimiter(rate.Limit(q.IOPS), burst)
+			}
+			c.disconnect = q.Disconnect
+		}
+	}
+	if s.m == nil {
+		s.m = make(map[string]*clientState)
+	}
+	s.m[id] = c
+	return c
+}
+
+// admit blocks until req is within the quota of c. If c is disconnected on
+// exceeding its quota, it returns errQuota instead.
+func (c *clientState) admit(ctx context.Context, req *request) error {
+	if err := c.take(ctx, c.ops, 1); err != nil {
+		return err
+	}
+	if req.typ != cmdRead && req.typ != cmdWrite {
+		return nil
+	}
+	return c.take(ctx, c.bytes, int(req.length))
+}
+
+func (c *clientState) take(ctx context.Context, l *rate.Limiter, n int) error {
+	if l == nil {
+		return nil
+	}
+	if c.disconnect {
+		if n > l.Burst() || !l.AllowN(time.Now(), n) {
+			return errQuota
+		}
+		return nil
+	}
+	for n > 0 {
+		m := n
+		if m > l.Burst() {
+			m = l.Burst()
+		}
+		if err := l.WaitN(ctx, m); err != nil {
+			return err
+		}
+		n -= m
+	}
+	return nil
+}
@@ -0,0 +1,242 @@
+// Copyright 2018 Axel Wagner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raid
+
+import (
+	"errors"
+	"io"
+	"sort"
+	"sync"
+
+	"github.com/Merovius/nbd"
+)
+
+// Member is a Device of a Composite, with its size.
+type Member struct {
+	nbd.Device
+	Size uint64
+}
+
+// Composite is a Device combining several members, by concatenating them
+// (Concat) or striping over them (Stripe). Requests spanning several members
+// are split and sent to them concurrently.
+type Composite struct {
+	members []Member
+	size    uint64
+	// mapOff maps off to the member containing it, the offset in the member
+	// and the number of bytes from there on, which are contiguous in the
+	// member.
+	mapOff func(off int64) (m int, moff, n int64)
+}
+
+// Concat returns a Composite concatenating members, so the first Size bytes
+// are stored in the first member, the next in the second and so on.
+func Concat(members ...Member) *Composite {
+	c := &Composite{members: members}
+	starts := make([]int64, len(members))
+	for i, m := range members {
+		starts[i] = int64(c.size)
+		c.size += m.Size
+	}
+	c.mapOff = func(off int64) (int, int64, int64) {
+		// The last member starting at or before off. Members of size 0 are
+		// skipped.
+		i := sort.Search(len(starts), func(i int) bool { return starts[i] > off }) - 1
+		moff := off - starts[i]
+		return i, moff, int64(members[i].Size) - moff
+	}
+	return c
+}
+
+// Stripe returns a Composite striping over members: the first stripeSize
+// bytes are stored in the first member, the next in the second and so on,
+// continuing with the first member after the last. All members are used up
+// to the same size, a multiple of stripeSize, so space at the end of larger
+// members is unused.
+func Stripe(stripeSize int64, members ...Member) (*Composite, error) {
+	if stripeSize <= 0 {
+		return nil, errors.New("stripe size must be positive")
+	}
+	if len(members) == 0 {
+		return nil, errors.New("stripe needs at least one member")
+	}
+	min := members[0].Size
+	for _, m := range members[1:] {
+		if m.Size < min {
+			min = m.Size
+		}
+	}
+	min -= min % uint64(stripeSize)
+	n := int64(len(members))
+	c := &Composite{
+		members: members,
+		size:    min * uint64(n),
+		mapOff: func(off int64) (int, int64, int64) {
+			s, rem := off/stripeSize, off%stripeSize
+			return int(s % n), (s/n)*stripeSize + rem, stripeSize - rem
+		},
+	}
+	return c, nil
+}
+
+// Size returns the size of c.
+func (c *Composite) Size() uint64 {
+	return c.size
+}
+
+// Members returns the members of c.
+func (c *Composite) Members() []Member {
+	return c.members
+}
+
+// segment is the part of a request stored in one member.
+type segment struct {
+	m    int
+	moff int64
+	// pos is the offset of the segment in the request.
+	pos int64
+	n   int64
+}
+
+// split splits the n bytes at off into segments. The range must be within
+// the size of c.
+func (c *Composite) split(off, n int64) []segment {
+	var segs []segment
+	for pos := int64(0); pos < n; {
+		m, moff, l := c.mapOff(off + pos)
+		if l > n-pos {
+			l = n - pos
+		}
+		segs = append(segs, segment{m, moff, pos, l})
+		pos += l
+	}
+	return segs
+}
+
+// do calls f concurrently for the segments of the n bytes at off and returns
+// the first error.
+func (c *Composite) do(off, n int64, f func(d nbd.Device, s segment) error) error {
+	segs := c.split(off, n)
+	if len(segs) == 1 {
+		return f(c.members[segs[0].m].Device, segs[0])
+	}
+	errs := make([]error, len(segs))
+	var wg sync.WaitGroup
+	for i, s := range segs {
+		wg.Add(1)
+		go func(i int, s segment) {
+			defer wg.Done()
+			errs[i] = f(c.members[s.m].Device, s)
+		}(i, s)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ReadAt implements nbd.Device.
+func (c *Composite) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, nbd.Errorf(nbd.EINVAL, "negative offset")
+	}
+	if uint64(off) >= c.size {
+		return 0, io.EOF
+	}
+	var eof error
+	if rest := int64(c.size) - off; int64(len(p)) > rest {
+		p, eof = p[:rest], io.EOF
+	}
+	err := c.do(off, int64(len(p)), func(d nbd.Device, s segment) error {
+		b := p[s.pos : s.pos+s.n]
+		if n, err := d.ReadAt(b, s.moff); err != nil && !(err == io.EOF && n == len(b)) {
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return len(p), eof
+}
+
+// check returns an error, if the n bytes at off are not within c.
+func (c *Composite) check(off, n int64) error {
+	if off < 0 || n < 0 || uint64(off+n) > c.size {
+		return nbd.Errorf(nbd.ENOSPC, "request past end of device")
+	}
+	return nil
+}
+
+// WriteAt implements nbd.Device.
+func (c *Composite) WriteAt(p []byte, off int64) (int, error) {
+	if err := c.check(off, int64(len(p))); err != nil {
+		return 0, err
+	}
+	err := c.do(off, int64(len(p)), func(d nbd.Device, s segment) error {
+		_, err := d.WriteAt(p[s.pos:s.pos+s.n], s.moff)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Trim implements nbd.Trimmer. Members not implementing it are skipped.
+func (c *Composite) Trim(off, length int64) error {
+	if err := c.check(off, length); err != nil {
+		return err
+	}
+	return c.do(off, length, func(d nbd.Device, s segment) error {
+		if t, ok := d.(nbd.Trimmer); ok {
+			return t.Trim(s.moff, s.n)
+		}
+		return nil
+	})
+}
+
+// WriteZeroes implements nbd.ZeroWriter.
+func (c *Composite) WriteZeroes(off, length int64, noHole bool) error {
+	if err := c.check(off, length); err != nil {
+		return err
+	}
+	return c.do(off, length, func(d nbd.Device, s segment) error {
+		return nbd.WriteZeroes(d, s.moff, s.n, noHole)
+	})
+}
+
+// Sync implements nbd.Device. It syncs all members concurrently.
+func (c *Composite) Sync() error {
+	errs := make([]error, len(c.members))
+	var wg sync.WaitGroup
+	for i, m := range c.members {
+		wg.Add(1)
+		go func(i int, d nbd.Device) {
+			defer wg.Done()
+			errs[i] = d.Sync()
+		}(i, m.Device)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,463 @@
+// Copyright 2018 Axel Wagner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package raid combines several Devices into one.
+//
+// A Mirror replicates all writes to each of its legs (like RAID 1), so it
+// keeps working as long as one of them does. Legs which failed are resynced
+// from the others, copying only the blocks written in the meantime. Replacing
+// a leg by a new Device and resyncing it moves the data of a Mirror to new
+// storage while it is in use.
+//
+// Concat and Stripe present several Devices as one larger Device, by
+// concatenating them or by striping over them (like RAID 0).
+package raid
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Merovius/nbd"
+	"github.com/Merovius/nbd/dirty"
+)
+
+// DefaultBlockSize is the granularity in which a Mirror tracks the blocks a
+// failed leg is missing, if MirrorOptions.BlockSize is <= 0.
+const DefaultBlockSize = 64 << 10
+
+// MirrorOptions configures a Mirror.
+type MirrorOptions struct {
+	// BlockSize is the granularity of resyncing. If it is <= 0,
+	// DefaultBlockSize is used.
+	BlockSize int
+	// ResyncInterval is the interval, in which failed legs are resynced in
+	// the background. If it is 0, failed legs are only resynced by calling
+	// Resync.
+	ResyncInterval time.Duration
+	// OnFailure, if not nil, is called when leg i fails with err.
+	OnFailure func(i int, err error)
+}
+
+// State is the state of a leg of a Mirror.
+type State int
+
+const (
+	// Healthy legs contain all data and are used for reads and writes.
+	Healthy State = iota
+	// Failed legs are missing some writes. They are not used.
+	Failed
+	// Resyncing legs are being brought up to date. They are written, but
+	// not read.
+	Resyncing
+)
+
+func (s State) String() string {
+	switch s {
+	case Healthy:
+		return "healthy"
+	case Failed:
+		return "failed"
+	case Resyncing:
+		return "resyncing"
+	default:
+		return fmt.Sprintf("State(%d)", int(s))
+	}
+}
+
+// LegStatus describes a leg of a Mirror.
+type LegStatus struct {
+	State State
+	// Err is the error the leg failed with, if it is not Healthy.
+	Err error
+	// Missing is the approximate number of bytes the leg is missing.
+	Missing int64
+	// Latency is the moving average of the latency of reads from the leg.
+	Latency time.Duration
+}
+
+// leg is a Device of a Mirror.
+type leg struct {
+	d nbd.Device
+	// latency is the moving average of read latencies in nanoseconds. It is
+	// accessed atomically.
+	latency int64
+
+	// Protected by Mirror.mu.
+	state State
+	err   error
+	// missing contains the blocks, which have to be resynced.
+	missing *dirty.Bitmap
+}
+
+// Mirror is a Device replicating writes to several legs, which have the same
+// size. Reads are served by the healthy leg with the lowest latency and
+// retried on the others, if it fails. A leg failing a write or a sync is
+// marked as failed and not used, until it is resynced. Requests only fail,
+// if all legs do.
+type Mirror struct {
+	size      uint64
+	blockSize int
+	onFailure func(int, error)
+
+	// locks serialize writes and resyncing, for blocks with the same index
+	// modulo the number of locks.
+	locks [64]sync.Mutex
+
+	mu   sync.Mutex
+	legs []*leg
+
+	resyncing sync.Mutex
+	done      chan struct{}
+	wg        sync.WaitGroup
+}
+
+// NewMirror returns a Mirror of the given legs, which have the given size.
+// All legs must contain the same data. opts may be nil.
+func NewMirror(size uint64, opts *MirrorOptions, legs ...nbd.Device) (*Mirror, error) {
+	if len(legs) == 0 {
+		return nil, errors.New("mirror needs at least one leg")
+	}
+	if opts == nil {
+		opts = new(MirrorOptions)
+	}
+	m := &Mirror{
+		size:      size,
+		blockSize: opts.BlockSize,
+		onFailure: opts.OnFailure,
+		done:      make(chan struct{}),
+	}
+	if m.blockSize <= 0 {
+		m.blockSize = DefaultBlockSize
+	}
+	for _, d := range legs {
+		m.legs = append(m.legs, &leg{d: d, missing: dirty.NewBitmap(size, m.blockSize)})
+	}
+	if opts.ResyncInterval > 0 {
+		m.wg.Add(1)
+		go m.resyncLoop(opts.ResyncInterval)
+	}
+	return m, nil
+}
+
+// fail marks l as failed with err. Unless all is set, the blocks overlapping
+// the n bytes at off are marked as missing. Otherwise, the leg is missing
+// everything.
+func (m *Mirror) fail(l *leg, err error, off int64, n int, all bool) {
+	m.mu.Lock()
+	i := -1
+	for j, o := range m.legs {
+		if o == l {
+			i = j
+		}
+	}
+	prev := l.state
+	l.state, l.err = Failed, err
+	if all {
+		l.missing.MarkAll()
+	} else {
+		l.missing.Mark(off, n)
+	}
+	m.mu.Unlock()
+	if prev != Failed && i >= 0 && m.onFailure != nil {
+		m.onFailure(i, err)
+	}
+}
+
+// readOrder returns the healthy legs, with the lowest latency first.
+func (m *Mirror) readOrder() []*leg {
+	m.mu.Lock()
+	var legs []*leg
+	for _, l := range m.legs {
+		if l.state == Healthy {
+			legs = append(legs, l)
+		}
+	}
+	m.mu.Unlock()
+	sort.Slice(legs, func(a, b int) bool {
+		return atomic.LoadInt64(&legs[a].latency) < atomic.LoadInt64(&legs[b].latency)
+	})
+	return legs
+}
+
+// ReadAt implements nbd.Device.
+func (m *Mirror) ReadAt(p []byte, off int64) (int, error) {
+	err := error(nbd.Errorf(nbd.EIO, "no healthy leg"))
+	for _, l := range m.readOrder() {
+		start := time.Now()
+		n, rerr := l.d.ReadAt(p, off)
+		if rerr == nil || rerr == io.EOF {
+			lat := int64(time.Since(start))
+			old := atomic.LoadInt64(&l.latency)
+			atomic.StoreInt64(&l.latency, old+(lat-old)/8)
+			return n, rerr
+		}
+		err = rerr
+		// A failed read does not mean the leg is missing data, but it can
+		// not be relied on anymore either.
+		m.fail(l, rerr, off, len(p), false)
+	}
+	return 0, err
+}
+
+// lockBlocks locks the blocks overlapping the n bytes at off and returns a
+// function unlocking them.
+func (m *Mirror) lockBlocks(off int64, n int) func() {
+	if n <= 0 || off < 0 {
+		return func() {}
+	}
+	bs := int64(m.blockSize)
+	var idx []int
+	seen := make(map[int]bool)
+	for b := off / bs; b <= (off+int64(n)-1)/bs && len(idx) < len(m.locks); b++ {
+		i := int(b % int64(len(m.locks)))
+		if !seen[i] {
+			seen[i] = true
+			idx = append(idx, i)
+		}
+	}
+	// Lock in ascending order, so concurrent writes do not deadlock.
+	sort.Ints(idx)
+	for _, i := range idx {
+		m.locks[i].Lock()
+	}
+	return func() {
+		for _, i := range idx {
+			m.locks[i].Unlock()
+		}
+	}
+}
+
+// WriteAt implements nbd.Device. It writes all legs, which are not failed,
+// concurrently. Failed legs remember the blocks written, to resync them.
+func (m *Mirror) WriteAt(p []byte, off int64) (int, error) {
+	defer m.lockBlocks(off, len(p))()
+	return len(p), m.each(off, len(p), func(d nbd.Device) error {
+		_, err := d.WriteAt(p, off)
+		return err
+	})
+}
+
+// each calls f concurrently with the Device of every leg, which is not
+// failed, and marks the legs failing as failed. A Failed leg is marked as
+// missing the n bytes at off. It returns an error, if no leg succeeded.
+func (m *Mirror) each(off int64, n int, f func(nbd.Device) error) error {
+	m.mu.Lock()
+	var legs []*leg
+	for _, l := range m.legs {
+		if l.state == Failed {
+			l.missing.Mark(off, n)
+			continue
+		}
+		legs = append(legs, l)
+	}
+	m.mu.Unlock()
+
+	errs := make([]error, len(legs))
+	var wg sync.WaitGroup
+	for j := range legs {
+		wg.Add(1)
+		go func(j int) {
+			defer wg.Done()
+			errs[j] = f(legs[j].d)
+		}(j)
+	}
+	wg.Wait()
+	var (
+		ok  bool
+		err = error(nbd.Errorf(nbd.EIO, "no healthy leg"))
+	)
+	for j, e := range errs {
+		if e == nil {
+			ok = ok || m.state(legs[j]) == Healthy
+			continue
+		}
+		err = e
+		if n < 0 {
+			m.fail(legs[j], e, 0, 0, true)
+		} else {
+			m.fail(legs[j], e, off, n, false)
+		}
+	}
+	if ok {
+		return nil
+	}
+	return err
+}
+
+// state returns the state of l.
+func (m *Mirror) state(l *leg) State {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return l.state
+}
+
+// Sync implements nbd.Device. A leg failing to sync is missing all data, as
+// it is unknown which writes it lost.
+func (m *Mirror) Sync() error {
+	return m.each(0, -1, func(d nbd.Device) error { return d.Sync() })
+}
+
+// Status returns the status of all legs.
+func (m *Mirror) Status() []LegStatus {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var st []LegStatus
+	for _, l := range m.legs {
+		st = append(st, LegStatus{
+			State:   l.state,
+			Err:     l.err,
+			Missing: int64(l.missing.Count()) * int64(m.blockSize),
+			Latency: time.Duration(atomic.LoadInt64(&l.latency)),
+		})
+	}
+	return st
+}
+
+// Replace replaces leg i by d, which then has to be resynced completely. This
+// can be used to move a Mirror to new storage, by replacing the legs one
+// after the other. The old Device is not closed.
+func (m *Mirror) Replace(i int, d nbd.Device) {
+	m.resyncing.Lock()
+	defer m.resyncing.Unlock()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	l := &leg{d: d, state: Failed, err: errors.New("replaced"), missing: dirty.NewBitmap(m.size, m.blockSize)}
+	l.missing.MarkAll()
+	m.legs[i] = l
+}
+
+// Resync copies the blocks missing from leg i from the healthy legs and
+// marks it as healthy, if it is not already. While it is resyncing, the leg
+// is written by clients, to converge. If ctx is cancelled or copying fails,
+// the leg stays failed and keeps the blocks of the current pass, for the next
+// attempt.
+func (m *Mirror) Resync(ctx context.Context, i int) error {
+	m.resyncing.Lock()
+	defer m.resyncing.Unlock()
+
+	m.mu.Lock()
+	l := m.legs[i]
+	if l.state == Healthy {
+		m.mu.Unlock()
+		return nil
+	}
+	l.state = Resyncing
+	m.mu.Unlock()
+
+	buf := make([]byte, m.blockSize)
+	for {
+		m.mu.Lock()
+		if l.state != Resyncing {
+			// A write failed concurrently.
+			err := l.err
+			m.mu.Unlock()
+			return err
+		}
+		bm := l.missing
+		if bm.Count() == 0 {
+			l.state, l.err = Healthy, nil
+			m.mu.Unlock()
+			return nil
+		}
+		l.missing = dirty.NewBitmap(m.size, m.blockSize)
+		m.mu.Unlock()
+
+		if err := m.copyMissing(ctx, l, bm, buf); err != nil {
+			m.mu.Lock()
+			l.missing.Or(bm)
+			if l.state != Failed {
+				l.state, l.err = Failed, err
+			}
+			m.mu.Unlock()
+			return err
+		}
+	}
+}
+
+// copyMissing copies the blocks in bm from a healthy leg to l.
+func (m *Mirror) copyMissing(ctx context.Context, l *leg, bm *dirty.Bitmap, buf []byte) error {
+	for _, r := range bm.Ranges(int64(m.blockSize)) {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := m.copyRange(l, r, buf[:r.Length]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// copyRange copies r from a healthy leg to l.
+func (m *Mirror) copyRange(l *leg, r dirty.Range, b []byte) error {
+	defer m.lockBlocks(r.Offset, len(b))()
+	var err error
+	for _, src := range m.readOrder() {
+		if src == l {
+			continue
+		}
+		var n int
+		if n, err = src.d.ReadAt(b, r.Offset); err != nil && !(err == io.EOF && n == len(b)) {
+			m.fail(src, err, r.Offset, len(b), false)
+			continue
+		}
+		_, err = l.d.WriteAt(b, r.Offset)
+		return err
+	}
+	if err == nil {
+		err = nbd.Errorf(nbd.EIO, "no healthy leg to resync from")
+	}
+	return err
+}
+
+// resyncLoop resyncs failed legs every interval, until m is closed.
+func (m *Mirror) resyncLoop(interval time.Duration) {
+	defer m.wg.Done()
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-m.done
+		cancel()
+	}()
+	for {
+		select {
+		case <-m.done:
+			return
+		case <-t.C:
+		}
+		for i, st := range m.Status() {
+			if st.State == Failed {
+				m.Resync(ctx, i)
+			}
+		}
+	}
+}
+
+// Close stops resyncing in the background. It does not close the legs.
+func (m *Mirror) Close() error {
+	select {
+	case <-m.done:
+	default:
+		close(m.done)
+	}
+	m.wg.Wait()
+	return nil
+}
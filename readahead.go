@@ -0,0 +1,133 @@
+// Copyright 2018 Axel Wagner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nbd
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// minSequential is the number of reads that have to directly follow each
+// other, before readahead starts.
+const minSequential = 2
+
+// readahead detects sequential reads on a connection and asynchronously reads
+// ahead of them into a small cache.
+type readahead struct {
+	c    *serverConn
+	size int
+
+	mu sync.Mutex
+	// next is the offset the next read is expected at, if the stream of reads
+	// is sequential.
+	next int64
+	// seq is the number of sequential reads seen in a row.
+	seq int
+	// prev and cur are the two most recently started readahead windows. prev
+	// is kept, so reads can still be served from it while cur is fetched.
+	prev, cur *raWindow
+}
+
+// raWindow is a range of data read ahead from the Device.
+type raWindow struct {
+	off  int64
+	buf  []byte
+	gen  uint64
+	done chan struct{}
+	err  error
+}
+
+func (w *raWindow) end() int64 {
+	return w.off + int64(len(w.buf))
+}
+
+func (w *raWindow) covers(off, end int64) bool {
+	return w != nil && off >= w.off && end <= w.end()
+}
+
+func newReadahead(c *serverConn, size int) *readahead {
+	return &readahead{c: c, size: size, next: -1}
+}
+
+// read records a read of len(p) bytes at off and then tries to fill p from the
+// cache. It reports whether p was filled. If the read continues a sequential
+// stream, read starts reading ahead of it.
+func (ra *readahead) read(p []byte, off int64) bool {
+	end := off + int64(len(p))
+
+	ra.mu.Lock()
+	if off == ra.next {
+		ra.seq++
+	} else {
+		ra.seq = 0
+	}
+	ra.next = end
+	var w *raWindow
+	switch {
+	case ra.cur.covers(off, end):
+		w = ra.cur
+	case ra.prev.covers(off, end):
+		w = ra.prev
+	}
+	if ra.seq >= minSequential {
+		start := end
+		if ra.cur != nil && ra.cur.off <= end && end <= ra.cur.end() {
+			start = ra.cur.end()
+		}
+		if start-end < int64(ra.size)/2 {
+			ra.startLocked(start)
+		}
+	}
+	ra.mu.Unlock()
+
+	if w == nil {
+		return false
+	}
+	<-w.done
+	if w.err != nil || atomic.LoadUint64(&ra.c.exp.gen) != w.gen {
+		return false
+	}
+	copy(p, w.buf[off-w.off:])
+	return true
+}
+
+// startLocked starts reading ahead a window at off. ra.mu must be held.
+func (ra *readahead) startLocked(off int64) {
+	size := uint64(ra.size)
+	end := ra.c.size()
+	if uint64(off) >= end {
+		return
+	}
+	if rem := end - uint64(off); rem < size {
+		size = rem
+	}
+	w := &raWindow{
+		off:  off,
+		buf:  make([]byte, size),
+		gen:  atomic.LoadUint64(&ra.c.exp.gen),
+		done: make(chan struct{}),
+	}
+	ra.prev, ra.cur = ra.cur, w
+	go func() {
+		defer close(w.done)
+		ra.c.acquire()
+		defer ra.c.release()
+		n, err := ra.c.p.Export.Device.ReadAt(w.buf, w.off)
+		if n == len(w.buf) {
+			err = nil
+		}
+		w.err = err
+	}()
+}
@@ -0,0 +1,247 @@
+// Copyright 2018 Axel Wagner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nbd
+
+import (
+	"sync"
+	"time"
+)
+
+// MaxIOSizer is an optional interface a Device can implement, to declare the
+// largest ReadAt or WriteAt call it handles efficiently, e.g. the size of the
+// chunks of a remote backend. Unlike BlockSizer, it does not restrict
+// clients; Schedule splits larger requests.
+type MaxIOSizer interface {
+	MaxIOSize() int
+}
+
+// ScheduleOptions configures Schedule. The zero value neither merges nor
+// splits requests, unless the Device implements MaxIOSizer.
+type ScheduleOptions struct {
+	// MergeWindow is the time a read waits for adjacent reads to be merged
+	// with it. If it is 0, reads are not merged.
+	MergeWindow time.Duration
+	// MaxMerge is the maximum size of a merged read. If it is 0, MaxIO is
+	// used, or 1MiB if that is 0, too.
+	MaxMerge int
+	// MaxIO is the maximum size of a single ReadAt or WriteAt call on the
+	// Device. Larger reads and writes are split into pieces, which are
+	// executed concurrently. If it is 0 and the Device implements
+	// MaxIOSizer, its MaxIOSize is used. Otherwise, requests are not split.
+	MaxIO int
+	// Parallel limits the number of pieces of a split request executed
+	// concurrently. If it is <= 0, all pieces are.
+	Parallel int
+}
+
+// Schedule returns a Device that merges adjacent small reads and splits
+// large reads and writes to d. This improves the throughput of backends with
+// a high cost per call, which are most efficient with requests of a certain
+// size, like object stores.
+//
+// A read only returns after the merged read containing it finished, so
+// merging only has an effect if reads are issued concurrently (e.g. by
+// setting Server.Workers), as the kernel does with sequential reads. Writes
+// are not merged, use CoalesceWrites for that. The pieces of split requests
+// are executed concurrently, so d must be safe for concurrent use.
+//
+// If d implements ReaderAtVec, merged reads are passed to it without copying
+// them from a contiguous buffer. The returned Device implements Unwrapper.
+func Schedule(d Device, o *ScheduleOptions) Device {
+	if o == nil {
+		o = new(ScheduleOptions)
+	}
+	s := &scheduler{
+		Device:   d,
+		window:   o.MergeWindow,
+		maxIO:    o.MaxIO,
+		maxMerge: o.MaxMerge,
+		par:      o.Parallel,
+	}
+	if s.maxIO <= 0 {
+		var m MaxIOSizer
+		if As(d, &m) {
+			s.maxIO = m.MaxIOSize()
+		}
+	}
+	if s.maxMerge <= 0 {
+		s.maxMerge = s.maxIO
+	}
+	if s.maxMerge <= 0 {
+		s.maxMerge = 1 << 20
+	}
+	if s.maxIO > 0 && s.maxMerge > s.maxIO {
+		s.maxMerge = s.maxIO
+	}
+	return s
+}
+
+type scheduler struct {
+	Device
+	window   time.Duration
+	maxIO    int
+	maxMerge int
+	par      int
+
+	mu sync.Mutex
+	// pending is the batch currently accepting reads, if any.
+	pending *readBatch
+}
+
+// readBatch is a set of adjacent reads, which are read from the underlying
+// Device together.
+type readBatch struct {
+	off int64
+	// bufs are the buffers of the merged reads, in order. They are owned by
+	// the blocked callers of ReadAt and can be used until done is closed.
+	bufs  [][]byte
+	n     int
+	timer *time.Timer
+	done  chan struct{}
+	err   error
+}
+
+// Unwrap implements Unwrapper.
+func (s *scheduler) Unwrap() Device {
+	return s.Device
+}
+
+func (s *scheduler) ReadAt(p []byte, off int64) (int, error) {
+	if s.window <= 0 || len(p) >= s.maxMerge {
+		if err := s.split(p, off, s.Device.ReadAt); err != nil {
+			return 0, err
+		}
+		return len(p), nil
+	}
+
+	s.mu.Lock()
+	b := s.pending
+	switch {
+	case b != nil && b.n+len(p) <= s.maxMerge && off == b.off+int64(b.n):
+		b.bufs = append(b.bufs, p)
+		b.n += len(p)
+	case b != nil && b.n+len(p) <= s.maxMerge && off+int64(len(p)) == b.off:
+		b.bufs = append([][]byte{p}, b.bufs...)
+		b.n += len(p)
+		b.off = off
+	default:
+		s.startLocked()
+		b = &readBatch{
+			off:  off,
+			bufs: [][]byte{p},
+			n:    len(p),
+			done: make(chan struct{}),
+		}
+		b.timer = time.AfterFunc(s.window, func() {
+			s.mu.Lock()
+			if s.pending == b {
+				s.startLocked()
+			}
+			s.mu.Unlock()
+		})
+		s.pending = b
+	}
+	if b.n >= s.maxMerge {
+		s.startLocked()
+	}
+	s.mu.Unlock()
+
+	<-b.done
+	if b.err != nil {
+		return 0, b.err
+	}
+	return len(p), nil
+}
+
+// startLocked starts reading the pending batch, if any. s.mu must be held.
+func (s *scheduler) startLocked() {
+	b := s.pending
+	if b == nil {
+		return
+	}
+	s.pending = nil
+	b.timer.Stop()
+	go func() {
+		b.err = s.read(b)
+		close(b.done)
+	}()
+}
+
+// read reads b from the underlying Device.
+func (s *scheduler) read(b *readBatch) error {
+	if len(b.bufs) == 1 {
+		_, err := s.Device.ReadAt(b.bufs[0], b.off)
+		return err
+	}
+	if v, ok := s.Device.(ReaderAtVec); ok {
+		_, err := v.ReadAtVec(b.bufs, b.off)
+		return err
+	}
+	buf := make([]byte, b.n)
+	if _, err := s.Device.ReadAt(buf, b.off); err != nil {
+		return err
+	}
+	for _, p := range b.bufs {
+		buf = buf[copy(p, buf):]
+	}
+	return nil
+}
+
+func (s *scheduler) WriteAt(p []byte, off int64) (int, error) {
+	if err := s.split(p, off, s.Device.WriteAt); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// split calls f with the pieces of buf of at most s.maxIO bytes and their
+// offsets, concurrently. It returns the error of the failing piece with the
+// lowest offset, if any.
+func (s *scheduler) split(buf []byte, off int64, f func([]byte, int64) (int, error)) error {
+	if s.maxIO <= 0 || len(buf) <= s.maxIO {
+		_, err := f(buf, off)
+		return err
+	}
+	n := (len(buf) + s.maxIO - 1) / s.maxIO
+	par := s.par
+	if par <= 0 || par > n {
+		par = n
+	}
+	var (
+		wg   sync.WaitGroup
+		sem  = make(chan struct{}, par)
+		errs = make([]error, n)
+	)
+	for i := 0; i < n; i++ {
+		p := buf[i*s.maxIO:]
+		if len(p) > s.maxIO {
+			p = p[:s.maxIO]
+		}
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(i int, p []byte) {
+			defer wg.Done()
+			_, errs[i] = f(p, off+int64(i*s.maxIO))
+			<-sem
+		}(i, p)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
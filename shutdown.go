@@ -0,0 +1,70 @@
+// Copyright 2018 Axel Wagner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nbd
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// ErrServerClosed is returned by Server.Serve after a call to Shutdown.
+var ErrServerClosed = errors.New("nbd: server closed")
+
+// errDraining is returned by ctxRW.Read, if the connection was drained.
+var errDraining = errors.New("connection drained")
+
+// shutdownPoll is the interval in which Shutdown checks for connections to
+// be closed.
+const shutdownPoll = 10 * time.Millisecond
+
+// Shutdown gracefully shuts down the server, without interrupting requests:
+// Serve stops accepting connections and returns ErrServerClosed. Each
+// connection stops reading requests once it is between two requests, waits
+// for the requests in flight to be answered, flushes the Device (unless the
+// export is read-only) and terminates. Shutdown waits until all connections
+// are terminated, or ctx is done. In the latter case, the remaining
+// connections are closed abruptly and Shutdown returns ctx.Err.
+//
+// Requests sent by a client after its connection stopped reading are not
+// answered; the client sees the connection closing. Connections still in the
+// handshake are not waited for, but are drained once they enter the
+// transmission phase. Requests abandoned after RequestTimeout might still be
+// executed afterwards. The Server can not be used after Shutdown.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.once.Do(s.init)
+	s.drainOnce.Do(func() { close(s.drain) })
+	t := time.NewTicker(shutdownPoll)
+	defer t.Stop()
+	for s.conns.len() > 0 {
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			s.conns.each(func(c *serverConn) { c.cancel() })
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// shuttingDown returns whether Shutdown was called.
+func (s *Server) shuttingDown() bool {
+	select {
+	case <-s.drain:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,478 @@
+// Copyright 2018 Axel Wagner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package soaktest implements a long-running integrity test for Devices.
+//
+// Run issues concurrent, randomized reads, writes and syncs against a Device,
+// while injecting faults: latency, reconnects and simulated crashes. Every
+// block written carries a header with its index, a generation number and a
+// checksum, so reads detect corrupted, misdirected and stale data without
+// keeping a copy of the contents. After a reconnect, all acknowledged writes
+// must be visible; after a crash, all writes acknowledged before the last
+// successful sync must be, which checks flush durability.
+//
+// The Device under test can be anything: an export accessed through the
+// client, a kernel NBD device opened via Loopback, or a backend used
+// directly. For example, to soak a backend through the protocol:
+//
+//	dev := &crashtest.Device{Device: backend}
+//	rep, err := soaktest.Run(ctx, soaktest.Config{
+//		Size:     size,
+//		Duration: time.Hour,
+//		Open: func(ctx context.Context) (nbd.Device, error) {
+//			dev.Restart()
+//			return connect(ctx, dev)
+//		},
+//		Crash:          func() error { dev.Crash(); return nil },
+//		CrashEvery:     time.Minute,
+//		ReconnectEvery: 10 * time.Second,
+//	})
+package soaktest
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Merovius/nbd"
+)
+
+// Config configures Run.
+type Config struct {
+	// Open returns the Device under test. It is called at the start and
+	// after every reconnect and crash, after the previous Device was closed
+	// (if it implements io.Closer). It must not be nil.
+	Open func(ctx context.Context) (nbd.Device, error)
+	// Size is the size of the Device in bytes. Only whole blocks are tested.
+	Size int64
+	// BlockSize is the size of the blocks written. It must be at least 64.
+	// If it is 0, 4096 is used.
+	BlockSize int
+	// MaxBlocks is the maximum number of blocks written or read by a single
+	// request. If it is <= 0, 16 is used.
+	MaxBlocks int
+	// Workers is the number of goroutines issuing requests concurrently. If
+	// it is <= 0, 4 is used.
+	Workers int
+	// Duration is the time to run for. If it is 0, Run runs until ctx is
+	// cancelled.
+	Duration time.Duration
+	// Seed seeds the random number generators.
+	Seed int64
+
+	// Latency, if not nil, returns a delay to inject before each request.
+	Latency func(r *rand.Rand) time.Duration
+	// ReconnectEvery is the interval in which the Device is closed and opened
+	// again. If it is 0, no reconnects are done.
+	ReconnectEvery time.Duration
+	// CrashEvery is the interval in which a crash is simulated by calling
+	// Crash, followed by reopening the Device. If it is 0 or Crash is nil, no
+	// crashes are simulated.
+	CrashEvery time.Duration
+	// Crash simulates a crash of the Device, e.g. by calling Crash on a
+	// crashtest.Device or killing the server. Writes not synced before may
+	// be lost afterwards.
+	Crash func() error
+
+	// Logf, if not nil, is used to log progress and injected faults.
+	Logf func(format string, args ...interface{})
+}
+
+// Report summarizes a run.
+type Report struct {
+	Reads      uint64
+	Writes     uint64
+	Syncs      uint64
+	Reconnects int
+	Crashes    int
+	// Verified is the number of blocks read and validated.
+	Verified uint64
+}
+
+// IntegrityError is returned by Run, if the Device returned wrong data.
+type IntegrityError struct {
+	// Block is the index of the block.
+	Block int64
+	// Reason describes what is wrong with the data.
+	Reason string
+}
+
+func (e *IntegrityError) Error() string {
+	return fmt.Sprintf("block %d: %s", e.Block, e.Reason)
+}
+
+const (
+	headerSize = 32
+	magic      = 0x534f414b // "SOAK"
+)
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// block is the model of a block.
+type block struct {
+	// acked is the generation of the last acknowledged write and durable the
+	// one of the last write acknowledged before a successful sync. 0 means
+	// the contents are unknown.
+	acked   uint64
+	durable uint64
+	// issued is the highest generation ever written, so generations are
+	// never reused, even if a crash lost them.
+	issued uint64
+}
+
+// soak is the state of a run.
+type soak struct {
+	cfg    Config
+	bs     int64
+	blocks []block
+	rep    Report
+
+	// mu is held for reading by every request and for writing while a fault
+	// is injected, so there are no requests in flight.
+	mu sync.RWMutex
+	d  nbd.Device
+}
+
+// Run runs a soak test configured by cfg. It returns after cfg.Duration or
+// once ctx is cancelled, with a nil error, if no problem was found. If the
+// Device returns wrong data, the error is an *IntegrityError.
+func Run(ctx context.Context, cfg Config) (Report, error) {
+	if cfg.Open == nil {
+		return Report{}, errors.New("soaktest: Config.Open is nil")
+	}
+	if cfg.BlockSize == 0 {
+		cfg.BlockSize = 4096
+	}
+	if cfg.BlockSize < 2*headerSize {
+		return Report{}, fmt.Errorf("soaktest: block size %d too small", cfg.BlockSize)
+	}
+	if cfg.MaxBlocks <= 0 {
+		cfg.MaxBlocks = 16
+	}
+	if cfg.Workers <= 0 {
+		cfg.Workers = 4
+	}
+	s := &soak{cfg: cfg, bs: int64(cfg.BlockSize)}
+	s.blocks = make([]block, cfg.Size/s.bs)
+	if len(s.blocks) < cfg.Workers {
+		return Report{}, errors.New("soaktest: Device too small")
+	}
+	if cfg.Duration > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, cfg.Duration)
+		defer cancel()
+	}
+	d, err := cfg.Open(ctx)
+	if err != nil {
+		return Report{}, err
+	}
+	s.d = d
+	defer func() { closeDevice(s.d) }()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var (
+		wg   sync.WaitGroup
+		once sync.Once
+		ferr error
+	)
+	fail := func(err error) {
+		once.Do(func() {
+			ferr = err
+			cancel()
+		})
+	}
+	n := int64(len(s.blocks))
+	for w := 0; w < cfg.Workers; w++ {
+		first, last := n*int64(w)/int64(cfg.Workers), n*int64(w+1)/int64(cfg.Workers)
+		r := rand.New(rand.NewSource(cfg.Seed + int64(w)))
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := s.work(ctx, r, first, last); err != nil {
+				fail(err)
+			}
+		}()
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		if err := s.faults(ctx); err != nil {
+			fail(err)
+		}
+	}()
+	wg.Wait()
+
+	if ferr == nil {
+		ferr = s.verifyAll(false)
+	}
+	rep := s.rep
+	rep.Reads = atomic.LoadUint64(&s.rep.Reads)
+	rep.Writes = atomic.LoadUint64(&s.rep.Writes)
+	rep.Syncs = atomic.LoadUint64(&s.rep.Syncs)
+	rep.Verified = atomic.LoadUint64(&s.rep.Verified)
+	return rep, ferr
+}
+
+func (s *soak) logf(format string, args ...interface{}) {
+	if s.cfg.Logf != nil {
+		s.cfg.Logf(format, args...)
+	}
+}
+
+func closeDevice(d nbd.Device) {
+	if c, ok := d.(io.Closer); ok {
+		c.Close()
+	}
+}
+
+// work issues random requests for the blocks [first, last), until ctx is
+// done.
+func (s *soak) work(ctx context.Context, r *rand.Rand, first, last int64) error {
+	buf := make([]byte, int64(s.cfg.MaxBlocks)*s.bs)
+	for ctx.Err() == nil {
+		if s.cfg.Latency != nil {
+			time.Sleep(s.cfg.Latency(r))
+		}
+		b := first + r.Int63n(last-first)
+		n := 1 + r.Int63n(int64(s.cfg.MaxBlocks))
+		if b+n > last {
+			n = last - b
+		}
+		var err error
+		switch op := r.Intn(10); {
+		case op < 5:
+			err = s.write(r, buf[:n*s.bs], b)
+		case op < 9:
+			err = s.read(buf[:n*s.bs], b)
+		default:
+			err = s.sync(first, last)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *soak) write(r *rand.Rand, p []byte, first int64) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	n := int64(len(p)) / s.bs
+	for i := int64(0); i < n; i++ {
+		bl := &s.blocks[first+i]
+		bl.issued++
+		s.fill(r, p[i*s.bs:(i+1)*s.bs], first+i, bl.issued)
+	}
+	if _, err := s.d.WriteAt(p, first*s.bs); err != nil {
+		return fmt.Errorf("writing blocks [%d,%d): %v", first, first+n, err)
+	}
+	for i := int64(0); i < n; i++ {
+		bl := &s.blocks[first+i]
+		bl.acked = bl.issued
+	}
+	atomic.AddUint64(&s.rep.Writes, 1)
+	return nil
+}
+
+func (s *soak) read(p []byte, first int64) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if _, err := s.d.ReadAt(p, first*s.bs); err != nil && err != io.EOF {
+		return fmt.Errorf("reading blocks [%d,%d): %v", first, first+int64(len(p))/s.bs, err)
+	}
+	atomic.AddUint64(&s.rep.Reads, 1)
+	for i := int64(0); i < int64(len(p))/s.bs; i++ {
+		if err := s.verify(p[i*s.bs:(i+1)*s.bs], first+i, false); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sync syncs the Device and marks the acknowledged writes to the blocks
+// [first, last) durable.
+func (s *soak) sync(first, last int64) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	acked := make([]uint64, last-first)
+	for i := range acked {
+		acked[i] = s.blocks[first+int64(i)].acked
+	}
+	if err := s.d.Sync(); err != nil {
+		return fmt.Errorf("sync: %v", err)
+	}
+	for i, g := range acked {
+		s.blocks[first+int64(i)].durable = g
+	}
+	atomic.AddUint64(&s.rep.Syncs, 1)
+	return nil
+}
+
+// fill fills p with the contents of generation gen of block b.
+func (s *soak) fill(r *rand.Rand, p []byte, b int64, gen uint64) {
+	binary.BigEndian.PutUint32(p[0:], magic)
+	binary.BigEndian.PutUint64(p[4:], uint64(b))
+	binary.BigEndian.PutUint64(p[12:], gen)
+	binary.BigEndian.PutUint64(p[20:], uint64(s.bs))
+	r.Read(p[headerSize:])
+	binary.BigEndian.PutUint32(p[28:], checksum(p))
+}
+
+func checksum(p []byte) uint32 {
+	crc := crc32.Update(0, castagnoli, p[:28])
+	return crc32.Update(crc, castagnoli, p[headerSize:])
+}
+
+// decode returns the block index and generation stored in p and whether its
+// header and checksum are valid.
+func decode(p []byte) (b int64, gen uint64, ok bool) {
+	if binary.BigEndian.Uint32(p) != magic || binary.BigEndian.Uint64(p[20:]) != uint64(len(p)) {
+		return 0, 0, false
+	}
+	if binary.BigEndian.Uint32(p[28:]) != checksum(p) {
+		return 0, 0, false
+	}
+	return int64(binary.BigEndian.Uint64(p[4:])), binary.BigEndian.Uint64(p[12:]), true
+}
+
+// verify checks the contents p read from block b against the model. If
+// crashed is true, the Device crashed since the last check, so writes not
+// synced may be lost and the model is updated to the contents found.
+func (s *soak) verify(p []byte, b int64, crashed bool) error {
+	atomic.AddUint64(&s.rep.Verified, 1)
+	bl := &s.blocks[b]
+	got, gen, ok := decode(p)
+	if ok && got != b {
+		return &IntegrityError{b, fmt.Sprintf("contains data written to block %d", got)}
+	}
+	if !crashed {
+		switch {
+		case bl.acked == 0:
+		case !ok:
+			return &IntegrityError{b, "corrupt data"}
+		case gen != bl.acked:
+			return &IntegrityError{b, fmt.Sprintf("has generation %d, want %d", gen, bl.acked)}
+		}
+		return nil
+	}
+
+	switch {
+	case bl.durable == 0:
+		// Nothing was synced, so anything can be there.
+	case !ok && bl.acked == bl.durable:
+		return &IntegrityError{b, "corrupt data after crash"}
+	case !ok:
+		// An unsynced write may be torn.
+	case gen < bl.durable:
+		return &IntegrityError{b, fmt.Sprintf("lost synced generation %d after crash, has %d", bl.durable, gen)}
+	case gen > bl.acked:
+		return &IntegrityError{b, fmt.Sprintf("has unacknowledged generation %d after crash, want at most %d", gen, bl.acked)}
+	}
+	if ok && (bl.durable != 0 || gen <= bl.acked) {
+		bl.acked, bl.durable = gen, gen
+	} else {
+		bl.acked, bl.durable = 0, 0
+	}
+	return nil
+}
+
+// verifyAll reads and checks all blocks. s.mu must be held for writing or no
+// workers may be running.
+func (s *soak) verifyAll(crashed bool) error {
+	n := int64(len(s.blocks))
+	chunk := int64(s.cfg.MaxBlocks)
+	buf := make([]byte, chunk*s.bs)
+	for b := int64(0); b < n; b += chunk {
+		if b+chunk > n {
+			chunk = n - b
+		}
+		p := buf[:chunk*s.bs]
+		if _, err := s.d.ReadAt(p, b*s.bs); err != nil && err != io.EOF {
+			return fmt.Errorf("reading blocks [%d,%d): %v", b, b+chunk, err)
+		}
+		for i := int64(0); i < chunk; i++ {
+			if err := s.verify(p[i*s.bs:(i+1)*s.bs], b+i, crashed); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// faults injects reconnects and crashes, until ctx is done.
+func (s *soak) faults(ctx context.Context) error {
+	var reconnect, crash <-chan time.Time
+	if s.cfg.ReconnectEvery > 0 {
+		t := time.NewTicker(s.cfg.ReconnectEvery)
+		defer t.Stop()
+		reconnect = t.C
+	}
+	if s.cfg.CrashEvery > 0 && s.cfg.Crash != nil {
+		t := time.NewTicker(s.cfg.CrashEvery)
+		defer t.Stop()
+		crash = t.C
+	}
+	for {
+		var err error
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-reconnect:
+			err = s.reopen(ctx, false)
+		case <-crash:
+			err = s.reopen(ctx, true)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// reopen closes and reopens the Device, simulating a crash first, if crashed
+// is true. It then verifies all blocks.
+func (s *soak) reopen(ctx context.Context, crashed bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if crashed {
+		s.logf("soaktest: simulating crash")
+		if err := s.cfg.Crash(); err != nil {
+			return fmt.Errorf("crash: %v", err)
+		}
+		s.rep.Crashes++
+	} else {
+		s.logf("soaktest: reconnecting")
+		s.rep.Reconnects++
+	}
+	closeDevice(s.d)
+	// The Device is needed for the final verification, even if ctx is done
+	// by now.
+	d, err := s.cfg.Open(context.WithoutCancel(ctx))
+	if err != nil {
+		return fmt.Errorf("reopening Device: %v", err)
+	}
+	s.d = d
+	if err := s.verifyAll(crashed); err != nil {
+		return err
+	}
+	s.logf("soaktest: verified %d blocks", len(s.blocks))
+	return nil
+}
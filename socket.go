@@ -0,0 +1,126 @@
+// Copyright 2018 Axel Wagner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nbd
+
+import (
+	"context"
+	"net"
+	"time"
+)
+
+// SocketOptions tunes the sockets used for NBD connections. The OS defaults
+// are often suboptimal for high-bandwidth links. The zero value leaves all
+// defaults in place.
+type SocketOptions struct {
+	// Nagle enables Nagle's algorithm on TCP connections, by clearing
+	// TCP_NODELAY. By default, TCP_NODELAY is set, as for all Go connections.
+	Nagle bool
+	// SendBuffer and RecvBuffer set SO_SNDBUF and SO_RCVBUF respectively, for
+	// both TCP and unix domain sockets. If <= 0, the OS default is used.
+	SendBuffer int
+	RecvBuffer int
+	// KeepAlive is the TCP keepalive interval. If zero, Go's default is used.
+	// If negative, keepalives are disabled.
+	KeepAlive time.Duration
+}
+
+// Apply applies o to c. Options not applicable to c are ignored.
+func (o SocketOptions) Apply(c net.Conn) error {
+	if tc, ok := c.(*net.TCPConn); ok {
+		if err := tc.SetNoDelay(!o.Nagle); err != nil {
+			return err
+		}
+		if o.KeepAlive < 0 {
+			if err := tc.SetKeepAlive(false); err != nil {
+				return err
+			}
+		} else if o.KeepAlive > 0 {
+			if err := tc.SetKeepAlive(true); err != nil {
+				return err
+			}
+			if err := tc.SetKeepAlivePeriod(o.KeepAlive); err != nil {
+				return err
+			}
+		}
+	}
+	type buffered interface {
+		SetReadBuffer(int) error
+		SetWriteBuffer(int) error
+	}
+	if bc, ok := c.(buffered); ok {
+		if o.RecvBuffer > 0 {
+			if err := bc.SetReadBuffer(o.RecvBuffer); err != nil {
+				return err
+			}
+		}
+		if o.SendBuffer > 0 {
+			if err := bc.SetWriteBuffer(o.SendBuffer); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Listen listens on the given network address and returns a listener, which
+// applies o to all accepted connections. Buffer sizes are also set on the
+// listening socket, so they take effect during connection setup (e.g. for TCP
+// window scaling).
+func (o SocketOptions) Listen(ctx context.Context, network, addr string) (net.Listener, error) {
+	lc := net.ListenConfig{
+		Control:   o.control,
+		KeepAlive: o.KeepAlive,
+	}
+	l, err := lc.Listen(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+	return &socketListener{l, o}, nil
+}
+
+// Dial connects to the given network address and applies o to the
+// connection.
+func (o SocketOptions) Dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	d := net.Dialer{
+		Control:   o.control,
+		KeepAlive: o.KeepAlive,
+	}
+	c, err := d.DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+	if err := o.Apply(c); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+type socketListener struct {
+	net.Listener
+	o SocketOptions
+}
+
+func (l *socketListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if err := l.o.Apply(c); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return c, nil
+}
@@ -0,0 +1,46 @@
+// +build linux darwin
+
+// Copyright 2018 Axel Wagner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nbd
+
+import (
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// control sets socket buffer sizes on a socket before it is bound or
+// connected.
+func (o SocketOptions) control(network, address string, c syscall.RawConn) error {
+	if o.SendBuffer <= 0 && o.RecvBuffer <= 0 {
+		return nil
+	}
+	var serr error
+	err := c.Control(func(fd uintptr) {
+		if o.SendBuffer > 0 {
+			if serr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_SNDBUF, o.SendBuffer); serr != nil {
+				return
+			}
+		}
+		if o.RecvBuffer > 0 {
+			serr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_RCVBUF, o.RecvBuffer)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return serr
+}
@@ -0,0 +1,217 @@
+// Copyright 2018 Axel Wagner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nbd
+
+import (
+	"expvar"
+	"math/bits"
+	"sync/atomic"
+	"time"
+)
+
+// Stats is a snapshot of the statistics of a Server.
+type Stats struct {
+	// Uptime is the time since the Server started serving.
+	Uptime time.Duration
+	// Counters are the totals across all exports, including removed ones.
+	Counters
+	// Exports contains the counters of each export, keyed by name.
+	Exports map[string]Counters
+	// Latency contains the distribution of request latencies, keyed by
+	// command (as returned by Command.String). Commands that were never
+	// received are omitted.
+	Latency map[string]LatencyStats
+}
+
+// Counters count the requests and connections served by a Server, or issued
+// by a Conn.
+type Counters struct {
+	// Connections is the number of connections currently in transmission
+	// phase.
+	Connections int64
+	// Requests is the number of requests executed and Errors the number of
+	// those that failed.
+	Requests uint64
+	Errors   uint64
+	// InFlight is the number of requests currently executed.
+	InFlight int64
+	// BytesRead and BytesWritten are the number of bytes read from and
+	// written to the Devices by successful requests.
+	BytesRead    uint64
+	BytesWritten uint64
+}
+
+// load returns a snapshot of c, reading all fields atomically. Like record,
+// it requires c to be 64-bit aligned (see sync/atomic), so Counters used
+// with them must be the first field of an allocated struct or only be
+// preceded by other 64-bit fields.
+func (c *Counters) load() Counters {
+	return Counters{
+		Connections:  atomic.LoadInt64(&c.Connections),
+		Requests:     atomic.LoadUint64(&c.Requests),
+		Errors:       atomic.LoadUint64(&c.Errors),
+		InFlight:     atomic.LoadInt64(&c.InFlight),
+		BytesRead:    atomic.LoadUint64(&c.BytesRead),
+		BytesWritten: atomic.LoadUint64(&c.BytesWritten),
+	}
+}
+
+// record atomically records the completion of a request of the given type,
+// which was counted in InFlight.
+func (c *Counters) record(typ uint16, length uint64, err error) {
+	atomic.AddInt64(&c.InFlight, -1)
+	atomic.AddUint64(&c.Requests, 1)
+	switch {
+	case err != nil:
+		atomic.AddUint64(&c.Errors, 1)
+	case typ == cmdRead:
+		atomic.AddUint64(&c.BytesRead, length)
+	case typ == cmdWrite:
+		atomic.AddUint64(&c.BytesWritten, length)
+	}
+}
+
+// LatencyStats summarizes a distribution of latencies. Percentiles are
+// approximate, with a relative error of at most 25%.
+type LatencyStats struct {
+	Count uint64
+	P50   time.Duration
+	P95   time.Duration
+	P99   time.Duration
+}
+
+// Stats returns a snapshot of the statistics of s. It is safe to call
+// concurrently with serving.
+func (s *Server) Stats() Stats {
+	list, states := s.snapshot()
+	st := Stats{
+		Uptime:  time.Since(s.stats.start),
+		Exports: make(map[string]Counters, len(states)),
+		Latency: make(map[string]LatencyStats),
+	}
+	for i, e := range states {
+		st.Exports[list[i].Name] = e.counters.load()
+	}
+	st.Counters = s.stats.counters.load()
+	for i := range s.stats.latency {
+		h := &s.stats.latency[i]
+		if ls := h.summarize(); ls.Count > 0 {
+			st.Latency[Command(i).String()] = ls
+		}
+	}
+	return st
+}
+
+// Publish publishes the statistics of s as an expvar under the given name.
+// Like expvar.Publish, it panics if the name is already in use.
+func (s *Server) Publish(name string) {
+	expvar.Publish(name, expvar.Func(func() interface{} {
+		return s.Stats()
+	}))
+}
+
+// serverStats is the internal, lock-free representation of Stats. It is
+// allocated on its own, so its counters are 64-bit aligned.
+type serverStats struct {
+	// counters are the totals of all connections. They are kept separately
+	// from the exports', so they survive RemoveExport. They and latency
+	// must come first, to be 64-bit aligned.
+	counters Counters
+	latency  [cmdResize + 1]histogram
+	start    time.Time
+}
+
+// observe records the latency of a request of the given type.
+func (s *serverStats) observe(typ uint16, d time.Duration) {
+	if int(typ) < len(s.latency) {
+		s.latency[typ].record(d)
+	}
+}
+
+const (
+	// histSubBits is the number of bits used to subdivide each power of two
+	// in a histogram.
+	histSubBits = 2
+	histSub     = 1 << histSubBits
+	// histBuckets covers durations up to 2^42ns (about 73 minutes).
+	histBuckets = 41 * histSub
+)
+
+// histogram is a log-linear histogram of durations. Each power of two is
+// split into histSub buckets of equal width. It is safe for concurrent use.
+type histogram struct {
+	buckets [histBuckets]uint64
+}
+
+// bucket returns the index of the bucket d falls into.
+func bucket(d time.Duration) int {
+	if d <= 0 {
+		return 0
+	}
+	v := uint64(d)
+	n := bits.Len64(v)
+	if n <= histSubBits {
+		return int(v)
+	}
+	sub := (v >> uint(n-1-histSubBits)) & (histSub - 1)
+	i := (n-histSubBits)*histSub + int(sub)
+	if i >= histBuckets {
+		return histBuckets - 1
+	}
+	return i
+}
+
+// upper returns an upper bound of the durations in bucket i.
+func upper(i int) time.Duration {
+	if i < histSub {
+		return time.Duration(i)
+	}
+	n := uint(i/histSub + histSubBits)
+	sub := uint64(i % histSub)
+	return time.Duration(1<<(n-1) + (sub+1)<<(n-1-histSubBits) - 1)
+}
+
+func (h *histogram) record(d time.Duration) {
+	atomic.AddUint64(&h.buckets[bucket(d)], 1)
+}
+
+func (h *histogram) summarize() LatencyStats {
+	var (
+		counts [histBuckets]uint64
+		ls     LatencyStats
+	)
+	for i := range counts {
+		counts[i] = atomic.LoadUint64(&h.buckets[i])
+		ls.Count += counts[i]
+	}
+	if ls.Count == 0 {
+		return ls
+	}
+	percentile := func(p float64) time.Duration {
+		rank := uint64(p*float64(ls.Count-1)) + 1
+		var sum uint64
+		for i, c := range counts {
+			sum += c
+			if sum >= rank {
+				return upper(i)
+			}
+		}
+		return upper(histBuckets - 1)
+	}
+	ls.P50 = percentile(0.5)
+	ls.P95 = percentile(0.95)
+	ls.P99 = percentile(0.99)
+	return ls
+}
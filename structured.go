@@ -0,0 +1,144 @@
+// Copyright 2018 Axel Wagner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nbd
+
+import "encoding/binary"
+
+// This file implements sending structured replies, once a client negotiated
+// them with NBD_OPT_STRUCTURED_REPLY or NBD_OPT_EXTENDED_HEADERS.
+
+const (
+	// maxDataChunk is the maximum size of a single NBD_REPLY_TYPE_OFFSET_DATA
+	// chunk. Larger reads are split into several chunks.
+	maxDataChunk = 1 << 20
+	// holeGranularity is the granularity in which read data is checked for
+	// zeros, which are sent as NBD_REPLY_TYPE_OFFSET_HOLE chunks instead.
+	holeGranularity = 4096
+)
+
+// chunkHeader encodes the header of a reply chunk to req with a payload of the
+// given length, followed by the first part of the payload, extra. If req has
+// an extended header, so has the chunk.
+func chunkHeader(req *request, flags, typ uint16, length uint64, extra []byte) []byte {
+	if req.extended {
+		e := &encoder{buf: make([]byte, 0, 32+len(extra))}
+		(&extendedReply{flags, typ, req.handle, req.offset, length, extra}).encode(e)
+		return e.buf
+	}
+	e := &encoder{buf: make([]byte, 0, 20+len(extra))}
+	(&structuredReply{flags, typ, req.handle, uint32(length), extra}).encode(e)
+	return e.buf
+}
+
+// structuredError returns the chunks of an error reply to req.
+func structuredError(req *request, err error) [][]byte {
+	var p [6]byte
+	binary.BigEndian.PutUint32(p[:], uint32(ErrnoOf(err)))
+	return [][]byte{chunkHeader(req, replyFlagDone, replyTypeError, 6, p[:])}
+}
+
+// structuredDone returns the chunks of a successful reply to req for commands
+// without payload.
+func structuredDone(req *request) [][]byte {
+	return [][]byte{chunkHeader(req, replyFlagDone, replyTypeNone, 0, nil)}
+}
+
+// structuredRead returns the chunks of a successful reply to the read request
+// req, with the data read in bufs. Unless the client set NBD_CMD_FLAG_DF, the
+// data is split into chunks of at most maxDataChunk bytes and zero blocks are
+// sent as holes.
+func structuredRead(req *request, bufs [][]byte) [][]byte {
+	off := req.offset
+	if req.flags&cmdFlagDF != 0 {
+		var n int
+		for _, b := range bufs {
+			n += len(b)
+		}
+		return append([][]byte{offsetData(req, off, n, true)}, bufs...)
+	}
+	var chunks [][]byte
+	for i, b := range bufs {
+		for len(b) > 0 {
+			n, hole := run(b)
+			last := i == len(bufs)-1 && n == len(b)
+			if hole {
+				chunks = append(chunks, offsetHole(req, off, uint32(n), last))
+			} else {
+				chunks = append(chunks, offsetData(req, off, n, last), b[:n])
+			}
+			b, off = b[n:], off+uint64(n)
+		}
+	}
+	return chunks
+}
+
+// run returns the length of the run of zero or non-zero blocks at the start of
+// b and whether they are zero. Runs of data are at most maxDataChunk bytes.
+func run(b []byte) (n int, hole bool) {
+	block := func(i int) []byte {
+		if len(b)-i < holeGranularity {
+			return b[i:]
+		}
+		return b[i : i+holeGranularity]
+	}
+	hole = isZero(block(0))
+	for n < len(b) && (hole || n < maxDataChunk) {
+		blk := block(n)
+		if isZero(blk) != hole {
+			break
+		}
+		n += len(blk)
+	}
+	return n, hole
+}
+
+// isZero returns whether b only contains zeros.
+func isZero(b []byte) bool {
+	for len(b) >= 8 {
+		if binary.LittleEndian.Uint64(b) != 0 {
+			return false
+		}
+		b = b[8:]
+	}
+	for _, c := range b {
+		if c != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// offsetData returns the header of an NBD_REPLY_TYPE_OFFSET_DATA chunk for n
+// bytes at off. The data itself must follow.
+func offsetData(req *request, off uint64, n int, done bool) []byte {
+	var p [8]byte
+	binary.BigEndian.PutUint64(p[:], off)
+	return chunkHeader(req, doneFlag(done), replyTypeOffsetData, uint64(8+n), p[:])
+}
+
+// offsetHole returns an NBD_REPLY_TYPE_OFFSET_HOLE chunk for n bytes at off.
+func offsetHole(req *request, off uint64, n uint32, done bool) []byte {
+	var p [12]byte
+	binary.BigEndian.PutUint64(p[:], off)
+	binary.BigEndian.PutUint32(p[8:], n)
+	return chunkHeader(req, doneFlag(done), replyTypeOffsetHole, 12, p[:])
+}
+
+func doneFlag(done bool) uint16 {
+	if done {
+		return replyFlagDone
+	}
+	return 0
+}
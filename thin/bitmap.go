@@ -0,0 +1,67 @@
+// Copyright 2018 Axel Wagner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package thin
+
+import "math/bits"
+
+// bitmap is the allocation bitmap of the physical chunks of an image: bit p
+// is set, if physical chunk p is referenced by the map. It is not stored in
+// the image, but rebuilt from the map on Open.
+type bitmap struct {
+	words []uint64
+	n     int
+}
+
+// len returns the number of chunks covered by b.
+func (b *bitmap) len() int {
+	return b.n
+}
+
+// get returns whether chunk p is allocated.
+func (b *bitmap) get(p uint64) bool {
+	return b.words[p/64]&(1<<(p%64)) != 0
+}
+
+// set marks chunk p as allocated or unallocated.
+func (b *bitmap) set(p uint64, v bool) {
+	if v {
+		b.words[p/64] |= 1 << (p % 64)
+	} else {
+		b.words[p/64] &^= 1 << (p % 64)
+	}
+}
+
+// resize changes the number of chunks covered by b to n. Added chunks are
+// unallocated.
+func (b *bitmap) resize(n int) {
+	w := (n + 63) / 64
+	for len(b.words) < w {
+		b.words = append(b.words, 0)
+	}
+	b.words = b.words[:w]
+	if r := n % 64; r != 0 {
+		b.words[w-1] &= 1<<uint(r) - 1
+	}
+	b.n = n
+}
+
+// count returns the number of allocated chunks.
+func (b *bitmap) count() int {
+	n := 0
+	for _, w := range b.words {
+		n += bits.OnesCount64(w)
+	}
+	return n
+}
@@ -0,0 +1,243 @@
+// Copyright 2018 Axel Wagner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package thin
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Snapshots of an image are stored in its backing images. Snapshot seals
+// the current contents of the image file at path as path@name (by hard
+// linking it) and atomically replaces path by a new, empty image backed by
+// it. So at every point, path is a consistent image, even if the process
+// crashes.
+
+// SnapshotInfo describes a snapshot of an image.
+type SnapshotInfo struct {
+	Name string
+	// Path is the path of the image file containing the snapshot.
+	Path string
+	// Allocated is the number of bytes allocated in the snapshot, that is
+	// the data written between it and the previous snapshot.
+	Allocated int64
+}
+
+// checkName returns an error, if name is not a valid snapshot name.
+func checkName(name string) error {
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, `/\`) {
+		return fmt.Errorf("invalid snapshot name %q", name)
+	}
+	return nil
+}
+
+// snapshotName returns the name of the snapshot stored in the backing image
+// b of img.
+func (img *Image) snapshotName(b *Image) string {
+	return strings.TrimPrefix(filepath.Base(b.path), filepath.Base(img.path)+"@")
+}
+
+// find returns the snapshot with the given name and the image it is the
+// backing image of. img.mu must be held.
+func (img *Image) find(name string) (child, snap *Image, err error) {
+	for c := img; c.backing != nil; c = c.backing {
+		if img.snapshotName(c.backing) == name {
+			return c, c.backing, nil
+		}
+	}
+	return nil, nil, fmt.Errorf("snapshot %q does not exist", name)
+}
+
+// Snapshot creates a snapshot with the given name of the current contents
+// of img, which can be in use. Writes are blocked while it is created, so
+// the snapshot is crash-consistent: it contains all writes which completed
+// before and none of the ones started after. To make it consistent for a
+// filesystem on the image, freeze the filesystem while calling Snapshot
+// (see package quiesce).
+func (img *Image) Snapshot(name string) error {
+	if err := checkName(name); err != nil {
+		return err
+	}
+	img.mu.Lock()
+	defer img.mu.Unlock()
+	if err := img.syncLocked(); err != nil {
+		return err
+	}
+	path := img.path + "@" + name
+	if err := os.Link(img.path, path); err != nil {
+		return err
+	}
+	top, err := img.stack(filepath.Base(path))
+	if err != nil {
+		os.Remove(path)
+		return err
+	}
+	sealed := &Image{
+		f:         img.f,
+		path:      path,
+		size:      img.size,
+		chunkSize: img.chunkSize,
+		dataOff:   img.dataOff,
+		backing:   img.backing,
+		chunks:    img.chunks,
+		used:      img.used,
+		free:      img.free,
+	}
+	img.replace(top, sealed)
+	return nil
+}
+
+// stack atomically replaces the file of img by a new, empty image with the
+// given backing image and returns it. img.mu must be held.
+func (img *Image) stack(backing string) (*Image, error) {
+	tmp := img.path + ".tmp"
+	// Left over by a crash.
+	os.Remove(tmp)
+	top, err := create(tmp, img.size, img.chunkSize, backing)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Rename(tmp, img.path); err != nil {
+		top.f.Close()
+		os.Remove(tmp)
+		return nil, err
+	}
+	syncDir(filepath.Dir(img.path))
+	return top, nil
+}
+
+// replace makes img use the file and chunks of top, with the given backing
+// image.
+func (img *Image) replace(top, backing *Image) {
+	img.f = top.f
+	img.chunks = top.chunks
+	img.used = top.used
+	img.free = top.free
+	img.pending = top.pending
+	img.backing = backing
+}
+
+// syncDir syncs the directory dir, to make renames durable. Errors are
+// ignored, as not all systems support syncing directories.
+func syncDir(dir string) {
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+}
+
+// Snapshots returns the snapshots of img, the latest first.
+func (img *Image) Snapshots() []SnapshotInfo {
+	img.mu.RLock()
+	defer img.mu.RUnlock()
+	var list []SnapshotInfo
+	for b := img.backing; b != nil; b = b.backing {
+		list = append(list, SnapshotInfo{
+			Name:      img.snapshotName(b),
+			Path:      b.path,
+			Allocated: int64(b.used.count()) * b.chunkSize,
+		})
+	}
+	return list
+}
+
+// DeleteSnapshot deletes the snapshot with the given name. Its data still
+// needed by later snapshots or the current contents of img is copied into
+// them first, during which writes to img are blocked.
+func (img *Image) DeleteSnapshot(name string) error {
+	img.mu.Lock()
+	defer img.mu.Unlock()
+	child, snap, err := img.find(name)
+	if err != nil {
+		return err
+	}
+	if err := child.merge(snap); err != nil {
+		return err
+	}
+	snap.f.Close()
+	return os.Remove(snap.path)
+}
+
+// merge copies the chunks of its backing image b, which img does not
+// allocate, into img and makes the backing image of b the one of img.
+func (img *Image) merge(b *Image) error {
+	empty := uint64(zeroEntry)
+	if b.backing == nil {
+		empty = 0
+	}
+	buf := make([]byte, img.chunkSize)
+	for c, e := range img.chunks {
+		be := b.chunks[c]
+		if e != 0 || be == 0 {
+			continue
+		}
+		if be == zeroEntry {
+			if err := img.setMapEntry(int64(c), empty); err != nil {
+				return err
+			}
+			continue
+		}
+		p := buf[:img.chunkEnd(int64(c))]
+		if _, err := b.ReadAt(p, int64(c)*img.chunkSize); err != nil {
+			return err
+		}
+		if err := img.allocate(int64(c), p, 0); err != nil {
+			return err
+		}
+	}
+	// The copied chunks must be durable, before b is dropped from the
+	// chain.
+	if err := img.f.Sync(); err != nil {
+		return err
+	}
+	var name string
+	if b.backing != nil {
+		name = filepath.Base(b.backing.path)
+	}
+	if err := img.writeHeader(name); err != nil {
+		return err
+	}
+	if err := img.f.Sync(); err != nil {
+		return err
+	}
+	img.backing = b.backing
+	return nil
+}
+
+// Revert reverts img to the snapshot with the given name, discarding all
+// data written after it, including later snapshots. Clients of img must not
+// cache its data (e.g. a filesystem on it must not be mounted), as it
+// changes under them.
+func (img *Image) Revert(name string) error {
+	img.mu.Lock()
+	defer img.mu.Unlock()
+	_, snap, err := img.find(name)
+	if err != nil {
+		return err
+	}
+	top, err := img.stack(filepath.Base(snap.path))
+	if err != nil {
+		return err
+	}
+	img.f.Close()
+	for b := img.backing; b != snap; b = b.backing {
+		b.f.Close()
+		os.Remove(b.path)
+	}
+	img.replace(top, snap)
+	return nil
+}
@@ -0,0 +1,766 @@
+// Copyright 2018 Axel Wagner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package thin implements thinly provisioned images: a Device, whose data is
+// stored in chunks in a container file, which are only allocated once they
+// are written.
+//
+// The physical chunks in use are tracked in an allocation bitmap, which is
+// rebuilt from the chunk map when an image is opened. Chunks which are
+// trimmed or overwritten with zeros are freed and reused by later
+// allocations, but the container file does not shrink by itself.
+// Compact moves chunks from the end of the file into free slots and
+// truncates it, so long-lived images don't grow without bound.
+//
+// An image can have a backing image of the same size and chunk size, from
+// which its unallocated chunks are read. Snapshot uses this to create
+// snapshots of an image while it is in use: the current contents are sealed
+// as the backing image of a new, empty one (see snapshot.go).
+//
+// # Format
+//
+// An image starts with a header, followed by the chunk map and the data
+// area. All integers are big-endian.
+//
+//	header (4096 bytes):
+//		magic      [8]byte  "NBDTHIN\x00"
+//		version    uint32   1
+//		chunkSize  uint32   a power of two, at least 4096
+//		size       uint64   virtual size of the image
+//		backingLen uint16   length of backing, 0 without a backing image
+//		backing    [backingLen]byte
+//		                    file name of the backing image, which is in
+//		                    the same directory
+//	map (at offset 4096):
+//		entry      uint64   for every virtual chunk: the index of the
+//		                    physical chunk plus one, 0 if unallocated
+//		                    or 2^64-1 if it reads as zeros, even with a
+//		                    backing image
+//	data (at the first multiple of chunkSize after the map):
+//		chunk      [chunkSize]byte
+//
+// The data of a newly allocated chunk is synced before its map entry is
+// written, and a freed chunk is only reused after the next Sync made its new
+// map entry durable, so a crash never exposes unwritten data or data of
+// another chunk.
+package thin
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/Merovius/nbd"
+	"golang.org/x/time/rate"
+)
+
+// Magic is the magic number at the start of every image.
+const Magic = "NBDTHIN\x00"
+
+// DefaultChunkSize is the chunk size used, if Create is passed 0.
+const DefaultChunkSize = 1 << 20
+
+const (
+	version    = 1
+	headerSize = 4096
+)
+
+// zeroEntry is the map entry of chunks reading as zeros, which are not read
+// from the backing image.
+const zeroEntry = 1<<64 - 1
+
+// Image is a thinly provisioned Device stored in a file. It is safe for
+// concurrent use.
+type Image struct {
+	f         *os.File
+	path      string
+	size      uint64
+	chunkSize int64
+	dataOff   int64
+
+	mu sync.RWMutex
+	// backing is the backing image, if any. Backing images are only
+	// modified while mu of the image at the top of the chain is held.
+	backing *Image
+	// chunks maps virtual to physical chunks plus one.
+	chunks []uint64
+	// used is the allocation bitmap of the physical chunks.
+	used bitmap
+	// free are the unreferenced physical chunks, in ascending order.
+	free []uint64
+	// pending are the physical chunks freed since the last Sync. They are
+	// only reused once the map entries no longer referencing them are
+	// durable, as the old entries might survive a crash otherwise.
+	pending []uint64
+}
+
+// Create creates a new, empty image of the given virtual size at path.
+// chunkSize must be a power of two of at least 4096; if it is 0,
+// DefaultChunkSize is used.
+func Create(path string, size uint64, chunkSize int) (*Image, error) {
+	if chunkSize == 0 {
+		chunkSize = DefaultChunkSize
+	}
+	if chunkSize < 4096 || chunkSize&(chunkSize-1) != 0 {
+		return nil, fmt.Errorf("invalid chunk size %d", chunkSize)
+	}
+	return create(path, size, int64(chunkSize), "")
+}
+
+// create creates a new, empty image at path, with the given backing image
+// name.
+func create(path string, size uint64, chunkSize int64, backing string) (*Image, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return nil, err
+	}
+	img := newImage(f, size, chunkSize)
+	img.path = path
+	err = img.writeHeader(backing)
+	if err == nil {
+		err = f.Truncate(img.dataOff)
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if err != nil {
+		f.Close()
+		os.Remove(path)
+		return nil, err
+	}
+	return img, nil
+}
+
+// writeHeader writes the header of img, with the given backing image name.
+func (img *Image) writeHeader(backing string) error {
+	var h [headerSize]byte
+	if 26+len(backing) > len(h) {
+		return fmt.Errorf("backing image name %q too long", backing)
+	}
+	copy(h[:], Magic)
+	binary.BigEndian.PutUint32(h[8:], version)
+	binary.BigEndian.PutUint32(h[12:], uint32(img.chunkSize))
+	binary.BigEndian.PutUint64(h[16:], img.size)
+	binary.BigEndian.PutUint16(h[24:], uint16(len(backing)))
+	copy(h[26:], backing)
+	_, err := img.f.WriteAt(h[:], 0)
+	return err
+}
+
+func newImage(f *os.File, size uint64, chunkSize int64) *Image {
+	n := int64((size + uint64(chunkSize) - 1) / uint64(chunkSize))
+	dataOff := headerSize + 8*n
+	if r := dataOff % chunkSize; r != 0 {
+		dataOff += chunkSize - r
+	}
+	return &Image{
+		f:         f,
+		size:      size,
+		chunkSize: chunkSize,
+		dataOff:   dataOff,
+		chunks:    make([]uint64, n),
+	}
+}
+
+// Open opens the image at path, including its backing images.
+func Open(path string) (*Image, error) {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+	img, backing, err := open(f)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	img.path = path
+	if backing == "" {
+		return img, nil
+	}
+	if filepath.Base(backing) != backing {
+		f.Close()
+		return nil, fmt.Errorf("%s: invalid backing image name %q", path, backing)
+	}
+	if img.backing, err = Open(filepath.Join(filepath.Dir(path), backing)); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if img.backing.size != img.size || img.backing.chunkSize != img.chunkSize {
+		img.Close()
+		return nil, fmt.Errorf("%s: backing image %s has a different size or chunk size", path, backing)
+	}
+	return img, nil
+}
+
+// open reads the image in f. It also returns the name of its backing image,
+// if any.
+func open(f *os.File) (*Image, string, error) {
+	var h [headerSize]byte
+	if _, err := io.ReadFull(io.NewSectionReader(f, 0, headerSize), h[:]); err != nil {
+		return nil, "", err
+	}
+	if string(h[:8]) != Magic {
+		return nil, "", errors.New("not a thin image")
+	}
+	if v := binary.BigEndian.Uint32(h[8:]); v != version {
+		return nil, "", fmt.Errorf("unsupported version %d", v)
+	}
+	chunkSize := int64(binary.BigEndian.Uint32(h[12:]))
+	if chunkSize < 4096 || chunkSize&(chunkSize-1) != 0 {
+		return nil, "", fmt.Errorf("invalid chunk size %d", chunkSize)
+	}
+	n := int(binary.BigEndian.Uint16(h[24:]))
+	if 26+n > len(h) {
+		return nil, "", errors.New("invalid backing image name")
+	}
+	backing := string(h[26 : 26+n])
+	img := newImage(f, binary.BigEndian.Uint64(h[16:]), chunkSize)
+	m := make([]byte, 8*len(img.chunks))
+	if _, err := io.ReadFull(io.NewSectionReader(f, headerSize, int64(len(m))), m); err != nil {
+		return nil, "", err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, "", err
+	}
+	nphys := (fi.Size() - img.dataOff + chunkSize - 1) / chunkSize
+	if nphys < 0 {
+		nphys = 0
+	}
+	img.used.resize(int(nphys))
+	for i := range img.chunks {
+		e := binary.BigEndian.Uint64(m[8*i:])
+		if e == 0 || e == zeroEntry {
+			img.chunks[i] = e
+			continue
+		}
+		if e > uint64(nphys) || img.used.get(e-1) {
+			return nil, "", fmt.Errorf("corrupt map entry %d for chunk %d", e, i)
+		}
+		img.chunks[i] = e
+		img.used.set(e-1, true)
+	}
+	for p := uint64(0); p < uint64(nphys); p++ {
+		if !img.used.get(p) {
+			img.free = append(img.free, p)
+		}
+	}
+	return img, backing, nil
+}
+
+// Size returns the virtual size of the image.
+func (img *Image) Size() uint64 {
+	return img.size
+}
+
+// Close closes the image file and those of its backing images.
+func (img *Image) Close() error {
+	err := img.f.Close()
+	if img.backing != nil {
+		if berr := img.backing.Close(); err == nil {
+			err = berr
+		}
+	}
+	return err
+}
+
+// empty returns the map entry for chunks reading as zeros, which is 0
+// unless img has a backing image.
+func (img *Image) empty() uint64 {
+	if img.backing != nil {
+		return zeroEntry
+	}
+	return 0
+}
+
+// readsZero returns whether map entry e reads as zeros without reading
+// the backing image.
+func (img *Image) readsZero(e uint64) bool {
+	return e == zeroEntry || (e == 0 && img.backing == nil)
+}
+
+// isHole returns whether virtual chunk c is unallocated in img and all of
+// its backing images.
+func (img *Image) isHole(c int64) bool {
+	e := img.chunks[c]
+	if e == 0 && img.backing != nil {
+		return img.backing.isHole(c)
+	}
+	return e == 0 || e == zeroEntry
+}
+
+// physOff returns the offset of physical chunk p in the file.
+func (img *Image) physOff(p uint64) int64 {
+	return img.dataOff + int64(p)*img.chunkSize
+}
+
+// ReadAt implements nbd.Device. Unallocated chunks are read from the
+// backing image or as zeros, if there is none.
+func (img *Image) ReadAt(b []byte, off int64) (int, error) {
+	if off < 0 || uint64(off)+uint64(len(b)) > img.size {
+		return 0, nbd.Errorf(nbd.EINVAL, "read past end of image")
+	}
+	img.mu.RLock()
+	defer img.mu.RUnlock()
+	n := 0
+	for n < len(b) {
+		c, co := (off+int64(n))/img.chunkSize, (off+int64(n))%img.chunkSize
+		l := int(img.chunkSize - co)
+		if l > len(b)-n {
+			l = len(b) - n
+		}
+		p := b[n : n+l]
+		if e := img.chunks[c]; img.readsZero(e) {
+			zero(p)
+		} else if e == 0 {
+			if _, err := img.backing.ReadAt(p, off+int64(n)); err != nil {
+				return n, err
+			}
+		} else if m, err := img.f.ReadAt(p, img.physOff(e-1)+co); err != nil {
+			if err != io.EOF {
+				return n, err
+			}
+			// The last chunk of the file may be short.
+			zero(p[m:])
+		}
+		n += l
+	}
+	return n, nil
+}
+
+// WriteAt implements nbd.Device. Writing zeros to an entire chunk frees it.
+func (img *Image) WriteAt(b []byte, off int64) (int, error) {
+	if off < 0 || uint64(off)+uint64(len(b)) > img.size {
+		return 0, nbd.Errorf(nbd.ENOSPC, "write past end of image")
+	}
+	img.mu.Lock()
+	defer img.mu.Unlock()
+	n := 0
+	for n < len(b) {
+		c, co := (off+int64(n))/img.chunkSize, (off+int64(n))%img.chunkSize
+		l := int(img.chunkSize - co)
+		if l > len(b)-n {
+			l = len(b) - n
+		}
+		p := b[n : n+l]
+		e := img.chunks[c]
+		whole := co == 0 && int64(l) == img.chunkEnd(c)
+		switch {
+		case isZero(p) && (img.readsZero(e) || whole):
+			if e != img.empty() {
+				if err := img.setMap(c, img.empty()); err != nil {
+					return n, err
+				}
+			}
+		case e == 0 || e == zeroEntry:
+			if err := img.allocate(c, p, co); err != nil {
+				return n, err
+			}
+		default:
+			if _, err := img.f.WriteAt(p, img.physOff(e-1)+co); err != nil {
+				return n, err
+			}
+		}
+		n += l
+	}
+	return n, nil
+}
+
+// chunkEnd returns the length of virtual chunk c, which is shorter than the
+// chunk size for the last chunk of an image with an unaligned size.
+func (img *Image) chunkEnd(c int64) int64 {
+	if rest := int64(img.size) - c*img.chunkSize; rest < img.chunkSize {
+		return rest
+	}
+	return img.chunkSize
+}
+
+// allocate allocates a physical chunk for virtual chunk c, writes p at
+// offset co in it and fills the rest from the backing image or with zeros.
+func (img *Image) allocate(c int64, p []byte, co int64) error {
+	var phys uint64
+	if len(img.free) > 0 {
+		phys = img.free[0]
+	} else {
+		phys = uint64(img.used.len())
+	}
+	buf := make([]byte, img.chunkSize)
+	if !img.readsZero(img.chunks[c]) && int64(len(p)) < img.chunkEnd(c) {
+		if _, err := img.backing.ReadAt(buf[:img.chunkEnd(c)], c*img.chunkSize); err != nil {
+			return err
+		}
+	}
+	copy(buf[co:], p)
+	if _, err := img.f.WriteAt(buf, img.physOff(phys)); err != nil {
+		return err
+	}
+	// The data must be durable before the map points to it.
+	if err := img.f.Sync(); err != nil {
+		return err
+	}
+	if len(img.free) > 0 {
+		img.free = img.free[1:]
+	} else {
+		img.used.resize(img.used.len() + 1)
+	}
+	img.used.set(phys, true)
+	return img.setMapEntry(c, phys+1)
+}
+
+// setMap frees the physical chunk of virtual chunk c, if any, and sets its
+// map entry to e.
+func (img *Image) setMap(c int64, e uint64) error {
+	old := img.chunks[c]
+	if err := img.setMapEntry(c, e); err != nil {
+		return err
+	}
+	if old != 0 && old != zeroEntry {
+		img.release(old - 1)
+	}
+	return nil
+}
+
+// setMapEntry writes the map entry of virtual chunk c.
+func (img *Image) setMapEntry(c int64, e uint64) error {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], e)
+	if _, err := img.f.WriteAt(b[:], headerSize+8*c); err != nil {
+		return err
+	}
+	img.chunks[c] = e
+	return nil
+}
+
+// release marks physical chunk p as unreferenced. It is reused after the next
+// Sync.
+func (img *Image) release(p uint64) {
+	img.used.set(p, false)
+	img.pending = append(img.pending, p)
+}
+
+// addFree adds physical chunk p to the free chunks.
+func (img *Image) addFree(p uint64) {
+	i := sort.Search(len(img.free), func(i int) bool { return img.free[i] >= p })
+	img.free = append(img.free, 0)
+	copy(img.free[i+1:], img.free[i:])
+	img.free[i] = p
+}
+
+// Trim frees all chunks entirely contained in the given range and zeros the
+// rest of it.
+func (img *Image) Trim(off, length int64) error {
+	if off < 0 || length < 0 || uint64(off)+uint64(length) > img.size {
+		return nbd.Errorf(nbd.EINVAL, "trim past end of image")
+	}
+	for length > 0 {
+		l := img.chunkSize - off%img.chunkSize
+		if l > length {
+			l = length
+		}
+		c := off / img.chunkSize
+		if off%img.chunkSize == 0 && l == img.chunkEnd(c) {
+			img.mu.Lock()
+			err := img.setMap(c, img.empty())
+			img.mu.Unlock()
+			if err != nil {
+				return err
+			}
+		} else if _, err := img.WriteAt(make([]byte, l), off); err != nil {
+			return err
+		}
+		off, length = off+l, length-l
+	}
+	return nil
+}
+
+// Extents implements nbd.Extenter, so a Server reports the allocation of img
+// to clients with NBD_CMD_BLOCK_STATUS. Chunks, which are unallocated in the
+// image and its backing images, are reported as holes.
+func (img *Image) Extents(off, length int64) ([]nbd.Extent, error) {
+	if off < 0 || length < 0 || uint64(off)+uint64(length) > img.size {
+		return nil, nbd.Errorf(nbd.EINVAL, "block status past end of image")
+	}
+	img.mu.RLock()
+	defer img.mu.RUnlock()
+	var ext []nbd.Extent
+	for length > 0 {
+		l := img.chunkSize - off%img.chunkSize
+		if l > length {
+			l = length
+		}
+		hole := img.isHole(off / img.chunkSize)
+		if n := len(ext); n > 0 && ext[n-1].Hole == hole {
+			ext[n-1].Length += l
+		} else {
+			ext = append(ext, nbd.Extent{Length: l, Hole: hole, Zero: hole})
+		}
+		off, length = off+l, length-l
+	}
+	return ext, nil
+}
+
+// Sync implements nbd.Device. It also makes the chunks freed before it
+// available for reuse.
+func (img *Image) Sync() error {
+	img.mu.Lock()
+	pending := img.pending
+	img.pending = nil
+	img.mu.Unlock()
+	err := img.f.Sync()
+	img.mu.Lock()
+	defer img.mu.Unlock()
+	if err != nil {
+		img.pending = append(img.pending, pending...)
+		return err
+	}
+	for _, p := range pending {
+		img.addFree(p)
+	}
+	return nil
+}
+
+// syncLocked is like Sync, but img.mu must be held.
+func (img *Image) syncLocked() error {
+	if err := img.f.Sync(); err != nil {
+		return err
+	}
+	for _, p := range img.pending {
+		img.addFree(p)
+	}
+	img.pending = nil
+	return nil
+}
+
+// Stats describes the space used by an image.
+type Stats struct {
+	// ChunkSize is the size of a chunk in bytes.
+	ChunkSize int64
+	// Chunks is the number of virtual chunks.
+	Chunks int
+	// Allocated is the number of allocated chunks.
+	Allocated int
+	// Physical is the number of chunks in the container file, including
+	// free ones.
+	Physical int
+}
+
+// Stats returns the space used by img.
+func (img *Image) Stats() Stats {
+	img.mu.RLock()
+	defer img.mu.RUnlock()
+	return Stats{
+		ChunkSize: img.chunkSize,
+		Chunks:    len(img.chunks),
+		Allocated: img.used.count(),
+		Physical:  img.used.len(),
+	}
+}
+
+// CompactOptions configures Compact.
+type CompactOptions struct {
+	// BytesPerSecond limits the rate of data read and written by Compact,
+	// so it does not starve clients of the image. If it is <= 0, the rate
+	// is not limited.
+	BytesPerSecond float64
+	// Progress, if not nil, is called after every chunk processed.
+	Progress func(CompactProgress)
+}
+
+// CompactProgress describes the progress of Compact.
+type CompactProgress struct {
+	// Scanned is the number of allocated chunks checked for zeros out of
+	// Total.
+	Scanned, Total int
+	// Freed is the number of chunks freed, because they only contained
+	// zeros.
+	Freed int
+	// Moved is the number of chunks moved towards the start of the file.
+	Moved int
+}
+
+// Compact reclaims unused space of img: it frees allocated chunks containing
+// only zeros, moves chunks from the end of the container file into free
+// slots and truncates the file. The image stays usable while Compact runs;
+// img is only locked while a single chunk is processed. If ctx is cancelled,
+// Compact stops, leaving the image consistent.
+func (img *Image) Compact(ctx context.Context, opts *CompactOptions) error {
+	if opts == nil {
+		opts = new(CompactOptions)
+	}
+	var lim *rate.Limiter
+	if opts.BytesPerSecond > 0 {
+		burst := int(img.chunkSize)
+		if opts.BytesPerSecond > float64(burst) {
+			burst = int(opts.BytesPerSecond)
+		}
+		lim = rate.NewLimiter(rate.Limit(opts.BytesPerSecond), burst)
+	}
+	wait := func() error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if lim == nil {
+			return nil
+		}
+		return lim.WaitN(ctx, int(img.chunkSize))
+	}
+	progress := func(p CompactProgress) {
+		if opts.Progress != nil {
+			opts.Progress(p)
+		}
+	}
+
+	var pr CompactProgress
+	img.mu.RLock()
+	pr.Total = img.used.count()
+	img.mu.RUnlock()
+	buf := make([]byte, img.chunkSize)
+	for c := range img.chunks {
+		img.mu.RLock()
+		e := img.chunks[c]
+		img.mu.RUnlock()
+		if e == 0 || e == zeroEntry {
+			continue
+		}
+		if err := wait(); err != nil {
+			return err
+		}
+		img.mu.Lock()
+		err := img.freeZero(int64(c), buf, &pr)
+		img.mu.Unlock()
+		if err != nil {
+			return err
+		}
+		pr.Scanned++
+		progress(pr)
+	}
+
+	for {
+		if err := wait(); err != nil {
+			return err
+		}
+		img.mu.Lock()
+		moved, err := img.moveLast(buf)
+		img.mu.Unlock()
+		if err != nil {
+			return err
+		}
+		if !moved {
+			break
+		}
+		pr.Moved++
+		progress(pr)
+	}
+
+	img.mu.Lock()
+	defer img.mu.Unlock()
+	if err := img.syncLocked(); err != nil {
+		return err
+	}
+	if err := img.f.Truncate(img.physOff(uint64(img.used.len()))); err != nil {
+		return err
+	}
+	return img.f.Sync()
+}
+
+// freeZero frees virtual chunk c, if it is allocated and only contains
+// zeros. img.mu must be held.
+func (img *Image) freeZero(c int64, buf []byte, pr *CompactProgress) error {
+	e := img.chunks[c]
+	if e == 0 || e == zeroEntry {
+		return nil
+	}
+	m, err := img.f.ReadAt(buf, img.physOff(e-1))
+	if err != nil && err != io.EOF {
+		return err
+	}
+	if !isZero(buf[:m]) {
+		return nil
+	}
+	if err := img.setMap(c, img.empty()); err != nil {
+		return err
+	}
+	pr.Freed++
+	return nil
+}
+
+// moveLast moves the last physical chunk into the first free slot, dropping
+// free chunks at the end of the file. It returns false, if there are no free
+// slots left. img.mu must be held.
+func (img *Image) moveLast(buf []byte) (bool, error) {
+	// Chunks freed before (e.g. by the last move) can only be reused or
+	// dropped once their map entries are durable.
+	if err := img.syncLocked(); err != nil {
+		return false, err
+	}
+	for n := img.used.len(); n > 0 && !img.used.get(uint64(n-1)); n = img.used.len() {
+		img.used.resize(n - 1)
+		img.free = img.free[:len(img.free)-1]
+	}
+	if len(img.free) == 0 {
+		return false, nil
+	}
+	last := uint64(img.used.len() - 1)
+	c := -1
+	for i, e := range img.chunks {
+		if e == last+1 {
+			c = i
+			break
+		}
+	}
+	if c < 0 {
+		return false, fmt.Errorf("physical chunk %d is not referenced", last)
+	}
+	dst := img.free[0]
+	m, err := img.f.ReadAt(buf, img.physOff(last))
+	if err != nil && err != io.EOF {
+		return false, err
+	}
+	zero(buf[m:])
+	if _, err := img.f.WriteAt(buf, img.physOff(dst)); err != nil {
+		return false, err
+	}
+	// The copy must be durable before the map points to it, as the old
+	// chunk is overwritten by later allocations.
+	if err := img.f.Sync(); err != nil {
+		return false, err
+	}
+	img.free = img.free[1:]
+	img.used.set(dst, true)
+	if err := img.setMap(int64(c), dst+1); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func zero(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
+
+func isZero(b []byte) bool {
+	for _, v := range b {
+		if v != 0 {
+			return false
+		}
+	}
+	return true
+}
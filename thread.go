@@ -0,0 +1,40 @@
+// Copyright 2018 Axel Wagner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nbd
+
+import (
+	"log/slog"
+	"runtime"
+)
+
+// pinned runs f, locked to its own OS thread if configured. The thread is
+// never unlocked, so it is terminated once f returns, instead of being reused
+// with a modified CPU affinity.
+func (s *Server) pinned(log *slog.Logger, f func() error) error {
+	if !s.LockOSThread && len(s.CPUs) == 0 {
+		return f()
+	}
+	ch := make(chan error, 1)
+	go func() {
+		runtime.LockOSThread()
+		if len(s.CPUs) > 0 {
+			if err := setAffinity(s.CPUs); err != nil {
+				log.Warn("could not set CPU affinity", "cpus", s.CPUs, "err", err)
+			}
+		}
+		ch <- f()
+	}()
+	return <-ch
+}
@@ -0,0 +1,110 @@
+// Copyright 2018 Axel Wagner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nbd
+
+import (
+	"context"
+
+	"golang.org/x/time/rate"
+)
+
+// ThrottleOpts configures Throttle. Limits which are <= 0 are not enforced.
+type ThrottleOpts struct {
+	// ReadBps and WriteBps limit the number of bytes read and written per
+	// second.
+	ReadBps  float64
+	WriteBps float64
+	// IOPS limits the number of reads, writes and syncs per second.
+	IOPS float64
+}
+
+// Throttle returns a Device limiting the bandwidth and operations per second
+// of d with token buckets, e.g. to simulate slow media or to protect a shared
+// backend from a single noisy Device. Operations exceeding the limits are
+// delayed. Bursts of 100ms worth of bytes and a single operation are allowed;
+// larger reads and writes wait for their bytes in several steps.
+//
+// Unlike Server.Quota, which limits clients, Throttle limits a Device,
+// regardless of the connections and clients using it. The returned Device
+// implements Unwrapper; operations using the capabilities of d (like trims)
+// are not throttled.
+func Throttle(d Device, o ThrottleOpts) Device {
+	t := &throttle{Device: d}
+	if o.ReadBps > 0 {
+		t.read = rate.NewLimiter(rate.Limit(o.ReadBps), bytesBurst(o.ReadBps))
+	}
+	if o.WriteBps > 0 {
+		t.write = rate.NewLimiter(rate.Limit(o.WriteBps), bytesBurst(o.WriteBps))
+	}
+	if o.IOPS > 0 {
+		t.ops = rate.NewLimiter(rate.Limit(o.IOPS), 1)
+	}
+	return t
+}
+
+// bytesBurst returns the burst allowed by a limit of bps bytes per second.
+func bytesBurst(bps float64) int {
+	if b := int(bps / 10); b > 1 {
+		return b
+	}
+	return 1
+}
+
+type throttle struct {
+	Device
+	// read, write and ops are nil, if they are not limited.
+	read  *rate.Limiter
+	write *rate.Limiter
+	ops   *rate.Limiter
+}
+
+// wait waits for an operation on n bytes, limited by l.
+func (t *throttle) wait(l *rate.Limiter, n int) {
+	ctx := context.Background()
+	if t.ops != nil {
+		t.ops.Wait(ctx)
+	}
+	if l == nil {
+		return
+	}
+	for n > 0 {
+		m := n
+		if m > l.Burst() {
+			m = l.Burst()
+		}
+		l.WaitN(ctx, m)
+		n -= m
+	}
+}
+
+func (t *throttle) ReadAt(p []byte, off int64) (int, error) {
+	t.wait(t.read, len(p))
+	return t.Device.ReadAt(p, off)
+}
+
+func (t *throttle) WriteAt(p []byte, off int64) (int, error) {
+	t.wait(t.write, len(p))
+	return t.Device.WriteAt(p, off)
+}
+
+func (t *throttle) Sync() error {
+	t.wait(nil, 0)
+	return t.Device.Sync()
+}
+
+// Unwrap implements Unwrapper.
+func (t *throttle) Unwrap() Device {
+	return t.Device
+}
@@ -16,10 +16,16 @@ package nbd
 
 import (
 	"context"
+	"crypto/tls"
 	"io"
+	"log/slog"
 	"net"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
+
+	"golang.org/x/sync/semaphore"
 )
 
 // Error combines the normal error interface with an Errno method, that returns
@@ -33,6 +39,9 @@ type Error interface {
 // Device is the interface that should be implemented to expose an NBD device
 // to the network or the kernel. Errors returned should implement Error -
 // otherwise, EIO is assumed as the error number.
+//
+// A Device can implement optional interfaces, like ReaderAtVec, to improve
+// performance.
 type Device interface {
 	io.ReaderAt
 	io.WriterAt
@@ -41,108 +50,979 @@ type Device interface {
 	Sync() error
 }
 
+// DeviceContext is an optional interface a Device can implement, to be
+// notified when the result of a read or write is no longer needed: A Server
+// calls these methods instead of ReadAt and WriteAt, with a Context which is
+// cancelled when the connection is dropped, the Server shuts down or the
+// request times out (see Server.RequestTimeout). Backends doing slow I/O,
+// e.g. over the network, can then abort it early.
+//
+// Requests still have to be answered after the client disconnected cleanly,
+// so the Context is not cancelled then. A Device implementing DeviceContext
+// is never read with ReadAtVec, which can not be cancelled.
+type DeviceContext interface {
+	ReadAtContext(ctx context.Context, p []byte, off int64) (n int, err error)
+	WriteAtContext(ctx context.Context, p []byte, off int64) (n int, err error)
+}
+
+// Server serves a set of exports over the NBD network protocol. Its fields
+// must not be modified after it started serving.
+type Server struct {
+	// Exports is the list of exports served initially. The first one is used
+	// as the default export. Use AddExport and RemoveExport to change the
+	// exports while serving.
+	Exports []Export
+
+	// Workers is the number of goroutines per connection which execute
+	// requests against the Device. If Workers is greater than one, requests
+	// are executed concurrently and replies may be sent out of order, so the
+	// Device must be safe for concurrent use (see Export.Concurrency). If
+	// Workers is <= 1, requests are executed serially in the order they are
+	// received.
+	Workers int
+
+	// Readahead is the number of bytes to read ahead, once a connection is
+	// detected to read sequentially. Data read ahead is cached per connection
+	// and invalidated by any write to the export. If Readahead is <= 0, no
+	// readahead is done.
+	Readahead int
+
+	// ZeroCopy enables sending large read replies with MSG_ZEROCOPY, which
+	// reduces CPU usage for high read throughput. It is only supported for
+	// TCP connections on Linux and ignored otherwise.
+	ZeroCopy bool
+
+	// MaxInflightBytes limits the total size of buffers held by requests in
+	// flight, across all connections. If the limit is reached, reading
+	// requests from connections pauses, until enough requests are done.
+	// Waiting connections are resumed in order. If MaxInflightBytes is <= 0,
+	// the memory used is not limited.
+	MaxInflightBytes int64
+
+	// AdaptiveConcurrency, if not nil, adaptively limits the number of
+	// requests per connection executed concurrently, based on their latency
+	// and errors. It only has an effect if Workers is greater than one.
+	AdaptiveConcurrency *AdaptiveLimit
+
+	// SplitSize is the maximum size of a single ReadAt or WriteAt call on the
+	// Device. Larger requests are split into sub-requests, which are executed
+	// concurrently and reassembled before replying, so a single large request
+	// is not bottlenecked by one call. The Device must be safe for concurrent
+	// use (see Export.Concurrency). If SplitSize is <= 0, requests are not
+	// split.
+	SplitSize int
+
+	// SplitParallel limits the number of sub-requests of a single split
+	// request executed concurrently. If SplitParallel is <= 0, all
+	// sub-requests are executed concurrently.
+	SplitParallel int
+
+	// LockOSThread locks the goroutines reading and executing requests of
+	// each connection to their own OS thread, which reduces latency jitter,
+	// e.g. when serving a local kernel client.
+	LockOSThread bool
+
+	// CPUs restricts the threads locked by LockOSThread to the given set of
+	// CPUs. It is only supported on Linux and implies LockOSThread.
+	CPUs []int
+
+	// Identify returns the identity of the client connected via c. It is
+	// used to account resources (see ClientStats) and enforce quotas across
+	// all connections of a client. If Identify is nil, the IP address of the
+	// client is used.
+	Identify func(c net.Conn) string
+
+	// Quota returns the quota for the client with the given identity. It is
+	// called once per identity. If Quota is nil or returns nil, the client
+	// is not limited.
+	Quota func(id string) *Quota
+
+	// Socket is applied to all accepted connections.
+	Socket SocketOptions
+
+	// TLSConfig, if not nil, allows clients to upgrade connections to TLS
+	// with NBD_OPT_STARTTLS. It must contain at least one certificate (or
+	// GetCertificate callback). To authenticate clients, set ClientAuth
+	// (e.g. to tls.RequireAndVerifyClientCert) and ClientCAs, together with
+	// TLSRequired. The verified certificate of a client is then returned by
+	// ClientCertificate.
+	TLSConfig *tls.Config
+
+	// TLSRequired refuses to serve clients, which did not negotiate TLS. It
+	// requires TLSConfig to be set.
+	TLSRequired bool
+
+	// ReadOnly serves all exports read-only, as if FlagReadOnly was set in
+	// their Flags: It is advertised to clients and writes, trims and write
+	// zeroes are refused with EPERM.
+	ReadOnly bool
+
+	// Authorizer, if not nil, decides the access of the client connected via
+	// c to an export, e.g. based on its TLS client certificate (see
+	// ClientCertificate). Once the client upgraded to TLS, c is the
+	// *tls.Conn. It is called during the handshake, when the client lists,
+	// queries or selects exports, after checking Export.ACL; the client gets
+	// the lesser access granted by both. If Authorizer returns an error, the
+	// connection is closed.
+	Authorizer func(c net.Conn, export string) (Access, error)
+
+	// Observer, if not nil, is notified about all requests.
+	Observer Observer
+
+	// Audit, if not nil, records connections, the exports they negotiate
+	// and privileged operations, like adding or removing exports and
+	// resize or disconnect requests.
+	Audit Auditor
+
+	// Logger is used to log errors and events of connections. If it is nil,
+	// nothing is logged.
+	Logger *slog.Logger
+
+	// SlowRequest is a threshold, above which requests are logged as a
+	// warning, with their command, offset, length and duration. This helps
+	// finding pathological backend behavior. If SlowRequest is <= 0, slow
+	// requests are not logged.
+	SlowRequest time.Duration
+
+	// RequestTimeout, if positive, is the time after which a request still
+	// being executed by the Device fails with EIO (NBD has no error for
+	// timeouts), so a hanging backend does not stall the client, e.g. the
+	// kernel's queue, indefinitely. The call on the Device can not be
+	// interrupted and keeps running in the background; its result is
+	// discarded. Note that a write which timed out might still be done
+	// afterwards, even after later writes to the same range.
+	RequestTimeout time.Duration
+
+	// IdleTimeout, if positive, makes Serve return ErrIdle, once no
+	// connection accepted by it was open for that long. This allows servers
+	// started on demand (e.g. by systemd socket activation) to exit.
+	IdleTimeout time.Duration
+
+	once sync.Once
+	// emu protects list and exports, the exports currently served and their
+	// state. Both are replaced, never modified in place, so they can be
+	// used by connections without holding emu.
+	emu     sync.RWMutex
+	list    []Export
+	exports []*exportState
+	stats   *serverStats
+	conns   connSet
+	clients clientSet
+	// mem limits the memory used by requests in flight. It is nil, if
+	// MaxInflightBytes is <= 0.
+	mem *semaphore.Weighted
+	// bufs recycles the buffers of reads and writes of all connections.
+	bufs bufPool
+	// drain is closed by Shutdown, to drain all connections.
+	drain     chan struct{}
+	drainOnce sync.Once
+}
+
+// exportState is state shared by all connections serving an export. It is
+// always allocated on its own, so its first word is 64-bit aligned. Fields
+// accessed with 64-bit atomic operations must come first, so they stay
+// aligned on 32-bit platforms.
+type exportState struct {
+	// gen is incremented after every completed write to the Device. It must
+	// be accessed atomically.
+	gen uint64
+	// lastIO is the time of the last completed request, in nanoseconds
+	// since the Unix epoch. It must be accessed atomically.
+	lastIO int64
+	// size is the current size of the export, which changes when it is
+	// resized. It must be accessed atomically.
+	size uint64
+	// counters are the statistics of the export.
+	counters Counters
+
+	// sem limits the number of concurrent requests on the Device. It is nil,
+	// if the export does not limit concurrency.
+	sem chan struct{}
+	// removed is set to 1, once the export is removed from the Server. It
+	// must be accessed atomically.
+	removed int32
+}
+
+func (s *Server) init() {
+	// stats is allocated separately, so its counters are 64-bit aligned.
+	s.stats = &serverStats{start: time.Now()}
+	s.drain = make(chan struct{})
+	if s.MaxInflightBytes > 0 {
+		s.mem = semaphore.NewWeighted(s.MaxInflightBytes)
+	}
+	for _, e := range s.Exports {
+		s.list = append(s.list, e)
+		s.exports = append(s.exports, newExportState(e))
+	}
+}
+
+func newExportState(e Export) *exportState {
+	st := &exportState{size: e.Size}
+	if e.Concurrency > 0 {
+		st.sem = make(chan struct{}, e.Concurrency)
+	}
+	return st
+}
+
 // ListenAndServe starts listening on the given network/address and serves the
 // given exports, the first of which will serve as the default. It starts a new
 // goroutine for each connection. ListenAndServe only returns when ctx is
 // cancelled or an unrecoverable error occurs. Either way, it will wait for all
 // connections to terminate first.
 func ListenAndServe(ctx context.Context, network, addr string, exp ...Export) error {
-	l, err := net.Listen(network, addr)
+	return (&Server{Exports: exp}).ListenAndServe(ctx, network, addr)
+}
+
+// Serve serves the given exports on c. The first export is used as a default.
+// Serve returns after ctx is cancelled or an error occurs.
+func Serve(ctx context.Context, c net.Conn, exp ...Export) error {
+	return (&Server{Exports: exp}).ServeConn(ctx, c)
+}
+
+// ListenAndServe starts listening on the given network/address and calls Serve
+// with the resulting listener.
+func (s *Server) ListenAndServe(ctx context.Context, network, addr string) error {
+	lc := net.ListenConfig{
+		Control:   s.Socket.control,
+		KeepAlive: s.Socket.KeepAlive,
+	}
+	l, err := lc.Listen(ctx, network, addr)
 	if err != nil {
 		return err
 	}
+	return s.Serve(ctx, l)
+}
+
+// Serve accepts connections from l, starting a new goroutine for each of them.
+// Serve only returns when ctx is cancelled, an unrecoverable error occurs,
+// the server was idle for IdleTimeout or Shutdown was called. Either way, it
+// closes l and waits for all connections to terminate first.
+func (s *Server) Serve(ctx context.Context, l net.Listener) error {
+	s.once.Do(s.init)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-s.drain:
+		}
+		l.Close()
+	}()
+	var idle *idleTimer
+	if s.IdleTimeout > 0 {
+		idle = newIdleTimer(s.IdleTimeout, cancel)
+		defer idle.stop()
+	}
+
 	var wg sync.WaitGroup
 	defer wg.Wait()
 	for {
 		c, err := l.Accept()
 		if err != nil {
+			if idle != nil && idle.expired() {
+				return ErrIdle
+			}
+			if s.shuttingDown() {
+				return ErrServerClosed
+			}
+			if e := ctx.Err(); e != nil {
+				return e
+			}
 			return err
 		}
+		if err := s.Socket.Apply(c); err != nil {
+			orDiscard(s.Logger).Warn("could not apply socket options", "remote", c.RemoteAddr(), "err", err)
+			c.Close()
+			continue
+		}
 		wg.Add(1)
+		if idle != nil {
+			idle.open()
+		}
 		go func() {
 			defer wg.Done()
-			Serve(ctx, c, exp...)
+			if idle != nil {
+				defer idle.close()
+			}
+			if err := s.ServeConn(ctx, c); err != nil && ctx.Err() == nil {
+				orDiscard(s.Logger).Info("connection terminated", "remote", c.RemoteAddr(), "err", err)
+			}
 			c.Close()
 		}()
 	}
 }
 
-// Serve serves the given exports on c. The first export is used as a default.
-// Serve returns after ctx is cancelled or an error occurs.
-func Serve(ctx context.Context, c net.Conn, exp ...Export) error {
-	parms, err := serverHandshake(c, exp)
+// ServeConn performs the handshake on c and then serves requests for the
+// negotiated export. It returns after ctx is cancelled or an error occurs.
+func (s *Server) ServeConn(ctx context.Context, c net.Conn) (err error) {
+	var export string
+	if s.Audit != nil {
+		s.audit(c, NewAuditEvent(AuditConnect, "", nil))
+		defer func() {
+			s.audit(c, NewAuditEvent(AuditClose, export, err))
+		}()
+	}
+	var done func(string, error)
+	if o, ok := s.Observer.(NegotiationObserver); ok {
+		done = o.StartNegotiation(c.RemoteAddr())
+	}
+	list, states := s.snapshot()
+	if s.ReadOnly {
+		list = readOnlyExports(list)
+	}
+	parms, err := serverHandshake(c, list, s.TLSConfig, s.TLSRequired, s.authorize)
+	if done != nil {
+		done(parms.Export.Name, err)
+	}
+	export = parms.Export.Name
+	s.audit(c, NewAuditEvent(AuditNegotiate, export, err))
 	if err != nil {
+		orDiscard(s.Logger).Debug("handshake failed", "remote", c.RemoteAddr(), "err", err)
 		return err
 	}
-	return serve(ctx, c, parms)
+	if parms.tls != nil {
+		c = parms.tls
+	}
+	return s.serve(ctx, c, parms, states[parms.index])
 }
 
-// serve serves nbd requests for a connection in transmission mode using p. It
-// returns after ctx is cancelled or an error occurs.
-func serve(ctx context.Context, c net.Conn, p connParameters) error {
-	return do(wrapConn(ctx, c), func(e *encoder) {
-		var req request
-		for {
-			if err := req.decode(e); err != nil {
-				respondErr(e, req.handle, err)
-				continue
-			}
-			switch req.typ {
-			case cmdRead:
-				if req.length == 0 {
-					respondErr(e, req.handle, EINVAL)
-					continue
+// readOnlyExports returns a copy of list, with FlagReadOnly set for all
+// exports.
+func readOnlyExports(list []Export) []Export {
+	ro := make([]Export, len(list))
+	for i, e := range list {
+		e.Flags |= FlagReadOnly
+		ro[i] = e
+	}
+	return ro
+}
+
+// serve serves nbd requests for a connection in transmission mode using p and
+// the state exp of the export. It returns after ctx is cancelled or an error
+// occurs.
+func (s *Server) serve(ctx context.Context, c net.Conn, p connParameters, exp *exportState) (err error) {
+	s.once.Do(s.init)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	rw := wrapConn(ctx, c)
+	rw.drain = s.drain
+	id := nextConnID()
+	log := orDiscard(s.Logger).With("conn", id, "remote", c.RemoteAddr(), "export", p.Export.Name)
+	log.Debug("entering transmission phase")
+	sc := &serverConn{
+		ctx:    ctx,
+		log:    log,
+		stats:  s.stats,
+		mem:    s.mem,
+		bufs:   &s.bufs,
+		slow:   s.SlowRequest,
+		tmo:    s.RequestTimeout,
+		split:  s.SplitSize,
+		splitN: s.SplitParallel,
+		p:      p,
+		exp:    exp,
+		obs:    s.Observer,
+		id:     id,
+		w:      rw,
+		cancel: cancel,
+		info:   connInfo{remote: c.RemoteAddr(), since: time.Now()},
+		client: s.clients.get(s.identify(c), s.Quota),
+	}
+	if s.Audit != nil {
+		sc.audit = func(e AuditEvent) { s.audit(c, e) }
+	}
+	sc.resized = func(size uint64) { s.resizeState(exp, size) }
+	if s.ZeroCopy {
+		sc.zc = newZeroCopy(c)
+	}
+	if s.Readahead > 0 {
+		sc.ra = newReadahead(sc, s.Readahead)
+	}
+	if o, ok := s.Observer.(TraceObserver); ok {
+		sc.tobs = o
+		done := o.StartConn(sc.id, c.RemoteAddr(), p.Export.Name)
+		defer func() { done(err) }()
+	}
+
+	var (
+		wg   sync.WaitGroup
+		reqs chan *request
+	)
+	if s.Workers > 1 {
+		if s.AdaptiveConcurrency != nil {
+			sc.lim = newLimiter(*s.AdaptiveConcurrency, s.Workers)
+		}
+		reqs = make(chan *request, s.Workers)
+		sc.info.queue = reqs
+		for i := 0; i < s.Workers; i++ {
+			wg.Add(1)
+			go s.pinned(log, func() error {
+				defer wg.Done()
+				for req := range reqs {
+					sc.handle(req)
 				}
-				buf := make([]byte, req.length)
-				_, err := p.Export.Device.ReadAt(buf, int64(req.offset))
-				if err != nil {
-					respondErr(e, req.handle, err)
-					continue
+				return nil
+			})
+		}
+	}
+	s.conns.add(sc)
+	defer s.conns.remove(sc)
+	// RemoveExport only disconnects the connections it finds, so check if
+	// the export was removed during the handshake.
+	if atomic.LoadInt32(&exp.removed) != 0 {
+		return errExportRemoved
+	}
+	atomic.AddInt64(&sc.exp.counters.Connections, 1)
+	defer atomic.AddInt64(&sc.exp.counters.Connections, -1)
+	atomic.AddInt64(&sc.client.counters.Connections, 1)
+	defer atomic.AddInt64(&sc.client.counters.Connections, -1)
+	atomic.AddInt64(&s.stats.counters.Connections, 1)
+	defer atomic.AddInt64(&s.stats.counters.Connections, -1)
+
+	err = s.pinned(log, func() error {
+		return s.read(ctx, rw, sc, reqs)
+	})
+	// Outstanding requests still have to be answered, even if the client
+	// requested a disconnect or the connection is drained. If the connection
+	// failed, their results are no longer needed.
+	if err != nil && err != errDraining {
+		cancel()
+	}
+	if reqs != nil {
+		close(reqs)
+		wg.Wait()
+	}
+	if err == errDraining {
+		log.Debug("connection drained")
+		err = sc.flush()
+	}
+	if werr := sc.err(); werr != nil && err == nil {
+		return werr
+	}
+	return err
+}
+
+// read reads requests from rw, until the client disconnects, the connection
+// is drained or an error occurs. If reqs is nil, requests are handled
+// directly, otherwise they are passed to a worker via reqs.
+func (s *Server) read(ctx context.Context, rw *ctxRW, sc *serverConn, reqs chan *request) error {
+	return do(rw, func(e *encoder) {
+		for {
+			req := new(request)
+			rw.idle = true
+			err := req.decodeHeader(e, sc.p.extended)
+			req.received = time.Now()
+			if err == nil && req.typ != cmdDisc {
+				qerr := sc.client.admit(ctx, req)
+				if qerr == errQuota {
+					sc.log.Warn("disconnecting client exceeding its quota", "client", sc.client.id)
 				}
-				(&simpleReply{0, req.handle, buf, 0}).encode(e)
-			case cmdWrite:
-				if req.length == 0 {
-					respondErr(e, req.handle, EINVAL)
-					continue
+				e.check(qerr)
+			}
+			if n := req.memory(); err == nil && sc.mem != nil && n > 0 {
+				if n > s.MaxInflightBytes {
+					n = s.MaxInflightBytes
 				}
-				_, err := p.Export.Device.WriteAt(req.data, int64(req.offset))
-				if err != nil {
-					respondErr(e, req.handle, err)
-					continue
+				e.check(sc.mem.Acquire(ctx, n))
+				req.mem = n
+			}
+			if derr := req.decodeData(e, sc.bufs.get); err == nil {
+				err = derr
+			}
+			if err != nil {
+				sc.respond(req, nil, nil, err)
+				sc.recycle(req, nil)
+				sc.releaseMem(req)
+				continue
+			}
+			if req.typ == cmdDisc {
+				if sc.audit != nil {
+					sc.audit(NewAuditEvent(AuditDisconnect, sc.p.Export.Name, nil))
 				}
-				(&simpleReply{0, req.handle, nil, 0}).encode(e)
-			case cmdDisc:
 				return
-			case cmdFlush:
-				if req.length != 0 || req.offset != 0 {
-					respondErr(e, req.handle, EINVAL)
-					continue
-				}
-				err := p.Export.Device.Sync()
-				if err != nil {
-					respondErr(e, req.handle, err)
-					continue
-				}
-				(&simpleReply{0, req.handle, nil, 0}).encode(e)
-			default:
-				respondErr(e, req.handle, EINVAL)
+			}
+			if reqs == nil {
+				sc.handle(req)
+				continue
+			}
+			select {
+			case reqs <- req:
+			case <-ctx.Done():
+				e.check(ctx.Err())
 			}
 		}
 	})
 }
 
-// respondErr writes an error respons to e, based on handle an err.
-func respondErr(e *encoder, handle uint64, err error) {
-	code := EIO
-	if e, ok := err.(Error); ok {
-		code = e.Errno()
+// serverConn is the state of a server connection in transmission phase. Its
+// methods are safe for concurrent use.
+type serverConn struct {
+	ctx    context.Context
+	log    *slog.Logger
+	stats  *serverStats
+	mem    *semaphore.Weighted
+	bufs   *bufPool
+	slow   time.Duration
+	tmo    time.Duration
+	split  int
+	splitN int
+	p      connParameters
+	exp    *exportState
+	ra     *readahead
+	lim    *limiter
+	client *clientState
+	obs    Observer
+	// tobs is obs, if it implements TraceObserver.
+	tobs   TraceObserver
+	audit  func(AuditEvent)
+	cancel func()
+	// resized is called after the client resized the export.
+	resized func(size uint64)
+
+	// id is the ID of the connection reported in RequestInfo.Conn.
+	id       uint64
+	info     connInfo
+	inFlight inFlight
+
+	wmu  sync.Mutex
+	w    io.Writer
+	zc   *zeroCopy
+	werr error
+}
+
+// flush syncs the Device after the connection was drained, so the writes it
+// completed are persisted. Read-only exports are not synced.
+func (c *serverConn) flush() error {
+	if c.p.Export.Flags&FlagReadOnly != 0 {
+		return nil
+	}
+	c.acquire()
+	err := c.p.Export.Device.Sync()
+	c.release()
+	if err != nil {
+		c.log.Error("flushing drained connection failed", "err", err)
+	}
+	return err
+}
+
+// acquire blocks until a request may be executed on the Device.
+func (c *serverConn) acquire() {
+	if c.exp.sem != nil {
+		c.exp.sem <- struct{}{}
+	}
+}
+
+// release must be called after a request acquired with acquire is done.
+func (c *serverConn) release() {
+	if c.exp.sem != nil {
+		<-c.exp.sem
+	}
+}
+
+// handle executes req and sends the reply.
+func (c *serverConn) handle(req *request) {
+	info := RequestInfo{
+		ID:       nextRequestID(),
+		Conn:     c.id,
+		Handle:   req.handle,
+		Export:   c.p.Export.Name,
+		Command:  Command(req.typ),
+		Offset:   req.offset,
+		Length:   req.length,
+		Received: req.received,
+	}
+	var done func(error)
+	if c.obs != nil {
+		done = c.obs.Start(info)
+	}
+	if c.lim != nil {
+		c.lim.acquire()
+	}
+	start := time.Now()
+	if c.tobs != nil {
+		c.tobs.EndPhase(info, PhaseReceive, req.received, nil)
+	}
+	c.inFlight.add(info, start)
+	atomic.AddInt64(&c.exp.counters.InFlight, 1)
+	atomic.AddInt64(&c.client.counters.InFlight, 1)
+	atomic.AddInt64(&c.stats.counters.InFlight, 1)
+	data, vec, abandoned, err := c.execTimeout(WithRequestID(c.ctx, info.ID), req)
+	d := time.Since(start)
+	if c.tobs != nil {
+		c.tobs.EndPhase(info, PhaseExecute, start, err)
+	}
+	c.exp.counters.record(req.typ, req.length, err)
+	c.client.counters.record(req.typ, req.length, err)
+	c.stats.counters.record(req.typ, req.length, err)
+	atomic.StoreInt64(&c.exp.lastIO, time.Now().UnixNano())
+	if c.lim != nil {
+		c.lim.release(d, err)
+	}
+	c.inFlight.remove(info.ID)
+	c.stats.observe(req.typ, d)
+	if c.slow > 0 && d >= c.slow {
+		c.log.Warn("slow request", requestAttrs(info, "duration", d, "err", err)...)
+	}
+	if done != nil {
+		done(err)
+	}
+	if req.typ == cmdResize && c.audit != nil {
+		e := NewAuditEvent(AuditResize, info.Export, err)
+		e.Detail = "size=" + strconv.FormatUint(req.offset, 10)
+		c.audit(e)
+	}
+	if abandoned {
+		c.log.Warn("request timed out", requestAttrs(info, "timeout", c.tmo)...)
+	} else if err != nil {
+		c.log.Debug("request failed", requestAttrs(info, "err", err)...)
+	}
+	replied := time.Now()
+	c.respond(req, data, vec, err)
+	if c.tobs != nil {
+		c.tobs.EndPhase(info, PhaseReply, replied, c.err())
+	}
+	if !abandoned {
+		c.recycle(req, data)
+		c.releaseMem(req)
+	}
+}
+
+// execTimeout executes req with ctx like exec, but gives up after c.tmo, if
+// it is positive. An abandoned call keeps running in the background and still
+// uses the payload and memory of req, which are released once it returns.
+func (c *serverConn) execTimeout(ctx context.Context, req *request) (data []byte, vec [][]byte, abandoned bool, err error) {
+	if c.tmo <= 0 {
+		data, vec, err = c.exec(ctx, req)
+		return data, vec, false, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, c.tmo)
+	type result struct {
+		data []byte
+		vec  [][]byte
+		err  error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		data, vec, err := c.exec(ctx, req)
+		cancel()
+		ch <- result{data, vec, err}
+	}()
+	t := time.NewTimer(c.tmo)
+	defer t.Stop()
+	select {
+	case r := <-ch:
+		return r.data, r.vec, false, r.err
+	case <-t.C:
+		go func() {
+			r := <-ch
+			c.recycle(req, r.data)
+			c.releaseMem(req)
+		}()
+		return nil, nil, true, Errorf(EIO, "request timed out after %v", c.tmo)
+	}
+}
+
+// splitExec calls f concurrently for consecutive pieces of buf of at most
+// c.split bytes, with the corresponding offsets. It returns the error of the
+// failing piece with the lowest offset, if any.
+func (c *serverConn) splitExec(buf []byte, off int64, f func([]byte, int64) (int, error)) error {
+	n := (len(buf) + c.split - 1) / c.split
+	par := c.splitN
+	if par <= 0 || par > n {
+		par = n
+	}
+	var (
+		wg   sync.WaitGroup
+		sem  = make(chan struct{}, par)
+		errs = make([]error, n)
+	)
+	for i := 0; i < n; i++ {
+		p := buf[i*c.split:]
+		if len(p) > c.split {
+			p = p[:c.split]
+		}
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(i int, p []byte) {
+			defer wg.Done()
+			c.acquire()
+			_, errs[i] = f(p, off+int64(i*c.split))
+			c.release()
+			<-sem
+		}(i, p)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// recycle returns the payload of req and the data read for it to the buffer
+// pool, once the reply was sent. Data sent with zero copy is not recycled, as
+// the kernel might still be sending it.
+func (c *serverConn) recycle(req *request, data []byte) {
+	if req.data != nil {
+		c.bufs.put(req.data)
+		req.data = nil
+	}
+	if data != nil && (c.zc == nil || len(data) < zeroCopyMin) {
+		c.bufs.put(data)
+	}
+}
+
+// releaseMem releases the memory accounted to req.
+func (c *serverConn) releaseMem(req *request) {
+	if req.mem > 0 {
+		c.mem.Release(req.mem)
+		req.mem = 0
+	}
+}
+
+// requestAttrs returns the attributes used to log a request, followed by
+// extra.
+func requestAttrs(r RequestInfo, extra ...interface{}) []interface{} {
+	return append([]interface{}{
+		"request_id", r.ID,
+		"handle", r.Handle,
+		"command", r.Command,
+		"offset", r.Offset,
+		"length", r.Length,
+	}, extra...)
+}
+
+// check validates req against the export: Requests must not exceed its size
+// and read-only exports refuse modifications.
+func (c *serverConn) check(req *request) error {
+	modifies := req.typ == cmdWrite || req.typ == cmdWriteZeroes || req.typ == cmdTrim || req.typ == cmdResize
+	if modifies && c.p.Export.Flags&FlagReadOnly != 0 {
+		return EPERM
+	}
+	switch req.typ {
+	case cmdRead, cmdWrite, cmdWriteZeroes, cmdTrim, cmdBlockStatus, cmdCache:
+	default:
+		return nil
+	}
+	if size := c.size(); req.offset > size || req.length > size-req.offset {
+		if req.typ == cmdWrite || req.typ == cmdWriteZeroes {
+			return ENOSPC
+		}
+		return EINVAL
+	}
+	if !checkBlockSizes(req, c.p.BlockSizes) {
+		return EINVAL
 	}
-	rep := simpleReply{
-		errno:  uint32(code),
+	return nil
+}
+
+// size returns the current size of the export.
+func (c *serverConn) size() uint64 {
+	return atomic.LoadUint64(&c.exp.size)
+}
+
+// exec executes req against the Device and returns the data to reply with,
+// either contiguous or as a vector of buffers. ctx is passed to the Device,
+// if it implements DeviceContext.
+func (c *serverConn) exec(ctx context.Context, req *request) (data []byte, vec [][]byte, err error) {
+	if err := c.check(req); err != nil {
+		return nil, nil, err
+	}
+	d := c.p.Export.Device
+	readAt, writeAt := d.ReadAt, d.WriteAt
+	dc, hasCtx := d.(DeviceContext)
+	if hasCtx {
+		readAt = func(p []byte, off int64) (int, error) { return dc.ReadAtContext(ctx, p, off) }
+		writeAt = func(p []byte, off int64) (int, error) { return dc.WriteAtContext(ctx, p, off) }
+	}
+	switch req.typ {
+	case cmdRead:
+		if req.length == 0 {
+			return nil, nil, EINVAL
+		}
+		if v, ok := d.(ReaderAtVec); ok && !hasCtx && c.ra == nil && req.length > vecChunk && (c.split <= 0 || int(req.length) <= c.split) {
+			vec = splitVec(int(req.length), vecChunk)
+			c.acquire()
+			_, err = v.ReadAtVec(vec, int64(req.offset))
+			c.release()
+			return nil, vec, err
+		}
+		buf := c.bufs.get(int(req.length))
+		if c.ra != nil && c.ra.read(buf, int64(req.offset)) {
+			return buf, nil, nil
+		}
+		if c.split > 0 && len(buf) > c.split {
+			return buf, nil, c.splitExec(buf, int64(req.offset), readAt)
+		}
+		c.acquire()
+		_, err = readAt(buf, int64(req.offset))
+		c.release()
+		return buf, nil, err
+	case cmdWrite:
+		if req.length == 0 {
+			return nil, nil, EINVAL
+		}
+		if c.split > 0 && len(req.data) > c.split {
+			err = c.splitExec(req.data, int64(req.offset), writeAt)
+			atomic.AddUint64(&c.exp.gen, 1)
+		} else {
+			c.acquire()
+			_, err = writeAt(req.data, int64(req.offset))
+			atomic.AddUint64(&c.exp.gen, 1)
+			c.release()
+		}
+		if err == nil && req.flags&cmdFlagFUA != 0 && needsFlush(d) {
+			c.acquire()
+			err = d.Sync()
+			c.release()
+		}
+		return nil, nil, err
+	case cmdWriteZeroes:
+		if req.length == 0 {
+			return nil, nil, EINVAL
+		}
+		c.acquire()
+		err = WriteZeroes(d, int64(req.offset), int64(req.length), req.flags&cmdFlagNoHole != 0)
+		atomic.AddUint64(&c.exp.gen, 1)
+		if err == nil && req.flags&cmdFlagFUA != 0 && needsFlush(d) {
+			err = d.Sync()
+		}
+		c.release()
+		return nil, nil, err
+	case cmdBlockStatus:
+		if len(c.p.meta) == 0 || req.length == 0 {
+			return nil, nil, EINVAL
+		}
+		c.acquire()
+		vec, err = blockStatus(d, c.p.meta, int64(req.offset), int64(req.length), req.flags&cmdFlagReqOne != 0, req.extended)
+		c.release()
+		return nil, vec, err
+	case cmdFlush:
+		if req.length != 0 || req.offset != 0 {
+			return nil, nil, EINVAL
+		}
+		c.acquire()
+		err = d.Sync()
+		c.release()
+		return nil, nil, err
+	case cmdTrim:
+		var t Trimmer
+		if !As(d, &t) || req.length == 0 {
+			return nil, nil, EINVAL
+		}
+		c.acquire()
+		err = t.Trim(int64(req.offset), int64(req.length))
+		atomic.AddUint64(&c.exp.gen, 1)
+		c.release()
+		return nil, nil, err
+	case cmdResize:
+		// The new size is passed as the offset.
+		var r Resizer
+		if !As(d, &r) || req.length != 0 {
+			return nil, nil, EINVAL
+		}
+		c.acquire()
+		err = r.Resize(req.offset)
+		c.release()
+		if err == nil {
+			c.resized(req.offset)
+		}
+		return nil, nil, err
+	default:
+		return nil, nil, EINVAL
+	}
+}
+
+// respond sends the reply to req, with err or the data read, either
+// contiguous or as a vector of buffers. If the client negotiated structured
+// replies, they are used.
+func (c *serverConn) respond(req *request, data []byte, vec [][]byte, err error) {
+	if !c.p.structured {
+		if err != nil {
+			c.reply(errReply(req.handle, err))
+		} else {
+			c.reply(&simpleReply{0, req.handle, data, 0}, vec...)
+		}
+		return
+	}
+	switch {
+	case err != nil:
+		c.write(structuredError(req, err))
+	case req.typ == cmdRead && data != nil:
+		c.write(structuredRead(req, [][]byte{data}))
+	case req.typ == cmdRead:
+		c.write(structuredRead(req, vec))
+	case req.typ == cmdBlockStatus:
+		c.write(structuredBlockStatus(req, vec))
+	default:
+		c.write(structuredDone(req))
+	}
+}
+
+// reply encodes rep and writes it to the connection, followed by vec, if
+// given.
+func (c *serverConn) reply(rep *simpleReply, vec ...[]byte) {
+	data := rep.data
+	rep.data = nil
+	e := &encoder{buf: make([]byte, 0, 16)}
+	rep.encode(e)
+	bufs := [][]byte{e.buf}
+	if len(data) > 0 {
+		bufs = append(bufs, data)
+	}
+	c.write(append(bufs, vec...))
+}
+
+// write writes bufs to the connection with a single call, if possible. Large
+// buffers are sent with zero copy, if enabled. If writing fails, the
+// connection is shut down and the error is recorded.
+func (c *serverConn) write(bufs [][]byte) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if c.werr != nil {
+		return
+	}
+	var err error
+	switch {
+	case len(bufs) == 1:
+		_, err = c.w.Write(bufs[0])
+	case c.zc == nil:
+		err = writeBuffers(c.w, bufs)
+	default:
+		for _, b := range bufs {
+			if err != nil {
+				break
+			}
+			if len(b) >= zeroCopyMin {
+				err = c.zc.send(c.ctx, b)
+			} else {
+				_, err = c.w.Write(b)
+			}
+		}
+	}
+	if err != nil {
+		c.log.Debug("writing reply failed", "err", err)
+		c.werr = err
+		c.cancel()
+	}
+}
+
+// err returns the first error that occured writing replies.
+func (c *serverConn) err() error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	return c.werr
+}
+
+// errReply returns an error reply for handle, based on err.
+func errReply(handle uint64, err error) *simpleReply {
+	return &simpleReply{
+		errno:  uint32(ErrnoOf(err)),
 		handle: handle,
 		length: 0,
 	}
-	rep.encode(e)
 }
 
 // ctxRW wraps a net.Conn to provide cancellation. It does so by setting a
@@ -153,12 +1033,18 @@ type ctxRW struct {
 	c     net.Conn
 	hasDL bool
 	dl    time.Time
+
+	// drain, if not nil, is closed to stop reading at the next request
+	// boundary: While idle is set, Read returns errDraining instead of
+	// waiting for data. idle is cleared once data is read.
+	drain <-chan struct{}
+	idle  bool
 }
 
 // wrapConn wraps a connection in a ctxRW.
-func wrapConn(ctx context.Context, c net.Conn) io.ReadWriter {
+func wrapConn(ctx context.Context, c net.Conn) *ctxRW {
 	dl, ok := ctx.Deadline()
-	return &ctxRW{ctx, c, ok, dl}
+	return &ctxRW{ctx: ctx, c: c, hasDL: ok, dl: dl}
 }
 
 // maybeIgnore checks whether err is an error we want to ignore (i.e. a timeout
@@ -173,13 +1059,27 @@ func (rw *ctxRW) maybeIgnore(err error) error {
 	return err
 }
 
-// setDeadline sets the deadline for the next read/write.
-func (rw *ctxRW) setDeadline() {
+// deadline returns the deadline for the next read/write.
+func (rw *ctxRW) deadline() time.Time {
 	dl := time.Now().Add(100 * time.Millisecond)
 	if rw.hasDL && dl.After(rw.dl) {
 		dl = rw.dl
 	}
-	rw.c.SetDeadline(dl)
+	return dl
+}
+
+// setWriteDeadline sets the deadline for the next write. The returned function
+// must be called once the write returned. A timed out write corrupts a TLS
+// connection, so writes to those are only interrupted once ctx is done.
+func (rw *ctxRW) setWriteDeadline() (stop func() bool) {
+	if _, ok := rw.c.(*tls.Conn); !ok {
+		rw.c.SetWriteDeadline(rw.deadline())
+		return func() bool { return true }
+	}
+	rw.c.SetWriteDeadline(rw.dl)
+	return context.AfterFunc(rw.ctx, func() {
+		rw.c.SetWriteDeadline(time.Now())
+	})
 }
 
 // Read implements io.Reader. It returns ctx.Err if the context was cancelled.
@@ -187,9 +1087,15 @@ func (rw *ctxRW) Read(p []byte) (n int, err error) {
 	var m int
 	err = rw.ctx.Err()
 	for err == nil && n < len(p) {
-		rw.setDeadline()
+		if rw.idle && rw.drained() {
+			return 0, errDraining
+		}
+		rw.c.SetReadDeadline(rw.deadline())
 		m, err = rw.c.Read(p[n:])
 		n += m
+		if n > 0 {
+			rw.idle = false
+		}
 		if err == nil {
 			return n, err
 		}
@@ -198,13 +1104,24 @@ func (rw *ctxRW) Read(p []byte) (n int, err error) {
 	return n, err
 }
 
+// drained returns whether drain is closed.
+func (rw *ctxRW) drained() bool {
+	select {
+	case <-rw.drain:
+		return true
+	default:
+		return false
+	}
+}
+
 // Write implements io.Writer. It returns ctx.Err if the context was cancelled.
 func (rw *ctxRW) Write(p []byte) (n int, err error) {
 	var m int
 	err = rw.ctx.Err()
 	for err == nil && n < len(p) {
-		rw.setDeadline()
+		stop := rw.setWriteDeadline()
 		m, err = rw.c.Write(p[n:])
+		stop()
 		n += m
 		err = rw.maybeIgnore(err)
 	}
@@ -0,0 +1,228 @@
+// Copyright 2018 Axel Wagner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nbd
+
+import (
+	"context"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// Dialer establishes connections to a server over some transport.
+// *net.Dialer implements it, as do the dialers of golang.org/x/net/proxy.
+type Dialer interface {
+	DialContext(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+// Dial connects to addr using d and starts the handshake. If d is nil, a
+// zero net.Dialer is used. If the handshake fails, the connection is closed.
+func Dial(ctx context.Context, d Dialer, network, addr string) (*Client, error) {
+	if d == nil {
+		d = new(net.Dialer)
+	}
+	c, err := d.DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+	cl, err := ClientHandshake(ctx, c)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	return cl, nil
+}
+
+// ChanListener returns a net.Listener, which accepts the connections sent on
+// ch. It can be used to pass connections of a custom transport (e.g. SSH
+// channels wrapped with StreamConn) to Server.Serve. Accept returns
+// net.ErrClosed after ch is closed or the listener is closed. addr is
+// returned by Addr and may be nil.
+func ChanListener(ch <-chan net.Conn, addr net.Addr) net.Listener {
+	if addr == nil {
+		addr = streamAddr{}
+	}
+	return &chanListener{ch: ch, addr: addr, closed: make(chan struct{})}
+}
+
+type chanListener struct {
+	ch     <-chan net.Conn
+	addr   net.Addr
+	once   sync.Once
+	closed chan struct{}
+}
+
+func (l *chanListener) Accept() (net.Conn, error) {
+	select {
+	case c, ok := <-l.ch:
+		if !ok {
+			return nil, net.ErrClosed
+		}
+		return c, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *chanListener) Close() error {
+	l.once.Do(func() { close(l.closed) })
+	return nil
+}
+
+func (l *chanListener) Addr() net.Addr {
+	return l.addr
+}
+
+// StreamConn adapts a bidirectional stream without deadlines, like an SSH
+// channel or the stdin/stdout of a process, to a net.Conn, so it can be used
+// with Server.ServeConn and ClientHandshake. local and remote are returned by
+// LocalAddr and RemoteAddr and may be nil.
+//
+// Read deadlines are emulated by reading from rwc in a separate goroutine.
+// Write deadlines are ignored, so a blocked Write only returns once rwc is
+// closed, which happens when the connection is closed.
+func StreamConn(rwc io.ReadWriteCloser, local, remote net.Addr) net.Conn {
+	if local == nil {
+		local = streamAddr{}
+	}
+	if remote == nil {
+		remote = streamAddr{}
+	}
+	c := &streamConn{
+		rwc:    rwc,
+		local:  local,
+		remote: remote,
+		data:   make(chan chunk),
+		closed: make(chan struct{}),
+	}
+	go c.readLoop()
+	return c
+}
+
+type streamConn struct {
+	rwc    io.ReadWriteCloser
+	local  net.Addr
+	remote net.Addr
+	data   chan chunk
+	once   sync.Once
+	closed chan struct{}
+
+	// rmu serializes reads and protects buf and err.
+	rmu sync.Mutex
+	buf []byte
+	err error
+
+	mu sync.Mutex
+	dl time.Time
+}
+
+// chunk is the result of a single Read from the underlying stream.
+type chunk struct {
+	b   []byte
+	err error
+}
+
+func (c *streamConn) readLoop() {
+	for {
+		b := make([]byte, 32<<10)
+		n, err := c.rwc.Read(b)
+		select {
+		case c.data <- chunk{b[:n], err}:
+		case <-c.closed:
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (c *streamConn) Read(p []byte) (int, error) {
+	c.rmu.Lock()
+	defer c.rmu.Unlock()
+	if len(c.buf) == 0 && c.err == nil {
+		c.mu.Lock()
+		dl := c.dl
+		c.mu.Unlock()
+		var timeout <-chan time.Time
+		if !dl.IsZero() {
+			t := time.NewTimer(time.Until(dl))
+			defer t.Stop()
+			timeout = t.C
+		}
+		select {
+		case ch := <-c.data:
+			c.buf, c.err = ch.b, ch.err
+		case <-timeout:
+			return 0, os.ErrDeadlineExceeded
+		case <-c.closed:
+			return 0, net.ErrClosed
+		}
+	}
+	n := copy(p, c.buf)
+	c.buf = c.buf[n:]
+	if n == 0 && len(p) > 0 {
+		return 0, c.err
+	}
+	return n, nil
+}
+
+func (c *streamConn) Write(p []byte) (int, error) {
+	select {
+	case <-c.closed:
+		return 0, net.ErrClosed
+	default:
+	}
+	return c.rwc.Write(p)
+}
+
+func (c *streamConn) Close() error {
+	err := net.ErrClosed
+	c.once.Do(func() {
+		close(c.closed)
+		err = c.rwc.Close()
+	})
+	return err
+}
+
+func (c *streamConn) LocalAddr() net.Addr  { return c.local }
+func (c *streamConn) RemoteAddr() net.Addr { return c.remote }
+
+func (c *streamConn) SetDeadline(t time.Time) error {
+	return c.SetReadDeadline(t)
+}
+
+// SetReadDeadline sets the deadline for future Read calls. A Read already
+// blocked is not affected.
+func (c *streamConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.dl = t
+	return nil
+}
+
+// SetWriteDeadline is a no-op, as writes to the stream can not be
+// interrupted without corrupting it.
+func (c *streamConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+// streamAddr is the address of a connection without one.
+type streamAddr struct{}
+
+func (streamAddr) Network() string { return "stream" }
+func (streamAddr) String() string  { return "stream" }
@@ -0,0 +1,26 @@
+// Copyright 2018 Axel Wagner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nbd
+
+// Trimmer is an optional interface a Device can implement, to discard data
+// which is no longer needed (NBD_CMD_TRIM), e.g. by punching holes into a
+// file. If it is implemented, a Server advertises FlagSendTrim and forwards
+// trim requests to it, so the kernel passes on discards (like fstrim(8)).
+//
+// Trim discards length bytes starting at off. Afterwards, reading the range
+// may return any data, though most implementations return zeros.
+type Trimmer interface {
+	Trim(off, length int64) error
+}
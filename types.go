@@ -15,9 +15,13 @@
 package nbd
 
 import (
+	"bytes"
+	"encoding/binary"
 	"errors"
 	"fmt"
+	"io"
 	"strconv"
+	"time"
 )
 
 const (
@@ -27,10 +31,17 @@ const (
 	reqMagic             = 0x25609513
 	simpleReplyMagic     = 0x67446698
 	structuredReplyMagic = 0x668e33ef
+	extendedRequestMagic = 0x21e41c71
+	extendedReplyMagic   = 0x6e8a278c
 	flagFixedNewstyle    = 1 << 0
 	flagNoZeroes         = 1 << 1
 	flagDefaults         = flagFixedNewstyle | flagNoZeroes
 	maxOptionLength      = 4 << 10
+	maxOptionReplyLength = 4 << 20
+	// maxPayload is the maximum length of a read or write served. Larger
+	// requests are refused with EOVERFLOW, so a single request can not
+	// make a Server allocate arbitrary amounts of memory.
+	maxPayload = 4 << 20
 )
 
 type optionRequest interface {
@@ -47,8 +58,14 @@ func decodeOption(e *encoder) (uint32, interface{}, errno) {
 	option := e.uint32()
 	length := e.uint32()
 	if length > maxOptionLength {
+		e.discard(uint64(length))
 		return option, nil, errTooBig
 	}
+	// The payload is read completely before decoding it, so a malformed
+	// option can't desynchronize the stream.
+	payload := make([]byte, length)
+	e.read(payload)
+
 	var o interface{ decode(*encoder, uint32) errno }
 	switch option {
 	case cOptExportName:
@@ -57,15 +74,41 @@ func decodeOption(e *encoder) (uint32, interface{}, errno) {
 		o = new(optAbort)
 	case cOptList:
 		o = new(optList)
+	case cOptStartTLS:
+		o = new(optStartTLS)
 	case cOptInfo:
 		o = &optInfo{done: false}
 	case cOptGo:
 		o = &optInfo{done: true}
+	case cOptStructuredReply:
+		o = new(optStructuredReply)
+	case cOptListMetaContext:
+		o = &optMetaContext{set: false}
+	case cOptSetMetaContext:
+		o = &optMetaContext{set: true}
+	case cOptExtendedHeaders:
+		o = new(optExtendedHeaders)
 	}
 	if o == nil {
 		return option, nil, errUnsup
 	}
-	return option, o, o.decode(e, length)
+	var (
+		r   = bytes.NewReader(payload)
+		ret errno
+	)
+	if err := do(readOnly{r}, func(e *encoder) { ret = o.decode(e, length) }); err != nil || (ret == 0 && r.Len() != 0) {
+		return option, nil, errInvalid
+	}
+	return option, o, ret
+}
+
+// readOnly is an io.ReadWriter, which can only be read from.
+type readOnly struct {
+	io.Reader
+}
+
+func (readOnly) Write([]byte) (int, error) {
+	return 0, errors.New("write to read-only stream")
 }
 
 const (
@@ -78,6 +121,7 @@ const (
 	cOptStructuredReply = 8
 	cOptListMetaContext = 9
 	cOptSetMetaContext  = 10
+	cOptExtendedHeaders = 11
 )
 
 type optExportName struct {
@@ -117,6 +161,99 @@ func (o *optList) decode(e *encoder, l uint32) errno {
 
 func (o *optList) encode(e *encoder) {}
 
+type optStartTLS struct{}
+
+func (o *optStartTLS) code() uint32 { return cOptStartTLS }
+
+func (o *optStartTLS) decode(e *encoder, l uint32) errno {
+	if l != 0 {
+		return errInvalid
+	}
+	return 0
+}
+
+func (o *optStartTLS) encode(e *encoder) {}
+
+type optStructuredReply struct{}
+
+func (o *optStructuredReply) code() uint32 { return cOptStructuredReply }
+
+func (o *optStructuredReply) decode(e *encoder, l uint32) errno {
+	if l != 0 {
+		return errInvalid
+	}
+	return 0
+}
+
+func (o *optStructuredReply) encode(e *encoder) {}
+
+type optExtendedHeaders struct{}
+
+func (o *optExtendedHeaders) code() uint32 { return cOptExtendedHeaders }
+
+func (o *optExtendedHeaders) decode(e *encoder, l uint32) errno {
+	if l != 0 {
+		return errInvalid
+	}
+	return 0
+}
+
+func (o *optExtendedHeaders) encode(e *encoder) {}
+
+type optMetaContext struct {
+	set     bool
+	name    string
+	queries []string
+}
+
+func (o *optMetaContext) code() uint32 {
+	if o.set {
+		return cOptSetMetaContext
+	}
+	return cOptListMetaContext
+}
+
+func (o *optMetaContext) decode(e *encoder, l uint32) errno {
+	if l < 8 {
+		return errInvalid
+	}
+	nlen := e.uint32()
+	if nlen > l-8 {
+		return errInvalid
+	}
+	name := make([]byte, nlen)
+	e.read(name)
+	o.name = string(name)
+	l -= nlen + 8
+	for n := e.uint32(); n > 0; n-- {
+		if l < 4 {
+			return errInvalid
+		}
+		qlen := e.uint32()
+		if qlen > l-4 {
+			return errInvalid
+		}
+		q := make([]byte, qlen)
+		e.read(q)
+		o.queries = append(o.queries, string(q))
+		l -= qlen + 4
+	}
+	if l != 0 {
+		return errInvalid
+	}
+	return 0
+}
+
+func (o *optMetaContext) encode(e *encoder) {
+	e.writeUint32(uint32(len(o.name)))
+	e.writeString(o.name)
+	e.writeUint32(uint32(len(o.queries)))
+	for _, q := range o.queries {
+		e.writeUint32(uint32(len(q)))
+		e.writeString(q)
+	}
+}
+
 type optInfo struct {
 	done bool
 	name string
@@ -170,6 +307,7 @@ const (
 	errShutdown
 	errBlockSizeReqd
 	errTooBig
+	errExtHeaderReqd
 )
 
 func (e errno) String() string {
@@ -192,6 +330,8 @@ func (e errno) String() string {
 		return "ERR_BLOCK_SIZE_REQD"
 	case errTooBig:
 		return "ERR_TOO_BIG"
+	case errExtHeaderReqd:
+		return "ERR_EXT_HEADER_REQD"
 	default:
 		return "0x" + strconv.FormatUint(uint64(e), 16)
 	}
@@ -216,9 +356,10 @@ func encodeReply(e *encoder, option uint32, reply optionReply) {
 }
 
 const (
-	cRepAck    = 1
-	cRepServer = 2
-	cRepInfo   = 3
+	cRepAck         = 1
+	cRepServer      = 2
+	cRepInfo        = 3
+	cRepMetaContext = 4
 )
 
 type repAck struct{}
@@ -260,6 +401,28 @@ func (r *repServer) decode(e *encoder, l uint32) {
 	r.details = string(b[length:])
 }
 
+type repMetaContext struct {
+	id   uint32
+	name string
+}
+
+func (r *repMetaContext) code() uint32 { return cRepMetaContext }
+
+func (r *repMetaContext) encode(e *encoder) {
+	e.writeUint32(r.id)
+	e.writeString(r.name)
+}
+
+func (r *repMetaContext) decode(e *encoder, l uint32) {
+	if l < 4 {
+		e.check(errors.New("invalid meta context response"))
+	}
+	r.id = e.uint32()
+	b := make([]byte, l-4)
+	e.read(b)
+	r.name = string(b)
+}
+
 const (
 	cInfoExport      = 0
 	cInfoName        = 1
@@ -283,7 +446,7 @@ func decodeInfo(e *encoder, l uint32) optionReply {
 	case cInfoBlockSize:
 		rep = new(infoBlockSize)
 	default:
-		e.discard(l - 2)
+		e.discard(uint64(l - 2))
 		return nil
 	}
 	rep.decode(e, l-2)
@@ -474,6 +637,8 @@ const (
 	cmdFlagNoHole = 1 << 1
 	cmdFlagDF     = 1 << 2
 	cmdFlagReqOne = 1 << 3
+	// cmdFlagPayloadLen is only valid in extended requests.
+	cmdFlagPayloadLen = 1 << 5
 )
 
 const (
@@ -485,8 +650,11 @@ const (
 	replyTypeOffsetData  = 1
 	replyTypeOffsetHole  = 2
 	replyTypeBlockStatus = 5
-	replyTypeError       = (1 << 15) + 1
-	replyTypeErrorOffset = (1 << 15) + 2
+	// replyTypeBlockStatusExt replaces replyTypeBlockStatus in extended
+	// replies.
+	replyTypeBlockStatusExt = 6
+	replyTypeError          = (1 << 15) + 1
+	replyTypeErrorOffset    = (1 << 15) + 2
 )
 
 type request struct {
@@ -494,8 +662,18 @@ type request struct {
 	typ    uint16
 	handle uint64
 	offset uint64
-	length uint32
+	length uint64
 	data   []byte
+	// extended is set, if the request used an extended header, so its reply
+	// must use one, too.
+	extended bool
+
+	// mem is the number of bytes accounted to the request by the server's
+	// memory limit.
+	mem int64
+	// received is the time the header of the request was read by a
+	// Server.
+	received time.Time
 }
 
 func (r *request) encode(e *encoder) {
@@ -508,31 +686,85 @@ func (r *request) encode(e *encoder) {
 	e.write(r.data)
 }
 
-func (r *request) decode(e *encoder) Error {
-	if e.uint32() != reqMagic {
+// decodeHeader decodes the header of a request. If extended is set, an
+// extended header is expected, otherwise a compact one. If it returns an
+// error, the request must still be passed to decodeData, to consume its
+// payload.
+func (r *request) decodeHeader(e *encoder, extended bool) Error {
+	magic := uint32(reqMagic)
+	if extended {
+		magic = extendedRequestMagic
+	}
+	// The header is read at once, as the connection is not buffered.
+	var b [32]byte
+	h := b[:28]
+	if extended {
+		h = b[:32]
+	}
+	e.read(h)
+	if binary.BigEndian.Uint32(h) != magic {
 		e.check(errors.New("invalid magic for request"))
 	}
-	r.flags = e.uint16()
-	r.typ = e.uint16()
-	r.handle = e.uint64()
-	r.offset = e.uint64()
-	r.length = e.uint32()
+	r.extended = extended
+	r.flags = binary.BigEndian.Uint16(h[4:])
+	r.typ = binary.BigEndian.Uint16(h[6:])
+	r.handle = binary.BigEndian.Uint64(h[8:])
+	r.offset = binary.BigEndian.Uint64(h[16:])
+	if extended {
+		r.length = binary.BigEndian.Uint64(h[24:])
+	} else {
+		r.length = uint64(binary.BigEndian.Uint32(h[24:]))
+	}
 	if r.offset&(1<<63) != 0 {
 		return EOVERFLOW
 	}
-	if r.typ != cmdWrite {
+	if (r.typ == cmdRead || r.typ == cmdWrite) && r.length > maxPayload {
+		return EOVERFLOW
+	}
+	return nil
+}
+
+// hasPayload returns whether the request is followed by a payload of length
+// bytes.
+func (r *request) hasPayload() bool {
+	return r.typ == cmdWrite || (r.extended && r.flags&cmdFlagPayloadLen != 0)
+}
+
+// decodeData decodes the payload of a request, if it has one. Only writes
+// may have a payload. It is read into a buffer returned by alloc, if not nil.
+func (r *request) decodeData(e *encoder, alloc func(int) []byte) Error {
+	if !r.hasPayload() {
 		return nil
 	}
-	if r.length > 4<<20 {
+	if r.typ != cmdWrite {
+		e.discard(r.length)
+		return EINVAL
+	}
+	if r.length > maxPayload {
 		e.discard(r.length)
 		return EOVERFLOW
 	}
-	buf := make([]byte, r.length)
+	var buf []byte
+	if alloc != nil {
+		buf = alloc(int(r.length))
+	} else {
+		buf = make([]byte, r.length)
+	}
 	e.read(buf)
 	r.data = buf
 	return nil
 }
 
+// memory returns the number of bytes of buffer space needed to process r.
+func (r *request) memory() int64 {
+	switch r.typ {
+	case cmdRead, cmdWrite:
+		return int64(r.length)
+	default:
+		return 0
+	}
+}
+
 type simpleReply struct {
 	errno  uint32
 	handle uint64
@@ -548,13 +780,21 @@ func (r *simpleReply) encode(e *encoder) {
 	e.write(r.data)
 }
 
+// decode decodes a reply. r.length must be set to the length of the data
+// expected, if the request succeeded. If the reply is an error, it is
+// returned and no data is read.
 func (r *simpleReply) decode(e *encoder) Error {
 	if e.uint32() != simpleReplyMagic {
 		e.check(errors.New("invalid magic for reply"))
 	}
+	r.errno = e.uint32()
 	r.handle = e.uint64()
+	if r.errno != 0 {
+		return Errno(r.errno)
+	}
 	buf := make([]byte, r.length)
 	e.read(buf)
+	r.data = buf
 	return nil
 }
 
@@ -575,18 +815,49 @@ func (r *structuredReply) encode(e *encoder) {
 	e.write(r.data)
 }
 
+// extendedReply is the header of a reply chunk, once extended headers are
+// negotiated. offset echoes the offset of the request.
+type extendedReply struct {
+	flags  uint16
+	typ    uint16
+	handle uint64
+	offset uint64
+	length uint64
+	data   []byte
+}
+
+func (r *extendedReply) encode(e *encoder) {
+	e.writeUint32(extendedReplyMagic)
+	e.writeUint16(r.flags)
+	e.writeUint16(r.typ)
+	e.writeUint64(r.handle)
+	e.writeUint64(r.offset)
+	e.writeUint64(r.length)
+	e.write(r.data)
+}
+
+// decode decodes a structured reply chunk, or an extended one, whose offset
+// is ignored.
 func (r *structuredReply) decode(e *encoder) Error {
-	if e.uint64() != structuredReplyMagic {
+	magic := e.uint32()
+	if magic != structuredReplyMagic && magic != extendedReplyMagic {
 		e.check(errors.New("invalid magic for reply"))
 	}
 	r.flags = e.uint16()
 	r.typ = e.uint16()
 	r.handle = e.uint64()
-	r.length = e.uint32()
-	if r.length > 4<<20 {
-		e.discard(r.length)
+	var length uint64
+	if magic == extendedReplyMagic {
+		e.uint64()
+		length = e.uint64()
+	} else {
+		length = uint64(e.uint32())
+	}
+	if length > 4<<20 {
+		e.discard(length)
 		return EOVERFLOW
 	}
+	r.length = uint32(length)
 	buf := make([]byte, r.length)
 	e.read(buf)
 	r.data = buf
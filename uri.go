@@ -0,0 +1,85 @@
+// Copyright 2018 Axel Wagner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nbd
+
+import (
+	"context"
+	"crypto/tls"
+
+	"github.com/Merovius/nbd/nbduri"
+)
+
+// ParseURI parses an NBD URI, like nbd://example.com/disk,
+// nbds://example.com/disk or nbd+unix:///disk?socket=/run/nbd.sock. See
+// package nbduri for details.
+func ParseURI(s string) (*nbduri.URI, error) {
+	return nbduri.Parse(s)
+}
+
+// DialURI connects to the server addressed by u and starts the handshake. If
+// u.TLS is set (nbds URIs), the connection is upgraded to TLS, configured by
+// u.TLSConfig, and DialURI fails if the server does not support it. If the
+// handshake fails, the connection is closed.
+func DialURI(ctx context.Context, u *nbduri.URI) (*Client, error) {
+	var tc *tls.Config
+	if u.TLS {
+		var err error
+		if tc, err = u.TLSConfig(); err != nil {
+			return nil, err
+		}
+	}
+	c, err := u.Dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+	cl, err := ClientHandshake(ctx, c)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	if tc != nil {
+		if err := cl.StartTLS(tc); err != nil {
+			if err == ErrNoTLS {
+				cl.Abort()
+			}
+			c.Close()
+			return nil, err
+		}
+	}
+	return cl, nil
+}
+
+// OpenURI connects to the server addressed by the NBD URI uri and opens the
+// export named by it, negotiating structured replies if the server supports
+// them.
+func OpenURI(ctx context.Context, uri string) (*Conn, error) {
+	u, err := ParseURI(uri)
+	if err != nil {
+		return nil, err
+	}
+	cl, err := DialURI(ctx, u)
+	if err != nil {
+		return nil, err
+	}
+	// Conn handles simple replies as well, so failing to negotiate
+	// structured replies is not an error.
+	cl.StructuredReplies()
+	cn, err := cl.Open(u.Export)
+	if err != nil {
+		cl.conn.Close()
+		return nil, err
+	}
+	return cn, nil
+}
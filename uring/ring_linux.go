@@ -0,0 +1,441 @@
+// +build linux
+
+// Copyright 2018 Axel Wagner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package uring
+
+import (
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// System calls. Their numbers are the same on all architectures.
+const (
+	sysSetup    = 425
+	sysEnter    = 426
+	sysRegister = 427
+)
+
+// Constants from linux/io_uring.h.
+const (
+	setupSQPoll = 1 << 1
+
+	featSingleMmap = 1 << 0
+
+	offSQRing = 0
+	offCQRing = 0x8000000
+	offSQEs   = 0x10000000
+
+	enterGetEvents = 1 << 0
+	enterSQWakeup  = 1 << 1
+
+	sqNeedWakeup = 1 << 0
+
+	registerBuffers = 0
+	registerFiles   = 2
+
+	opNop        = 0
+	opFsync      = 3
+	opReadFixed  = 4
+	opWriteFixed = 5
+
+	sqeFixedFile = 1 << 0
+)
+
+// maxEntries is the maximum number of entries. Older kernels refuse to
+// register more buffers.
+const maxEntries = 1024
+
+// closeData is the user data of the request stopping the reaper.
+const closeData = ^uint64(0)
+
+// params is struct io_uring_params.
+type params struct {
+	sqEntries    uint32
+	cqEntries    uint32
+	flags        uint32
+	sqThreadCPU  uint32
+	sqThreadIdle uint32
+	features     uint32
+	wqFD         uint32
+	resv         [3]uint32
+	sqOff        sqringOffsets
+	cqOff        cqringOffsets
+}
+
+// sqringOffsets is struct io_sqring_offsets.
+type sqringOffsets struct {
+	head, tail, ringMask, ringEntries, flags, dropped, array, resv1 uint32
+	userAddr                                                        uint64
+}
+
+// cqringOffsets is struct io_cqring_offsets.
+type cqringOffsets struct {
+	head, tail, ringMask, ringEntries, overflow, cqes, flags, resv1 uint32
+	userAddr                                                        uint64
+}
+
+// sqe is struct io_uring_sqe.
+type sqe struct {
+	opcode      uint8
+	flags       uint8
+	ioprio      uint16
+	fd          int32
+	off         uint64
+	addr        uint64
+	len         uint32
+	rwFlags     uint32
+	userData    uint64
+	bufIndex    uint16
+	personality uint16
+	spliceFDIn  int32
+	addr3       uint64
+	pad         uint64
+}
+
+// cqe is struct io_uring_cqe.
+type cqe struct {
+	userData uint64
+	res      int32
+	flags    uint32
+}
+
+// ring is an io_uring instance, on which a single file and one buffer per
+// entry are registered. Each request in flight uses a slot, which determines
+// its buffer and user data.
+type ring struct {
+	fd     int
+	sqpoll bool
+
+	// sqMem, cqMem and sqeMem are the memory shared with the kernel. cqMem
+	// is the same as sqMem, if the kernel maps both rings at once.
+	sqMem, cqMem, sqeMem []byte
+
+	sqHead, sqTail, sqFlags *uint32
+	sqMask                  uint32
+	sqArray                 []uint32
+	sqes                    []sqe
+
+	cqHead, cqTail *uint32
+	cqMask         uint32
+	cqes           []cqe
+
+	bufMem  []byte
+	bufSize int
+
+	// slots contains the free slots.
+	slots chan int
+	// done receives the result of the request using a slot.
+	done []chan int32
+	// reaped is closed, once the reaper exits.
+	reaped chan struct{}
+
+	// mu is held while adding entries to the submission queue.
+	mu sync.Mutex
+	// err is set, if submitting failed, which leaves the ring unusable.
+	err error
+}
+
+// newRing sets up a ring for f with the given number of entries and buffers
+// of bufSize bytes.
+func newRing(f *os.File, entries, bufSize int, sqpoll bool, idle time.Duration) (r *ring, err error) {
+	n := 1
+	for n < entries && n < maxEntries {
+		n <<= 1
+	}
+	var p params
+	if sqpoll {
+		p.flags |= setupSQPoll
+		p.sqThreadIdle = uint32(idle / time.Millisecond)
+	}
+	fd, _, errno := unix.Syscall(sysSetup, uintptr(n), uintptr(unsafe.Pointer(&p)), 0)
+	if errno != 0 {
+		return nil, os.NewSyscallError("io_uring_setup", errno)
+	}
+	r = &ring{
+		fd:      int(fd),
+		sqpoll:  sqpoll,
+		bufSize: bufSize,
+		reaped:  make(chan struct{}),
+	}
+	defer func() {
+		if err != nil {
+			r.free()
+		}
+	}()
+
+	sqSize := int(p.sqOff.array + 4*p.sqEntries)
+	cqSize := int(p.cqOff.cqes + uint32(unsafe.Sizeof(cqe{}))*p.cqEntries)
+	single := p.features&featSingleMmap != 0
+	if single && cqSize > sqSize {
+		sqSize = cqSize
+	}
+	if r.sqMem, err = mmap(r.fd, offSQRing, sqSize); err != nil {
+		return nil, err
+	}
+	r.cqMem = r.sqMem
+	if !single {
+		if r.cqMem, err = mmap(r.fd, offCQRing, cqSize); err != nil {
+			return nil, err
+		}
+	}
+	if r.sqeMem, err = mmap(r.fd, offSQEs, int(unsafe.Sizeof(sqe{}))*int(p.sqEntries)); err != nil {
+		return nil, err
+	}
+	r.sqHead = word(r.sqMem, p.sqOff.head)
+	r.sqTail = word(r.sqMem, p.sqOff.tail)
+	r.sqFlags = word(r.sqMem, p.sqOff.flags)
+	r.sqMask = *word(r.sqMem, p.sqOff.ringMask)
+	r.sqArray = (*[1 << 16]uint32)(unsafe.Pointer(&r.sqMem[p.sqOff.array]))[:p.sqEntries:p.sqEntries]
+	r.sqes = (*[1 << 16]sqe)(unsafe.Pointer(&r.sqeMem[0]))[:p.sqEntries:p.sqEntries]
+	r.cqHead = word(r.cqMem, p.cqOff.head)
+	r.cqTail = word(r.cqMem, p.cqOff.tail)
+	r.cqMask = *word(r.cqMem, p.cqOff.ringMask)
+	r.cqes = (*[1 << 17]cqe)(unsafe.Pointer(&r.cqMem[p.cqOff.cqes]))[:p.cqEntries:p.cqEntries]
+
+	// The buffers are allocated outside of the Go heap, as the kernel keeps
+	// them pinned.
+	slots := int(p.sqEntries)
+	r.bufMem, err = unix.Mmap(-1, 0, slots*bufSize, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_PRIVATE|unix.MAP_ANON)
+	if err != nil {
+		return nil, os.NewSyscallError("mmap", err)
+	}
+	iovs := make([]unix.Iovec, slots)
+	for i := range iovs {
+		iovs[i].Base = &r.bufMem[i*bufSize]
+		iovs[i].SetLen(bufSize)
+	}
+	if err := r.register(registerBuffers, unsafe.Pointer(&iovs[0]), slots); err != nil {
+		return nil, err
+	}
+	fds := []int32{int32(f.Fd())}
+	if err := r.register(registerFiles, unsafe.Pointer(&fds[0]), 1); err != nil {
+		return nil, err
+	}
+
+	r.slots = make(chan int, slots)
+	r.done = make([]chan int32, slots)
+	for i := range r.done {
+		r.slots <- i
+		r.done[i] = make(chan int32, 1)
+	}
+	go r.reap()
+	return r, nil
+}
+
+// mmap maps size bytes of the ring fd at off.
+func mmap(fd int, off int64, size int) ([]byte, error) {
+	b, err := unix.Mmap(fd, off, size, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED|unix.MAP_POPULATE)
+	if err != nil {
+		return nil, os.NewSyscallError("mmap", err)
+	}
+	return b, nil
+}
+
+// word returns a pointer to the uint32 at b[off:].
+func word(b []byte, off uint32) *uint32 {
+	return (*uint32)(unsafe.Pointer(&b[off]))
+}
+
+// register registers n resources at arg with the ring.
+func (r *ring) register(op uintptr, arg unsafe.Pointer, n int) error {
+	_, _, errno := unix.Syscall6(sysRegister, uintptr(r.fd), op, uintptr(arg), uintptr(n), 0, 0)
+	if errno != 0 {
+		return os.NewSyscallError("io_uring_register", errno)
+	}
+	return nil
+}
+
+// enter calls io_uring_enter, retrying if it is interrupted.
+func (r *ring) enter(submit, wait, flags uint32) error {
+	for {
+		_, _, errno := unix.Syscall6(sysEnter, uintptr(r.fd), uintptr(submit), uintptr(wait), uintptr(flags), 0, 0)
+		switch errno {
+		case 0:
+			return nil
+		case unix.EINTR, unix.EAGAIN:
+			continue
+		default:
+			return os.NewSyscallError("io_uring_enter", errno)
+		}
+	}
+}
+
+// push adds e to the submission queue and submits it. The caller must hold a
+// slot, so the queue is never full.
+func (r *ring) push(e sqe) error {
+	r.mu.Lock()
+	if r.err != nil {
+		r.mu.Unlock()
+		return r.err
+	}
+	tail := atomic.LoadUint32(r.sqTail)
+	i := tail & r.sqMask
+	r.sqes[i] = e
+	r.sqArray[i] = i
+	atomic.StoreUint32(r.sqTail, tail+1)
+	r.mu.Unlock()
+
+	// Every entry is submitted by one call, though not necessarily the one
+	// following it.
+	var err error
+	if !r.sqpoll {
+		err = r.enter(1, 0, 0)
+	} else if atomic.LoadUint32(r.sqFlags)&sqNeedWakeup != 0 {
+		err = r.enter(0, 0, enterSQWakeup)
+	}
+	if err != nil {
+		r.mu.Lock()
+		r.err = err
+		r.mu.Unlock()
+	}
+	return err
+}
+
+// do executes e using slot and returns its result.
+func (r *ring) do(slot int, e sqe) (int, error) {
+	e.flags |= sqeFixedFile
+	e.fd = 0
+	e.userData = uint64(slot)
+	if err := r.push(e); err != nil {
+		return 0, err
+	}
+	res := <-r.done[slot]
+	if res < 0 {
+		return 0, syscall.Errno(-res)
+	}
+	return int(res), nil
+}
+
+// reap delivers completions to the slots, until the request with closeData
+// completes.
+func (r *ring) reap() {
+	defer close(r.reaped)
+	for {
+		head := atomic.LoadUint32(r.cqHead)
+		tail := atomic.LoadUint32(r.cqTail)
+		if head == tail {
+			if err := r.enter(0, 1, enterGetEvents); err != nil {
+				panic(err)
+			}
+			continue
+		}
+		for ; head != tail; head++ {
+			c := r.cqes[head&r.cqMask]
+			if c.userData == closeData {
+				atomic.StoreUint32(r.cqHead, head+1)
+				return
+			}
+			r.done[c.userData] <- c.res
+		}
+		atomic.StoreUint32(r.cqHead, head)
+	}
+}
+
+// buf returns the buffer of slot.
+func (r *ring) buf(slot int) []byte {
+	return r.bufMem[slot*r.bufSize : (slot+1)*r.bufSize]
+}
+
+func (r *ring) readAt(p []byte, off int64) (int, error) {
+	slot := <-r.slots
+	defer func() { r.slots <- slot }()
+	buf := r.buf(slot)
+	n := 0
+	for n < len(p) {
+		chunk := p[n:]
+		if len(chunk) > len(buf) {
+			chunk = chunk[:len(buf)]
+		}
+		res, err := r.do(slot, sqe{
+			opcode:   opReadFixed,
+			off:      uint64(off) + uint64(n),
+			addr:     uint64(uintptr(unsafe.Pointer(&buf[0]))),
+			len:      uint32(len(chunk)),
+			bufIndex: uint16(slot),
+		})
+		if err != nil {
+			return n, err
+		}
+		if res == 0 {
+			return n, io.EOF
+		}
+		n += copy(chunk, buf[:res])
+	}
+	return n, nil
+}
+
+func (r *ring) writeAt(p []byte, off int64) (int, error) {
+	slot := <-r.slots
+	defer func() { r.slots <- slot }()
+	buf := r.buf(slot)
+	n := 0
+	for n < len(p) {
+		m := copy(buf, p[n:])
+		res, err := r.do(slot, sqe{
+			opcode:   opWriteFixed,
+			off:      uint64(off) + uint64(n),
+			addr:     uint64(uintptr(unsafe.Pointer(&buf[0]))),
+			len:      uint32(m),
+			bufIndex: uint16(slot),
+		})
+		if err != nil {
+			return n, err
+		}
+		if res == 0 {
+			return n, io.ErrShortWrite
+		}
+		n += res
+	}
+	return n, nil
+}
+
+func (r *ring) fsync() error {
+	slot := <-r.slots
+	defer func() { r.slots <- slot }()
+	_, err := r.do(slot, sqe{opcode: opFsync})
+	return err
+}
+
+// close stops the reaper and frees the ring.
+func (r *ring) close() {
+	<-r.slots
+	if err := r.push(sqe{opcode: opNop, userData: closeData}); err != nil {
+		// The reaper might still use the ring.
+		return
+	}
+	<-r.reaped
+	r.free()
+}
+
+// free unmaps the memory of r and closes it.
+func (r *ring) free() {
+	if r.cqMem != nil && &r.cqMem[0] == &r.sqMem[0] {
+		r.cqMem = nil
+	}
+	for _, b := range [][]byte{r.bufMem, r.sqeMem, r.cqMem, r.sqMem} {
+		if b != nil {
+			unix.Munmap(b)
+		}
+	}
+	unix.Close(r.fd)
+}
@@ -0,0 +1,35 @@
+// +build !linux
+
+// Copyright 2018 Axel Wagner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package uring
+
+import (
+	"errors"
+	"os"
+	"time"
+)
+
+// ring is not available on this system.
+type ring struct{}
+
+func newRing(f *os.File, entries, bufSize int, sqpoll bool, idle time.Duration) (*ring, error) {
+	return nil, errors.New("io_uring is only supported on Linux")
+}
+
+func (r *ring) readAt(p []byte, off int64) (int, error)  { panic("unreachable") }
+func (r *ring) writeAt(p []byte, off int64) (int, error) { panic("unreachable") }
+func (r *ring) fsync() error                             { panic("unreachable") }
+func (r *ring) close()                                   {}
@@ -0,0 +1,155 @@
+// Copyright 2018 Axel Wagner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package uring provides a Device backed by a file, which is read and written
+// using io_uring on Linux.
+//
+// Serving an os.File makes one pread or pwrite system call per request, which
+// limits the throughput on fast (e.g. NVMe) storage. A File instead submits
+// requests to an io_uring instance shared with the kernel, using buffers
+// registered with it once, and reaps their completions on a dedicated
+// goroutine. With Options.SQPoll, a kernel thread polls for submissions, so
+// submitting a request does not need a system call either.
+//
+// On other systems, or if the kernel does not support io_uring (it was added
+// in Linux 5.1 and might be disabled, e.g. by seccomp), a File falls back to
+// pread and pwrite. Fallback reports whether it did.
+package uring
+
+import (
+	"io"
+	"os"
+	"time"
+)
+
+// Defaults for Options.
+const (
+	DefaultEntries    = 64
+	DefaultBufferSize = 128 << 10
+)
+
+// Options configures a File. The zero value uses the defaults.
+type Options struct {
+	// Entries is the number of requests which can be in flight at once. It
+	// is rounded up to a power of two. If it is 0, DefaultEntries is used.
+	Entries int
+	// BufferSize is the size of each of the Entries buffers registered with
+	// the kernel. Data is copied between them and the buffers of reads and
+	// writes. Larger requests are split. If it is 0, DefaultBufferSize is
+	// used.
+	BufferSize int
+	// SQPoll makes a kernel thread poll for submitted requests. This burns
+	// CPU while requests are coming in, but saves a system call for each.
+	// Before Linux 5.11, it requires CAP_SYS_ADMIN.
+	SQPoll bool
+	// SQPollIdle is the time after which the polling thread goes to sleep,
+	// if no requests are submitted. If it is 0, the kernel default is used.
+	SQPollIdle time.Duration
+	// ReadOnly opens the file read-only.
+	ReadOnly bool
+}
+
+// File is a Device backed by a file. It is safe for concurrent use.
+type File struct {
+	f    *os.File
+	size uint64
+	// r is nil, if the File falls back to pread and pwrite.
+	r *ring
+}
+
+// Open opens the file at path, which can also be a block device. If o is nil,
+// the defaults are used. Setting up io_uring failing is not an error, the File
+// then falls back to pread and pwrite.
+func Open(path string, o *Options) (*File, error) {
+	if o == nil {
+		o = new(Options)
+	}
+	flag := os.O_RDWR
+	if o.ReadOnly {
+		flag = os.O_RDONLY
+	}
+	f, err := os.OpenFile(path, flag, 0)
+	if err != nil {
+		return nil, err
+	}
+	// Seeking determines the size of block devices, too.
+	size, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	entries := DefaultEntries
+	if o.Entries > 0 {
+		entries = o.Entries
+	}
+	bufSize := DefaultBufferSize
+	if o.BufferSize > 0 {
+		bufSize = o.BufferSize
+	}
+	r, _ := newRing(f, entries, bufSize, o.SQPoll, o.SQPollIdle)
+	return &File{f: f, size: uint64(size), r: r}, nil
+}
+
+// Size returns the size of the file, when it was opened.
+func (f *File) Size() uint64 {
+	return f.size
+}
+
+// Fallback returns whether f uses pread and pwrite, instead of io_uring.
+func (f *File) Fallback() bool {
+	return f.r == nil
+}
+
+// ReadAt implements nbd.Device.
+func (f *File) ReadAt(p []byte, off int64) (int, error) {
+	if f.r == nil {
+		return f.f.ReadAt(p, off)
+	}
+	n, err := f.r.readAt(p, off)
+	if err != nil && err != io.EOF {
+		err = &os.PathError{Op: "read", Path: f.f.Name(), Err: err}
+	}
+	return n, err
+}
+
+// WriteAt implements nbd.Device.
+func (f *File) WriteAt(p []byte, off int64) (int, error) {
+	if f.r == nil {
+		return f.f.WriteAt(p, off)
+	}
+	n, err := f.r.writeAt(p, off)
+	if err != nil {
+		err = &os.PathError{Op: "write", Path: f.f.Name(), Err: err}
+	}
+	return n, err
+}
+
+// Sync implements nbd.Device.
+func (f *File) Sync() error {
+	if f.r == nil {
+		return f.f.Sync()
+	}
+	if err := f.r.fsync(); err != nil {
+		return &os.PathError{Op: "sync", Path: f.f.Name(), Err: err}
+	}
+	return nil
+}
+
+// Close closes f. It must not be called with requests in flight.
+func (f *File) Close() error {
+	if f.r != nil {
+		f.r.close()
+	}
+	return f.f.Close()
+}
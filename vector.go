@@ -0,0 +1,124 @@
+// Copyright 2018 Axel Wagner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nbd
+
+import (
+	"io"
+	"net"
+)
+
+// ReaderAtVec is an optional interface a Device can implement, to read into
+// multiple buffers at once (like preadv(2)). If it is implemented, a Server
+// reads large requests into several smaller buffers and sends them without
+// copying them into a contiguous buffer first.
+//
+// ReadAtVec fills bufs in order, with data starting at off. Otherwise, it
+// behaves like io.ReaderAt.ReadAt, with n being the total number of bytes
+// read.
+type ReaderAtVec interface {
+	ReadAtVec(bufs [][]byte, off int64) (n int, err error)
+}
+
+// WriterAtVec is an optional interface a Device can implement, to write
+// multiple buffers at once (like pwritev(2)). It is used by wrappers like
+// CoalesceWrites, to avoid copying writes into a contiguous buffer.
+//
+// WriteAtVec writes bufs in order, starting at off. Otherwise, it behaves like
+// io.WriterAt.WriteAt, with n being the total number of bytes written.
+type WriterAtVec interface {
+	WriteAtVec(bufs [][]byte, off int64) (n int, err error)
+}
+
+// ReadAtVec reads into bufs from r, starting at off. If r implements
+// ReaderAtVec, it is used. Otherwise, ReadAt is called for each buffer.
+func ReadAtVec(r io.ReaderAt, bufs [][]byte, off int64) (n int, err error) {
+	if v, ok := r.(ReaderAtVec); ok {
+		return v.ReadAtVec(bufs, off)
+	}
+	for _, b := range bufs {
+		m, err := r.ReadAt(b, off)
+		n += m
+		off += int64(m)
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// WriteAtVec writes bufs to w, starting at off. If w implements WriterAtVec,
+// it is used. Otherwise, WriteAt is called for each buffer.
+func WriteAtVec(w io.WriterAt, bufs [][]byte, off int64) (n int, err error) {
+	if v, ok := w.(WriterAtVec); ok {
+		return v.WriteAtVec(bufs, off)
+	}
+	for _, b := range bufs {
+		m, err := w.WriteAt(b, off)
+		n += m
+		off += int64(m)
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// vecChunk is the size of the buffers reads are split into, if the Device
+// implements ReaderAtVec.
+const vecChunk = 64 << 10
+
+// splitVec allocates buffers with a total size of n, each at most chunk
+// bytes.
+func splitVec(n, chunk int) [][]byte {
+	bufs := make([][]byte, 0, (n+chunk-1)/chunk)
+	for n > 0 {
+		m := chunk
+		if n < m {
+			m = n
+		}
+		bufs = append(bufs, make([]byte, m))
+		n -= m
+	}
+	return bufs
+}
+
+// writeBuffers writes bufs to w. If w is a connection wrapped by wrapConn,
+// the buffers are written with a single writev(2), if possible.
+func writeBuffers(w io.Writer, bufs [][]byte) error {
+	if rw, ok := w.(*ctxRW); ok {
+		return rw.writeBuffers(bufs)
+	}
+	for _, b := range bufs {
+		if _, err := w.Write(b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeBuffers writes bufs to the connection. It returns ctx.Err if the
+// context was cancelled.
+func (rw *ctxRW) writeBuffers(bufs [][]byte) error {
+	b := net.Buffers(bufs)
+	err := rw.ctx.Err()
+	for err == nil && len(b) > 0 {
+		stop := rw.setWriteDeadline()
+		// WriteTo consumes what was written, so it can be retried.
+		_, err = b.WriteTo(rw.c)
+		stop()
+		err = rw.maybeIgnore(err)
+	}
+	return err
+}
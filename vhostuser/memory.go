@@ -0,0 +1,102 @@
+// +build linux
+
+// Copyright 2018 Axel Wagner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vhostuser
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"golang.org/x/sys/unix"
+)
+
+// maxRegions is the maximum number of memory regions in SET_MEM_TABLE.
+const maxRegions = 8
+
+// region is a region of guest memory, mapped into our address space.
+type region struct {
+	// guest is the guest physical address of the region.
+	guest uint64
+	// user is the address of the region in the frontend's address space.
+	user uint64
+	size uint64
+	// mapped is the mmapped file. The region starts at offset into it.
+	mapped []byte
+	offset uint64
+}
+
+// memory is the guest memory shared by the frontend.
+type memory []region
+
+// parseMemory maps the regions described by a SET_MEM_TABLE payload, using
+// fds.
+func parseMemory(p []byte, fds []int) (memory, error) {
+	if len(p) < 8 {
+		return nil, errors.New("short memory table")
+	}
+	n := binary.LittleEndian.Uint32(p)
+	if n > maxRegions || int(n) != len(fds) || len(p) < 8+int(n)*32 {
+		return nil, fmt.Errorf("invalid memory table with %d regions and %d fds", n, len(fds))
+	}
+	var m memory
+	for i := 0; i < int(n); i++ {
+		b := p[8+i*32:]
+		r := region{
+			guest:  binary.LittleEndian.Uint64(b[0:]),
+			size:   binary.LittleEndian.Uint64(b[8:]),
+			user:   binary.LittleEndian.Uint64(b[16:]),
+			offset: binary.LittleEndian.Uint64(b[24:]),
+		}
+		mapped, err := unix.Mmap(fds[i], 0, int(r.size+r.offset), unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED)
+		if err != nil {
+			m.unmap()
+			return nil, fmt.Errorf("mapping memory region: %v", err)
+		}
+		r.mapped = mapped
+		m = append(m, r)
+	}
+	return m, nil
+}
+
+// unmap unmaps all regions of m.
+func (m memory) unmap() {
+	for _, r := range m {
+		unix.Munmap(r.mapped)
+	}
+}
+
+// guest returns the n bytes of memory at the guest physical address addr.
+func (m memory) guest(addr, n uint64) ([]byte, error) {
+	for _, r := range m {
+		if addr >= r.guest && addr-r.guest < r.size && n <= r.size-(addr-r.guest) {
+			off := r.offset + addr - r.guest
+			return r.mapped[off : off+n : off+n], nil
+		}
+	}
+	return nil, fmt.Errorf("guest address %#x (len %d) is not mapped", addr, n)
+}
+
+// user returns the n bytes of memory at the frontend's address addr.
+func (m memory) user(addr, n uint64) ([]byte, error) {
+	for _, r := range m {
+		if addr >= r.user && addr-r.user < r.size && n <= r.size-(addr-r.user) {
+			off := r.offset + addr - r.user
+			return r.mapped[off : off+n : off+n], nil
+		}
+	}
+	return nil, fmt.Errorf("frontend address %#x (len %d) is not mapped", addr, n)
+}
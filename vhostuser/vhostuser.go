@@ -0,0 +1,594 @@
+// +build linux
+
+// Copyright 2018 Axel Wagner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package vhostuser exposes a Device as a vhost-user-blk backend.
+//
+// vhost-user is a protocol used by virtual machine monitors like QEMU or
+// cloud-hypervisor to delegate the implementation of virtio devices to a
+// separate process. The monitor shares the memory of the guest over a unix
+// socket, so a Server processes the virtqueues of the guest directly,
+// without going through the kernel NBD client or a network connection:
+//
+//	srv := &vhostuser.Server{Device: d, Size: size}
+//	return srv.ListenAndServe(ctx, "/run/vm/disk.sock")
+//
+// With QEMU, the socket can be used with
+//
+//	-object memory-backend-memfd,id=mem,size=4G,share=on -numa node,memdev=mem
+//	-chardev socket,id=disk,path=/run/vm/disk.sock
+//	-device vhost-user-blk-pci,chardev=disk
+//
+// Only split virtqueues without indirect descriptors are supported. Dirty
+// page logging (and hence live migration) is not supported.
+package vhostuser
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"sync"
+
+	"github.com/Merovius/nbd"
+	"golang.org/x/sys/unix"
+)
+
+// Server serves a Device as a vhost-user-blk backend.
+type Server struct {
+	// Device is the Device exposed to the guest. It must be safe for
+	// concurrent use, if Queues is larger than 1.
+	Device nbd.Device
+	// Size is the size of Device in bytes. It should be a multiple of 512.
+	Size uint64
+	// ReadOnly makes the Device read-only for the guest.
+	ReadOnly bool
+	// BlockSize is the logical block size reported to the guest. If it is 0,
+	// the guest uses 512.
+	BlockSize uint32
+	// Queues is the number of virtqueues offered to the guest, which are
+	// processed concurrently. If it is <= 0, one queue is used.
+	Queues int
+	// Serial is returned to the guest as the serial number of the disk. It is
+	// truncated to 20 bytes.
+	Serial string
+
+	// Logger is used to log errors. If it is nil, nothing is logged.
+	Logger *slog.Logger
+}
+
+// ListenAndServe listens on the unix socket at path and serves every
+// connection until ctx is cancelled or an error occurs. Usually, a monitor
+// only connects once per device.
+func (s *Server) ListenAndServe(ctx context.Context, path string) error {
+	l, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		<-ctx.Done()
+		l.Close()
+	}()
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	for {
+		c, err := l.AcceptUnix()
+		if err != nil {
+			if e := ctx.Err(); e != nil {
+				return e
+			}
+			return err
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := s.ServeConn(ctx, c); err != nil && ctx.Err() == nil {
+				s.logger().Info("connection terminated", "err", err)
+			}
+		}()
+	}
+}
+
+// ServeConn serves the frontend connected via c. It returns after ctx is
+// cancelled, the frontend disconnects or an error occurs. Either way, c is
+// closed.
+func (s *Server) ServeConn(ctx context.Context, c *net.UnixConn) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		<-ctx.Done()
+		c.Close()
+	}()
+
+	cn := &conn{srv: s, c: c, log: s.logger()}
+	for i := 0; i < s.queues(); i++ {
+		cn.rings = append(cn.rings, &vring{kick: -1})
+	}
+	defer cn.close()
+	err := cn.serve()
+	if e := ctx.Err(); e != nil {
+		return e
+	}
+	if err == io.EOF {
+		return nil
+	}
+	return err
+}
+
+func (s *Server) logger() *slog.Logger {
+	if s.Logger == nil {
+		return slog.New(slog.NewTextHandler(io.Discard, nil))
+	}
+	return s.Logger
+}
+
+func (s *Server) queues() int {
+	if s.Queues <= 0 {
+		return 1
+	}
+	return s.Queues
+}
+
+// Message types of the vhost-user protocol.
+const (
+	msgGetFeatures         = 1
+	msgSetFeatures         = 2
+	msgSetOwner            = 3
+	msgResetOwner          = 4
+	msgSetMemTable         = 5
+	msgSetVringNum         = 8
+	msgSetVringAddr        = 9
+	msgSetVringBase        = 10
+	msgGetVringBase        = 11
+	msgSetVringKick        = 12
+	msgSetVringCall        = 13
+	msgSetVringErr         = 14
+	msgGetProtocolFeatures = 15
+	msgSetProtocolFeatures = 16
+	msgGetQueueNum         = 17
+	msgSetVringEnable      = 18
+	msgGetConfig           = 24
+	msgSetConfig           = 25
+)
+
+// Flags in the message header.
+const (
+	flagVersion   = 0x1
+	flagReply     = 0x4
+	flagNeedReply = 0x8
+)
+
+// Feature bits of the device.
+const (
+	featRO               = 1 << 5
+	featBlkSize          = 1 << 6
+	featFlush            = 1 << 9
+	featMQ               = 1 << 12
+	featProtocolFeatures = 1 << 30
+	featVersion1         = 1 << 32
+)
+
+// Protocol feature bits.
+const (
+	protoMQ       = 1 << 0
+	protoReplyAck = 1 << 3
+	protoConfig   = 1 << 9
+)
+
+// vringNoFD is set in the payload of SET_VRING_KICK, SET_VRING_CALL and
+// SET_VRING_ERR, if no fd is passed.
+const vringNoFD = 0x100
+
+// maxPayload is the maximum size of a message payload accepted.
+const maxPayload = 4096
+
+// maxQueueSize is the maximum size of a virtqueue.
+const maxQueueSize = 32768
+
+// configSize is the size of struct virtio_blk_config.
+const configSize = 60
+
+// conn is the state of a connection to a frontend.
+type conn struct {
+	srv *Server
+	c   *net.UnixConn
+	log *slog.Logger
+
+	features uint64
+	protocol uint64
+
+	// memMu protects mem against being replaced, while rings are processed.
+	memMu sync.RWMutex
+	mem   memory
+
+	rings []*vring
+}
+
+// serve processes messages, until an error occurs.
+func (c *conn) serve() error {
+	var (
+		hdr [12]byte
+		oob = make([]byte, unix.CmsgSpace(4*maxRegions))
+	)
+	for {
+		n, oobn, _, _, err := c.c.ReadMsgUnix(hdr[:], oob)
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return io.EOF
+		}
+		fds, err := parseFDs(oob[:oobn])
+		if err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(c.c, hdr[n:]); err != nil {
+			closeFDs(fds)
+			return err
+		}
+		req := binary.LittleEndian.Uint32(hdr[0:])
+		flags := binary.LittleEndian.Uint32(hdr[4:])
+		size := binary.LittleEndian.Uint32(hdr[8:])
+		if size > maxPayload {
+			closeFDs(fds)
+			return fmt.Errorf("message %d too large (%d bytes)", req, size)
+		}
+		p := make([]byte, size)
+		if _, err := io.ReadFull(c.c, p); err != nil {
+			closeFDs(fds)
+			return err
+		}
+
+		reply, err := c.handle(req, p, fds)
+		if err != nil {
+			c.log.Error("handling message failed", "request", req, "err", err)
+		}
+		if reply == nil && flags&flagNeedReply != 0 && c.protocol&protoReplyAck != 0 {
+			reply = make([]byte, 8)
+			if err != nil {
+				reply[0] = 1
+			}
+			err = nil
+		}
+		if err != nil {
+			return err
+		}
+		if reply != nil {
+			if err := c.send(req, reply); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// send sends a reply to req.
+func (c *conn) send(req uint32, p []byte) error {
+	b := make([]byte, 12+len(p))
+	binary.LittleEndian.PutUint32(b[0:], req)
+	binary.LittleEndian.PutUint32(b[4:], flagVersion|flagReply)
+	binary.LittleEndian.PutUint32(b[8:], uint32(len(p)))
+	copy(b[12:], p)
+	_, err := c.c.Write(b)
+	return err
+}
+
+// handle handles a message and returns the payload of the reply, if any. It
+// takes ownership of fds.
+func (c *conn) handle(req uint32, p []byte, fds []int) ([]byte, error) {
+	switch req {
+	case msgSetMemTable:
+		defer closeFDs(fds)
+		return nil, c.setMemTable(p, fds)
+	case msgSetVringKick, msgSetVringCall, msgSetVringErr:
+		return nil, c.setVringFD(req, p, fds)
+	}
+	closeFDs(fds)
+
+	switch req {
+	case msgGetFeatures:
+		f := uint64(featVersion1 | featProtocolFeatures | featFlush)
+		if c.srv.ReadOnly {
+			f |= featRO
+		}
+		if c.srv.BlockSize != 0 {
+			f |= featBlkSize
+		}
+		if c.srv.queues() > 1 {
+			f |= featMQ
+		}
+		return u64(f), nil
+	case msgSetFeatures:
+		if len(p) < 8 {
+			return nil, errors.New("short SET_FEATURES")
+		}
+		c.features = binary.LittleEndian.Uint64(p)
+		return nil, nil
+	case msgGetProtocolFeatures:
+		f := uint64(protoReplyAck | protoConfig)
+		if c.srv.queues() > 1 {
+			f |= protoMQ
+		}
+		return u64(f), nil
+	case msgSetProtocolFeatures:
+		if len(p) < 8 {
+			return nil, errors.New("short SET_PROTOCOL_FEATURES")
+		}
+		c.protocol = binary.LittleEndian.Uint64(p)
+		return nil, nil
+	case msgGetQueueNum:
+		return u64(uint64(c.srv.queues())), nil
+	case msgSetOwner:
+		return nil, nil
+	case msgResetOwner:
+		c.stopAll()
+		c.features = 0
+		return nil, nil
+	case msgSetVringNum, msgSetVringBase, msgGetVringBase, msgSetVringEnable:
+		return c.vringState(req, p)
+	case msgSetVringAddr:
+		return nil, c.setVringAddr(p)
+	case msgGetConfig:
+		return c.config(p)
+	case msgSetConfig:
+		// The configuration of virtio-blk contains only one writable field
+		// (the cache mode), which is not supported.
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("unsupported message %d", req)
+	}
+}
+
+// ring returns the vring with the given index.
+func (c *conn) ring(i uint32) (*vring, error) {
+	if i >= uint32(len(c.rings)) {
+		return nil, fmt.Errorf("invalid virtqueue %d", i)
+	}
+	return c.rings[i], nil
+}
+
+func (c *conn) setMemTable(p []byte, fds []int) error {
+	m, err := parseMemory(p, fds)
+	if err != nil {
+		return err
+	}
+	c.memMu.Lock()
+	old := c.mem
+	c.mem = m
+	c.memMu.Unlock()
+	old.unmap()
+	for _, q := range c.rings {
+		c.update(q)
+	}
+	return nil
+}
+
+func (c *conn) vringState(req uint32, p []byte) ([]byte, error) {
+	if len(p) < 8 {
+		return nil, errors.New("short vring state")
+	}
+	q, err := c.ring(binary.LittleEndian.Uint32(p[0:]))
+	if err != nil {
+		return nil, err
+	}
+	num := binary.LittleEndian.Uint32(p[4:])
+	switch req {
+	case msgSetVringNum:
+		if num == 0 || num > maxQueueSize || num&(num-1) != 0 {
+			return nil, fmt.Errorf("invalid virtqueue size %d", num)
+		}
+		c.stop(q)
+		q.num = uint16(num)
+		c.update(q)
+	case msgSetVringBase:
+		c.stop(q)
+		q.last, q.next = uint16(num), uint16(num)
+		c.update(q)
+	case msgGetVringBase:
+		c.stop(q)
+		if q.kick >= 0 {
+			unix.Close(q.kick)
+			q.kick = -1
+		}
+		b := make([]byte, 8)
+		copy(b, p[:4])
+		binary.LittleEndian.PutUint32(b[4:], uint32(q.last))
+		return b, nil
+	case msgSetVringEnable:
+		q.enabled = num != 0
+		c.update(q)
+	}
+	return nil, nil
+}
+
+func (c *conn) setVringAddr(p []byte) error {
+	if len(p) < 40 {
+		return errors.New("short SET_VRING_ADDR")
+	}
+	q, err := c.ring(binary.LittleEndian.Uint32(p[0:]))
+	if err != nil {
+		return err
+	}
+	c.stop(q)
+	q.desc = binary.LittleEndian.Uint64(p[8:])
+	q.used = binary.LittleEndian.Uint64(p[16:])
+	q.avail = binary.LittleEndian.Uint64(p[24:])
+	c.update(q)
+	return nil
+}
+
+func (c *conn) setVringFD(req uint32, p []byte, fds []int) error {
+	if len(p) < 8 {
+		closeFDs(fds)
+		return errors.New("short vring fd message")
+	}
+	v := binary.LittleEndian.Uint64(p)
+	want := 1
+	if v&vringNoFD != 0 {
+		want = 0
+	}
+	if len(fds) != want {
+		closeFDs(fds)
+		return fmt.Errorf("got %d fds, expected %d", len(fds), want)
+	}
+	q, err := c.ring(uint32(v & 0xff))
+	if err != nil {
+		closeFDs(fds)
+		return err
+	}
+	fd := -1
+	if want == 1 {
+		fd = fds[0]
+	}
+
+	switch req {
+	case msgSetVringKick:
+		c.stop(q)
+		if q.kick >= 0 {
+			unix.Close(q.kick)
+		}
+		q.kick = fd
+		// Without protocol features, rings are enabled as soon as they are
+		// started.
+		if c.features&featProtocolFeatures == 0 {
+			q.enabled = true
+		}
+		c.update(q)
+	case msgSetVringCall:
+		c.stop(q)
+		if q.call != nil {
+			q.call.Close()
+			q.call = nil
+		}
+		if fd >= 0 {
+			q.call = os.NewFile(uintptr(fd), "call")
+		}
+		c.update(q)
+	case msgSetVringErr:
+		// Errors are never signalled to the frontend.
+		if fd >= 0 {
+			unix.Close(fd)
+		}
+	}
+	return nil
+}
+
+// config returns the requested part of the device configuration.
+func (c *conn) config(p []byte) ([]byte, error) {
+	if len(p) < 12 {
+		return nil, errors.New("short GET_CONFIG")
+	}
+	off := binary.LittleEndian.Uint32(p[0:])
+	size := binary.LittleEndian.Uint32(p[4:])
+
+	var cfg [configSize]byte
+	binary.LittleEndian.PutUint64(cfg[0:], c.srv.Size/sectorSize)
+	binary.LittleEndian.PutUint32(cfg[20:], c.srv.BlockSize)
+	binary.LittleEndian.PutUint16(cfg[34:], uint16(c.srv.queues()))
+
+	reply := make([]byte, 12+int(size))
+	copy(reply, p[:12])
+	if off < configSize {
+		copy(reply[12:], cfg[off:])
+	}
+	return reply, nil
+}
+
+// update starts q, if it is ready and not running.
+func (c *conn) update(q *vring) {
+	if q.stop != nil || !q.enabled || q.kick < 0 || q.num == 0 || c.mem == nil {
+		return
+	}
+	fd, err := unix.Dup(q.kick)
+	if err != nil {
+		c.log.Error("could not start virtqueue", "err", err)
+		return
+	}
+	unix.SetNonblock(fd, true)
+	q.stop = os.NewFile(uintptr(fd), "kick")
+	q.done = make(chan struct{})
+	go c.run(q, q.stop, q.done)
+}
+
+// stop stops processing q and waits for the processing goroutine to exit.
+func (c *conn) stop(q *vring) {
+	if q.stop == nil {
+		return
+	}
+	q.stop.Close()
+	<-q.done
+	q.stop, q.done = nil, nil
+}
+
+// stopAll stops all rings.
+func (c *conn) stopAll() {
+	for _, q := range c.rings {
+		c.stop(q)
+	}
+}
+
+// close stops all rings and releases all resources of c.
+func (c *conn) close() {
+	c.stopAll()
+	for _, q := range c.rings {
+		if q.kick >= 0 {
+			unix.Close(q.kick)
+		}
+		if q.call != nil {
+			q.call.Close()
+		}
+	}
+	c.mem.unmap()
+	c.c.Close()
+}
+
+// parseFDs returns the fds passed in the control message oob.
+func parseFDs(oob []byte) ([]int, error) {
+	if len(oob) == 0 {
+		return nil, nil
+	}
+	msgs, err := unix.ParseSocketControlMessage(oob)
+	if err != nil {
+		return nil, err
+	}
+	var fds []int
+	for _, m := range msgs {
+		f, err := unix.ParseUnixRights(&m)
+		if err != nil {
+			closeFDs(fds)
+			return nil, err
+		}
+		fds = append(fds, f...)
+	}
+	return fds, nil
+}
+
+func closeFDs(fds []int) {
+	for _, fd := range fds {
+		unix.Close(fd)
+	}
+}
+
+func u64(v uint64) []byte {
+	b := make([]byte, 8)
+	binary.LittleEndian.PutUint64(b, v)
+	return b
+}
@@ -0,0 +1,268 @@
+// +build linux
+
+// Copyright 2018 Axel Wagner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vhostuser
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"sync/atomic"
+	"unsafe"
+
+	"github.com/Merovius/nbd"
+)
+
+// Flags of descriptors and the available ring.
+const (
+	descNext     = 1
+	descWrite    = 2
+	descIndirect = 4
+
+	availNoInterrupt = 1
+)
+
+// virtio-blk request types and status codes.
+const (
+	blkIn    = 0
+	blkOut   = 1
+	blkFlush = 4
+	blkGetID = 8
+
+	blkOK     = 0
+	blkIOErr  = 1
+	blkUnsupp = 2
+)
+
+// sectorSize is the unit of offsets in virtio-blk requests.
+const sectorSize = 512
+
+// blkIDLen is the length of the serial returned for GET_ID requests.
+const blkIDLen = 20
+
+// vring is a split virtqueue.
+type vring struct {
+	num uint16
+	// desc, avail and used are addresses in the frontend's address space.
+	desc, avail, used uint64
+	// last is the index of the next available entry to process and next the
+	// index of the next used entry.
+	last, next uint16
+	enabled    bool
+
+	// kick is the eventfd signalled by the frontend for new requests. It is
+	// -1, if not set.
+	kick int
+	// call is signalled after requests are completed. It is nil, if not set.
+	call *os.File
+
+	// stop is a duplicate of kick, which is read by the goroutine processing
+	// the ring. Closing it stops that goroutine, which then closes done. Both
+	// are nil, if the ring is not running.
+	stop *os.File
+	done chan struct{}
+}
+
+// load16 atomically loads the little-endian uint16 at b[off:]. The avail ring
+// is only 2-byte aligned, so this uses the aligned word containing it.
+func load16(b []byte, off int) uint16 {
+	p := unsafe.Pointer(&b[off])
+	if uintptr(p)%4 == 0 {
+		return uint16(atomic.LoadUint32((*uint32)(p)))
+	}
+	return uint16(atomic.LoadUint32((*uint32)(unsafe.Pointer(&b[off-2]))) >> 16)
+}
+
+// run processes the requests of q, until stop is closed.
+func (c *conn) run(q *vring, stop *os.File, done chan struct{}) {
+	defer close(done)
+	var buf [8]byte
+	for {
+		if err := c.process(q); err != nil {
+			c.log.Error("processing virtqueue failed", "err", err)
+			return
+		}
+		if _, err := stop.Read(buf[:]); err != nil {
+			return
+		}
+	}
+}
+
+// process processes all available requests of q.
+func (c *conn) process(q *vring) error {
+	c.memMu.RLock()
+	defer c.memMu.RUnlock()
+	mem := c.mem
+	n := uint64(q.num)
+	desc, err := mem.user(q.desc, 16*n)
+	if err != nil {
+		return err
+	}
+	avail, err := mem.user(q.avail, 6+2*n)
+	if err != nil {
+		return err
+	}
+	used, err := mem.user(q.used, 6+8*n)
+	if err != nil {
+		return err
+	}
+	if uintptr(unsafe.Pointer(&used[0]))%4 != 0 {
+		return errors.New("used ring is not aligned")
+	}
+
+	processed := false
+	for q.last != load16(avail, 2) {
+		head := binary.LittleEndian.Uint16(avail[4+2*(q.last%q.num):])
+		written, err := c.request(mem, desc, head, q.num)
+		if err != nil {
+			return err
+		}
+		slot := used[4+8*uint64(q.next%q.num):]
+		binary.LittleEndian.PutUint32(slot[0:], uint32(head))
+		binary.LittleEndian.PutUint32(slot[4:], written)
+		q.last++
+		q.next++
+		// Publishes the entry. The flags in the lower half are always 0.
+		atomic.StoreUint32((*uint32)(unsafe.Pointer(&used[0])), uint32(q.next)<<16)
+		processed = true
+	}
+	if processed && q.call != nil && load16(avail, 0)&availNoInterrupt == 0 {
+		var one [8]byte
+		binary.LittleEndian.PutUint64(one[:], 1)
+		q.call.Write(one[:])
+	}
+	return nil
+}
+
+// request executes the request starting at the descriptor head and returns
+// the number of bytes written to guest memory.
+func (c *conn) request(mem memory, desc []byte, head, num uint16) (uint32, error) {
+	var out, in [][]byte
+	i := head
+	for n := uint16(0); ; n++ {
+		if i >= num || n >= num {
+			return 0, errors.New("invalid descriptor chain")
+		}
+		d := desc[16*uint64(i):]
+		flags := binary.LittleEndian.Uint16(d[12:])
+		if flags&descIndirect != 0 {
+			return 0, errors.New("indirect descriptors are not supported")
+		}
+		b, err := mem.guest(binary.LittleEndian.Uint64(d[0:]), uint64(binary.LittleEndian.Uint32(d[8:])))
+		if err != nil {
+			return 0, err
+		}
+		if flags&descWrite != 0 {
+			in = append(in, b)
+		} else {
+			out = append(out, b)
+		}
+		if flags&descNext == 0 {
+			break
+		}
+		i = binary.LittleEndian.Uint16(d[14:])
+	}
+
+	// The status is the last byte of the last writable descriptor.
+	if len(in) == 0 || len(in[len(in)-1]) == 0 {
+		return 0, errors.New("request without status byte")
+	}
+	last := in[len(in)-1]
+	status := &last[len(last)-1]
+	in[len(in)-1] = last[:len(last)-1]
+
+	var hdr [16]byte
+	out, ok := consume(out, hdr[:])
+	if !ok {
+		*status = blkIOErr
+		return 1, nil
+	}
+	typ := binary.LittleEndian.Uint32(hdr[0:])
+	off := int64(binary.LittleEndian.Uint64(hdr[8:]) * sectorSize)
+
+	var written uint32
+	*status = blkOK
+	switch typ {
+	case blkIn:
+		l := length(in)
+		if !c.inBounds(off, l) {
+			*status = blkIOErr
+			break
+		}
+		n, err := nbd.ReadAtVec(c.srv.Device, in, off)
+		if err != nil && !(err == io.EOF && n == l) {
+			c.log.Error("read failed", "offset", off, "length", l, "err", err)
+			*status = blkIOErr
+		}
+		written = uint32(n)
+	case blkOut:
+		if c.srv.ReadOnly || !c.inBounds(off, length(out)) {
+			*status = blkIOErr
+			break
+		}
+		if _, err := nbd.WriteAtVec(c.srv.Device, out, off); err != nil {
+			c.log.Error("write failed", "offset", off, "length", length(out), "err", err)
+			*status = blkIOErr
+		}
+	case blkFlush:
+		if err := c.srv.Device.Sync(); err != nil {
+			c.log.Error("flush failed", "err", err)
+			*status = blkIOErr
+		}
+	case blkGetID:
+		id := make([]byte, blkIDLen)
+		copy(id, c.srv.Serial)
+		for _, b := range in {
+			n := copy(b, id)
+			id = id[n:]
+			written += uint32(n)
+		}
+	default:
+		*status = blkUnsupp
+	}
+	return written + 1, nil
+}
+
+// inBounds returns whether n bytes at off are within the Device.
+func (c *conn) inBounds(off int64, n int) bool {
+	return off >= 0 && uint64(off)+uint64(n) <= c.srv.Size
+}
+
+// consume copies len(p) bytes from the start of bufs into p and returns the
+// remaining buffers.
+func consume(bufs [][]byte, p []byte) ([][]byte, bool) {
+	for len(p) > 0 {
+		if len(bufs) == 0 {
+			return nil, false
+		}
+		n := copy(p, bufs[0])
+		p = p[n:]
+		if bufs[0] = bufs[0][n:]; len(bufs[0]) == 0 {
+			bufs = bufs[1:]
+		}
+	}
+	return bufs, true
+}
+
+// length returns the total length of bufs.
+func length(bufs [][]byte) int {
+	var n int
+	for _, b := range bufs {
+		n += len(b)
+	}
+	return n
+}
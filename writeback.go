@@ -0,0 +1,400 @@
+// Copyright 2018 Axel Wagner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nbd
+
+import (
+	"io"
+	"sort"
+	"sync"
+	"time"
+)
+
+// WriteBackOptions configures a WriteBackCache.
+type WriteBackOptions struct {
+	// Cache holds the written data, until it is written back. It must be at
+	// least as large as the cached Device; a file on a local SSD allows
+	// absorbing large bursts of writes. If Cache is nil, a MemDevice is used.
+	Cache Device
+	// BlockSize is the granularity of caching. Partial writes to a block
+	// which is not cached read it from the Device first. If BlockSize is <=
+	// 0, 64 KiB are used.
+	BlockSize int
+	// MaxDirty is the maximum number of bytes waiting to be written back.
+	// Writes block, once it is exceeded, until enough data is written back.
+	// If MaxDirty is <= 0, 64 MiB are used.
+	MaxDirty int64
+	// FlushInterval is the maximum time written data is cached, before it
+	// is written back in the background. If it is 0, one second is used. If
+	// it is negative, data is only written back by Sync or once MaxDirty is
+	// exceeded.
+	FlushInterval time.Duration
+}
+
+// WriteBackCache is a Device caching writes to another, possibly slow or
+// remote, Device. Writes only modify the cache and are written back in the
+// background. Sync writes back all cached data and syncs the Device, so
+// flushes and writes with FUA (for which a Server calls Sync) are durability
+// barriers, as expected by clients.
+//
+// Data which is not written back yet is lost if the process crashes, unless
+// a client synced it. The Device must not be modified other than through the
+// WriteBackCache, while it is used.
+type WriteBackCache struct {
+	d         Device
+	cache     Device
+	size      int64
+	blockSize int64
+	maxBlocks int
+	interval  time.Duration
+
+	// locks serialize accesses to blocks, by their index modulo the number
+	// of locks.
+	locks [64]sync.Mutex
+
+	mu   sync.Mutex
+	cond *sync.Cond
+	// dirty contains the time of the first write of every block, which is
+	// not written back yet.
+	dirty map[int64]time.Time
+	// err is the first error of a background write back since the last
+	// Sync.
+	err    error
+	closed bool
+	done   chan struct{}
+	wg     sync.WaitGroup
+}
+
+// NewWriteBackCache returns a WriteBackCache for d, which has the given size.
+// opts may be nil.
+func NewWriteBackCache(d Device, size uint64, opts *WriteBackOptions) (*WriteBackCache, error) {
+	if opts == nil {
+		opts = new(WriteBackOptions)
+	}
+	c := &WriteBackCache{
+		d:         d,
+		cache:     opts.Cache,
+		size:      int64(size),
+		blockSize: int64(opts.BlockSize),
+		interval:  opts.FlushInterval,
+		dirty:     make(map[int64]time.Time),
+		done:      make(chan struct{}),
+	}
+	if c.blockSize <= 0 {
+		c.blockSize = 64 << 10
+	}
+	maxDirty := opts.MaxDirty
+	if maxDirty <= 0 {
+		maxDirty = 64 << 20
+	}
+	if c.maxBlocks = int(maxDirty / c.blockSize); c.maxBlocks < 1 {
+		c.maxBlocks = 1
+	}
+	if c.interval == 0 {
+		c.interval = time.Second
+	}
+	if c.cache == nil {
+		m, err := NewMemDevice(size)
+		if err != nil {
+			return nil, err
+		}
+		c.cache = m
+	}
+	c.cond = sync.NewCond(&c.mu)
+	c.wg.Add(1)
+	go c.flusher()
+	return c, nil
+}
+
+// blockLen returns the length of block i, which is shorter than the block
+// size for the last block of a Device with an unaligned size.
+func (c *WriteBackCache) blockLen(i int64) int64 {
+	if rest := c.size - i*c.blockSize; rest < c.blockSize {
+		return rest
+	}
+	return c.blockSize
+}
+
+// lock locks block i and returns the function unlocking it.
+func (c *WriteBackCache) lock(i int64) func() {
+	l := &c.locks[i%int64(len(c.locks))]
+	l.Lock()
+	return l.Unlock
+}
+
+// isDirty returns whether block i is cached.
+func (c *WriteBackCache) isDirty(i int64) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, ok := c.dirty[i]
+	return ok
+}
+
+// do calls f for the parts of the n bytes at off in each block, with the
+// index of the block, the offset of the part and its offset in the range.
+func (c *WriteBackCache) do(off, n int64, f func(i, off, pos, n int64) error) error {
+	for pos := int64(0); pos < n; {
+		i := (off + pos) / c.blockSize
+		m := (i+1)*c.blockSize - (off + pos)
+		if m > n-pos {
+			m = n - pos
+		}
+		if err := f(i, off+pos, pos, m); err != nil {
+			return err
+		}
+		pos += m
+	}
+	return nil
+}
+
+// ReadAt implements Device. Cached blocks are read from the cache.
+func (c *WriteBackCache) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, Errorf(EINVAL, "negative offset")
+	}
+	if off >= c.size {
+		return 0, io.EOF
+	}
+	var eof error
+	if rest := c.size - off; int64(len(p)) > rest {
+		p, eof = p[:rest], io.EOF
+	}
+	err := c.do(off, int64(len(p)), func(i, off, pos, n int64) error {
+		defer c.lock(i)()
+		d := c.d
+		if c.isDirty(i) {
+			d = c.cache
+		}
+		if m, err := d.ReadAt(p[pos:pos+n], off); err != nil && !(err == io.EOF && m == int(n)) {
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return len(p), eof
+}
+
+// WriteAt implements Device. It blocks, while MaxDirty is exceeded.
+func (c *WriteBackCache) WriteAt(p []byte, off int64) (int, error) {
+	if off < 0 || off+int64(len(p)) > c.size {
+		return 0, Errorf(ENOSPC, "write past end of device")
+	}
+	var buf []byte
+	err := c.do(off, int64(len(p)), func(i, off, pos, n int64) error {
+		// Waiting while holding the lock of the block could deadlock with
+		// writing it back.
+		if err := c.wait(i); err != nil {
+			return err
+		}
+		defer c.lock(i)()
+		start, l := i*c.blockSize, c.blockLen(i)
+		if n < l && !c.isDirty(i) {
+			if buf == nil {
+				buf = make([]byte, c.blockSize)
+			}
+			b := buf[:l]
+			if m, err := c.d.ReadAt(b, start); err != nil && !(err == io.EOF && m == len(b)) {
+				return err
+			}
+			if _, err := c.cache.WriteAt(b, start); err != nil {
+				return err
+			}
+		}
+		if _, err := c.cache.WriteAt(p[pos:pos+n], off); err != nil {
+			return err
+		}
+		c.mu.Lock()
+		if _, ok := c.dirty[i]; !ok {
+			c.dirty[i] = time.Now()
+		}
+		if len(c.dirty) >= c.maxBlocks {
+			c.cond.Broadcast()
+		}
+		c.mu.Unlock()
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// wait blocks until block i can be cached without exceeding MaxDirty.
+func (c *WriteBackCache) wait(i int64) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for {
+		if c.closed {
+			return Errorf(ESHUTDOWN, "write back cache closed")
+		}
+		if _, ok := c.dirty[i]; ok || len(c.dirty) < c.maxBlocks {
+			return nil
+		}
+		c.cond.Wait()
+	}
+}
+
+// writeBack writes block i back to the Device, if it is cached.
+func (c *WriteBackCache) writeBack(i int64, buf []byte) error {
+	defer c.lock(i)()
+	if !c.isDirty(i) {
+		return nil
+	}
+	start, b := i*c.blockSize, buf[:c.blockLen(i)]
+	if m, err := c.cache.ReadAt(b, start); err != nil && !(err == io.EOF && m == len(b)) {
+		return err
+	}
+	if _, err := c.d.WriteAt(b, start); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	delete(c.dirty, i)
+	c.cond.Broadcast()
+	c.mu.Unlock()
+	// Release the space of the block, e.g. the memory of a MemDevice.
+	if t, ok := c.cache.(Trimmer); ok {
+		t.Trim(start, int64(len(b)))
+	}
+	return nil
+}
+
+// pending returns the cached blocks in ascending order, to write them back
+// sequentially. If all is false, only blocks cached for longer than the
+// flush interval are returned, plus the oldest ones, if MaxDirty is reached.
+func (c *WriteBackCache) pending(all bool) []int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var blocks []int64
+	if all {
+		for i := range c.dirty {
+			blocks = append(blocks, i)
+		}
+		sort.Slice(blocks, func(i, j int) bool { return blocks[i] < blocks[j] })
+		return blocks
+	}
+	type aged struct {
+		i     int64
+		since time.Time
+	}
+	var byAge []aged
+	for i, t := range c.dirty {
+		byAge = append(byAge, aged{i, t})
+	}
+	sort.Slice(byAge, func(i, j int) bool { return byAge[i].since.Before(byAge[j].since) })
+	now := time.Now()
+	for n, a := range byAge {
+		// Write back half of the cache when it is full, so writers do not
+		// block on every block.
+		if (c.interval < 0 || now.Sub(a.since) < c.interval) && len(byAge)-n <= c.maxBlocks/2 {
+			break
+		}
+		blocks = append(blocks, a.i)
+	}
+	sort.Slice(blocks, func(i, j int) bool { return blocks[i] < blocks[j] })
+	return blocks
+}
+
+// flusher writes back blocks in the background, until c is closed.
+func (c *WriteBackCache) flusher() {
+	defer c.wg.Done()
+	tick := c.interval / 2
+	if tick <= 0 {
+		tick = time.Second
+	}
+	t := time.NewTicker(tick)
+	defer t.Stop()
+	// Wake up when writers are blocked.
+	full := make(chan struct{}, 1)
+	go func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		for !c.closed {
+			if len(c.dirty) >= c.maxBlocks {
+				select {
+				case full <- struct{}{}:
+				default:
+				}
+			}
+			c.cond.Wait()
+		}
+	}()
+	buf := make([]byte, c.blockSize)
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-t.C:
+		case <-full:
+		}
+		for _, i := range c.pending(false) {
+			if err := c.writeBack(i, buf); err != nil {
+				c.mu.Lock()
+				if c.err == nil {
+					c.err = err
+				}
+				c.mu.Unlock()
+				break
+			}
+		}
+	}
+}
+
+// Sync implements Device. It writes back all cached data and syncs the
+// Device. If a background write back failed since the last call, it returns
+// that error.
+func (c *WriteBackCache) Sync() error {
+	buf := make([]byte, c.blockSize)
+	for _, i := range c.pending(true) {
+		if err := c.writeBack(i, buf); err != nil {
+			return err
+		}
+	}
+	c.mu.Lock()
+	err := c.err
+	c.err = nil
+	c.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return c.d.Sync()
+}
+
+// Dirty returns the number of bytes waiting to be written back.
+func (c *WriteBackCache) Dirty() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return int64(len(c.dirty)) * c.blockSize
+}
+
+// Close writes back all cached data, like Sync, and stops writing back in
+// the background. It does not close the Device.
+func (c *WriteBackCache) Close() error {
+	err := c.Sync()
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return err
+	}
+	c.closed = true
+	c.cond.Broadcast()
+	c.mu.Unlock()
+	close(c.done)
+	c.wg.Wait()
+	if cl, ok := c.cache.(*MemDevice); ok {
+		cl.Close()
+	}
+	return err
+}
@@ -0,0 +1,56 @@
+// Copyright 2018 Axel Wagner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nbd
+
+import "io"
+
+// ZeroWriter is an optional interface a Device can implement, to write zeros
+// efficiently (NBD_CMD_WRITE_ZEROES), e.g. with fallocate(2). A Server always
+// advertises FlagSendWriteZeroes and falls back to writing buffered zeros for
+// Devices not implementing it.
+//
+// WriteZeroes writes length zero bytes starting at off. Unless noHole is set,
+// it may deallocate the range instead, as long as it reads as zeros
+// afterwards. If noHole is set, the range must stay allocated, so later
+// writes to it do not fail for lack of space.
+type ZeroWriter interface {
+	WriteZeroes(off, length int64, noHole bool) error
+}
+
+// zeros is written by WriteZeroes for Devices not implementing ZeroWriter.
+var zeros = make([]byte, 1<<20)
+
+// WriteZeroes writes length zero bytes to w, starting at off. If w implements
+// ZeroWriter, it is used. Otherwise, zeros are written with WriteAt.
+func WriteZeroes(w io.WriterAt, off, length int64, noHole bool) error {
+	if z, ok := w.(ZeroWriter); ok {
+		return z.WriteZeroes(off, length, noHole)
+	}
+	for length > 0 {
+		b := zeros
+		if length < int64(len(b)) {
+			b = b[:length]
+		}
+		n, err := w.WriteAt(b, off)
+		if err != nil {
+			return err
+		}
+		if n < len(b) {
+			return io.ErrShortWrite
+		}
+		off, length = off+int64(n), length-int64(n)
+	}
+	return nil
+}
@@ -0,0 +1,197 @@
+// +build linux
+
+// Copyright 2018 Axel Wagner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nbd
+
+import (
+	"context"
+	"net"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// zeroCopyMin is the minimum size of a payload to be sent with
+	// MSG_ZEROCOPY. For smaller payloads, the overhead of page pinning and
+	// completion notifications outweighs the cost of copying.
+	zeroCopyMin = 16 << 10
+	// zeroCopyMaxPending is the maximum number of bytes for which completion
+	// notifications can be outstanding, before sending blocks.
+	zeroCopyMaxPending = 16 << 20
+
+	soEEOriginZeroCopy = 5
+)
+
+// sockExtendedErr is struct sock_extended_err from linux/errqueue.h.
+type sockExtendedErr struct {
+	errno  uint32
+	origin uint8
+	typ    uint8
+	code   uint8
+	pad    uint8
+	info   uint32
+	data   uint32
+}
+
+// zeroCopy sends data on a TCP connection using MSG_ZEROCOPY. The kernel
+// references the sent pages until it notifies us of completion via the
+// socket's error queue, so zeroCopy keeps every sent buffer alive until then.
+// It is not safe for concurrent use.
+type zeroCopy struct {
+	c  *net.TCPConn
+	rc syscall.RawConn
+	// seq is the sequence number the kernel will assign the next successful
+	// send.
+	seq     uint32
+	pending []zeroCopyBuf
+	npend   int
+}
+
+type zeroCopyBuf struct {
+	seq uint32
+	buf []byte
+}
+
+// newZeroCopy enables MSG_ZEROCOPY on c. It returns nil if c doesn't support
+// it.
+func newZeroCopy(c net.Conn) *zeroCopy {
+	tc, ok := c.(*net.TCPConn)
+	if !ok {
+		return nil
+	}
+	rc, err := tc.SyscallConn()
+	if err != nil {
+		return nil
+	}
+	var serr error
+	err = rc.Control(func(fd uintptr) {
+		serr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_ZEROCOPY, 1)
+	})
+	if err != nil || serr != nil {
+		return nil
+	}
+	return &zeroCopy{c: tc, rc: rc}
+}
+
+// send writes b to the connection. b must not be modified afterwards. It
+// returns ctx.Err() if ctx is cancelled.
+func (z *zeroCopy) send(ctx context.Context, b []byte) error {
+	for z.npend >= zeroCopyMaxPending {
+		if err := z.reap(); err != nil {
+			return err
+		}
+		if z.npend < zeroCopyMaxPending {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Millisecond):
+		}
+	}
+
+	buf := b
+	for len(b) > 0 {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		z.c.SetWriteDeadline(time.Now().Add(100 * time.Millisecond))
+		var (
+			n    int
+			serr error
+		)
+		err := z.rc.Write(func(fd uintptr) bool {
+			n, serr = unix.SendmsgN(int(fd), b, nil, nil, unix.MSG_ZEROCOPY)
+			return serr != unix.EAGAIN
+		})
+		if to, ok := err.(interface{ Timeout() bool }); ok && to.Timeout() {
+			continue
+		}
+		if err == nil {
+			err = serr
+		}
+		if err != nil {
+			return err
+		}
+		z.seq++
+		b = b[n:]
+	}
+	z.pending = append(z.pending, zeroCopyBuf{z.seq - 1, buf})
+	z.npend += len(buf)
+	return z.reap()
+}
+
+// reap processes all completion notifications currently in the error queue
+// and releases the corresponding buffers. It does not block.
+func (z *zeroCopy) reap() error {
+	var rerr error
+	err := z.rc.Control(func(fd uintptr) {
+		oob := make([]byte, 128)
+		for {
+			_, oobn, _, _, err := unix.Recvmsg(int(fd), nil, oob, unix.MSG_ERRQUEUE|unix.MSG_DONTWAIT)
+			if err == unix.EAGAIN || err == unix.EINTR {
+				return
+			}
+			if err != nil {
+				rerr = err
+				return
+			}
+			msgs, err := unix.ParseSocketControlMessage(oob[:oobn])
+			if err != nil {
+				rerr = err
+				return
+			}
+			for _, m := range msgs {
+				if !(m.Header.Level == unix.SOL_IP && m.Header.Type == unix.IP_RECVERR) &&
+					!(m.Header.Level == unix.SOL_IPV6 && m.Header.Type == unix.IPV6_RECVERR) {
+					continue
+				}
+				if len(m.Data) < int(unsafe.Sizeof(sockExtendedErr{})) {
+					continue
+				}
+				ee := (*sockExtendedErr)(unsafe.Pointer(&m.Data[0]))
+				if ee.origin != soEEOriginZeroCopy || ee.errno != 0 {
+					continue
+				}
+				z.release(ee.info, ee.data)
+			}
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return rerr
+}
+
+// release drops all pending buffers with sequence numbers in the inclusive
+// range [lo, hi].
+func (z *zeroCopy) release(lo, hi uint32) {
+	out := z.pending[:0]
+	for _, p := range z.pending {
+		if p.seq-lo <= hi-lo {
+			z.npend -= len(p.buf)
+			continue
+		}
+		out = append(out, p)
+	}
+	for i := len(out); i < len(z.pending); i++ {
+		z.pending[i] = zeroCopyBuf{}
+	}
+	z.pending = out
+}
@@ -0,0 +1,96 @@
+// Copyright 2018 Axel Wagner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nbd
+
+// DetectZeroes returns a Device, which writes blocks of zeros to d with
+// WriteZeroes instead of WriteAt, so d can deallocate them (e.g. by punching
+// holes into a file). This keeps backing files sparse, when clients write
+// zeros instead of trimming, like image copies or mkfs do.
+//
+// A write consisting only of zeros is passed to WriteZeroes as a whole. Other
+// writes are split, so every aligned block of granularity bytes of zeros is
+// written with WriteZeroes, if there is any. If granularity is <= 0, 4096 is
+// used. If d does not implement ZeroWriter, it is returned unchanged.
+func DetectZeroes(d Device, granularity int) Device {
+	z, ok := d.(ZeroWriter)
+	if !ok {
+		return d
+	}
+	if granularity <= 0 {
+		granularity = 4096
+	}
+	return &zeroDetector{Device: d, z: z, granularity: int64(granularity)}
+}
+
+type zeroDetector struct {
+	Device
+	z           ZeroWriter
+	granularity int64
+}
+
+func (d *zeroDetector) WriteAt(p []byte, off int64) (int, error) {
+	if len(p) == 0 {
+		return d.Device.WriteAt(p, off)
+	}
+	if isZero(p) {
+		if err := d.z.WriteZeroes(off, int64(len(p)), false); err != nil {
+			return 0, err
+		}
+		return len(p), nil
+	}
+	g := d.granularity
+	// start is the offset of the pending run in p and zero is set, if it
+	// consists of zero blocks.
+	var (
+		start int64
+		zero  bool
+	)
+	flush := func(end int64) error {
+		if end == start {
+			return nil
+		}
+		var err error
+		if zero {
+			err = d.z.WriteZeroes(off+start, end-start, false)
+		} else {
+			_, err = d.Device.WriteAt(p[start:end], off+start)
+		}
+		start = end
+		return err
+	}
+	// The first block ends at the next multiple of the granularity.
+	for pos := int64(0); pos < int64(len(p)); {
+		end := (off+pos)/g*g + g - off
+		if end > int64(len(p)) {
+			end = int64(len(p))
+		}
+		z := end-pos == g && isZero(p[pos:end])
+		if z != zero {
+			if err := flush(pos); err != nil {
+				return 0, err
+			}
+			zero = z
+		}
+		pos = end
+	}
+	if err := flush(int64(len(p))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (d *zeroDetector) WriteZeroes(off, length int64, noHole bool) error {
+	return d.z.WriteZeroes(off, length, noHole)
+}